@@ -2,6 +2,7 @@ package common
 
 import (
 	_ "github.com/yinqiwen/gsnova/common/channel/direct"
+	_ "github.com/yinqiwen/gsnova/common/channel/grpc"
 	_ "github.com/yinqiwen/gsnova/common/channel/http"
 	_ "github.com/yinqiwen/gsnova/common/channel/http2"
 	_ "github.com/yinqiwen/gsnova/common/channel/kcp"
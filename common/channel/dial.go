@@ -1,6 +1,7 @@
 package channel
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -9,16 +10,16 @@ import (
 	"sync"
 	"time"
 
-	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/hosts"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/netx"
 )
 
+//NewTLSConfig create the client TLS config, certs of servers are verified unless InsecureSkipVerify of config is set.
 func NewTLSConfig(conf *ProxyChannelConfig) *tls.Config {
 	tlscfg := &tls.Config{}
-	tlscfg.InsecureSkipVerify = true
+	tlscfg.InsecureSkipVerify = conf.InsecureSkipVerify
 	if len(conf.SNI) > 0 {
 		tlscfg.ServerName = conf.SNI[0]
 	}
@@ -26,6 +27,11 @@ func NewTLSConfig(conf *ProxyChannelConfig) *tls.Config {
 }
 
 func DialServerByConf(server string, conf *ProxyChannelConfig) (net.Conn, error) {
+	return DialServerByConfContext(context.Background(), server, conf)
+}
+
+//DialServerByConfContext dial server with context, the dial timeout of config is still applied.
+func DialServerByConfContext(ctx context.Context, server string, conf *ProxyChannelConfig) (net.Conn, error) {
 	rurl, err := url.Parse(server)
 	if nil != err {
 		return nil, err
@@ -34,13 +40,13 @@ func DialServerByConf(server string, conf *ProxyChannelConfig) (net.Conn, error)
 	tcpHost, tcpPort, err := net.SplitHostPort(hostport)
 	if nil != err {
 		switch rurl.Scheme {
-		case "http", "ws", "tcp", "tcp4", "tcp6":
+		case "http", "ws", "grpc", "tcp", "tcp4", "tcp6":
 			tcpHost = rurl.Host
 			tcpPort = "80"
 		case "ssh":
 			tcpPort = "22"
 			tcpHost = rurl.Host
-		case "http2", "https", "quic", "kcp", "tls", "wss":
+		case "http2", "https", "quic", "kcp", "tls", "wss", "grpcs":
 			tcpHost = rurl.Host
 			tcpPort = "443"
 		default:
@@ -75,19 +81,13 @@ func DialServerByConf(server string, conf *ProxyChannelConfig) (net.Conn, error)
 	if 0 == dailTimeout {
 		dailTimeout = 5000
 	}
-	timeout := time.Duration(dailTimeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(dailTimeout)*time.Millisecond)
+	defer cancel()
 	connAddr := hostport
 	if len(conf.Proxy) == 0 {
-		if net.ParseIP(tcpHost) == nil {
-			iphost, err := dns.DnsGetDoaminIP(tcpHost)
-			if nil != err {
-				return nil, err
-			}
-			hostport = net.JoinHostPort(iphost, tcpPort)
-		}
-		conn, err = netx.DialTimeout("tcp", hostport, timeout)
+		conn, err = netx.DialHappyEyeballs(ctx, "tcp", hostport, conf.IPv6, conf.LookupIP)
 	} else {
-		conn, err = helper.ProxyDial(conf.Proxy, hostport, timeout)
+		conn, err = helper.ProxyDialContext(ctx, conf.Proxy, hostport)
 		connAddr = conf.Proxy
 	}
 	if nil == err {
@@ -96,9 +96,10 @@ func DialServerByConf(server string, conf *ProxyChannelConfig) (net.Conn, error)
 			fallthrough
 		case "http2":
 			tlsconn := tls.Client(conn, tlscfg)
-			err = tlsconn.Handshake()
+			err = tlsconn.HandshakeContext(ctx)
 			if err != nil {
 				logger.Notice("TLS Handshake Failed %v", err)
+				conn.Close()
 				return nil, err
 			}
 			conn = tlsconn
@@ -112,6 +113,64 @@ func DialServerByConf(server string, conf *ProxyChannelConfig) (net.Conn, error)
 	return conn, err
 }
 
+//ListenPacketByConf create the packet conn for channels over udp, packets are relayed by the SOCKS5 proxy
+//via UDP ASSOCIATE if proxy of config is set. Since udp could not go through http proxies, packets are sent
+//directly if the proxy is not a SOCKS5 proxy.
+func ListenPacketByConf(conf *ProxyChannelConfig) (net.PacketConn, error) {
+	if len(conf.Proxy) == 0 {
+		return netx.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	}
+	proxyURL := conf.ProxyURL()
+	if nil == proxyURL {
+		return nil, fmt.Errorf("Invalid proxy url:%s", conf.Proxy)
+	}
+	switch proxyURL.Scheme {
+	case "socks", "socks5", "socks5h":
+	default:
+		logger.Notice("UDP is not supported by %s proxy:%s, packets of channel:%s are sent directly.", proxyURL.Scheme, proxyURL.Host, conf.Name)
+		return netx.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	}
+	dailTimeout := conf.LocalDialMSTimeout
+	if 0 == dailTimeout {
+		dailTimeout = 5000
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dailTimeout)*time.Millisecond)
+	defer cancel()
+	conn, err := helper.Socks5UDPAssociate(ctx, proxyURL)
+	if nil != err {
+		logger.Notice("UDP associate with proxy:%s failed with reason:%v.", proxyURL.Host, err)
+	}
+	return conn, err
+}
+
+//BindConnContext interrupt pending io of conn once the context done, until the returned stop func called.
+func BindConnContext(ctx context.Context, conn net.Conn) func() {
+	if nil == ctx.Done() {
+		return func() {}
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+//NewDialContextByConf is like NewDialByConf, while the returned dial func is bounded by the context.
+func NewDialContextByConf(ctx context.Context, conf *ProxyChannelConfig, scheme string) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		server := fmt.Sprintf("%s://%s", scheme, addr)
+		return DialServerByConfContext(ctx, server, conf)
+	}
+}
+
 func NewDialByConf(conf *ProxyChannelConfig, scheme string) func(network, addr string) (net.Conn, error) {
 	localDial := func(network, addr string) (net.Conn, error) {
 		//log.Printf("Connect %s", addr)
@@ -130,6 +189,12 @@ func NewHTTPClient(conf *ProxyChannelConfig, scheme string) (*http.Client, error
 		MaxIdleConnsPerHost:   2 * int(conf.ConnsPerServer),
 		ResponseHeaderTimeout: time.Duration(conf.HTTP.ReadTimeout) * time.Millisecond,
 	}
+	if scheme == "https" {
+		tr.TLSClientConfig = NewTLSConfig(conf)
+		//transports with custom dial need to be forced to negotiate HTTP/2, servers without HTTP/2 are
+		//connected by HTTP/1.1 as before
+		tr.ForceAttemptHTTP2 = !conf.HTTP.DisableHTTP2
+	}
 	// if len(conf.SNI) > 0 {
 	// 	tlscfg := &tls.Config{}
 	// 	tlscfg.InsecureSkipVerify = true
@@ -0,0 +1,168 @@
+package channel
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func TestDialServerByConfContextCancel(t *testing.T) {
+	//the server accepts conns but never answers TLS handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	conf := &ProxyChannelConfig{LocalDialMSTimeout: 10000}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err = DialServerByConfContext(ctx, "tls://"+l.Addr().String(), conf); nil == err {
+		t.Fatalf("Expected error after cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Dial is not cancelled in time, elapsed:%v", elapsed)
+	}
+
+	conn, err := DialServerByConfContext(context.Background(), "tcp://"+l.Addr().String(), conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDialServerByConfVerify(t *testing.T) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", helper.GenerateTLSConfig())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				c.(*tls.Conn).Handshake()
+				c.Close()
+			}()
+		}
+	}()
+	if _, err = DialServerByConf("tls://"+l.Addr().String(), &ProxyChannelConfig{}); nil == err {
+		t.Fatalf("Expected error of unverified cert")
+	}
+	conn, err := DialServerByConf("tls://"+l.Addr().String(), &ProxyChannelConfig{InsecureSkipVerify: true})
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestListenPacketByConfFallback(t *testing.T) {
+	//udp could not go through http proxies, packets are sent directly
+	conf := &ProxyChannelConfig{Name: "test", Proxy: "http://127.0.0.1:1"}
+	pc, err := ListenPacketByConf(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, ok := pc.(*net.UDPConn); !ok {
+		t.Fatalf("Unexpected packet conn:%T via http proxy", pc)
+	}
+	//the unreachable socks5 proxy fails the association
+	conf = &ProxyChannelConfig{Name: "test", Proxy: "socks5://127.0.0.1:1", LocalDialMSTimeout: 1000}
+	if _, err = ListenPacketByConf(conf); nil == err {
+		t.Fatalf("Expected error of unreachable socks5 proxy")
+	}
+}
+
+func TestBindConnContext(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := BindConnContext(ctx, c1)
+	time.AfterFunc(100*time.Millisecond, cancel)
+	buf := make([]byte, 1)
+	if _, err := c1.Read(buf); nil == err {
+		t.Fatalf("Expected read interrupted by context")
+	}
+	stop()
+
+	//io is not interrupted after stopped
+	c1.SetDeadline(time.Time{})
+	ctx, cancel = context.WithCancel(context.Background())
+	stop = BindConnContext(ctx, c1)
+	stop()
+	cancel()
+	go c2.Write([]byte("a"))
+	c1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c1.Read(buf); nil != err {
+		t.Fatalf("Read interrupted after stopped:%v", err)
+	}
+}
+
+type testSession struct {
+	closed chan struct{}
+}
+
+func (s *testSession) OpenStream() (mux.MuxStream, error)     { return nil, nil }
+func (s *testSession) CloseStream(stream mux.MuxStream) error { return nil }
+func (s *testSession) AcceptStream() (mux.MuxStream, error)   { return nil, nil }
+func (s *testSession) Ping() (time.Duration, error)           { return 0, nil }
+func (s *testSession) NumStreams() int                        { return 0 }
+func (s *testSession) Close() error {
+	close(s.closed)
+	return nil
+}
+
+//testChannel creates sessions without context support, creation is blocked until released
+type testChannel struct {
+	release chan struct{}
+	session *testSession
+}
+
+func (c *testChannel) CreateMuxSession(server string, conf *ProxyChannelConfig) (mux.MuxSession, error) {
+	<-c.release
+	return c.session, nil
+}
+
+func (c *testChannel) Features() FeatureSet {
+	return FeatureSet{}
+}
+
+func TestCreateMuxSessionCancel(t *testing.T) {
+	ch := &testChannel{release: make(chan struct{}), session: &testSession{closed: make(chan struct{})}}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := CreateMuxSession(ctx, ch, "test://127.0.0.1", &ProxyChannelConfig{}); err != context.Canceled {
+		t.Fatalf("Unexpected error:%v after cancelled", err)
+	}
+	//the session created after cancelled is closed
+	close(ch.release)
+	select {
+	case <-ch.session.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Session created after cancelled is not closed")
+	}
+
+	ch = &testChannel{release: make(chan struct{}), session: &testSession{closed: make(chan struct{})}}
+	close(ch.release)
+	if session, err := CreateMuxSession(context.Background(), ch, "test://127.0.0.1", &ProxyChannelConfig{}); nil != err || session != ch.session {
+		t.Fatalf("Unexpected session:%v with err:%v", session, err)
+	}
+}
@@ -1,14 +1,15 @@
 package direct
 
 import (
+	"context"
 	"io"
 	"net"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yinqiwen/gsnova/common/channel"
-	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/hosts"
 	"github.com/yinqiwen/gsnova/common/logger"
@@ -17,12 +18,14 @@ import (
 )
 
 type directStream struct {
+	//unix nano of latest io through the stream
+	latestIOTime int64
 	net.Conn
-	conf         *channel.ProxyChannelConfig
-	addr         string
-	session      *directMuxSession
-	proxyServer  string
-	latestIOTime time.Time
+	conf        *channel.ProxyChannelConfig
+	addr        string
+	session     *directMuxSession
+	proxyServer string
+	spliced     int32
 }
 
 func (tc *directStream) Auth(req *mux.AuthRequest) error {
@@ -30,6 +33,10 @@ func (tc *directStream) Auth(req *mux.AuthRequest) error {
 }
 
 func (tc *directStream) Connect(network string, addr string, opt mux.StreamOptions) error {
+	return tc.ConnectContext(context.Background(), network, addr, opt)
+}
+
+func (tc *directStream) ConnectContext(ctx context.Context, network string, addr string, opt mux.StreamOptions) error {
 	host, port, _ := net.SplitHostPort(addr)
 	//log.Printf("Session:%d enter direct with host %s & event:%T", ev.GetId(), host, ev)
 
@@ -57,20 +64,17 @@ func (tc *directStream) Connect(network string, addr string, opt mux.StreamOptio
 			proxyURL = u
 		}
 	}
-	connectHost, connectPort, _ := net.SplitHostPort(addr)
-	if net.ParseIP(connectHost) == nil {
-		iphost, err := dns.DnsGetDoaminIP(connectHost)
-		if nil != err {
-			return err
-		}
-		addr = net.JoinHostPort(iphost, connectPort)
-	}
 	//dailTimeout := tc.conf.DialTimeout
 	if 0 == opt.DialTimeout {
 		opt.DialTimeout = 5000
 	}
 	//log.Printf("Session:%d connect %s:%s for %s %T %v %v %s", ev.GetId(), network, addr, host, ev, needHttpsConnect, conf.ProxyURL(), net.JoinHostPort(host, port))
-	c, err := netx.DialTimeout(network, addr, time.Duration(opt.DialTimeout)*time.Millisecond)
+	dialCtx, cancel := context.WithTimeout(ctx, time.Duration(opt.DialTimeout)*time.Millisecond)
+	c, err := netx.DialHappyEyeballs(dialCtx, network, addr, tc.conf.IPv6, tc.conf.LookupIP)
+	cancel()
+	if nil == err {
+		addr = c.RemoteAddr().String()
+	}
 	if nil != proxyURL && nil == err {
 		switch proxyURL.Scheme {
 		case "http_proxy":
@@ -100,21 +104,49 @@ func (tc *directStream) StreamID() uint32 {
 }
 
 func (s *directStream) LatestIOTime() time.Time {
-	return s.latestIOTime
+	latest := time.Unix(0, atomic.LoadInt64(&s.latestIOTime))
+	if atomic.LoadInt32(&s.spliced) == 1 {
+		//IO bypass the stream while splicing, the kernel still knows when data passed the conn
+		if c := s.SpliceConn(); nil != c {
+			if t, ok := helper.TCPLatestIOTime(c); ok && t.After(latest) {
+				latest = t
+			}
+		}
+	}
+	return latest
+}
+
+//SpliceConn return the raw tcp conn for zero copy relaying
+func (s *directStream) SpliceConn() *net.TCPConn {
+	c, _ := s.Conn.(*net.TCPConn)
+	return c
+}
+
+func (s *directStream) OnSplice() {
+	//both relay directions notify splicing concurrently
+	atomic.StoreInt32(&s.spliced, 1)
+}
+
+//CloseWrite half close the underlying tcp conn
+func (s *directStream) CloseWrite() error {
+	if c, ok := s.Conn.(*net.TCPConn); ok {
+		return c.CloseWrite()
+	}
+	return mux.ErrHalfCloseUnsupported
 }
 
 func (tc *directStream) Read(p []byte) (int, error) {
 	if nil == tc.Conn {
 		return 0, io.EOF
 	}
-	tc.latestIOTime = time.Now()
+	atomic.StoreInt64(&tc.latestIOTime, time.Now().UnixNano())
 	return tc.Conn.Read(p)
 }
 func (tc *directStream) Write(p []byte) (int, error) {
 	if nil == tc.Conn {
 		return 0, io.EOF
 	}
-	tc.latestIOTime = time.Now()
+	atomic.StoreInt64(&tc.latestIOTime, time.Now().UnixNano())
 	return tc.Conn.Write(p)
 }
 
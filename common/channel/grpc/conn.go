@@ -0,0 +1,175 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//StreamPath is the method path of the bidirectional stream, which is declared as:
+//  service Tunnel { rpc Stream(stream Chunk) returns (stream Chunk); }
+//in package 'gsnova'.
+const StreamPath = "/gsnova.Tunnel/Stream"
+
+//ContentType is the content type of gRPC requests & responses
+const ContentType = "application/grpc"
+
+const (
+	//max data size of a chunk, which is far below the default 4MB message limit of gRPC proxies
+	maxChunkSize = 64 * 1024
+	//max message size accepted
+	maxMessageSize = 4 * 1024 * 1024
+	//gRPC status codes used in trailers
+	statusOK          = "0"
+	statusUnavailable = "14"
+)
+
+var errCompressedMessage = errors.New("Compressed gRPC message is not supported")
+
+//encodeChunk encode data as gRPC message of protobuf 'message Chunk { bytes data = 1; }'
+func encodeChunk(data []byte) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], uint64(len(data)))
+	msgLen := 1 + n + len(data)
+	buf := make([]byte, 5+msgLen)
+	//not compressed
+	buf[0] = 0
+	binary.BigEndian.PutUint32(buf[1:5], uint32(msgLen))
+	//field 1 with wire type 2(length delimited)
+	buf[5] = 0x0a
+	copy(buf[6:], varint[:n])
+	copy(buf[6+n:], data)
+	return buf
+}
+
+//decodeChunk return the data field of a Chunk message, unknown fields are skipped.
+func decodeChunk(msg []byte) ([]byte, error) {
+	var data []byte
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, fmt.Errorf("Invalid gRPC chunk field tag")
+		}
+		msg = msg[n:]
+		switch tag & 7 {
+		case 0:
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return nil, fmt.Errorf("Invalid gRPC chunk varint field")
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			msg = msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < size {
+				return nil, fmt.Errorf("Invalid gRPC chunk bytes field")
+			}
+			if tag>>3 == 1 {
+				data = msg[n : n+int(size)]
+			}
+			msg = msg[n+int(size):]
+		case 5:
+			if len(msg) < 4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			msg = msg[4:]
+		default:
+			return nil, fmt.Errorf("Invalid gRPC chunk wire type:%d", tag&7)
+		}
+	}
+	return data, nil
+}
+
+//chunkConn carry byte stream by chunks in messages of a gRPC stream, reads from the request/response body and
+//writes to the response/request body.
+type chunkConn struct {
+	reader  io.ReadCloser
+	readBuf []byte
+
+	writeLock sync.Mutex
+	writer    io.Writer
+	flush     func()
+	closeFunc func()
+	closeOnce sync.Once
+}
+
+func newChunkConn(r io.ReadCloser, w io.Writer, flush func(), closeFunc func()) *chunkConn {
+	return &chunkConn{reader: r, writer: w, flush: flush, closeFunc: closeFunc}
+}
+
+func (c *chunkConn) readMessage() error {
+	var header [5]byte
+	if _, err := io.ReadFull(c.reader, header[:]); nil != err {
+		return err
+	}
+	if header[0] != 0 {
+		return errCompressedMessage
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxMessageSize {
+		return fmt.Errorf("Too large gRPC message with size:%d", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, msg); nil != err {
+		return err
+	}
+	data, err := decodeChunk(msg)
+	if nil != err {
+		return err
+	}
+	c.readBuf = data
+	return nil
+}
+
+func (c *chunkConn) Read(p []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		if err := c.readMessage(); nil != err {
+			return 0, err
+		}
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *chunkConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if nil == c.writer {
+		return 0, io.EOF
+	}
+	written := 0
+	for written < len(p) {
+		end := written + maxChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if _, err := c.writer.Write(encodeChunk(p[written:end])); nil != err {
+			return written, err
+		}
+		written = end
+	}
+	if nil != c.flush {
+		c.flush()
+	}
+	return written, nil
+}
+
+func (c *chunkConn) Close() error {
+	c.closeOnce.Do(func() {
+		//pending writes are interrupted by closing the stream before waiting the write lock
+		c.reader.Close()
+		if nil != c.closeFunc {
+			c.closeFunc()
+		}
+		c.writeLock.Lock()
+		c.writer = nil
+		c.writeLock.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,153 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/mux"
+	"github.com/yinqiwen/gsnova/internal/testutil"
+)
+
+const testKey = "grpc-test-key"
+
+func listen(t *testing.T, scheme string, group *channel.SessionGroup) channel.RemoteListener {
+	channel.DefaultServerCipher = channel.CipherConfig{User: "gsnova", Key: testKey, Method: "chacha20poly1305"}
+	l, err := (&GRPCRemote{}).Listen(&channel.ListenerConfig{Scheme: scheme, Listen: "127.0.0.1:0"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	go l.Serve(group)
+	return l
+}
+
+func TestChunkCodec(t *testing.T) {
+	data := bytes.Repeat([]byte("gsnova"), 100)
+	msg := encodeChunk(data)[5:]
+	decoded, err := decodeChunk(msg)
+	if nil != err || !bytes.Equal(decoded, data) {
+		t.Fatalf("Unexpected decoded chunk with err:%v", err)
+	}
+	//unknown varint & bytes fields are skipped
+	msg = append([]byte{0x10, 0x96, 0x01, 0x1a, 0x01, 0x00}, msg...)
+	if decoded, err = decodeChunk(msg); nil != err || !bytes.Equal(decoded, data) {
+		t.Fatalf("Unexpected decoded chunk with unknown fields, err:%v", err)
+	}
+	if _, err = decodeChunk([]byte{0x0a, 0x05, 0x00}); nil == err {
+		t.Fatalf("Expected error of truncated chunk")
+	}
+}
+
+func TestGRPCRoundTrip(t *testing.T) {
+	defer channel.StopLocalChannels()
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+	for _, scheme := range []string{"grpc", "grpcs"} {
+		l := listen(t, scheme, channel.NewSessionGroup())
+		u, _ := url.Parse(scheme + "://gsnova:" + testKey + "@" + l.Addr().String() + "?method=chacha20poly1305&insecure=true")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		stream, conf, err := channel.GetMuxStreamByURLContext(ctx, u, "gsnova", &channel.DefaultServerCipher)
+		if nil != err {
+			t.Fatalf("Failed to open stream via %s:%v", scheme, err)
+		}
+		opt := mux.StreamOptions{DialTimeout: conf.RemoteDialMSTimeout}
+		if err = mux.ConnectStream(ctx, stream, "tcp", echo.Addr().String(), opt); nil != err {
+			t.Fatalf("Failed to connect echo server via %s:%v", scheme, err)
+		}
+		cancel()
+		//larger than a chunk
+		data := bytes.Repeat([]byte("hello grpc "), 2*maxChunkSize/10)
+		go stream.Write(data)
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, len(data))
+		if _, err = io.ReadFull(stream, buf); nil != err || !bytes.Equal(buf, data) {
+			t.Fatalf("Unexpected echo with err:%v via %s", err, scheme)
+		}
+		stream.Close()
+		l.Close()
+	}
+}
+
+func TestGRPCRejectedByClosedGroup(t *testing.T) {
+	group := channel.NewSessionGroup()
+	group.Close(false)
+	l := listen(t, "grpc", group)
+	defer l.Close()
+	//the trailers-only response with status unavailable fails the session creation
+	conf := &channel.ProxyChannelConfig{}
+	if _, err := (&GRPCProxy{}).CreateMuxSession("grpc://"+l.Addr().String(), conf); nil == err {
+		t.Fatalf("Expected error while server is closed")
+	}
+}
+
+func TestGRPCServerSessionFailed(t *testing.T) {
+	//stream window smaller than the initial window is rejected by pmux
+	group := channel.NewServerSessionGroup(&channel.ServerOptions{Mux: channel.MuxConfig{MaxStreamWindow: "1KB"}})
+	l := listen(t, "grpc", group)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(conn)
+	if nil != err {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ := http.NewRequest("POST", "http://"+l.Addr().String()+StreamPath, pr)
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("Te", "trailers")
+	res, err := cc.RoundTrip(req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if _, err = ioutil.ReadAll(res.Body); nil != err {
+		t.Fatal(err)
+	}
+	if res.Trailer.Get("Grpc-Status") != statusUnavailable || len(res.Trailer.Get("Grpc-Message")) == 0 {
+		t.Fatalf("Unexpected trailer:%v", res.Trailer)
+	}
+}
+
+func TestGRPCCreateMuxSessionCancel(t *testing.T) {
+	//the server accepts conns but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	conf := &channel.ProxyChannelConfig{LocalDialMSTimeout: 10000}
+	for _, scheme := range []string{"grpc", "grpcs"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		if _, err = (&GRPCProxy{}).CreateMuxSessionContext(ctx, scheme+"://"+l.Addr().String(), conf); nil == err {
+			t.Fatalf("Expected error after cancelled via %s", scheme)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Session creation via %s is not cancelled in time, elapsed:%v", scheme, elapsed)
+		}
+	}
+}
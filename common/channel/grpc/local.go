@@ -0,0 +1,108 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http2"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+	"github.com/yinqiwen/gsnova/common/pmux"
+)
+
+//GRPCProxy is the local channel of grpc/grpcs schemes, the mux session is carried by one gRPC bidirectional
+//stream over h2c(grpc) or HTTP/2 on TLS(grpcs).
+type GRPCProxy struct {
+}
+
+func (p *GRPCProxy) Features() channel.FeatureSet {
+	return channel.FeatureSet{
+		AutoExpire: true,
+		Pingable:   true,
+	}
+}
+
+func (p *GRPCProxy) CreateMuxSession(server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
+	return p.CreateMuxSessionContext(context.Background(), server, conf)
+}
+
+func (p *GRPCProxy) CreateMuxSessionContext(ctx context.Context, server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
+	u, err := url.Parse(server)
+	if nil != err {
+		return nil, err
+	}
+	conn, err := channel.DialServerByConfContext(ctx, server, conf)
+	if nil != err {
+		return nil, err
+	}
+	scheme := "http"
+	if u.Scheme == "grpcs" {
+		tlscfg := channel.NewTLSConfig(conf)
+		if len(tlscfg.ServerName) == 0 {
+			tlscfg.ServerName = u.Hostname()
+		}
+		tlscfg.NextProtos = []string{http2.NextProtoTLS}
+		tlsconn := tls.Client(conn, tlscfg)
+		if err = tlsconn.HandshakeContext(ctx); nil != err {
+			logger.Notice("TLS Handshake Failed %v", err)
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsconn
+		scheme = "https"
+	}
+	tr := &http2.Transport{AllowHTTP: true}
+	cc, err := tr.NewClientConn(conn)
+	if nil != err {
+		conn.Close()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", scheme+"://"+u.Host+StreamPath, pr)
+	req.ContentLength = -1
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("Te", "trailers")
+	if len(conf.HTTP.UserAgent) > 0 {
+		req.Header.Set("User-Agent", conf.HTTP.UserAgent)
+	}
+	conf.HTTP.SetHeaders(req.Header, req)
+	//the stream is not bounded by the dial context
+	stop := channel.BindConnContext(ctx, conn)
+	res, err := cc.RoundTrip(req)
+	stop()
+	if nil == err && (res.StatusCode != 200 || !strings.HasPrefix(res.Header.Get("Content-Type"), ContentType) ||
+		len(res.Header.Get("Grpc-Status")) > 0) {
+		res.Body.Close()
+		err = fmt.Errorf("Invalid gRPC response with status:%d, grpc-status:%s", res.StatusCode, res.Header.Get("Grpc-Status"))
+	}
+	if nil != err {
+		logger.Notice("Failed to open gRPC stream to %s with reason:%v", server, err)
+		pw.Close()
+		conn.Close()
+		return nil, err
+	}
+	logger.Debug("Connect %s success.", server)
+	stream := newChunkConn(res.Body, pw, nil, func() {
+		pw.Close()
+		conn.Close()
+	})
+	ps, err := pmux.Client(stream, conf.PMuxConfig())
+	if nil != err {
+		stream.Close()
+		return nil, err
+	}
+	return &mux.ProxyMuxSession{Session: ps}, nil
+}
+
+func init() {
+	channel.RegisterLocalChannelType("grpc", &GRPCProxy{})
+	channel.RegisterLocalChannelType("grpcs", &GRPCProxy{})
+}
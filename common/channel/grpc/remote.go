@@ -0,0 +1,144 @@
+package grpc
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+	"github.com/yinqiwen/gsnova/common/pmux"
+)
+
+//NewHandler create the handler of gRPC stream which serve mux sessions in the group, it should be served by
+//HTTP/2 servers, eg: http.Server on TLS or the h2c listener of grpc scheme.
+func NewHandler(group *channel.SessionGroup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveGRPC(w, r, group)
+	}
+}
+
+func serveGRPC(w http.ResponseWriter, r *http.Request, group *channel.SessionGroup) {
+	if r.Method != "POST" || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), ContentType) {
+		http.Error(w, "Unsupported gRPC request", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	if group.Closed() {
+		//trailers-only response
+		w.Header().Set("Grpc-Status", statusUnavailable)
+		w.WriteHeader(200)
+		return
+	}
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(200)
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if nil != flusher {
+			flusher.Flush()
+		}
+	}
+	flush()
+	stream := newChunkConn(r.Body, w, flush, nil)
+	session, err := pmux.Server(stream, group.Options().PMuxConfig())
+	if nil != err {
+		logger.Error("Failed to create mux session for gRPC stream with reason:%v", err)
+		stream.Close()
+		w.Header().Set("Grpc-Status", statusUnavailable)
+		w.Header().Set("Grpc-Message", "Failed to create mux session")
+		return
+	}
+	group.Serve(&mux.ProxyMuxSession{Session: session})
+	//no write to the response after the handler returned
+	stream.Close()
+	w.Header().Set("Grpc-Status", statusOK)
+}
+
+//ServeListener accept h2c or TLS(if config is not nil) conns from the listener & serve them by the handler
+//until the listener closed.
+func ServeListener(lp net.Listener, config *tls.Config, handler http.Handler) error {
+	server := &http2.Server{
+		MaxConcurrentStreams: 4096,
+		IdleTimeout:          5 * time.Minute,
+	}
+	opt := &http2.ServeConnOpts{BaseConfig: &http.Server{}, Handler: handler}
+	for {
+		conn, err := lp.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go func() {
+			if nil != config {
+				tlsconn := tls.Server(conn, config)
+				if err := tlsconn.Handshake(); nil != err {
+					logger.Error("TLS handshake failed:%v", err)
+					conn.Close()
+					return
+				}
+				conn = tlsconn
+			}
+			server.ServeConn(conn, opt)
+			conn.Close()
+		}()
+	}
+}
+
+type grpcListener struct {
+	net.Listener
+	config  *tls.Config
+	handler func(group *channel.SessionGroup) http.Handler
+}
+
+func (l *grpcListener) Serve(group *channel.SessionGroup) error {
+	return ServeListener(l.Listener, l.config, l.handler(group))
+}
+
+//GRPCRemote is the remote channel of grpc/grpcs schemes, the grpc listener serve h2c with prior knowledge, which
+//works behind TLS terminating gRPC proxies, options of grpcs listener are TLSOptions.
+type GRPCRemote struct {
+}
+
+func (p *GRPCRemote) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	return channel.ListenStream(p, conf)
+}
+
+func (p *GRPCRemote) NewListener(l net.Listener, conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	endpoint, err := conf.HTTPEndpoint()
+	if nil != err {
+		return nil, err
+	}
+	return p.NewHTTPListener(l, conf, channel.HTTPHandler(p, endpoint))
+}
+
+//HandleHTTP register the gRPC stream path, the path prefix of endpoint is not applied since gRPC clients
+//always request the method path.
+func (p *GRPCRemote) HandleHTTP(mux *http.ServeMux, endpoint *channel.HTTPEndpointConfig, group *channel.SessionGroup) {
+	mux.HandleFunc(StreamPath, NewHandler(group))
+}
+
+func (p *GRPCRemote) NewHTTPListener(l net.Listener, conf *channel.ListenerConfig, handler func(group *channel.SessionGroup) http.Handler) (channel.RemoteListener, error) {
+	var tlscfg *tls.Config
+	if conf.Scheme == "grpcs" {
+		var err error
+		if tlscfg, err = conf.TLSConfig(); nil != err {
+			return nil, err
+		}
+		tlscfg.NextProtos = []string{http2.NextProtoTLS}
+	}
+	return &grpcListener{Listener: l, config: tlscfg, handler: handler}, nil
+}
+
+func init() {
+	remote := &GRPCRemote{}
+	channel.RegisterRemoteChannelType("grpc", remote)
+	channel.RegisterRemoteChannelType("grpcs", remote)
+}
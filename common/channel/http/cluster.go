@@ -0,0 +1,225 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+//clusterForwardedHeader mark requests forwarded by other instances, which are always served locally.
+//The value is 'timestamp:signature' signed by the cluster secret, so that clients could not forge it.
+const clusterForwardedHeader = "X-Session-Forwarded"
+
+//clusterForwardedMaxAge is the max clock skew of instances verifying forwarded requests
+const clusterForwardedMaxAge = 5 * time.Minute
+
+func signForwarded(secret string, id string, ts int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%d", id, ts)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//forwardedValue return the header value marking the request of session forwarded at now
+func forwardedValue(cluster *channel.HTTPClusterConfig, id string, now time.Time) string {
+	ts := now.Unix()
+	return strconv.FormatInt(ts, 10) + ":" + signForwarded(cluster.Secret, id, ts)
+}
+
+//verifyForwarded return true if the request of session is forwarded by an instance of cluster
+func verifyForwarded(cluster *channel.HTTPClusterConfig, id string, value string, now time.Time) bool {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if nil != err {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > clusterForwardedMaxAge || age < -clusterForwardedMaxAge {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(signForwarded(cluster.Secret, id, ts)))
+}
+
+var clusterProxyTable = make(map[string]*httputil.ReverseProxy)
+var clusterProxyMutex sync.Mutex
+
+func getClusterProxy(owner string) (*httputil.ReverseProxy, error) {
+	clusterProxyMutex.Lock()
+	defer clusterProxyMutex.Unlock()
+	proxy, exist := clusterProxyTable[owner]
+	if !exist {
+		u, err := url.Parse(owner)
+		if nil != err {
+			return nil, err
+		}
+		proxy = httputil.NewSingleHostReverseProxy(u)
+		//pull responses & chunked push requests are streams
+		proxy.FlushInterval = -1
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Error("Failed to forward HTTP request to %s with reason:%v", owner, err)
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		clusterProxyTable[owner] = proxy
+	}
+	return proxy, nil
+}
+
+//forwardHTTP forward the request of session to the instance owning the session
+func forwardHTTP(cluster *channel.HTTPClusterConfig, owner string, id string, w http.ResponseWriter, r *http.Request) {
+	proxy, err := getClusterProxy(owner)
+	if nil != err {
+		logger.Error("Invalid HTTP cluster instance:%s with reason:%v", owner, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	r.Header.Set(clusterForwardedHeader, forwardedValue(cluster, id, time.Now()))
+	proxy.ServeHTTP(w, r)
+}
+
+//sessionOwner return url of the instance owning the session, empty means the session is served locally.
+//New sessions are registered to this instance if owners are recorded in registry dir.
+func sessionOwner(cluster *channel.HTTPClusterConfig, id string, r *http.Request, endpoint *channel.HTTPEndpointConfig) string {
+	if forwarded := r.Header.Get(clusterForwardedHeader); len(forwarded) > 0 {
+		//the header is never trusted unless it's signed by an instance of cluster
+		r.Header.Del(clusterForwardedHeader)
+		if cluster.Enabled() && verifyForwarded(cluster, id, forwarded, time.Now()) {
+			return ""
+		}
+		logger.Notice("Invalid forwarded header of HTTP session:%s from %s", id, r.RemoteAddr)
+	}
+	if !cluster.Enabled() {
+		return ""
+	}
+	if c, _ := getHttpDuplexServConnByID(id, nil, false); nil != c {
+		return ""
+	}
+	var owner string
+	if len(cluster.Peers) > 0 {
+		owner = hashSessionOwner(cluster.Peers, id)
+	} else if len(r.Header.Get(endpoint.SessionACKIDHeader)) > 0 {
+		//sessions with ack id are created already
+		owner = lookupSessionOwner(cluster, id)
+	} else {
+		var err error
+		owner, err = registerSessionOwner(cluster, id)
+		if nil != err {
+			logger.Error("Failed to register HTTP session:%s with reason:%v", id, err)
+			return ""
+		}
+	}
+	if owner == cluster.Self {
+		return ""
+	}
+	return owner
+}
+
+//hashSessionOwner select the owner by rendezvous hashing, so that owners of most sessions are not changed
+//while instances added or removed
+func hashSessionOwner(peers []string, id string) string {
+	var owner string
+	var max uint64
+	for _, peer := range peers {
+		h := fnv.New64a()
+		h.Write([]byte(peer))
+		h.Write([]byte(id))
+		if v := h.Sum64(); len(owner) == 0 || v > max {
+			owner, max = peer, v
+		}
+	}
+	return owner
+}
+
+func sessionRegistryPath(dir, id string) string {
+	//session ids are sent by clients, never use them as file names directly
+	sum := sha1.Sum([]byte(id))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+func useSessionRegistry(cluster *channel.HTTPClusterConfig) bool {
+	return len(cluster.Peers) == 0 && len(cluster.RegistryDir) > 0
+}
+
+//lookupSessionOwner return the owner recorded in registry, entries not refreshed in TTL are treated as owned by
+//crashed instances, they are removed so that the session could be registered again.
+func lookupSessionOwner(cluster *channel.HTTPClusterConfig, id string) string {
+	path := sessionRegistryPath(cluster.RegistryDir, id)
+	st, err := os.Stat(path)
+	if nil != err {
+		return ""
+	}
+	if time.Now().Sub(st.ModTime()) > time.Duration(cluster.RegistryTTL)*time.Second {
+		logger.Notice("Remove expired HTTP session:%s in registry since %v", id, st.ModTime())
+		os.Remove(path)
+		return ""
+	}
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		return ""
+	}
+	return string(content)
+}
+
+//registerSessionOwner record self as the owner of the session, the owner registered by other instance is
+//returned if they are racing on the same session, eg: the first pull & push requests.
+func registerSessionOwner(cluster *channel.HTTPClusterConfig, id string) (string, error) {
+	path := sessionRegistryPath(cluster.RegistryDir, id)
+	tmp := path + "." + helper.RandAsciiString(8)
+	if err := ioutil.WriteFile(tmp, []byte(cluster.Self), 0644); nil != err {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	//link fails if the file exists, which make the registering atomic, expired entries are removed by lookup
+	for i := 0; i < 2; i++ {
+		err := os.Link(tmp, path)
+		if nil == err {
+			break
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		if owner := lookupSessionOwner(cluster, id); len(owner) > 0 {
+			return owner, nil
+		}
+	}
+	return cluster.Self, nil
+}
+
+//refreshSessionOwner update the modify time of registry entry owned by self, it's called periodically by
+//running sessions to keep entries alive
+func refreshSessionOwner(cluster *channel.HTTPClusterConfig, id string) {
+	if !useSessionRegistry(cluster) {
+		return
+	}
+	if lookupSessionOwner(cluster, id) == cluster.Self {
+		now := time.Now()
+		os.Chtimes(sessionRegistryPath(cluster.RegistryDir, id), now, now)
+	}
+}
+
+//unregisterSessionOwner remove the session from registry if it's owned by self
+func unregisterSessionOwner(cluster *channel.HTTPClusterConfig, id string) {
+	if !useSessionRegistry(cluster) {
+		return
+	}
+	if lookupSessionOwner(cluster, id) == cluster.Self {
+		os.Remove(sessionRegistryPath(cluster.RegistryDir, id))
+	}
+}
@@ -0,0 +1,126 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+)
+
+func TestVerifyForwarded(t *testing.T) {
+	cluster := &channel.HTTPClusterConfig{Secret: "cluster secret"}
+	now := time.Now()
+	value := forwardedValue(cluster, "session", now)
+	if !verifyForwarded(cluster, "session", value, now.Add(time.Minute)) {
+		t.Fatalf("Signed forwarded header is not verified")
+	}
+	invalid := []string{"1", "", "abc:def", forwardedValue(cluster, "other", now), forwardedValue(cluster, "session", now.Add(-time.Hour))}
+	for _, v := range invalid {
+		if verifyForwarded(cluster, "session", v, now) {
+			t.Fatalf("Invalid forwarded header:%s is verified", v)
+		}
+	}
+	if verifyForwarded(&channel.HTTPClusterConfig{Secret: "other secret"}, "session", value, now) {
+		t.Fatalf("Forwarded header signed by other secret is verified")
+	}
+}
+
+func TestSessionOwnerForwarded(t *testing.T) {
+	cluster := &channel.HTTPClusterConfig{Self: "http://10.0.0.1", Peers: []string{"http://10.0.0.1", "http://10.0.0.2"}, Secret: "cluster secret"}
+	endpoint := &channel.HTTPEndpointConfig{}
+	endpoint.Adjust()
+	//find a session owned by the other instance
+	id := "session"
+	for i := 0; hashSessionOwner(cluster.Peers, id) == cluster.Self; i++ {
+		id = "session" + string(rune('a'+i))
+	}
+	r, _ := http.NewRequest("POST", "http://10.0.0.1/http/pull", nil)
+	r.Header.Set(clusterForwardedHeader, "1")
+	if owner := sessionOwner(cluster, id, r, endpoint); owner != "http://10.0.0.2" {
+		t.Fatalf("Forged forwarded request is served by:%s", owner)
+	}
+	if len(r.Header.Get(clusterForwardedHeader)) > 0 {
+		t.Fatalf("Forged forwarded header is not removed")
+	}
+	r.Header.Set(clusterForwardedHeader, forwardedValue(cluster, id, time.Now()))
+	if owner := sessionOwner(cluster, id, r, endpoint); len(owner) > 0 {
+		t.Fatalf("Forwarded request is forwarded again to:%s", owner)
+	}
+
+	//the forwarded header is removed while cluster is not enabled
+	r.Header.Set(clusterForwardedHeader, "1")
+	if owner := sessionOwner(&channel.HTTPClusterConfig{}, id, r, endpoint); len(owner) > 0 || len(r.Header.Get(clusterForwardedHeader)) > 0 {
+		t.Fatalf("Unexpected owner:%s with header:%v", owner, r.Header)
+	}
+}
+
+func TestForwardHTTP(t *testing.T) {
+	cluster := &channel.HTTPClusterConfig{Secret: "cluster secret"}
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !verifyForwarded(cluster, "session", r.Header.Get(clusterForwardedHeader), time.Now()) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("forwarded"))
+	}))
+	defer owner.Close()
+	r := httptest.NewRequest("POST", "http://10.0.0.1/http/pull", nil)
+	r.Header.Set(clusterForwardedHeader, "1")
+	w := httptest.NewRecorder()
+	forwardHTTP(cluster, owner.URL, "session", w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "forwarded" {
+		t.Fatalf("Unexpected forwarded response:%d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSessionRegistryExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsnova-registry")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := &channel.HTTPClusterConfig{Self: "http://10.0.0.1", RegistryDir: dir, RegistryTTL: 60}
+	b := &channel.HTTPClusterConfig{Self: "http://10.0.0.2", RegistryDir: dir, RegistryTTL: 60}
+
+	if owner, err := registerSessionOwner(a, "session"); nil != err || owner != a.Self {
+		t.Fatalf("Unexpected owner:%s with err:%v", owner, err)
+	}
+	if owner, err := registerSessionOwner(b, "session"); nil != err || owner != a.Self {
+		t.Fatalf("Unexpected owner:%s with err:%v while racing", owner, err)
+	}
+	//entries refreshed by the owner are not expired
+	path := sessionRegistryPath(dir, "session")
+	recent := time.Now().Add(-30 * time.Second).Truncate(time.Second)
+	os.Chtimes(path, recent, recent)
+	refreshSessionOwner(b, "session")
+	if st, _ := os.Stat(path); nil == st || !st.ModTime().Equal(recent) {
+		t.Fatalf("Entry is refreshed by other instance")
+	}
+	refreshSessionOwner(a, "session")
+	if st, _ := os.Stat(path); nil == st || !st.ModTime().After(recent) {
+		t.Fatalf("Entry is not refreshed by owner")
+	}
+
+	//the owner crashed, its entry is expired and the session could be registered by others
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(path, old, old)
+	if owner := lookupSessionOwner(b, "session"); len(owner) > 0 {
+		t.Fatalf("Unexpected owner:%s of expired entry", owner)
+	}
+	os.Chtimes(path, old, old)
+	if owner, err := registerSessionOwner(b, "session"); nil != err || owner != b.Self {
+		t.Fatalf("Unexpected owner:%s with err:%v after expired", owner, err)
+	}
+	unregisterSessionOwner(a, "session")
+	if owner := lookupSessionOwner(a, "session"); owner != b.Self {
+		t.Fatalf("Entry is removed by other instance")
+	}
+	unregisterSessionOwner(b, "session")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Entry is not removed by owner")
+	}
+}
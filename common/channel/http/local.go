@@ -8,14 +8,16 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 	"golang.org/x/time/rate"
 )
 
@@ -71,6 +73,7 @@ type sendReady struct {
 type httpDuplexConn struct {
 	id           string
 	ackID        string
+	ackLock      sync.Mutex
 	server       string
 	conf         *channel.ProxyChannelConfig
 	client       *http.Client
@@ -80,7 +83,7 @@ type httpDuplexConn struct {
 	recvReader   io.ReadCloser
 	recvLock     sync.Mutex
 	writeLock    sync.Mutex
-	running      bool
+	running      int32
 	sendCh       chan sendReady
 	closeCh      chan struct{}
 	recvNotifyCh chan struct{}
@@ -104,14 +107,18 @@ func (h *httpDuplexConn) buildHTTPReq(u *url.URL, body io.ReadCloser) *http.Requ
 	}
 	req.Close = false
 	req.Header.Set("Connection", "keep-alive")
-	req.Header.Set("Content-Type", "image/jpeg")
+	endpoint := &h.conf.HTTP.HTTPEndpointConfig
+	req.Header.Set("Content-Type", endpoint.ContentType)
 	if len(h.conf.HTTP.UserAgent) > 0 {
 		req.Header.Set("User-Agent", h.conf.HTTP.UserAgent)
 	}
-	req.Header.Set(mux.HTTPMuxSessionIDHeader, h.id)
+	endpoint.SetHeaders(req.Header, req)
+	req.Header.Set(endpoint.SessionIDHeader, h.id)
+	h.ackLock.Lock()
 	if len(h.ackID) > 0 {
-		req.Header.Set(mux.HTTPMuxSessionACKIDHeader, h.ackID)
+		req.Header.Set(endpoint.SessionACKIDHeader, h.ackID)
 	}
+	h.ackLock.Unlock()
 	return req
 }
 
@@ -130,26 +137,36 @@ func (h *httpDuplexConn) testChunkPush() {
 	}
 	h.chunkPushSupported = true
 	h.newChunkPushBody()
+	if response.ProtoMajor == 2 {
+		//pull & push requests of all sessions to the server share the HTTP/2 connection
+		logger.Notice("Server:%s support streaming request over HTTP/2.", h.server)
+		return
+	}
 	logger.Notice("Server:%s support chunked transfer encoding request.", h.server)
 }
 
 func (h *httpDuplexConn) init(server string, pushRateLimit int) error {
 	h.server = server
-	_, err := url.Parse(server)
+	u, err := url.Parse(server)
 	if nil != err {
 		return err
 	}
+	//cipher user/key & options in server url are not part of the http endpoint
+	u.User = nil
+	u.RawQuery = ""
+	base := strings.TrimSuffix(u.String(), "/")
 	h.id = helper.RandAsciiString(64)
-	h.pushurl, _ = url.Parse(server + "/http/push")
-	h.pullurl, _ = url.Parse(server + "/http/pull")
-	h.testurl, _ = url.Parse(server + "/http/test")
+	endpoint := &h.conf.HTTP.HTTPEndpointConfig
+	h.pushurl, _ = url.Parse(base + endpoint.Path("/http/push"))
+	h.pullurl, _ = url.Parse(base + endpoint.Path("/http/pull"))
+	h.testurl, _ = url.Parse(base + endpoint.Path("/http/test"))
 	h.testChunkPush()
 	h.sendCh = make(chan sendReady, 10)
 	h.closeCh = make(chan struct{})
 	h.recvNotifyCh = make(chan struct{})
 	h.pullNotifyCh = make(chan struct{})
 	h.pushLimiter = rate.NewLimiter(rate.Limit(pushRateLimit), 1)
-	h.running = true
+	atomic.StoreInt32(&h.running, 1)
 	if h.chunkPushSupported {
 		go h.chunkPush()
 	}
@@ -160,9 +177,11 @@ func (h *httpDuplexConn) init(server string, pushRateLimit int) error {
 
 func (h *httpDuplexConn) setAckId(res *http.Response) {
 	if nil != res && res.StatusCode == 200 {
+		h.ackLock.Lock()
 		if len(h.ackID) == 0 {
-			h.ackID = res.Header.Get(mux.HTTPMuxSessionACKIDHeader)
+			h.ackID = res.Header.Get(h.conf.HTTP.SessionACKIDHeader)
 		}
+		h.ackLock.Unlock()
 	}
 }
 
@@ -179,7 +198,7 @@ func (h *httpDuplexConn) newChunkPushBody() {
 func (h *httpDuplexConn) chunkPush() {
 	var restartChunkPushTimer *time.Timer
 
-	for h.running {
+	for h.isRunning() {
 		h.pushLimiter.Wait(context.TODO())
 		logger.Debug("HTTP start chunked push for %v with id:%s", h.pushurl, h.id)
 		req := h.buildHTTPReq(h.pushurl, h.chunkPushBody)
@@ -210,8 +229,11 @@ func (h *httpDuplexConn) chunkPush() {
 }
 
 func (h *httpDuplexConn) pull() {
-	for h.running {
-		if nil != h.recvReader {
+	for h.isRunning() {
+		h.recvLock.Lock()
+		reading := nil != h.recvReader
+		h.recvLock.Unlock()
+		if reading {
 			select {
 			case <-h.pullNotifyCh:
 			case <-time.After(10 * time.Second):
@@ -219,7 +241,7 @@ func (h *httpDuplexConn) pull() {
 			continue
 		}
 		req := h.buildHTTPReq(h.pullurl, nil)
-		req.Header.Set(mux.HTTPMuxPullPeriodHeader, strconv.Itoa(h.conf.ReconnectPeriod))
+		req.Header.Set(h.conf.HTTP.PullPeriodHeader, strconv.Itoa(h.conf.ReconnectPeriod))
 		response, err := h.client.Do(req)
 		if nil != err {
 			logger.Notice("Failed to write data to HTTP server for reason:%v", err)
@@ -269,7 +291,7 @@ func (h *httpDuplexConn) push() {
 		}
 		frs = make([]sendReady, 0)
 	}
-	for h.running {
+	for h.isRunning() {
 		sendBuffer := &bytes.Buffer{}
 		if len(frs) == 0 {
 			frs, err = readFrames()
@@ -324,7 +346,7 @@ START:
 	h.recvLock.Lock()
 	if nil == h.recvReader {
 		h.recvLock.Unlock()
-		if !h.running {
+		if !h.isRunning() {
 			return 0, io.EOF
 		}
 		goto WAIT
@@ -349,7 +371,7 @@ WAIT:
 func (h *httpDuplexConn) Write(p []byte) (int, error) {
 	ready := sendReady{Data: p, Err: make(chan error, 1)}
 START:
-	if !h.running {
+	if !h.isRunning() {
 		return 0, io.EOF
 	}
 
@@ -370,13 +392,18 @@ START:
 		goto START
 	}
 }
+func (h *httpDuplexConn) isRunning() bool {
+	return atomic.LoadInt32(&h.running) > 0
+}
+
 func (h *httpDuplexConn) Close() error {
-	if h.running {
-		h.running = false
+	if atomic.CompareAndSwapInt32(&h.running, 1, 0) {
 		close(h.closeCh)
+		h.writeLock.Lock()
 		if nil != h.chunkPushBody {
 			h.chunkPushBody.Close()
 		}
+		h.writeLock.Unlock()
 	}
 	return nil
 }
@@ -402,7 +429,7 @@ func (ws *HTTPProxy) CreateMuxSession(server string, conf *channel.ProxyChannelC
 		return nil, err
 	}
 	//log.Printf("Connect %s success.", server)
-	ps, err := pmux.Client(conn, channel.InitialPMuxConfig(&conf.Cipher))
+	ps, err := pmux.Client(conn, conf.PMuxConfig())
 	if nil != err {
 		return nil, err
 	}
@@ -2,7 +2,9 @@ package http
 
 import (
 	"bytes"
+	"crypto/tls"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -14,11 +16,13 @@ import (
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
 type httpDuplexServConn struct {
+	lastActiveIOTime int64
 	id               string
+	cluster          *channel.HTTPClusterConfig
 	ackID            string
 	recvBuffer       bytes.Buffer
 	req              *http.Request
@@ -31,17 +35,22 @@ type httpDuplexServConn struct {
 	sendNotifyCh     chan struct{}
 	closeNotifyCh    chan struct{}
 	shutdownErr      error
-	lastActiveIOTime time.Time
 	checkAliveTicker *time.Ticker
 }
 
 func (h *httpDuplexServConn) touch() {
-	h.lastActiveIOTime = time.Now()
+	atomic.StoreInt64(&h.lastActiveIOTime, time.Now().UnixNano())
+}
+
+func (h *httpDuplexServConn) idleTime() time.Duration {
+	return time.Now().Sub(time.Unix(0, atomic.LoadInt64(&h.lastActiveIOTime)))
 }
 
 func (h *httpDuplexServConn) setReader(req *http.Request) {
 	h.touch()
+	h.recvLock.Lock()
 	h.req = req
+	h.recvLock.Unlock()
 	b := make([]byte, 8192)
 	counter := 0
 	for {
@@ -59,7 +68,9 @@ func (h *httpDuplexServConn) setReader(req *http.Request) {
 		}
 	}
 	//log.Printf("#####Chunk read %d bytes", counter)
+	h.recvLock.Lock()
 	h.req = nil
+	h.recvLock.Unlock()
 }
 
 func (h *httpDuplexServConn) setWriter(w http.ResponseWriter, ch chan struct{}) {
@@ -74,29 +85,31 @@ func (h *httpDuplexServConn) setWriter(w http.ResponseWriter, ch chan struct{})
 	helper.AsyncNotify(h.sendNotifyCh)
 }
 
-func (h *httpDuplexServConn) init(id string) error {
+func (h *httpDuplexServConn) init(id string, cluster *channel.HTTPClusterConfig) error {
 	h.id = id
+	h.cluster = cluster
 	h.ackID = helper.RandAsciiString(32)
 	h.recvNotifyCh = make(chan struct{})
 	h.sendNotifyCh = make(chan struct{})
 	h.closeNotifyCh = make(chan struct{})
 	h.checkAliveTicker = time.NewTicker(10 * time.Second)
-	h.lastActiveIOTime = time.Now()
+	h.touch()
+	atomic.StoreInt32(&h.running, 1)
 	go func() {
 		for _ = range h.checkAliveTicker.C {
 			if !h.isRunning() {
 				h.checkAliveTicker.Stop()
 				return
 			}
-			if time.Now().Sub(h.lastActiveIOTime) > 2*time.Minute {
+			refreshSessionOwner(h.cluster, h.id)
+			if idle := h.idleTime(); idle > 2*time.Minute {
 				h.checkAliveTicker.Stop()
 				h.Close()
-				logger.Debug("Stop http duplex conn:%s since it's not active since %v ago", h.id, time.Now().Sub(h.lastActiveIOTime))
+				logger.Debug("Stop http duplex conn:%s since it's not active since %v ago", h.id, idle)
 				return
 			}
 		}
 	}()
-	h.running = 1
 	return nil
 }
 
@@ -178,7 +191,9 @@ func (h *httpDuplexServConn) closeWrite() error {
 }
 
 func (h *httpDuplexServConn) closeRead() error {
+	h.recvLock.Lock()
 	req := h.req
+	h.recvLock.Unlock()
 	if nil != req && nil != req.Body {
 		req.Body.Close()
 	}
@@ -186,11 +201,19 @@ func (h *httpDuplexServConn) closeRead() error {
 }
 
 func (h *httpDuplexServConn) shutdown(err error) {
+	h.recvLock.Lock()
 	h.shutdownErr = err
+	h.recvLock.Unlock()
 	h.Close()
 	h.closeRead()
 }
 
+func (h *httpDuplexServConn) shutdownError() error {
+	h.recvLock.Lock()
+	defer h.recvLock.Unlock()
+	return h.shutdownErr
+}
+
 func (h *httpDuplexServConn) isRunning() bool {
 	return atomic.LoadInt32(&h.running) > 0
 }
@@ -199,8 +222,11 @@ func (h *httpDuplexServConn) Close() error {
 	if h.isRunning() {
 		h.closeWrite()
 		helper.AsyncNotify(h.recvNotifyCh)
-		helper.AsyncNotify(h.closeNotifyCh)
-		atomic.StoreInt32(&h.running, 0)
+		if atomic.CompareAndSwapInt32(&h.running, 1, 0) {
+			//wake up all pending pull requests
+			close(h.closeNotifyCh)
+		}
+		unregisterSessionOwner(h.cluster, h.id)
 	}
 	removetHttpDuplexServConnByID(h.id)
 	return nil
@@ -209,7 +235,8 @@ func (h *httpDuplexServConn) Close() error {
 var httpDuplexServConnTable = make(map[string]*httpDuplexServConn)
 var httpDuplexServConnMutex sync.Mutex
 
-func getHttpDuplexServConnByID(id string, createIfNotExist bool) (*httpDuplexServConn, bool) {
+//getHttpDuplexServConnByID return the conn of session, the created conn is owned by the cluster
+func getHttpDuplexServConnByID(id string, cluster *channel.HTTPClusterConfig, createIfNotExist bool) (*httpDuplexServConn, bool) {
 	httpDuplexServConnMutex.Lock()
 	defer httpDuplexServConnMutex.Unlock()
 
@@ -217,7 +244,7 @@ func getHttpDuplexServConnByID(id string, createIfNotExist bool) (*httpDuplexSer
 	if !exist {
 		if createIfNotExist {
 			c = &httpDuplexServConn{}
-			c.init(id)
+			c.init(id, cluster)
 			httpDuplexServConnTable[id] = c
 			return c, true
 		}
@@ -236,41 +263,68 @@ func HttpTest(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+var defaultEndpoint channel.HTTPEndpointConfig
+
 func HTTPInvoke(w http.ResponseWriter, r *http.Request) {
-	id := r.Header.Get(mux.HTTPMuxSessionIDHeader)
+	serveHTTP(w, r, &defaultEndpoint, nil)
+}
+
+//NewHandler create a http pull/push handler with the endpoint config which serve mux sessions in the group
+func NewHandler(endpoint *channel.HTTPEndpointConfig, group *channel.SessionGroup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveHTTP(w, r, endpoint, group)
+	}
+}
+
+func serveHTTP(w http.ResponseWriter, r *http.Request, endpoint *channel.HTTPEndpointConfig, group *channel.SessionGroup) {
+	id := r.Header.Get(endpoint.SessionIDHeader)
 	if len(id) == 0 {
 		logger.Debug("Invalid header with no session id:%v", r)
 		return
 	}
-	c, create := getHttpDuplexServConnByID(id, true)
+	opts := group.Options()
+	cluster := &opts.HTTPCluster
+	if owner := sessionOwner(cluster, id, r, endpoint); len(owner) > 0 {
+		logger.Debug("Forward HTTP request of session:%s to %s", id, owner)
+		forwardHTTP(cluster, owner, id, w, r)
+		return
+	}
+	c, create := getHttpDuplexServConnByID(id, cluster, true)
+	if create && group.Closed() {
+		c.Close()
+		w.WriteHeader(503)
+		return
+	}
 	if create {
-		if len(r.Header.Get(mux.HTTPMuxSessionACKIDHeader)) > 0 {
+		if len(r.Header.Get(endpoint.SessionACKIDHeader)) > 0 {
 			w.WriteHeader(401)
-			logger.Error("###ERR1 : %s", r.Header.Get(mux.HTTPMuxSessionACKIDHeader))
+			logger.Error("###ERR1 : %s", r.Header.Get(endpoint.SessionACKIDHeader))
 			return
 		}
-		session, err := pmux.Server(c, channel.InitialPMuxConfig(&channel.DefaultServerCipher))
+		session, err := pmux.Server(c, opts.PMuxConfig())
 		if nil != err {
 			return
 		}
 		muxSession := &mux.ProxyMuxSession{Session: session}
 		go func() {
-			err := channel.ServProxyMuxSession(muxSession)
+			err := group.Serve(muxSession)
 			if nil != err {
 				c.shutdown(err)
 			}
 		}()
 	}
-	ackID := r.Header.Get(mux.HTTPMuxSessionACKIDHeader)
+	ackID := r.Header.Get(endpoint.SessionACKIDHeader)
 	if len(ackID) > 0 && ackID != c.ackID {
 		w.WriteHeader(401)
-		logger.Error("###ERR2 : %s %s", r.Header.Get(mux.HTTPMuxSessionACKIDHeader), c.ackID)
+		logger.Error("###ERR2 : %s %s", ackID, c.ackID)
 		return
 	}
-	w.Header().Set(mux.HTTPMuxSessionACKIDHeader, c.ackID)
+	endpoint.SetHeaders(w.Header(), nil)
+	w.Header().Set("Content-Type", endpoint.ContentType)
+	w.Header().Set(endpoint.SessionACKIDHeader, c.ackID)
 	if strings.HasSuffix(r.URL.Path, "pull") {
 		logger.Debug("HTTP server recv pull for id:%s", id)
-		period, _ := strconv.Atoi(r.Header.Get("X-PullPeriod"))
+		period, _ := strconv.Atoi(r.Header.Get(endpoint.PullPeriodHeader))
 		if period <= 0 {
 			period = 30
 		}
@@ -300,8 +354,48 @@ func HTTPInvoke(w http.ResponseWriter, r *http.Request) {
 	} else {
 		//counter := r.URL.Query().Get(pmux.HTTPPullCounterKey)
 		c.setReader(r)
-		if nil != c.shutdownErr {
+		if nil != c.shutdownError() {
 			w.WriteHeader(401)
 		}
 	}
 }
+
+//HTTPRemote is the remote channel of http/https schemes, options of https listener are TLSOptions
+type HTTPRemote struct {
+}
+
+func (p *HTTPRemote) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	return channel.ListenStream(p, conf)
+}
+
+func (p *HTTPRemote) NewListener(l net.Listener, conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	endpoint, err := conf.HTTPEndpoint()
+	if nil != err {
+		return nil, err
+	}
+	return p.NewHTTPListener(l, conf, channel.HTTPHandler(p, endpoint))
+}
+
+func (p *HTTPRemote) HandleHTTP(mux *http.ServeMux, endpoint *channel.HTTPEndpointConfig, group *channel.SessionGroup) {
+	mux.HandleFunc(endpoint.Path("/http/pull"), NewHandler(endpoint, group))
+	mux.HandleFunc(endpoint.Path("/http/push"), NewHandler(endpoint, group))
+	mux.HandleFunc(endpoint.Path("/http/test"), HttpTest)
+}
+
+func (p *HTTPRemote) NewHTTPListener(l net.Listener, conf *channel.ListenerConfig, handler func(group *channel.SessionGroup) http.Handler) (channel.RemoteListener, error) {
+	var tlscfg *tls.Config
+	if conf.Scheme == "https" {
+		var err error
+		if tlscfg, err = conf.TLSConfig(); nil != err {
+			return nil, err
+		}
+	}
+	return channel.NewHTTPListener(l, tlscfg, handler), nil
+}
+
+func init() {
+	defaultEndpoint.Adjust()
+	remote := &HTTPRemote{}
+	channel.RegisterRemoteChannelType("http", remote)
+	channel.RegisterRemoteChannelType("https", remote)
+}
@@ -1,6 +1,7 @@
 package http2
 
 import (
+	"context"
 	"net/url"
 
 	"github.com/yinqiwen/gsnova/common/channel"
@@ -18,16 +19,30 @@ func (p *HTTP2Proxy) Features() channel.FeatureSet {
 }
 
 func (tc *HTTP2Proxy) CreateMuxSession(server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
+	return tc.CreateMuxSessionContext(context.Background(), server, conf)
+}
+
+func (tc *HTTP2Proxy) CreateMuxSessionContext(ctx context.Context, server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
 	rurl, err := url.Parse(server)
 	if nil != err {
 		return nil, err
 	}
-	conn, err := channel.DialServerByConf(server, conf)
+	conn, err := channel.DialServerByConfContext(ctx, server, conf)
 	if err != nil {
 		return nil, err
 	}
 	//log.Printf("Connect %s success.", server)
-	return mux.NewHTTP2ClientMuxSession(conn, rurl.Host)
+	stop := channel.BindConnContext(ctx, conn)
+	session, err := mux.NewHTTP2ClientMuxSession(conn, rurl.Host)
+	stop()
+	if nil == err {
+		err = ctx.Err()
+	}
+	if nil != err {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
 }
 
 func init() {
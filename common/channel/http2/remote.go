@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"golang.org/x/net/http2"
 
@@ -73,16 +74,25 @@ func (ss *http2Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	<-s.closeCh
 }
 
-func servHTTP2(lp net.Listener, addr string, config *tls.Config) {
+//ServeListener accept TLS conns from the listener & serve their HTTP2 mux sessions in the group until the listener closed.
+func ServeListener(lp net.Listener, config *tls.Config, group *channel.SessionGroup) error {
 	for {
 		conn, err := lp.Accept()
 		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if group.Closed() {
+			conn.Close()
 			continue
 		}
 		muxSession := mux.NewHTTP2ServerMuxSession(conn)
-		go channel.ServProxyMuxSession(muxSession)
+		go group.Serve(muxSession)
 		server := &http.Server{
-			Addr:      addr,
+			Addr:      lp.Addr().String(),
 			TLSConfig: config,
 		}
 		http2Server := &http2.Server{
@@ -95,7 +105,7 @@ func servHTTP2(lp net.Listener, addr string, config *tls.Config) {
 
 		go func() {
 			tlsconn := tls.Server(conn, config)
-			err = tlsconn.Handshake()
+			err := tlsconn.Handshake()
 			if nil != err {
 				logger.Error("TLS handshake failed:%v", err)
 				muxSession.Close()
@@ -109,13 +119,31 @@ func servHTTP2(lp net.Listener, addr string, config *tls.Config) {
 	}
 }
 
-func StartHTTTP2ProxyServer(addr string, config *tls.Config) error {
-	lp, err := net.Listen("tcp", addr)
+type http2Listener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *http2Listener) Serve(group *channel.SessionGroup) error {
+	return ServeListener(l.Listener, l.config, group)
+}
+
+//HTTP2Remote is the remote channel of http2 scheme, options of listener are TLSOptions
+type HTTP2Remote struct {
+}
+
+func (p *HTTP2Remote) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	return channel.ListenStream(p, conf)
+}
+
+func (p *HTTP2Remote) NewListener(l net.Listener, conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	tlscfg, err := conf.TLSConfig()
 	if nil != err {
-		logger.Error("[ERROR]Failed to listen TCP address:%s with reason:%v", addr, err)
-		return err
+		return nil, err
 	}
-	logger.Info("Listen on HTTP2 address:%s", addr)
-	servHTTP2(lp, addr, config)
-	return nil
+	return &http2Listener{l, tlscfg}, nil
+}
+
+func init() {
+	channel.RegisterRemoteChannelType("http2", &HTTP2Remote{})
 }
@@ -0,0 +1,60 @@
+package kcp
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync"
+
+	kcp "github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const kcpCryptSalt = "gsnova-kcp-crypt"
+
+//crypt keys derived from channel cipher keys, since PBKDF2 is too slow to run on every session setup
+var kcpCryptKeys sync.Map
+
+//deriveCryptKey derive the 32 bytes crypt key from the channel cipher key, the result is cached.
+func deriveCryptKey(key string) []byte {
+	if v, exist := kcpCryptKeys.Load(key); exist {
+		return v.([]byte)
+	}
+	pass := pbkdf2.Key([]byte(key), []byte(kcpCryptSalt), 4096, 32, sha1.New)
+	v, _ := kcpCryptKeys.LoadOrStore(key, pass)
+	return v.([]byte)
+}
+
+//newBlockCrypt create packet crypt for kcp session, the crypt key is derived from the channel cipher key,
+//so both client & server only need to agree on the crypt method.
+//The "xor" method of kcp-go is not supported, it's only an obfuscation which could be reverted by anyone.
+func newBlockCrypt(method string, key string) (kcp.BlockCrypt, error) {
+	if "" == method || "none" == method {
+		return kcp.NewNoneBlockCrypt(nil)
+	}
+	pass := deriveCryptKey(key)
+	switch method {
+	case "aes":
+		return kcp.NewAESBlockCrypt(pass)
+	case "aes-128":
+		return kcp.NewAESBlockCrypt(pass[:16])
+	case "aes-192":
+		return kcp.NewAESBlockCrypt(pass[:24])
+	case "salsa20":
+		return kcp.NewSalsa20BlockCrypt(pass)
+	case "xtea":
+		return kcp.NewXTEABlockCrypt(pass[:16])
+	case "tea":
+		return kcp.NewTEABlockCrypt(pass[:16])
+	case "blowfish":
+		return kcp.NewBlowfishBlockCrypt(pass)
+	case "twofish":
+		return kcp.NewTwofishBlockCrypt(pass)
+	case "cast5":
+		return kcp.NewCast5BlockCrypt(pass[:16])
+	case "3des":
+		return kcp.NewTripleDESBlockCrypt(pass[:24])
+	case "sm4":
+		return kcp.NewSM4BlockCrypt(pass[:16])
+	}
+	return nil, fmt.Errorf("Invalid kcp crypt method:%s", method)
+}
@@ -0,0 +1,74 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	kcp "github.com/xtaci/kcp-go"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestDeriveCryptKey(t *testing.T) {
+	expected := pbkdf2.Key([]byte("test key"), []byte(kcpCryptSalt), 4096, 32, sha1.New)
+	key := deriveCryptKey("test key")
+	if !bytes.Equal(key, expected) {
+		t.Fatalf("Unexpected derived key:%x", key)
+	}
+	//derived once per cipher key
+	if again := deriveCryptKey("test key"); &again[0] != &key[0] {
+		t.Fatalf("Derived key is not cached")
+	}
+	if bytes.Equal(deriveCryptKey("other key"), key) {
+		t.Fatalf("Same key derived from different cipher keys")
+	}
+}
+
+func TestNewBlockCrypt(t *testing.T) {
+	pass := pbkdf2.Key([]byte("test key"), []byte(kcpCryptSalt), 4096, 32, sha1.New)
+	expected := map[string]func() (kcp.BlockCrypt, error){
+		"none":     func() (kcp.BlockCrypt, error) { return kcp.NewNoneBlockCrypt(nil) },
+		"aes":      func() (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(pass) },
+		"aes-128":  func() (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(pass[:16]) },
+		"aes-192":  func() (kcp.BlockCrypt, error) { return kcp.NewAESBlockCrypt(pass[:24]) },
+		"salsa20":  func() (kcp.BlockCrypt, error) { return kcp.NewSalsa20BlockCrypt(pass) },
+		"xtea":     func() (kcp.BlockCrypt, error) { return kcp.NewXTEABlockCrypt(pass[:16]) },
+		"tea":      func() (kcp.BlockCrypt, error) { return kcp.NewTEABlockCrypt(pass[:16]) },
+		"blowfish": func() (kcp.BlockCrypt, error) { return kcp.NewBlowfishBlockCrypt(pass) },
+		"twofish":  func() (kcp.BlockCrypt, error) { return kcp.NewTwofishBlockCrypt(pass) },
+		"cast5":    func() (kcp.BlockCrypt, error) { return kcp.NewCast5BlockCrypt(pass[:16]) },
+		"3des":     func() (kcp.BlockCrypt, error) { return kcp.NewTripleDESBlockCrypt(pass[:24]) },
+		"sm4":      func() (kcp.BlockCrypt, error) { return kcp.NewSM4BlockCrypt(pass[:16]) },
+	}
+	plain := bytes.Repeat([]byte("gsnova kcp crypt"), 8)
+	for method, create := range expected {
+		block, err := newBlockCrypt(method, "test key")
+		if nil != err {
+			t.Fatalf("Failed to create crypt:%s with err:%v", method, err)
+		}
+		ref, _ := create()
+		//same cipher & key as the crypt created by kcp-go peers
+		encrypted, refEncrypted := make([]byte, len(plain)), make([]byte, len(plain))
+		block.Encrypt(encrypted, plain)
+		ref.Encrypt(refEncrypted, plain)
+		if !bytes.Equal(encrypted, refEncrypted) {
+			t.Fatalf("Crypt:%s is not compatible with kcp-go", method)
+		}
+		if method != "none" && bytes.Equal(encrypted, plain) {
+			t.Fatalf("Crypt:%s does not encrypt", method)
+		}
+		decrypted := make([]byte, len(plain))
+		block.Decrypt(decrypted, encrypted)
+		if !bytes.Equal(decrypted, plain) {
+			t.Fatalf("Crypt:%s could not decrypt", method)
+		}
+	}
+	if block, err := newBlockCrypt("", ""); nil != err || nil == block {
+		t.Fatalf("Expected none crypt by default, err:%v", err)
+	}
+	for _, method := range []string{"xor", "unknown"} {
+		if _, err := newBlockCrypt(method, "test key"); nil == err {
+			t.Fatalf("Expected error of crypt method:%s", method)
+		}
+	}
+}
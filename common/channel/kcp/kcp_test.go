@@ -0,0 +1,241 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/yinqiwen/gsnova/common/channel"
+)
+
+func echoKCP(t *testing.T, conn *kcp.UDPSession) {
+	conn.SetStreamMode(true)
+	data := bytes.Repeat([]byte("gsnova kcp "), 10000)
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, buf); nil != err {
+		t.Fatalf("Failed to read echo:%v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("Invalid echo data")
+	}
+}
+
+func TestPacketConnCompatible(t *testing.T) {
+	key := "test key"
+	config := &channel.KCPConfig{}
+	config.InitDefaultConf()
+	config.Crypt = "aes"
+	block, _ := newBlockCrypt(config.Crypt, key)
+
+	udpconn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	l, err := NewListener(udpconn, config, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.AcceptKCP()
+			if nil != err {
+				return
+			}
+			conn.SetStreamMode(true)
+			mc := newMuxConn(conn, l.pc, config)
+			go func() {
+				io.Copy(mc, mc)
+				mc.Close()
+			}()
+		}
+	}()
+
+	//kcp-go client crypt packets itself
+	conn, err := kcp.DialWithOptions(udpconn.LocalAddr().String(), block, config.DataShard, config.ParityShard)
+	if nil != err {
+		t.Fatal(err)
+	}
+	echoKCP(t, conn)
+	conn.Close()
+
+	//client with packet conn
+	raw, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	pc := newPacketConn(raw, block, config.DataShard, config.ParityShard)
+	stat := pc.register(udpconn.LocalAddr())
+	conn, err = kcp.NewConn(udpconn.LocalAddr().String(), nil, config.DataShard, config.ParityShard, pc)
+	if nil != err {
+		t.Fatal(err)
+	}
+	echoKCP(t, conn)
+	conn.Close()
+	if atomic.LoadUint64(&stat.outSegs) == 0 || atomic.LoadUint64(&stat.outParity) == 0 {
+		t.Fatalf("Packets not counted:%+v", stat)
+	}
+}
+
+//TestPacketConnInterop round trip between stock kcp-go & packet conns in both directions, so that any drift
+//of the wire format of crypt & FEC headers is caught.
+func TestPacketConnInterop(t *testing.T) {
+	key := "test key"
+	cases := []struct {
+		crypt        string
+		dataShards   int
+		parityShards int
+		activeParity int32
+	}{
+		{"none", 0, 0, 0},
+		{"aes", 10, 3, 3},
+		{"salsa20", 10, 3, 1},
+		{"sm4", 2, 2, 0},
+	}
+	for _, c := range cases {
+		config := &channel.KCPConfig{}
+		config.InitDefaultConf()
+		config.Crypt, config.DataShard, config.ParityShard = c.crypt, c.dataShards, c.parityShards
+		block, err := newBlockCrypt(c.crypt, key)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		//stock kcp-go client to the listener over packet conn
+		udpconn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		l, err := NewListener(udpconn, config, key)
+		if nil != err {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.AcceptKCP()
+				if nil != err {
+					return
+				}
+				conn.SetStreamMode(true)
+				go func() {
+					io.Copy(conn, conn)
+					conn.Close()
+				}()
+			}
+		}()
+		conn, err := kcp.DialWithOptions(udpconn.LocalAddr().String(), block, c.dataShards, c.parityShards)
+		if nil != err {
+			t.Fatal(err)
+		}
+		echoKCP(t, conn)
+		conn.Close()
+		l.Close()
+
+		//client over packet conn to stock kcp-go listener, with parity shards partly dropped
+		stock, err := kcp.ListenWithOptions("127.0.0.1:0", block, c.dataShards, c.parityShards)
+		if nil != err {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := stock.AcceptKCP()
+				if nil != err {
+					return
+				}
+				conn.SetStreamMode(true)
+				go func() {
+					io.Copy(conn, conn)
+					conn.Close()
+				}()
+			}
+		}()
+		raw, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		pc := newPacketConn(raw, block, c.dataShards, c.parityShards)
+		stat := pc.register(stock.Addr())
+		atomic.StoreInt32(&stat.parity, c.activeParity)
+		conn, err = kcp.NewConn(stock.Addr().String(), nil, c.dataShards, c.parityShards, pc)
+		if nil != err {
+			t.Fatal(err)
+		}
+		echoKCP(t, conn)
+		conn.Close()
+		stock.Close()
+	}
+}
+
+type discardPacketConn struct {
+	net.PacketConn
+	packets int
+}
+
+func (c *discardPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.packets++
+	return len(p), nil
+}
+
+func kcpPacket(fec []byte, sn uint32) []byte {
+	p := append([]byte{}, fec...)
+	seg := make([]byte, kcpOverhead)
+	seg[4] = kcp.IKCP_CMD_PUSH
+	binary.LittleEndian.PutUint32(seg[12:], sn)
+	return append(p, seg...)
+}
+
+func TestPacketConnStat(t *testing.T) {
+	block, _ := newBlockCrypt("none", "")
+	conn := &discardPacketConn{}
+	pc := newPacketConn(conn, block, 2, 2)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	stat := pc.register(addr)
+	atomic.StoreInt32(&stat.parity, 1)
+	fecHeader := func(seqid uint32, flag uint16) []byte {
+		h := make([]byte, fecHeaderSizePlus2)
+		binary.LittleEndian.PutUint32(h, seqid)
+		binary.LittleEndian.PutUint16(h[4:], flag)
+		return h
+	}
+	//data shards 0,1 & parity shards 2,3, while the second parity shard is dropped
+	pc.WriteTo(kcpPacket(fecHeader(0, fecTypeData), 0), addr)
+	pc.WriteTo(kcpPacket(fecHeader(1, fecTypeData), 1), addr)
+	pc.WriteTo(make([]byte, 32), addr)
+	pc.WriteTo(fecHeader(2, fecTypeParity), addr)
+	pc.WriteTo(fecHeader(3, fecTypeParity), addr)
+	//retransmission
+	pc.WriteTo(kcpPacket(fecHeader(4, fecTypeData), 1), addr)
+	if stat.outSegs != 3 || stat.retransSegs != 1 || stat.outParity != 1 || stat.droppedParity != 1 {
+		t.Fatalf("Unexpected stat:%+v", stat)
+	}
+	if conn.packets != 5 {
+		t.Fatalf("Unexpected sent packets:%d", conn.packets)
+	}
+}
+
+func TestKCPTuner(t *testing.T) {
+	config := &channel.KCPConfig{}
+	config.InitDefaultConf()
+	conn, err := kcp.DialWithOptions("127.0.0.1:1", nil, 10, 3)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stat := &sessionStat{parity: 1}
+	tuner := &kcpTuner{conn: conn, config: config, stat: stat, wnd: 128, interval: 50, parity: 1}
+	//high loss
+	stat.outSegs, stat.retransSegs = 100, 20
+	tuner.tune()
+	if tuner.wnd >= 128 || tuner.interval <= 50 || tuner.parity != 2 || stat.activeParity() != 2 {
+		t.Fatalf("Unexpected tuning under high loss:%d %d %d", tuner.wnd, tuner.interval, tuner.parity)
+	}
+	//no loss
+	wnd, interval := tuner.wnd, tuner.interval
+	stat.outSegs = 200
+	tuner.tune()
+	if tuner.wnd <= wnd || tuner.interval >= interval || tuner.parity != 1 {
+		t.Fatalf("Unexpected tuning under low loss:%d %d %d", tuner.wnd, tuner.interval, tuner.parity)
+	}
+	for i := 0; i < 10; i++ {
+		stat.outSegs += 100
+		tuner.tune()
+	}
+	if tuner.parity != config.MinParityShard || tuner.interval != config.MinInterval {
+		t.Fatalf("Unexpected tuning bounds:%d %d", tuner.interval, tuner.parity)
+	}
+}
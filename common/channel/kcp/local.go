@@ -7,11 +7,10 @@ import (
 
 	kcp "github.com/xtaci/kcp-go"
 	"github.com/yinqiwen/gsnova/common/channel"
-	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
 	"github.com/yinqiwen/gsnova/common/netx"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
 // connectedUDPConn is a wrapper for net.UDPConn which converts WriteTo syscalls
@@ -47,36 +46,49 @@ func (tc *KCPProxy) CreateMuxSession(server string, conf *channel.ProxyChannelCo
 	hostport := rurl.Host
 	tcpHost, tcpPort, _ := net.SplitHostPort(hostport)
 	if net.ParseIP(tcpHost) == nil {
-		iphost, err := dns.DnsGetDoaminIP(tcpHost)
+		iphost, err := conf.LookupHost(tcpHost)
 		if nil != err {
 			return nil, err
 		}
 		hostport = net.JoinHostPort(iphost, tcpPort)
 	}
-	block, _ := kcp.NewNoneBlockCrypt(nil)
+	block, err := newBlockCrypt(conf.KCP.Crypt, conf.Cipher.Key)
+	if nil != err {
+		return nil, err
+	}
 
 	udpaddr, err := net.ResolveUDPAddr("udp", hostport)
 	if err != nil {
 		return nil, err
 	}
-	udpconn, err := netx.DialUDP("udp", nil, udpaddr)
+	var udpconn net.PacketConn
+	if len(conf.Proxy) > 0 {
+		udpconn, err = channel.ListenPacketByConf(conf)
+	} else {
+		udpconn, err = netx.DialUDP("udp", nil, udpaddr)
+		if nil == err {
+			udpconn = &connectedUDPConn{udpconn}
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	kcpconn, err := kcp.NewConn(hostport, block, conf.KCP.DataShard, conf.KCP.ParityShard, &connectedUDPConn{udpconn})
-	//kcpconn, err := kcp.NewConn(hostport, block, conf.KCP.DataShard, conf.KCP.ParityShard, udpconn)
+	//packets are crypted by the packet conn
+	pc := newPacketConn(udpconn, block, conf.KCP.DataShard, conf.KCP.ParityShard)
+	kcpconn, err := kcp.NewConn(hostport, nil, conf.KCP.DataShard, conf.KCP.ParityShard, pc)
 	//kcpconn, err := kcp.DialWithOptions(hostport, block, conf.KCP.DataShard, conf.KCP.ParityShard)
 	if err != nil {
+		udpconn.Close()
 		return nil, err
 	}
 	kcpconn.SetStreamMode(true)
 	kcpconn.SetWriteDelay(true)
 	kcpconn.SetNoDelay(conf.KCP.NoDelay, conf.KCP.Interval, conf.KCP.Resend, conf.KCP.NoCongestion)
 	kcpconn.SetWindowSize(conf.KCP.SndWnd, conf.KCP.RcvWnd)
-	kcpconn.SetMtu(conf.KCP.MTU)
+	kcpconn.SetMtu(conf.KCP.MTU - cryptHeaderSize)
 	kcpconn.SetACKNoDelay(conf.KCP.AckNodelay)
 
-	if err := kcpconn.SetDSCP(conf.KCP.DSCP); err != nil {
+	if err := pc.SetDSCP(conf.KCP.DSCP); err != nil {
 		logger.Notice("SetDSCP:%v with value:%v", err, conf.KCP.DSCP)
 	}
 	if err := kcpconn.SetReadBuffer(conf.KCP.SockBuf); err != nil {
@@ -85,7 +97,7 @@ func (tc *KCPProxy) CreateMuxSession(server string, conf *channel.ProxyChannelCo
 	if err := kcpconn.SetWriteBuffer(conf.KCP.SockBuf); err != nil {
 		logger.Notice("SetWriteBuffer:%v", err)
 	}
-	session, err := pmux.Client(kcpconn, channel.InitialPMuxConfig(&conf.Cipher))
+	session, err := pmux.Client(newMuxConn(kcpconn, pc, &conf.KCP), conf.PMuxConfig())
 	if nil != err {
 		return nil, err
 	}
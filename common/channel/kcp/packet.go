@@ -0,0 +1,181 @@
+package kcp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	kcp "github.com/xtaci/kcp-go"
+	"golang.org/x/net/ipv4"
+)
+
+//wire format of kcp-go packets: crypt header(nonce + crc32) | fec header(seqid + flag [+ size]) | kcp segments
+const (
+	nonceSize          = 16
+	crcSize            = 4
+	cryptHeaderSize    = nonceSize + crcSize
+	fecHeaderSize      = 6
+	fecHeaderSizePlus2 = fecHeaderSize + 2
+	fecTypeData        = 0xf1
+	fecTypeParity      = 0xf2
+	kcpOverhead        = 24
+)
+
+var packetBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 2048)
+	},
+}
+
+//sessionStat is the counters of packets sent to a remote address, kcp-go only has process wide SNMP counters.
+type sessionStat struct {
+	//parity shards of every FEC group to send, the rest of parity shards are dropped like lost packets
+	parity        int32
+	outSegs       uint64
+	retransSegs   uint64
+	outParity     uint64
+	droppedParity uint64
+
+	//next sn of push segments, only accessed by the writer of the session
+	nextSN    uint32
+	hasNextSN bool
+}
+
+func (s *sessionStat) activeParity() int {
+	return int(atomic.LoadInt32(&s.parity))
+}
+
+//countSegments count push segments in kcp packet, segments with sn sent before are retransmissions.
+func (s *sessionStat) countSegments(data []byte) {
+	for len(data) >= kcpOverhead {
+		cmd := data[4]
+		sn := binary.LittleEndian.Uint32(data[12:])
+		length := binary.LittleEndian.Uint32(data[20:])
+		if cmd == kcp.IKCP_CMD_PUSH {
+			atomic.AddUint64(&s.outSegs, 1)
+			if s.hasNextSN && int32(sn-s.nextSN) < 0 {
+				atomic.AddUint64(&s.retransSegs, 1)
+			} else {
+				s.nextSN = sn + 1
+				s.hasNextSN = true
+			}
+		}
+		if uint64(length) > uint64(len(data)-kcpOverhead) {
+			return
+		}
+		data = data[kcpOverhead+int(length):]
+	}
+}
+
+//packetConn crypt packets for kcp sessions created without block crypt, the wire format is same as kcp-go's,
+//while packets are visible in plain text here so that sessions could be measured & FEC parity be adjusted.
+type packetConn struct {
+	net.PacketConn
+	block        kcp.BlockCrypt
+	dataShards   int
+	parityShards int
+	stats        sync.Map
+}
+
+func newPacketConn(conn net.PacketConn, block kcp.BlockCrypt, dataShards, parityShards int) *packetConn {
+	if dataShards <= 0 || parityShards <= 0 {
+		dataShards, parityShards = 0, 0
+	}
+	return &packetConn{PacketConn: conn, block: block, dataShards: dataShards, parityShards: parityShards}
+}
+
+//register start counting packets sent to the address, packets to unregistered addresses are not counted.
+func (c *packetConn) register(addr net.Addr) *sessionStat {
+	stat := &sessionStat{parity: int32(c.parityShards)}
+	v, _ := c.stats.LoadOrStore(addr.String(), stat)
+	return v.(*sessionStat)
+}
+
+func (c *packetConn) unregister(addr net.Addr) {
+	c.stats.Delete(addr.String())
+}
+
+func (c *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if v, ok := c.stats.Load(addr.String()); ok {
+		stat := v.(*sessionStat)
+		data := p
+		if c.parityShards > 0 && len(p) >= fecHeaderSize {
+			seqid := binary.LittleEndian.Uint32(p)
+			switch binary.LittleEndian.Uint16(p[4:]) {
+			case fecTypeParity:
+				shard := int(seqid%uint32(c.dataShards+c.parityShards)) - c.dataShards
+				if shard >= stat.activeParity() {
+					atomic.AddUint64(&stat.droppedParity, 1)
+					return len(p), nil
+				}
+				atomic.AddUint64(&stat.outParity, 1)
+				data = nil
+			case fecTypeData:
+				data = p[fecHeaderSizePlus2:]
+			}
+		}
+		stat.countSegments(data)
+	}
+	buf := packetBufPool.Get().([]byte)
+	defer packetBufPool.Put(buf)
+	if len(buf) < cryptHeaderSize+len(p) {
+		buf = make([]byte, cryptHeaderSize+len(p))
+	}
+	buf = buf[:cryptHeaderSize+len(p)]
+	rand.Read(buf[:nonceSize])
+	copy(buf[cryptHeaderSize:], p)
+	binary.LittleEndian.PutUint32(buf[nonceSize:], crc32.ChecksumIEEE(buf[cryptHeaderSize:]))
+	c.block.Encrypt(buf, buf)
+	if _, err := c.PacketConn.WriteTo(buf, addr); nil != err {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if nil != err {
+			return n, addr, err
+		}
+		if n < cryptHeaderSize {
+			continue
+		}
+		c.block.Decrypt(p[:n], p[:n])
+		if crc32.ChecksumIEEE(p[cryptHeaderSize:n]) != binary.LittleEndian.Uint32(p[nonceSize:]) {
+			atomic.AddUint64(&kcp.DefaultSnmp.InCsumErrors, 1)
+			continue
+		}
+		return copy(p, p[cryptHeaderSize:n]), addr, nil
+	}
+}
+
+func (c *packetConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+func (c *packetConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return nil
+}
+
+//SetDSCP set the DSCP field of IP header on the underlying udp conn
+func (c *packetConn) SetDSCP(dscp int) error {
+	conn := c.PacketConn
+	if cc, ok := conn.(*connectedUDPConn); ok {
+		conn = cc.PacketConn
+	}
+	if nc, ok := conn.(net.Conn); ok {
+		return ipv4.NewConn(nc).SetTOS(dscp << 2)
+	}
+	return fmt.Errorf("DSCP is not supported by %T", conn)
+}
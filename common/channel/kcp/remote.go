@@ -1,22 +1,35 @@
 package kcp
 
 import (
+	"net"
+
 	kcp "github.com/xtaci/kcp-go"
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
-func StartKCPProxyServer(addr string, config *channel.KCPConfig) error {
-	block, _ := kcp.NewNoneBlockCrypt(nil)
-	lis, err := kcp.ListenWithOptions(addr, block, config.DataShard, config.ParityShard)
+//Listener is the KCP listener with the packet conn measuring its sessions
+type Listener struct {
+	*kcp.Listener
+	pc *packetConn
+}
+
+//NewListener create a KCP listener on the packet conn with the server cipher key
+func NewListener(conn net.PacketConn, config *channel.KCPConfig, key string) (*Listener, error) {
+	block, err := newBlockCrypt(config.Crypt, key)
 	if nil != err {
-		logger.Error("[ERROR]Failed to listen KCP address:%s with reason:%v", addr, err)
-		return err
+		logger.Error("[ERROR]Failed to create KCP crypt with reason:%v", err)
+		return nil, err
 	}
-
-	if err := lis.SetDSCP(config.DSCP); err != nil {
+	//packets are crypted by the packet conn
+	pc := newPacketConn(conn, block, config.DataShard, config.ParityShard)
+	lis, err := kcp.ServeConn(nil, config.DataShard, config.ParityShard, pc)
+	if nil != err {
+		return nil, err
+	}
+	if err := pc.SetDSCP(config.DSCP); err != nil {
 		logger.Debug("SetDSCP:%v", err)
 	}
 	if err := lis.SetReadBuffer(config.SockBuf); err != nil {
@@ -25,31 +38,71 @@ func StartKCPProxyServer(addr string, config *channel.KCPConfig) error {
 	if err := lis.SetWriteBuffer(config.SockBuf); err != nil {
 		logger.Debug("SetWriteBuffer:%v", err)
 	}
-	logger.Info("Listen on KCP address:%s", addr)
-	servKCP(lis, config)
-	return nil
+	return &Listener{Listener: lis, pc: pc}, nil
 }
 
-func servKCP(lp *kcp.Listener, config *channel.KCPConfig) {
+//ServeListener accept KCP sessions from the listener & serve their mux sessions in the group until the listener closed.
+func ServeListener(lp *Listener, config *channel.KCPConfig, group *channel.SessionGroup) error {
 	for {
 		conn, err := lp.AcceptKCP()
 		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		if group.Closed() {
+			conn.Close()
 			continue
 		}
-		//config := &remote.ServerConf.KCP
 		conn.SetStreamMode(true)
 		conn.SetWriteDelay(true)
 		conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-		conn.SetMtu(config.MTU)
+		conn.SetMtu(config.MTU - cryptHeaderSize)
 		conn.SetWindowSize(config.SndWnd, config.RcvWnd)
 		conn.SetACKNoDelay(config.AckNodelay)
-		session, err := pmux.Server(conn, channel.InitialPMuxConfig(&channel.DefaultServerCipher))
+		mc := newMuxConn(conn, lp.pc, config)
+		session, err := pmux.Server(mc, group.Options().PMuxConfig())
 		if nil != err {
+			mc.Close()
 			logger.Error("[ERROR]Failed to create mux session for tcp server with reason:%v", err)
 			continue
 		}
 		muxSession := &mux.ProxyMuxSession{Session: session}
-		go channel.ServProxyMuxSession(muxSession)
+		go group.Serve(muxSession)
+	}
+}
+
+type kcpListener struct {
+	*Listener
+	config channel.KCPConfig
+}
+
+func (l *kcpListener) Serve(group *channel.SessionGroup) error {
+	return ServeListener(l.Listener, &l.config, group)
+}
+
+//KCPRemote is the remote channel of kcp scheme, options of listener are KCPConfig
+type KCPRemote struct {
+}
+
+func (p *KCPRemote) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	return channel.ListenPacket(p, conf)
+}
+
+func (p *KCPRemote) NewPacketListener(conn net.PacketConn, conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	l := &kcpListener{}
+	if err := conf.DecodeOptions(&l.config); nil != err {
+		return nil, err
+	}
+	lis, err := NewListener(conn, &l.config, conf.ServerOptions().Cipher.Key)
+	if nil != err {
+		return nil, err
 	}
-	//ws.WriteMessage(websocket.CloseMessage, []byte{})
+	l.Listener = lis
+	return l, nil
+}
+
+func init() {
+	channel.RegisterRemoteChannelType("kcp", &KCPRemote{})
 }
@@ -0,0 +1,183 @@
+package kcp
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+const (
+	adaptiveHighLossRate = 0.1
+	adaptiveLowLossRate  = 0.02
+	adaptiveIntervalStep = 10
+)
+
+//kcpTuner adjust window, interval & FEC parity of a kcp session by the counters of its packets.
+//The loss rate is the rate of retransmitted segments in every period, which are losses not recovered by FEC.
+//FEC shards must be same with the peer, so the parity is adjusted by sending only a part of parity shards of
+//every FEC group, while the peer takes the rest of them as lost packets.
+type kcpTuner struct {
+	conn        *kcp.UDPSession
+	config      *channel.KCPConfig
+	stat        *sessionStat
+	wnd         int
+	interval    int
+	parity      int
+	lossRate    float64
+	outSegs     uint64
+	retransSegs uint64
+	closeCh     chan struct{}
+	once        sync.Once
+	mutex       sync.Mutex
+}
+
+func (t *kcpTuner) tune() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	outSegs, retransSegs := atomic.LoadUint64(&t.stat.outSegs), atomic.LoadUint64(&t.stat.retransSegs)
+	sent, lost := outSegs-t.outSegs, retransSegs-t.retransSegs
+	t.outSegs, t.retransSegs = outSegs, retransSegs
+	if sent == 0 {
+		return
+	}
+	t.lossRate = float64(lost) / float64(sent)
+	wnd, interval, parity := t.wnd, t.interval, t.parity
+	if t.lossRate > adaptiveHighLossRate {
+		//back off & protect more packets by parity
+		wnd = wnd * 3 / 4
+		interval += adaptiveIntervalStep
+		parity++
+	} else if t.lossRate < adaptiveLowLossRate {
+		//flush more frequently for lower latency & waste less bandwidth on parity
+		wnd = wnd + wnd/8 + 1
+		interval -= adaptiveIntervalStep
+		parity--
+	}
+	if wnd < t.config.MinWnd {
+		wnd = t.config.MinWnd
+	}
+	if wnd > t.config.MaxWnd {
+		wnd = t.config.MaxWnd
+	}
+	if interval < t.config.MinInterval {
+		interval = t.config.MinInterval
+	}
+	if interval > t.config.MaxInterval {
+		interval = t.config.MaxInterval
+	}
+	if parity < t.config.MinParityShard {
+		parity = t.config.MinParityShard
+	}
+	if parity > t.config.ParityShard {
+		parity = t.config.ParityShard
+	}
+	if wnd != t.wnd {
+		t.wnd = wnd
+		t.conn.SetWindowSize(wnd, t.config.RcvWnd)
+	}
+	if interval != t.interval {
+		t.interval = interval
+		t.conn.SetNoDelay(t.config.NoDelay, interval, t.config.Resend, t.config.NoCongestion)
+	}
+	if parity != t.parity {
+		t.parity = parity
+		atomic.StoreInt32(&t.stat.parity, int32(parity))
+	}
+	logger.Debug("KCP session:%d tuned with loss rate:%.3f, window:%d, interval:%d, parity:%d", t.conn.GetConv(), t.lossRate, wnd, interval, parity)
+}
+
+func (t *kcpTuner) run() {
+	period := time.Duration(t.config.AdaptivePeriod) * time.Second
+	if period <= 0 {
+		period = 5 * time.Second
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.tune()
+		case <-t.closeCh:
+			return
+		}
+	}
+}
+
+func (t *kcpTuner) stop() {
+	t.once.Do(func() {
+		close(t.closeCh)
+		tuners.Delete(t)
+	})
+}
+
+var tuners sync.Map
+
+func startKCPTuner(conn *kcp.UDPSession, stat *sessionStat, config *channel.KCPConfig) *kcpTuner {
+	t := &kcpTuner{
+		conn:     conn,
+		config:   config,
+		stat:     stat,
+		wnd:      config.SndWnd,
+		interval: config.Interval,
+		parity:   stat.activeParity(),
+		closeCh:  make(chan struct{}),
+	}
+	tuners.Store(t, true)
+	go t.run()
+	return t
+}
+
+//muxConn stop counting packets of the kcp session & its tuner while closed
+type muxConn struct {
+	*kcp.UDPSession
+	pc    *packetConn
+	tuner *kcpTuner
+}
+
+func (c *muxConn) Close() error {
+	if nil != c.tuner {
+		c.tuner.stop()
+	}
+	c.pc.unregister(c.RemoteAddr())
+	return c.UDPSession.Close()
+}
+
+func newMuxConn(conn *kcp.UDPSession, pc *packetConn, config *channel.KCPConfig) io.ReadWriteCloser {
+	stat := pc.register(conn.RemoteAddr())
+	c := &muxConn{UDPSession: conn, pc: pc}
+	if config.Adaptive {
+		c.tuner = startKCPTuner(conn, stat, config)
+	}
+	return c
+}
+
+func dumpKCPStat(w io.Writer) {
+	snmp := kcp.DefaultSnmp.Copy()
+	if snmp.ActiveOpens == 0 && snmp.PassiveOpens == 0 {
+		return
+	}
+	header := snmp.Header()
+	values := snmp.ToSlice()
+	for i := range header {
+		fmt.Fprintf(w, "KCP%s: %s\n", header[i], values[i])
+	}
+	tuners.Range(func(key, value interface{}) bool {
+		t := key.(*kcpTuner)
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		fmt.Fprintf(w, "KCPSession:%d, LossRate:%.3f, Window:%d, Interval:%d, Parity:%d, OutSegs:%d, RetransSegs:%d, OutParity:%d, DroppedParity:%d\n",
+			t.conn.GetConv(), t.lossRate, t.wnd, t.interval, t.parity, atomic.LoadUint64(&t.stat.outSegs), atomic.LoadUint64(&t.stat.retransSegs),
+			atomic.LoadUint64(&t.stat.outParity), atomic.LoadUint64(&t.stat.droppedParity))
+		return true
+	})
+}
+
+func init() {
+	channel.RegisterStatDumper(dumpKCPStat)
+}
@@ -0,0 +1,239 @@
+package channel
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+)
+
+//ListenerConfig declare a server listener of a channel scheme, options are decoded by the remote channel.
+type ListenerConfig struct {
+	Scheme  string
+	Listen  string
+	Options json.RawMessage
+	//options of the server which the listener belongs to, nil means DefaultServerOptions
+	Server *ServerOptions `json:"-"`
+}
+
+//ServerOptions return options of the server which the listener belongs to
+func (c *ListenerConfig) ServerOptions() *ServerOptions {
+	if nil == c.Server {
+		return DefaultServerOptions()
+	}
+	return c.Server
+}
+
+//DecodeOptions decode options into v, empty options are decoded as '{}' so that v could init its defaults.
+func (c *ListenerConfig) DecodeOptions(v interface{}) error {
+	data := []byte(c.Options)
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+	if err := json.Unmarshal(data, v); nil != err {
+		return fmt.Errorf("Invalid options of %s listener:%s for reason:%v", c.Scheme, c.Listen, err)
+	}
+	return nil
+}
+
+//TLSOptions is the options of listeners with TLS, a self signed cert is generated if no cert/key.
+type TLSOptions struct {
+	Cert string
+	Key  string
+}
+
+//TLSConfig create the server TLS config by cert/key in options
+func (c *ListenerConfig) TLSConfig() (*tls.Config, error) {
+	var opt TLSOptions
+	if err := c.DecodeOptions(&opt); nil != err {
+		return nil, err
+	}
+	return NewServerTLSConfig(opt.Cert, opt.Key)
+}
+
+//SSHOptions is the options of ssh listeners, a host key is generated if no host key file. Clients are authenticated
+//by keys in authorized keys file, or password of cipher key with user of allowed users.
+type SSHOptions struct {
+	HostKey        string
+	AuthorizedKeys string
+}
+
+//HTTPEndpoint decode the endpoint config of http channels from options
+func (c *ListenerConfig) HTTPEndpoint() (*HTTPEndpointConfig, error) {
+	endpoint := &HTTPEndpointConfig{}
+	if err := c.DecodeOptions(endpoint); nil != err {
+		return nil, err
+	}
+	endpoint.Adjust()
+	return endpoint, nil
+}
+
+//NewServerTLSConfig load cert/key files, or generate a self signed cert if cert is empty
+func NewServerTLSConfig(cert, key string) (*tls.Config, error) {
+	if len(cert) > 0 {
+		tlscfg := &tls.Config{}
+		tlscfg.Certificates = make([]tls.Certificate, 1)
+		var err error
+		tlscfg.Certificates[0], err = tls.LoadX509KeyPair(cert, key)
+		return tlscfg, err
+	}
+	return helper.GenerateTLSConfig(), nil
+}
+
+//RemoteChannel is the server side of a channel scheme, it mirrors LocalChannel so that a transport
+//could plug in on both ends.
+type RemoteChannel interface {
+	//Listen listen the address of config
+	Listen(conf *ListenerConfig) (RemoteListener, error)
+}
+
+//StreamRemoteChannel is implemented by channels over tcp which could be served on given listeners
+type StreamRemoteChannel interface {
+	RemoteChannel
+	NewListener(l net.Listener, conf *ListenerConfig) (RemoteListener, error)
+}
+
+//PacketRemoteChannel is implemented by channels over udp which could be served on given packet conns
+type PacketRemoteChannel interface {
+	RemoteChannel
+	NewPacketListener(conn net.PacketConn, conf *ListenerConfig) (RemoteListener, error)
+}
+
+//HTTPRemoteChannel is implemented by channels served by http handlers, a server mounts the handlers of all
+//http channels on one http listener.
+type HTTPRemoteChannel interface {
+	StreamRemoteChannel
+	//HandleHTTP register the handlers on paths of endpoint config serving sessions in the group
+	HandleHTTP(mux *http.ServeMux, endpoint *HTTPEndpointConfig, group *SessionGroup)
+	//NewHTTPListener create a listener serving handler created for the group, eg: with TLS for https schemes
+	NewHTTPListener(l net.Listener, conf *ListenerConfig, handler func(group *SessionGroup) http.Handler) (RemoteListener, error)
+}
+
+//RemoteListener accept & serve mux sessions of a remote channel
+type RemoteListener interface {
+	//Serve serve accepted sessions in the group until the listener closed
+	Serve(group *SessionGroup) error
+	//Close close the listener, listeners over udp close their sessions too
+	Close() error
+	Addr() net.Addr
+}
+
+var RemoteChannelTypeTable = make(map[string]RemoteChannel)
+
+func RegisterRemoteChannelType(scheme string, p RemoteChannel) error {
+	RemoteChannelTypeTable[scheme] = p
+	return nil
+}
+
+//RemoteSchemes return schemes of registered remote channels
+func RemoteSchemes() []string {
+	schemes := []string{}
+	for scheme := range RemoteChannelTypeTable {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+//ListenStream listen the tcp address of config and create the listener by channel
+func ListenStream(p StreamRemoteChannel, conf *ListenerConfig) (RemoteListener, error) {
+	l, err := net.Listen("tcp", conf.Listen)
+	if nil != err {
+		return nil, err
+	}
+	rl, err := p.NewListener(l, conf)
+	if nil != err {
+		l.Close()
+		return nil, err
+	}
+	return rl, nil
+}
+
+//ListenPacket listen the udp address of config and create the listener by channel
+func ListenPacket(p PacketRemoteChannel, conf *ListenerConfig) (RemoteListener, error) {
+	addr, err := net.ResolveUDPAddr("udp", conf.Listen)
+	if nil != err {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if nil != err {
+		return nil, err
+	}
+	rl, err := p.NewPacketListener(conn, conf)
+	if nil != err {
+		conn.Close()
+		return nil, err
+	}
+	return rl, nil
+}
+
+type httpListener struct {
+	net.Listener
+	handler func(group *SessionGroup) http.Handler
+	mutex   sync.Mutex
+	server  *http.Server
+	closed  bool
+}
+
+func (l *httpListener) Serve(group *SessionGroup) error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return http.ErrServerClosed
+	}
+	l.server = &http.Server{Handler: l.handler(group)}
+	l.mutex.Unlock()
+	return l.server.Serve(l.Listener)
+}
+
+func (l *httpListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	if nil != l.server {
+		return l.server.Close()
+	}
+	return l.Listener.Close()
+}
+
+//Shutdown close the listener and wait active requests finished until the context done
+func (l *httpListener) Shutdown(ctx context.Context) error {
+	l.mutex.Lock()
+	l.closed = true
+	server := l.server
+	l.mutex.Unlock()
+	if nil == server {
+		return l.Listener.Close()
+	}
+	return server.Shutdown(ctx)
+}
+
+//NewHTTPListener create a listener serving handler created for the group, TLS is enabled if tlscfg is not nil,
+//and both HTTP/2 & HTTP/1.1 are served on TLS.
+func NewHTTPListener(l net.Listener, tlscfg *tls.Config, handler func(group *SessionGroup) http.Handler) RemoteListener {
+	if nil != tlscfg {
+		//the caller's config may be shared by other listeners
+		tlscfg = tlscfg.Clone()
+		if len(tlscfg.NextProtos) == 0 {
+			//HTTP/2 is served by http.Server once negotiated
+			tlscfg.NextProtos = []string{"h2", "http/1.1"}
+		}
+		l = tls.NewListener(l, tlscfg)
+	}
+	return &httpListener{Listener: l, handler: handler}
+}
+
+//HTTPHandler return the handler factory of a http channel for its standalone listeners
+func HTTPHandler(p HTTPRemoteChannel, endpoint *HTTPEndpointConfig) func(group *SessionGroup) http.Handler {
+	return func(group *SessionGroup) http.Handler {
+		mux := http.NewServeMux()
+		p.HandleHTTP(mux, endpoint, group)
+		return mux
+	}
+}
@@ -0,0 +1,151 @@
+package channel
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+)
+
+type testRemoteChannel struct {
+}
+
+func (p *testRemoteChannel) Listen(conf *ListenerConfig) (RemoteListener, error) {
+	return nil, nil
+}
+
+func TestRegisterRemoteChannelType(t *testing.T) {
+	RegisterRemoteChannelType("test", &testRemoteChannel{})
+	defer delete(RemoteChannelTypeTable, "test")
+	found := false
+	schemes := RemoteSchemes()
+	for i, scheme := range schemes {
+		if i > 0 && schemes[i-1] > scheme {
+			t.Fatalf("Schemes are not sorted:%v", schemes)
+		}
+		found = found || scheme == "test"
+	}
+	if !found {
+		t.Fatalf("Registered scheme is not found in %v", schemes)
+	}
+}
+
+func TestListenerOptions(t *testing.T) {
+	conf := &ListenerConfig{Scheme: "http"}
+	endpoint, err := conf.HTTPEndpoint()
+	if nil != err || endpoint.ContentType != "image/jpeg" || len(endpoint.SessionIDHeader) == 0 {
+		t.Fatalf("Unexpected default endpoint:%v with err:%v", endpoint, err)
+	}
+	conf.Options = []byte(`{"PathPrefix":"api/","ContentType":"application/octet-stream"}`)
+	if endpoint, err = conf.HTTPEndpoint(); nil != err || endpoint.Path("/ws") != "/api/ws" || endpoint.ContentType != "application/octet-stream" {
+		t.Fatalf("Unexpected endpoint:%v with err:%v", endpoint, err)
+	}
+	conf.Options = []byte(`{"Cert":1}`)
+	if _, err = conf.TLSConfig(); nil == err {
+		t.Fatalf("Expected error of invalid options")
+	}
+}
+
+func TestHTTPListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	group := NewSessionGroup()
+	handler := func(g *SessionGroup) http.Handler {
+		if g != group {
+			t.Errorf("Unexpected session group")
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello listener"))
+		})
+	}
+	hl := NewHTTPListener(l, nil, handler)
+	served := make(chan error, 1)
+	go func() {
+		served <- hl.Serve(group)
+	}()
+	res, err := http.Get("http://" + hl.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello listener" {
+		t.Fatalf("Unexpected response:%s", body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = hl.(interface{ Shutdown(context.Context) error }).Shutdown(ctx); nil != err {
+		t.Fatal(err)
+	}
+	if err = <-served; err != http.ErrServerClosed {
+		t.Fatalf("Unexpected serve error:%v after shutdown", err)
+	}
+
+	//the listener closed before serving is never served
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	hl = NewHTTPListener(l, nil, handler)
+	hl.Close()
+	if err = hl.Serve(group); err != http.ErrServerClosed {
+		t.Fatalf("Unexpected serve error:%v of closed listener", err)
+	}
+}
+
+func TestHTTPListenerTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	tlscfg := helper.GenerateTLSConfig()
+	hl := NewHTTPListener(l, tlscfg, func(g *SessionGroup) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		})
+	})
+	defer hl.Close()
+	if len(tlscfg.NextProtos) > 0 {
+		t.Fatalf("The caller's TLS config is modified:%v", tlscfg.NextProtos)
+	}
+	go hl.Serve(NewSessionGroup())
+
+	//the self signed cert is rejected unless verification skipped
+	conf := &ProxyChannelConfig{}
+	hc, _ := NewHTTPClient(conf, "https")
+	if _, err = hc.Get("https://" + hl.Addr().String()); nil == err {
+		t.Fatalf("Expected error of unverified cert")
+	}
+	conf = &ProxyChannelConfig{InsecureSkipVerify: true}
+	hc, _ = NewHTTPClient(conf, "https")
+	res, err := hc.Get("https://" + hl.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Fatalf("Unexpected protocol:%s", body)
+	}
+}
+
+func TestHTTPEndpointSetHeaders(t *testing.T) {
+	endpoint := &HTTPEndpointConfig{Headers: map[string]string{"Host": "cdn.example.com", "X-Test": "gsnova"}}
+	req, _ := http.NewRequest("GET", "http://127.0.0.1/ws", nil)
+	endpoint.SetHeaders(req.Header, req)
+	if req.Host != "cdn.example.com" || req.Header.Get("X-Test") != "gsnova" || len(req.Header.Get("Host")) > 0 {
+		t.Fatalf("Unexpected request host:%s with headers:%v", req.Host, req.Header)
+	}
+	//the 'Host' header is set as a normal header in responses
+	header := make(http.Header)
+	endpoint.SetHeaders(header, nil)
+	if header.Get("Host") != "cdn.example.com" {
+		t.Fatalf("Unexpected response headers:%v", header)
+	}
+}
@@ -1,6 +1,7 @@
 package channel
 
 import (
+	"context"
 	"reflect"
 	"sort"
 
@@ -13,6 +14,43 @@ type LocalChannel interface {
 	Features() FeatureSet
 }
 
+//ContextLocalChannel is implemented by channels which could cancel session creation by context
+type ContextLocalChannel interface {
+	CreateMuxSessionContext(ctx context.Context, server string, conf *ProxyChannelConfig) (mux.MuxSession, error)
+}
+
+type createSessionResult struct {
+	session mux.MuxSession
+	err     error
+}
+
+//CreateMuxSession create mux session by channel with context, the session created after context done
+//by channels without context support would be closed.
+func CreateMuxSession(ctx context.Context, p LocalChannel, server string, conf *ProxyChannelConfig) (mux.MuxSession, error) {
+	if cp, ok := p.(ContextLocalChannel); ok {
+		return cp.CreateMuxSessionContext(ctx, server, conf)
+	}
+	if nil == ctx.Done() {
+		return p.CreateMuxSession(server, conf)
+	}
+	resCh := make(chan createSessionResult, 1)
+	go func() {
+		session, err := p.CreateMuxSession(server, conf)
+		resCh <- createSessionResult{session, err}
+	}()
+	select {
+	case res := <-resCh:
+		return res.session, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-resCh; nil != res.session {
+				res.session.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
 var LocalChannelTypeTable map[string]reflect.Type = make(map[string]reflect.Type)
 
 const DirectChannelName = "direct"
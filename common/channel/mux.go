@@ -1,20 +1,23 @@
 package channel
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
 type muxSessionHolder struct {
@@ -27,7 +30,14 @@ type muxSessionHolder struct {
 	Channel         LocalChannel
 	sessionMutex    sync.Mutex
 	conf            *ProxyChannelConfig
+	streamConf      *ProxyChannelConfig
+	compressStat    *mux.CompressStat
 	heatbeating     bool
+	rtt             time.Duration
+	missedPings     int
+	//ctx is cancelled once the holder stopped, heartbeat exits & sessions would not be created any more
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (s *muxSessionHolder) tryCloseRetiredSessions() {
@@ -44,7 +54,11 @@ func (s *muxSessionHolder) dumpStat(w io.Writer) {
 	s.sessionMutex.Lock()
 	defer s.sessionMutex.Unlock()
 	s.tryCloseRetiredSessions()
-	fmt.Fprintf(w, "Server:%s, CreateTime:%v, RetireTime:%v, RetireSessionNum:%v\n", s.server, s.creatTime.Format("15:04:05"), s.expireTime.Format("15:04:05"), len(s.retiredSessions))
+	fmt.Fprintf(w, "Server:%s, CreateTime:%v, RetireTime:%v, RetireSessionNum:%v, RTT:%v, MissedPings:%d", s.server, s.creatTime.Format("15:04:05"), s.expireTime.Format("15:04:05"), len(s.retiredSessions), s.rtt, s.missedPings)
+	if ps, ok := s.muxSession.(*mux.ProxyMuxSession); ok {
+		fmt.Fprintf(w, ", AutoTunedWindow:%d", ps.AllocatedWindow())
+	}
+	fmt.Fprintf(w, "\n")
 }
 
 func (s *muxSessionHolder) close() {
@@ -56,6 +70,21 @@ func (s *muxSessionHolder) close() {
 		s.muxSession = nil
 	}
 }
+//stop close all sessions of the holder and stop its heartbeat
+func (s *muxSessionHolder) stop() {
+	s.cancel()
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	if nil != s.muxSession {
+		s.muxSession.Close()
+		s.muxSession = nil
+	}
+	for retiredSession := range s.retiredSessions {
+		retiredSession.Close()
+		delete(s.retiredSessions, retiredSession)
+	}
+}
+
 func (s *muxSessionHolder) check() {
 	if nil != s.muxSession && !s.expireTime.IsZero() && s.expireTime.Before(time.Now()) {
 		s.retiredSessions[s.muxSession] = true
@@ -63,7 +92,7 @@ func (s *muxSessionHolder) check() {
 	}
 }
 
-func (s *muxSessionHolder) getNewStream() (mux.MuxStream, error) {
+func (s *muxSessionHolder) getNewStream(ctx context.Context) (mux.MuxStream, *ProxyChannelConfig, error) {
 	s.sessionMutex.Lock()
 	defer s.sessionMutex.Unlock()
 	defer func() {
@@ -71,41 +100,74 @@ func (s *muxSessionHolder) getNewStream() (mux.MuxStream, error) {
 	}()
 	s.check()
 	if nil == s.muxSession {
-		s.init(false)
+		if err := s.initContext(ctx, false); nil != err && nil != ctx.Err() {
+			return nil, nil, err
+		}
 	}
 	if nil == s.muxSession {
-		return nil, pmux.ErrSessionShutdown
+		return nil, nil, pmux.ErrSessionShutdown
 	}
 	s.activeTime = time.Now()
-	return s.muxSession.OpenStream()
+	stream, err := s.muxSession.OpenStream()
+	return stream, s.streamConf, err
 }
 
-func (s *muxSessionHolder) heartbeat(interval int) {
-	if s.heatbeating {
-		return
+type pingResult struct {
+	rtt time.Duration
+	err error
+}
+
+func (s *muxSessionHolder) ping(session mux.MuxSession) (time.Duration, error) {
+	timeout := time.Duration(s.conf.HeartBeatMSTimeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = mux.DefaultPingTimeout
+	}
+	resCh := make(chan pingResult, 1)
+	go func() {
+		rtt, err := session.Ping()
+		resCh <- pingResult{rtt, err}
+	}()
+	select {
+	case res := <-resCh:
+		return res.rtt, res.err
+	case <-time.After(timeout):
+		return 0, mux.ErrPingTimeout
 	}
+}
+
+func (s *muxSessionHolder) heartbeat(interval int) {
 	for {
-		s.heatbeating = true
 		select {
+		case <-s.ctx.Done():
+			return
 		case <-time.After(time.Duration(interval) * time.Second):
 			s.sessionMutex.Lock()
 			s.check()
-			session := s.muxSession
+			session, activeTime := s.muxSession, s.activeTime
 			s.sessionMutex.Unlock()
 			if nil != session {
 				if s.Channel.Features().Pingable {
-					_, err := session.Ping()
+					rtt, err := s.ping(session)
+					s.sessionMutex.Lock()
 					if err != nil {
-						logger.Error("[ERR]: Ping remote:%s failed: %v", s.server, err)
-						s.close()
+						s.missedPings++
+						missedPings := s.missedPings
+						if missedPings >= s.conf.HeartBeatMaxMiss {
+							s.missedPings = 0
+						}
+						s.sessionMutex.Unlock()
+						logger.Error("[ERR]: Ping remote:%s failed(%d/%d): %v", s.server, missedPings, s.conf.HeartBeatMaxMiss, err)
+						if missedPings >= s.conf.HeartBeatMaxMiss {
+							s.close()
+						}
 					} else {
-						// if duration > time.Duration(100)*time.Millisecond {
-						// 	logger.Debug("Cost %v to ping remote:%s", duration, s.server)
-						// }
+						s.missedPings = 0
+						s.rtt = rtt
+						s.sessionMutex.Unlock()
 					}
 				}
 			} else {
-				if !s.conf.lazyConnect && time.Now().Sub(s.activeTime) > time.Duration(s.conf.HibernateAfterSecs)*time.Second {
+				if !s.conf.lazyConnect && time.Now().Sub(activeTime) > time.Duration(s.conf.HibernateAfterSecs)*time.Second {
 					s.init(true)
 				}
 			}
@@ -114,6 +176,10 @@ func (s *muxSessionHolder) heartbeat(interval int) {
 }
 
 func (s *muxSessionHolder) init(lock bool) error {
+	return s.initContext(s.ctx, lock)
+}
+
+func (s *muxSessionHolder) initContext(ctx context.Context, lock bool) error {
 	if lock {
 		s.sessionMutex.Lock()
 		defer s.sessionMutex.Unlock()
@@ -121,34 +187,72 @@ func (s *muxSessionHolder) init(lock bool) error {
 	if nil != s.muxSession {
 		return nil
 	}
-	session, err := s.Channel.CreateMuxSession(s.server, s.conf)
+	if nil != s.ctx.Err() {
+		return pmux.ErrSessionShutdown
+	}
+	session, err := CreateMuxSession(ctx, s.Channel, s.server, s.conf)
 	if nil == err && nil != session {
 		authStream, err := session.OpenStream()
 		if nil != err {
+			session.Close()
 			return err
 		}
+		if deadline, ok := ctx.Deadline(); ok {
+			authStream.SetReadDeadline(deadline)
+			authStream.SetWriteDeadline(deadline)
+		}
 		counter := uint64(helper.RandBetween(0, math.MaxInt32))
 		cipherMethod := s.conf.Cipher.Method
-		if strings.HasPrefix(s.server, "https://") || strings.HasPrefix(s.server, "wss://") || strings.HasPrefix(s.server, "tls://") || strings.HasPrefix(s.server, "quic://") || strings.HasPrefix(s.server, "http2://") {
+		if strings.HasPrefix(s.server, "https://") || strings.HasPrefix(s.server, "wss://") || strings.HasPrefix(s.server, "tls://") || strings.HasPrefix(s.server, "quic://") || strings.HasPrefix(s.server, "http2://") || strings.HasPrefix(s.server, "grpcs://") {
 			cipherMethod = "none"
 		}
+		compressors := s.conf.CompressorCandidates()
+		if len(compressors) == 0 {
+			compressors = []string{mux.NoneCompressor}
+		}
 		authReq := &mux.AuthRequest{
-			User:           s.conf.Cipher.User,
-			CipherCounter:  counter,
-			CipherMethod:   cipherMethod,
-			CompressMethod: s.conf.Compressor,
+			User:               s.conf.Cipher.User,
+			CipherCounter:      counter,
+			CipherMethod:       cipherMethod,
+			CompressMethod:     mux.LegacyCompressor(compressors),
+			CompressCandidates: compressors,
+			HalfClose:          true,
 		}
+		authDone, watchDone := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(watchDone)
+			select {
+			case <-ctx.Done():
+				session.Close()
+			case <-authDone:
+			}
+		}()
 		err = authStream.Auth(authReq)
+		close(authDone)
+		<-watchDone
 		authStream.Close()
+		if nil == err {
+			err = ctx.Err()
+		}
 		if nil != err {
+			session.Close()
 			return err
 		}
+		//streams in this session use the compressor negotiated with server
+		streamConf := *s.conf
+		streamConf.Compressor = authReq.CompressMethod
+		streamConf.compressStat = s.compressStat
+		streamConf.server = s.server
+		s.streamConf = &streamConf
 		if psession, ok := session.(*mux.ProxyMuxSession); ok {
 			err = psession.Session.ResetCryptoContext(cipherMethod, counter)
 			if nil != err {
 				logger.Error("[ERROR]Failed to reset cipher context with reason:%v, while cipher method:%s", err, cipherMethod)
 				return err
 			}
+			if authReq.HalfClose {
+				psession.Session.EnableHalfClose()
+			}
 		}
 		s.creatTime = time.Now()
 		s.muxSession = session
@@ -161,7 +265,8 @@ func (s *muxSessionHolder) init(lock bool) error {
 			logger.Debug("Mux session woulde expired after %d seconds.", expireAfter)
 			s.expireTime = time.Now().Add(time.Duration(expireAfter) * time.Second)
 		}
-		if features.Pingable && s.conf.HeartBeatPeriod > 0 {
+		if features.Pingable && s.conf.HeartBeatPeriod > 0 && !s.heatbeating {
+			s.heatbeating = true
 			go s.heartbeat(s.conf.HeartBeatPeriod)
 		}
 		return nil
@@ -172,48 +277,98 @@ func (s *muxSessionHolder) init(lock bool) error {
 	return err
 }
 
-var localChannelTable = make(map[string]*LocalProxyChannel)
-var localChannelMutex sync.Mutex
+//LocalChannelTable holds initialized channels by name, every client owns its table.
+type LocalChannelTable struct {
+	channels       map[string]*LocalProxyChannel
+	mutex          sync.Mutex
+	expireLaunched int32
+	expireStop     chan struct{}
+	//mux config & resolver shared by channels of the table, nil means the process defaults
+	muxConf  *MuxConfig
+	resolver dns.IPResolver
+}
+
+//NewLocalChannelTable create an empty channel table
+func NewLocalChannelTable() *LocalChannelTable {
+	return &LocalChannelTable{channels: make(map[string]*LocalProxyChannel)}
+}
+
+//Configure set the mux config & resolver used by channels initialized in the table later,
+//nil resolver means domains of servers are resolved by dns.DnsGetDoaminIPs.
+func (t *LocalChannelTable) Configure(muxConf MuxConfig, resolver dns.IPResolver) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.muxConf = &muxConf
+	t.resolver = resolver
+}
+
+//DefaultLocalChannelTable is the table used by package level functions
+var DefaultLocalChannelTable = NewLocalChannelTable()
 
 type LocalProxyChannel struct {
 	Conf           ProxyChannelConfig
 	sessions       map[*muxSessionHolder]bool
 	lastActiveTime time.Time
 	autoExpire     bool
+	compressStat   mux.CompressStat
 }
 
-func (ch *LocalProxyChannel) createMuxSessionByProxy(p LocalChannel, server string, init bool) (*muxSessionHolder, error) {
+func (ch *LocalProxyChannel) createMuxSessionByProxy(ctx context.Context, p LocalChannel, server string, init bool) (*muxSessionHolder, error) {
 	holder := &muxSessionHolder{
 		conf:            &ch.Conf,
 		Channel:         p,
 		server:          server,
 		retiredSessions: make(map[mux.MuxSession]bool),
+		compressStat:    &ch.compressStat,
 	}
+	holder.ctx, holder.cancel = context.WithCancel(context.Background())
 	var err error
 	if init {
-		err = holder.init(true)
+		err = holder.initContext(ctx, true)
 	}
 
 	if nil == err {
 		ch.sessions[holder] = true
 		return holder, nil
 	}
+	holder.cancel()
 	return nil, err
 }
 
-func (ch *LocalProxyChannel) getMuxStream() (stream mux.MuxStream, err error) {
-	for holder := range ch.sessions {
-		stream, err = holder.getNewStream()
-		if nil != err {
-			if err == pmux.ErrSessionShutdown {
-				holder.close()
+//openStream open stream in sessions of the channel, primary is the stream conf of the first subflow of a striped stream,
+//other subflows must be opened in sessions of the same server with the same negotiated compressor.
+//Striping across servers is not supported: subflows are joined in the memory of the server which received them,
+//while servers do not share striped streams with each other, so multipath only stripes over sessions of one server.
+func (ch *LocalProxyChannel) openStream(ctx context.Context, used map[*muxSessionHolder]bool, primary *ProxyChannelConfig) (stream mux.MuxStream, conf *ProxyChannelConfig, err error) {
+	//prefer sessions not used by other subflows of same striped stream
+	for _, preferUnused := range []bool{true, false} {
+		for holder := range ch.sessions {
+			if preferUnused && used[holder] {
+				continue
 			}
-			logger.Debug("Try to get next session since current session failed to open new stream with err:%v", err)
-		} else {
-			if ch.autoExpire {
-				ch.lastActiveTime = time.Now()
+			if nil != primary && holder.server != primary.server {
+				continue
 			}
-			return
+			stream, conf, err = holder.getNewStream(ctx)
+			if nil != err && nil != ctx.Err() {
+				return nil, nil, err
+			}
+			if nil != err {
+				if err == pmux.ErrSessionShutdown {
+					holder.close()
+				}
+				logger.Debug("Try to get next session since current session failed to open new stream with err:%v", err)
+			} else if nil != primary && conf.Compressor != primary.Compressor {
+				logger.Debug("Skip session with compressor:%s for subflow of striped stream with compressor:%s", conf.Compressor, primary.Compressor)
+				stream.Close()
+				stream = nil
+			} else {
+				used[holder] = true
+				return
+			}
+		}
+		if len(used) == 0 {
+			break
 		}
 	}
 	if nil == stream {
@@ -222,8 +377,45 @@ func (ch *LocalProxyChannel) getMuxStream() (stream mux.MuxStream, err error) {
 	return
 }
 
+func (ch *LocalProxyChannel) getMuxStream(ctx context.Context) (stream mux.MuxStream, conf *ProxyChannelConfig, err error) {
+	used := make(map[*muxSessionHolder]bool)
+	stream, conf, err = ch.openStream(ctx, used, nil)
+	if nil != err {
+		return
+	}
+	if ch.autoExpire {
+		ch.lastActiveTime = time.Now()
+	}
+	if ch.Conf.Multipath > 1 {
+		opener := func(index int) (mux.MuxStream, error) {
+			subflow, _, err := ch.openStream(ctx, used, conf)
+			return subflow, err
+		}
+		stream = mux.NewStripedStream(stream, ch.Conf.Multipath, opener)
+	}
+	return
+}
+
+//Init create sessions of the channel and register it to the default table
 func (ch *LocalProxyChannel) Init(lock bool) bool {
+	return DefaultLocalChannelTable.InitChannel(ch, lock)
+}
+
+//InitChannel create sessions of the channel and register it to the table if success
+func (t *LocalChannelTable) InitChannel(ch *LocalProxyChannel, lock bool) bool {
+	return t.InitChannelContext(context.Background(), ch, lock)
+}
+
+//InitChannelContext is like InitChannel, while creating the first session of servers is cancelled once the context done.
+func (t *LocalChannelTable) InitChannelContext(ctx context.Context, ch *LocalProxyChannel, lock bool) bool {
 	conf := &ch.Conf
+	if lock {
+		t.mutex.Lock()
+	}
+	conf.muxConf, conf.resolver = t.muxConf, t.resolver
+	if lock {
+		t.mutex.Unlock()
+	}
 	success := false
 	for _, server := range conf.ServerList {
 		u, err := url.Parse(server)
@@ -239,7 +431,7 @@ func (ch *LocalProxyChannel) Init(lock bool) bool {
 			v := reflect.New(t)
 			p := v.Interface().(LocalChannel)
 			for i := 0; i < conf.ConnsPerServer; i++ {
-				_, err := ch.createMuxSessionByProxy(p, server, i == 0)
+				_, err := ch.createMuxSessionByProxy(ctx, p, server, i == 0)
 				if nil != err {
 					logger.Error("[ERROR]Failed to create mux session for %s:%d with reason:%v", server, i, err)
 					break
@@ -253,10 +445,10 @@ func (ch *LocalProxyChannel) Init(lock bool) bool {
 	if success {
 		logger.Notice("Proxy channel:%s init success", conf.Name)
 		if lock {
-			localChannelMutex.Lock()
-			defer localChannelMutex.Unlock()
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
 		}
-		localChannelTable[conf.Name] = ch
+		t.channels[conf.Name] = ch
 
 	} else {
 		logger.Error("[ERROR]Proxy channel:%s init failed", conf.Name)
@@ -264,9 +456,30 @@ func (ch *LocalProxyChannel) Init(lock bool) bool {
 	return success
 }
 
+var statDumpers []func(w io.Writer)
+
+//RegisterStatDumper register extra stat printer for channel implementations
+func RegisterStatDumper(dumper func(w io.Writer)) {
+	statDumpers = append(statDumpers, dumper)
+}
+
+func dumpExtraStat(w io.Writer) {
+	for _, dumper := range statDumpers {
+		dumper(w)
+	}
+}
+
 func DumpLoaclChannelStat(w io.Writer) {
-	for _, pch := range localChannelTable {
+	DefaultLocalChannelTable.DumpStat(w)
+}
+
+//DumpStat dump stat of all channels in the table
+func (t *LocalChannelTable) DumpStat(w io.Writer) {
+	defer dumpExtraStat(w)
+	for _, pch := range t.channels {
 		if pch.Conf.Name != DirectChannelName {
+			fmt.Fprintf(w, "Channel:%s, Compressor:%s, CompressRawBytes:%d, CompressWireBytes:%d, CompressSavedBytes:%d, CompressBypassedStreams:%d\n",
+				pch.Conf.Name, pch.Conf.Compressor, pch.compressStat.RawBytes(), pch.compressStat.WireBytes(), pch.compressStat.SavedBytes(), pch.compressStat.BypassedStreams())
 			for holder := range pch.sessions {
 				if nil != holder {
 					holder.dumpStat(w)
@@ -284,20 +497,49 @@ func NewProxyChannel(conf *ProxyChannelConfig) *LocalProxyChannel {
 	return channel
 }
 
+func (ch *LocalProxyChannel) stop() {
+	for holder := range ch.sessions {
+		holder.stop()
+	}
+}
+
 func GetMuxStreamByChannel(name string) (mux.MuxStream, *ProxyChannelConfig, error) {
-	pch, exist := localChannelTable[name]
+	return GetMuxStreamByChannelContext(context.Background(), name)
+}
+
+//GetMuxStreamByChannelContext open a stream of the channel, session init is cancelled while context done.
+func GetMuxStreamByChannelContext(ctx context.Context, name string) (mux.MuxStream, *ProxyChannelConfig, error) {
+	return DefaultLocalChannelTable.GetMuxStreamContext(ctx, name)
+}
+
+//GetMuxStreamContext open a stream of the channel in the table
+func (t *LocalChannelTable) GetMuxStreamContext(ctx context.Context, name string) (mux.MuxStream, *ProxyChannelConfig, error) {
+	pch, exist := t.channels[name]
 	if !exist {
 		return nil, nil, fmt.Errorf("No proxy found to get mux session")
 	}
-	stream, err := pch.getMuxStream()
-	return stream, &pch.Conf, err
+	stream, conf, err := pch.getMuxStream(ctx)
+	if nil == conf {
+		conf = &pch.Conf
+	}
+	return stream, conf, err
 }
 
 func GetMuxStreamByURL(u *url.URL, defaultUser string, defaultCipher *CipherConfig) (mux.MuxStream, *ProxyChannelConfig, error) {
+	return GetMuxStreamByURLContext(context.Background(), u, defaultUser, defaultCipher)
+}
+
+//GetMuxStreamByURLContext open a stream of the channel created by url, session init is cancelled while context done.
+func GetMuxStreamByURLContext(ctx context.Context, u *url.URL, defaultUser string, defaultCipher *CipherConfig) (mux.MuxStream, *ProxyChannelConfig, error) {
+	return DefaultLocalChannelTable.GetMuxStreamByURLContext(ctx, u, defaultUser, defaultCipher)
+}
+
+//GetMuxStreamByURLContext open a stream of the channel created by url in the table
+func (t *LocalChannelTable) GetMuxStreamByURLContext(ctx context.Context, u *url.URL, defaultUser string, defaultCipher *CipherConfig) (mux.MuxStream, *ProxyChannelConfig, error) {
 	key := u.String()
-	localChannelMutex.Lock()
-	defer localChannelMutex.Unlock()
-	stream, conf, err := GetMuxStreamByChannel(key)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stream, conf, err := t.GetMuxStreamContext(ctx, key)
 	if nil == err {
 		return stream, conf, err
 	}
@@ -324,40 +566,54 @@ func GetMuxStreamByURL(u *url.URL, defaultUser string, defaultCipher *CipherConf
 		RCPRandomAdjustment: 10,
 		lazyConnect:         true,
 	}
+	//servers of url channels are usually deployed with self signed certs, skipping verification is explicit in url
+	conf.InsecureSkipVerify, _ = strconv.ParseBool(u.Query().Get("insecure"))
 	conf.Adjust()
 	ch := NewProxyChannel(conf)
-	if ch.Init(false) {
+	if t.InitChannelContext(ctx, ch, false) {
 		ch.autoExpire = true
-		stream, err := ch.getMuxStream()
-		expireLocalChannels()
-		return stream, conf, err
+		stream, streamConf, err := ch.getMuxStream(ctx)
+		t.expireChannels()
+		if nil == streamConf {
+			streamConf = conf
+		}
+		return stream, streamConf, err
 	}
 	return nil, nil, fmt.Errorf("Failed to init proxy channel by %s", key)
 }
 
 func StopLocalChannels() {
-	for _, pch := range localChannelTable {
-		for holder := range pch.sessions {
-			if nil != holder && nil != holder.muxSession {
-				holder.muxSession.Close()
-			}
-		}
-	}
-	localChannelTable = make(map[string]*LocalProxyChannel)
+	DefaultLocalChannelTable.Stop()
 }
 
-var expireTaskLauched int32
+//Stop close sessions of all channels in the table and stop their heartbeats, then clear the table
+func (t *LocalChannelTable) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, pch := range t.channels {
+		pch.stop()
+	}
+	t.channels = make(map[string]*LocalProxyChannel)
+	if nil != t.expireStop {
+		close(t.expireStop)
+		t.expireStop = nil
+		atomic.StoreInt32(&t.expireLaunched, 0)
+	}
+}
 
-func expireLocalChannels() {
-	if !atomic.CompareAndSwapInt32(&expireTaskLauched, 0, 1) {
+//expireChannels launch the routine removing expired channels until the table stopped, it's called with the table locked.
+func (t *LocalChannelTable) expireChannels() {
+	if !atomic.CompareAndSwapInt32(&t.expireLaunched, 0, 1) {
 		return
 	}
+	stopCh := make(chan struct{})
+	t.expireStop = stopCh
 	ticker := time.NewTicker(10 * time.Second)
 	removeExpiredChannels := func() {
 
-		localChannelMutex.Lock()
-		defer localChannelMutex.Unlock()
-		for key, ch := range localChannelTable {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		for key, ch := range t.channels {
 			if !ch.autoExpire {
 				continue
 			}
@@ -379,17 +635,21 @@ func expireLocalChannels() {
 			}
 			if expire {
 				logger.Info("Remove expired channel:%s", key)
-				delete(localChannelTable, key)
+				ch.stop()
+				delete(t.channels, key)
 			} else {
 
 			}
 		}
 	}
 	go func() {
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				removeExpiredChannels()
+			case <-stopCh:
+				return
 			}
 		}
 	}()
@@ -0,0 +1,47 @@
+package channel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/pmux"
+)
+
+func TestLocalChannelTableStop(t *testing.T) {
+	session := &testSession{closed: make(chan struct{})}
+	p := &testChannel{release: make(chan struct{}), session: session}
+	close(p.release)
+	ch := NewProxyChannel(&ProxyChannelConfig{Name: "test", HeartBeatMaxMiss: 1})
+	holder, err := ch.createMuxSessionByProxy(context.Background(), p, "test://127.0.0.1", false)
+	if nil != err {
+		t.Fatal(err)
+	}
+	holder.muxSession = session
+	table := NewLocalChannelTable()
+	table.channels[ch.Conf.Name] = ch
+
+	done := make(chan struct{})
+	go func() {
+		holder.heartbeat(1)
+		close(done)
+	}()
+	table.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Heartbeat is not stopped after table stopped")
+	}
+	select {
+	case <-session.closed:
+	default:
+		t.Fatalf("Session is not closed after table stopped")
+	}
+	//stopped holders never create sessions again
+	if err = holder.init(true); err != pmux.ErrSessionShutdown || nil != holder.muxSession {
+		t.Fatalf("Unexpected session:%v with err:%v after stopped", holder.muxSession, err)
+	}
+	if len(table.channels) != 0 {
+		t.Fatalf("Channels are not cleared after stopped")
+	}
+}
@@ -1,18 +1,32 @@
 package quic
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"net"
 	"net/url"
+	"time"
 
-	quic "github.com/lucas-clemente/quic-go"
+	quic "github.com/quic-go/quic-go"
 	"github.com/yinqiwen/gsnova/common/channel"
-	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/gsnova/common/netx"
 )
 
+//ALPN of QUIC sessions, which is required by QUIC.
+//QUIC channels run IETF QUIC(RFC 9000) since quic-go v0.63.0, peers still running the gQUIC transport of
+//quic-go v0.7.0 could not connect to each other, both clients & servers of quic channels should be upgraded together.
+const quicALPN = "gsnova"
+
+//newQUICConfig create the config of QUIC sessions, datagrams are enabled to carry UDP packets.
+func newQUICConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:    15 * time.Second,
+		MaxIncomingStreams: 4096,
+		EnableDatagrams:    true,
+	}
+}
+
 type QUICProxy struct {
 	//proxy.BaseProxy
 }
@@ -20,11 +34,15 @@ type QUICProxy struct {
 func (p *QUICProxy) Features() channel.FeatureSet {
 	return channel.FeatureSet{
 		AutoExpire: true,
-		Pingable:   false,
+		Pingable:   true,
 	}
 }
 
 func (tc *QUICProxy) CreateMuxSession(server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
+	return tc.CreateMuxSessionContext(context.Background(), server, conf)
+}
+
+func (tc *QUICProxy) CreateMuxSessionContext(ctx context.Context, server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
 	rurl, err := url.Parse(server)
 	if nil != err {
 		return nil, err
@@ -32,32 +50,48 @@ func (tc *QUICProxy) CreateMuxSession(server string, conf *channel.ProxyChannelC
 	hostport := rurl.Host
 	tcpHost, tcpPort, _ := net.SplitHostPort(hostport)
 	if net.ParseIP(tcpHost) == nil {
-		iphost, err := dns.DnsGetDoaminIP(tcpHost)
+		iphost, err := conf.LookupHost(tcpHost)
 		if nil != err {
 			return nil, err
 		}
 		hostport = net.JoinHostPort(iphost, tcpPort)
 	}
-	var quicSession quic.Session
-
 	udpAddr, err := net.ResolveUDPAddr("udp", hostport)
 	if err != nil {
 		return nil, err
 	}
-	udpConn, err := netx.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	udpConn, err := channel.ListenPacketByConf(conf)
 	if err != nil {
 		return nil, err
 	}
-	quicConfig := &quic.Config{
-		KeepAlive: true,
+	tlscfg := channel.NewTLSConfig(conf)
+	if len(tlscfg.ServerName) == 0 {
+		tlscfg.ServerName = tcpHost
 	}
-	quicSession, err = quic.Dial(udpConn, udpAddr, hostport, &tls.Config{InsecureSkipVerify: true}, quicConfig)
-
+	tlscfg.NextProtos = []string{quicALPN}
+	dailTimeout := conf.LocalDialMSTimeout
+	if 0 == dailTimeout {
+		dailTimeout = 5000
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(dailTimeout)*time.Millisecond)
+	defer cancel()
+	conn, err := quic.Dial(ctx, udpConn, udpAddr, tlscfg, newQUICConfig())
 	if err != nil {
+		udpConn.Close()
+		var vnErr *quic.VersionNegotiationError
+		if errors.As(err, &vnErr) {
+			logger.Error("QUIC server:%s offered versions:%v, it may still run the gQUIC transport which is not compatible with this client, upgrade both sides.", hostport, vnErr.Theirs)
+		}
 		return nil, err
 	}
-	logger.Debug("Connect %s success.", server)
-	return &mux.QUICMuxSession{Session: quicSession}, nil
+	//the packet conn is not closed by quic-go
+	go func() {
+		<-conn.Context().Done()
+		udpConn.Close()
+	}()
+	session := mux.NewQUICMuxSession(conn)
+	logger.Debug("Connect %s success, datagrams supported:%v.", server, session.SupportsDatagrams())
+	return session, nil
 }
 
 func init() {
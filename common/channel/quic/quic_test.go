@@ -0,0 +1,70 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func startUDPEchoServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if nil != err {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+//TestUDPRoundTrip relay udp packets through the quic channel, packets are carried by datagrams.
+func TestUDPRoundTrip(t *testing.T) {
+	channel.DefaultServerCipher = channel.CipherConfig{User: "gsnova", Key: "quic-test-key", Method: "chacha20poly1305"}
+	l, err := (&QUICRemote{}).Listen(&channel.ListenerConfig{Scheme: "quic", Listen: "127.0.0.1:0"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go l.Serve(channel.NewSessionGroup())
+	defer channel.StopLocalChannels()
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	u, _ := url.Parse("quic://gsnova:quic-test-key@" + l.Addr().String() + "?method=chacha20poly1305&insecure=true")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, conf, err := channel.GetMuxStreamByURLContext(ctx, u, "gsnova", &channel.DefaultServerCipher)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	opt := mux.StreamOptions{DialTimeout: conf.RemoteDialMSTimeout, ReadTimeout: 5000}
+	if err = mux.ConnectStream(ctx, stream, "udp", echo.LocalAddr().String(), opt); nil != err {
+		t.Fatal(err)
+	}
+	//packets are not compressed by datagram flows whatever the compressor is
+	reader, writer := mux.GetCompressStreamReaderWriter(stream, mux.SnappyCompressor, nil)
+	buf := make([]byte, 8192)
+	for i := 0; i < 10; i++ {
+		packet := bytes.Repeat([]byte{byte(i)}, 100+i)
+		writer.Write(packet)
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := reader.Read(buf)
+		if nil != err || !bytes.Equal(buf[:n], packet) {
+			t.Fatalf("Unexpected echo packet:%d/%d bytes with err:%v", n, len(packet), err)
+		}
+	}
+}
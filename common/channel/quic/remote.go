@@ -1,33 +1,54 @@
 package quic
 
 import (
-	"crypto/tls"
+	"context"
+	"net"
 
-	quic "github.com/lucas-clemente/quic-go"
+	quic "github.com/quic-go/quic-go"
 	"github.com/yinqiwen/gsnova/common/channel"
-	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
 )
 
-func servQUIC(lp quic.Listener) {
+//ServeListener accept QUIC sessions from the listener & serve them in the group until the listener closed.
+func ServeListener(lp *quic.Listener, group *channel.SessionGroup) error {
 	for {
-		sess, err := lp.Accept()
+		conn, err := lp.Accept(context.Background())
 		if nil != err {
-			continue
+			return err
 		}
-		muxSession := &mux.QUICMuxSession{Session: sess}
-		go channel.ServProxyMuxSession(muxSession)
+		go group.Serve(mux.NewQUICMuxSession(conn))
 	}
-	//ws.WriteMessage(websocket.CloseMessage, []byte{})
 }
 
-func StartQuicProxyServer(addr string, config *tls.Config) error {
-	lp, err := quic.ListenAddr(addr, config, nil)
+type quicListener struct {
+	*quic.Listener
+}
+
+func (l *quicListener) Serve(group *channel.SessionGroup) error {
+	return ServeListener(l.Listener, group)
+}
+
+//QUICRemote is the remote channel of quic scheme, options of listener are TLSOptions
+type QUICRemote struct {
+}
+
+func (p *QUICRemote) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	return channel.ListenPacket(p, conf)
+}
+
+func (p *QUICRemote) NewPacketListener(conn net.PacketConn, conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	tlscfg, err := conf.TLSConfig()
+	if nil != err {
+		return nil, err
+	}
+	tlscfg.NextProtos = []string{quicALPN}
+	lis, err := quic.Listen(conn, tlscfg, newQUICConfig())
 	if nil != err {
-		logger.Error("[ERROR]Failed to listen QUIC address:%s with reason:%v", addr, err)
-		return err
+		return nil, err
 	}
-	logger.Info("Listen on QUIC address:%s", addr)
-	servQUIC(lp)
-	return nil
+	return &quicListener{lis}, nil
+}
+
+func init() {
+	channel.RegisterRemoteChannelType("quic", &QUICRemote{})
 }
@@ -1,38 +1,86 @@
 package channel
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 
+	"github.com/yinqiwen/gsnova/common/dns"
+	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
+	"github.com/yinqiwen/gsnova/common/netx"
 )
 
 type sessionContext struct {
-	activeIOTime time.Time
+	//unix nano of latest io of streams, which is updated by relays of streams concurrently
+	activeIOTime int64
 }
 
-func handleProxyStream(stream mux.MuxStream, auth *mux.AuthRequest, ctx *sessionContext) {
-	creq, err := mux.ReadConnectRequest(stream)
-	if nil != err {
+func (ctx *sessionContext) touch(latest time.Time) {
+	ns := latest.UnixNano()
+	for {
+		prev := atomic.LoadInt64(&ctx.activeIOTime)
+		if ns <= prev || atomic.CompareAndSwapInt64(&ctx.activeIOTime, prev, ns) {
+			return
+		}
+	}
+}
+
+func (ctx *sessionContext) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&ctx.activeIOTime))
+}
+
+func handleProxyStream(stream mux.MuxStream, auth *mux.AuthRequest, ctx *sessionContext, opts *ServerOptions) {
+	var creq *mux.ConnectRequest
+	var err error
+	if cs, ok := stream.(mux.ConnectedStream); ok {
+		creq = cs.ConnectRequest()
+	} else if creq, err = mux.ReadConnectRequest(stream); nil != err {
 		stream.Close()
 		logger.Error("[ERROR]:Failed to read connect request:%v", err)
 		return
 	}
-	logger.Debug("[%d]Start handle stream:%v with comprresor:%s", stream.StreamID(), creq, auth.CompressMethod)
+	if creq.Network == mux.PingNetwork {
+		mux.WriteMessage(stream, creq)
+		stream.Close()
+		return
+	}
+	if creq.StripeCount > 1 {
+		//wait all subflows joined, the last one handle the striped stream
+		striped := mux.JoinStripedStream(auth.User, creq.StripeID, creq.StripeIndex, creq.StripeCount, auth.CompressMethod, stream)
+		if nil == striped {
+			return
+		}
+		stream = striped
+	}
+	if mux.AcceptDatagrams(stream, creq.Network) {
+		logger.Debug("[%d]Packets to %s are carried by datagrams", stream.StreamID(), creq.Addr)
+	}
+	creq.Priority = mux.NormalizePriority(creq.Priority)
+	mux.SetStreamPriority(stream, creq.Priority)
+	priorityStreams := &remotePriorityStreams[creq.Priority]
+	atomic.AddInt64(priorityStreams, 1)
+	defer atomic.AddInt64(priorityStreams, -1)
+	logger.Debug("[%d]Start handle %s stream:%v with comprresor:%s", stream.StreamID(), mux.PriorityName(creq.Priority), creq, auth.CompressMethod)
 
 	var c io.ReadWriteCloser
 	dialTimeout := creq.DialTimeout
 	if dialTimeout == 0 {
 		dialTimeout = 10000
 	}
+	dialCtx, cancel := context.WithTimeout(context.Background(), time.Duration(dialTimeout)*time.Millisecond)
 	if len(creq.Hops) == 0 {
 		var conn net.Conn
-		conn, err = net.DialTimeout(creq.Network, creq.Addr, time.Duration(dialTimeout)*time.Millisecond)
+		conn, err = netx.DialHappyEyeballs(dialCtx, creq.Network, creq.Addr, opts.IPv6, opts.lookupIP)
 		if nil != err {
 			logger.Error("[ERROR]:Failed to connect %s:%v for reason:%v", creq.Network, creq.Addr, err)
 		} else {
@@ -41,6 +89,7 @@ func handleProxyStream(stream mux.MuxStream, auth *mux.AuthRequest, ctx *session
 				readTimeout := time.Duration(creq.ReadTimeout) * time.Millisecond
 				conn.SetReadDeadline(time.Now().Add(readTimeout))
 			}
+			opts.setTargetKeepAlive(conn)
 			c = conn
 		}
 	} else {
@@ -50,14 +99,15 @@ func handleProxyStream(stream mux.MuxStream, auth *mux.AuthRequest, ctx *session
 		nextHops := creq.Hops[1:]
 		nextURL, err = url.Parse(next)
 		if nil == err {
-			nextStream, _, err = GetMuxStreamByURL(nextURL, auth.User, &DefaultServerCipher)
+			nextStream, _, err = opts.hops().GetMuxStreamByURLContext(dialCtx, nextURL, auth.User, &opts.Cipher)
 			if nil == err {
 				opt := mux.StreamOptions{
 					DialTimeout: creq.DialTimeout,
 					ReadTimeout: creq.ReadTimeout,
 					Hops:        nextHops,
+					IdleTimeout: creq.IdleTimeout,
 				}
-				err = nextStream.Connect(creq.Network, creq.Addr, opt)
+				err = mux.ConnectStream(dialCtx, nextStream, creq.Network, creq.Addr, opt)
 				if nil == err {
 					c = nextStream
 				} else {
@@ -68,54 +118,24 @@ func handleProxyStream(stream mux.MuxStream, auth *mux.AuthRequest, ctx *session
 			logger.Error("Failed to parse proxy url:%s with reason:%v", next, err)
 		}
 	}
+	cancel()
 
 	if nil != err {
 		stream.Close()
 		return
 	}
-	streamReader, streamWriter := mux.GetCompressStreamReaderWriter(stream, auth.CompressMethod)
-	defer c.Close()
-	closeSig := make(chan bool, 2)
-	go func() {
-		buf := make([]byte, 128*1024)
-		io.CopyBuffer(c, streamReader, buf)
-		closeSig <- true
-	}()
-	go func() {
-		buf := make([]byte, 128*1024)
-		io.CopyBuffer(streamWriter, c, buf)
-		closeSig <- true
-	}()
-	timeoutTicker := time.NewTicker(2 * time.Second)
-	stopTicker := make(chan bool, 1)
-	go func() {
-		for {
-			maxIdleTime := time.Duration(defaultMuxConfig.StreamIdleTimeout) * time.Second
-			if maxIdleTime == 0 {
-				maxIdleTime = 10 * time.Second
-			}
-			select {
-			case <-timeoutTicker.C:
-				if stream.LatestIOTime().After(ctx.activeIOTime) {
-					ctx.activeIOTime = stream.LatestIOTime()
-				}
-				if time.Now().Sub(stream.LatestIOTime()) > maxIdleTime {
-					c.Close()
-					stream.Close()
-					return
-				}
-			case <-stopTicker:
-				return
-			}
-		}
-	}()
-
-	<-closeSig
-	close(stopTicker)
-
-	if close, ok := streamWriter.(io.Closer); ok {
-		close.Close()
+	streamReader, streamWriter := mux.GetCompressStreamReaderWriter(stream, auth.CompressMethod, &remoteCompressStat)
+	relay := &mux.Relay{
+		Conn:         c,
+		Stream:       stream,
+		StreamReader: streamReader,
+		StreamWriter: streamWriter,
+		IdleTimeout:  time.Duration(opts.streamIdleTimeout(creq)) * time.Second,
+		OnActive:     ctx.touch,
 	}
+	reason := relay.Run()
+	logger.Debug("[%d]Stream to %s closed by %s, forward %d bytes, backward %d bytes.", stream.StreamID(), creq.Addr, reason, relay.ForwardBytes, relay.BackwardBytes)
+
 	if close, ok := streamReader.(io.Closer); ok {
 		close.Close()
 	}
@@ -123,20 +143,221 @@ func handleProxyStream(stream mux.MuxStream, auth *mux.AuthRequest, ctx *session
 
 var DefaultServerCipher CipherConfig
 
-func ServProxyMuxSession(session mux.MuxSession) error {
+//DefaultServerKeepAlive is the tcp keepalive period of target conns, 0 means system default, negative means disabled
+var DefaultServerKeepAlive time.Duration
+
+//DefaultServerHTTPCluster is the config of remote instances sharing sessions of HTTP channel
+var DefaultServerHTTPCluster HTTPClusterConfig
+
+//DefaultServerIPv6Mode is the IPv6 mode(prefer/fallback/require/disable) of server dialing target addresses
+var DefaultServerIPv6Mode string
+
+//ServerOptions is the state of one remote server shared by its listeners & sessions,
+//so that servers with different configs could run in one process.
+type ServerOptions struct {
+	Cipher CipherConfig
+	Mux    MuxConfig
+	//IPv6 mode(prefer/fallback/require/disable) of dialing target addresses
+	IPv6 string
+	//tcp keepalive period of target conns, 0 means system default, negative means disabled
+	KeepAlive time.Duration
+	//config of remote instances sharing sessions of HTTP channel
+	HTTPCluster HTTPClusterConfig
+	//resolver of target domains, nil means dns.DnsGetDoaminIPs
+	Resolver *dns.Resolver
+	//channels to next hops of streams
+	Hops *LocalChannelTable
+}
+
+//DefaultServerOptions return options by the package level defaults, which are used by listeners & session groups
+//created without options.
+func DefaultServerOptions() *ServerOptions {
+	opts := &ServerOptions{
+		Cipher:      DefaultServerCipher,
+		Mux:         defaultMuxConfig,
+		IPv6:        DefaultServerIPv6Mode,
+		KeepAlive:   DefaultServerKeepAlive,
+		HTTPCluster: DefaultServerHTTPCluster,
+		Resolver:    dns.ServerResolver,
+		Hops:        DefaultLocalChannelTable,
+	}
+	//forwarded requests are signed by the cipher key if no secret
+	if len(opts.HTTPCluster.Secret) == 0 {
+		opts.HTTPCluster.Secret = opts.Cipher.Key
+	}
+	return opts
+}
+
+//PMuxConfig return the initial pmux config of sessions served by the server
+func (o *ServerOptions) PMuxConfig() *pmux.Config {
+	return o.Mux.initialPMuxConfig(&o.Cipher)
+}
+
+//ResumeGracePeriod return the period to wait a broken resumable session re-attached
+func (o *ServerOptions) ResumeGracePeriod() time.Duration {
+	return o.Mux.resumeGracePeriod()
+}
+
+func (o *ServerOptions) hops() *LocalChannelTable {
+	if nil != o.Hops {
+		return o.Hops
+	}
+	return DefaultLocalChannelTable
+}
+
+func (o *ServerOptions) lookupIP(domain string) ([]net.IP, error) {
+	if nil != o.Resolver {
+		return o.Resolver.LookupIP(domain)
+	}
+	return dns.DnsGetDoaminIPs(domain)
+}
+
+func (o *ServerOptions) setTargetKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || o.KeepAlive == 0 {
+		return
+	}
+	if o.KeepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(o.KeepAlive)
+}
+
+//streamIdleTimeout return idle timeout seconds requested by client, which is limited by MaxStreamIdleTimeout
+func (o *ServerOptions) streamIdleTimeout(creq *mux.ConnectRequest) int {
+	timeout := creq.IdleTimeout
+	if timeout <= 0 {
+		return o.Mux.StreamIdleTimeout
+	}
+	if o.Mux.MaxStreamIdleTimeout > 0 && timeout > o.Mux.MaxStreamIdleTimeout {
+		timeout = o.Mux.MaxStreamIdleTimeout
+	}
+	return timeout
+}
+var remoteCompressStat mux.CompressStat
+var remotePriorityStreams = make([]int64, mux.PriorityClasses())
+
+//DumpRemoteChannelStat dump server side stat
+func DumpRemoteChannelStat(w io.Writer) {
+	fmt.Fprintf(w, "CompressRawBytes: %d\n", remoteCompressStat.RawBytes())
+	fmt.Fprintf(w, "CompressWireBytes: %d\n", remoteCompressStat.WireBytes())
+	fmt.Fprintf(w, "CompressSavedBytes: %d\n", remoteCompressStat.SavedBytes())
+	fmt.Fprintf(w, "CompressBypassedStreams: %d\n", remoteCompressStat.BypassedStreams())
+	for class := range remotePriorityStreams {
+		fmt.Fprintf(w, "RunningProxyStreamNum[%s]: %d\n", mux.PriorityName(class), atomic.LoadInt64(&remotePriorityStreams[class]))
+	}
+	var streams int64
+	for class := range remotePriorityStreams {
+		streams += atomic.LoadInt64(&remotePriorityStreams[class])
+	}
+	helper.DumpRelayStat(w, streams)
+	mux.DumpRelayStat(w)
+	dumpExtraStat(w)
+}
+
+//ErrServerClosed is returned while serving sessions or listeners of a closed server
+var ErrServerClosed = errors.New("server closed")
+
+//SessionGroup track mux sessions served by one server, so that the server could wait for them or close them
+//while shutting down. A nil group serve sessions without tracking.
+type SessionGroup struct {
+	mutex    sync.Mutex
+	sessions map[mux.MuxSession]struct{}
+	closed   bool
+	options  *ServerOptions
+}
+
+//NewSessionGroup create a group serving sessions by DefaultServerOptions
+func NewSessionGroup() *SessionGroup {
+	return NewServerSessionGroup(nil)
+}
+
+//NewServerSessionGroup create a group serving sessions by options of the server
+func NewServerSessionGroup(options *ServerOptions) *SessionGroup {
+	return &SessionGroup{sessions: make(map[mux.MuxSession]struct{}), options: options}
+}
+
+//Options return options of the server which the group belongs to
+func (g *SessionGroup) Options() *ServerOptions {
+	if nil == g || nil == g.options {
+		return DefaultServerOptions()
+	}
+	return g.options
+}
+
+//Serve serve the session until it's closed, the session is rejected if the group is closed.
+func (g *SessionGroup) Serve(session mux.MuxSession) error {
+	if nil == g {
+		return ServProxyMuxSession(session, nil)
+	}
+	g.mutex.Lock()
+	if g.closed {
+		g.mutex.Unlock()
+		session.Close()
+		return ErrServerClosed
+	}
+	g.sessions[session] = struct{}{}
+	g.mutex.Unlock()
+	defer func() {
+		g.mutex.Lock()
+		delete(g.sessions, session)
+		g.mutex.Unlock()
+	}()
+	return ServProxyMuxSession(session, g.Options())
+}
+
+//Len return the number of running sessions
+func (g *SessionGroup) Len() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.sessions)
+}
+
+//Closed return true if the group rejects new sessions
+func (g *SessionGroup) Closed() bool {
+	if nil == g {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.closed
+}
+
+//Close reject new sessions, running sessions are closed if force is true.
+func (g *SessionGroup) Close(force bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.closed = true
+	if force {
+		for session := range g.sessions {
+			session.Close()
+		}
+	}
+}
+
+//ServProxyMuxSession serve streams of the session by options of server, nil means DefaultServerOptions.
+func ServProxyMuxSession(session mux.MuxSession, opts *ServerOptions) error {
+	if nil == opts {
+		opts = DefaultServerOptions()
+	}
 	var authReq *mux.AuthRequest
 	ctx := &sessionContext{}
-	ctx.activeIOTime = time.Now()
+	ctx.touch(time.Now())
 	defer session.Close()
+	if as, ok := session.(mux.AuthenticatedSession); ok {
+		authReq = as.AuthRequest()
+	}
 
-	if defaultMuxConfig.SessionIdleTimeout > 0 {
+	if opts.Mux.SessionIdleTimeout > 0 {
 		sessionActiveTicker := time.NewTicker(10 * time.Second)
 		defer sessionActiveTicker.Stop()
 
 		go func() {
 			for range sessionActiveTicker.C {
-				ago := time.Now().Sub(ctx.activeIOTime)
-				if ago > time.Duration(defaultMuxConfig.SessionIdleTimeout)*time.Second {
+				ago := time.Now().Sub(ctx.lastActive())
+				if ago > time.Duration(opts.Mux.SessionIdleTimeout)*time.Second {
 					session.Close()
 					logger.Error("Close mux session since it's not active since %v ago.", ago)
 					return
@@ -161,24 +382,34 @@ func ServProxyMuxSession(session mux.MuxSession) error {
 				continue
 			}
 			logger.Info("Recv auth:%v", auth)
-			if !DefaultServerCipher.VerifyUser(auth.User) {
+			if !opts.Cipher.VerifyUser(auth.User) {
 				session.Close()
 				return mux.ErrAuthFailed
 			}
-			if !mux.IsValidCompressor(auth.CompressMethod) {
+			candidates := auth.CompressCandidates
+			if len(candidates) == 0 {
+				candidates = []string{auth.CompressMethod}
+			}
+			compressor := mux.SelectCompressor(candidates)
+			if len(compressor) == 0 {
 				logger.Error("[ERROR]Invalid compressor:%s", auth.CompressMethod)
 				session.Close()
 				return mux.ErrAuthFailed
 			}
+			auth.CompressMethod = compressor
 			authReq = auth
-			authRes := &mux.AuthResponse{Code: mux.AuthOK}
+			mux.BindResumableUser(session, auth.User)
+			authRes := &mux.AuthResponse{Code: mux.AuthOK, CompressMethod: compressor, HalfClose: auth.HalfClose}
 			mux.WriteMessage(stream, authRes)
 			stream.Close()
 			if tmp, ok := session.(*mux.ProxyMuxSession); ok {
 				tmp.Session.ResetCryptoContext(auth.CipherMethod, auth.CipherCounter)
+				if auth.HalfClose {
+					tmp.Session.EnableHalfClose()
+				}
 			}
 			continue
 		}
-		go handleProxyStream(stream, authReq, ctx)
+		go handleProxyStream(stream, authReq, ctx, opts)
 	}
 }
@@ -0,0 +1,53 @@
+package channel
+
+import (
+	"testing"
+
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+func TestStreamIdleTimeout(t *testing.T) {
+	opts := &ServerOptions{}
+	opts.Mux.StreamIdleTimeout = 10
+	opts.Mux.MaxStreamIdleTimeout = 300
+	cases := map[int]int{
+		0:    10,
+		-1:   10,
+		60:   60,
+		300:  300,
+		3600: 300,
+	}
+	for requested, expected := range cases {
+		if timeout := opts.streamIdleTimeout(&mux.ConnectRequest{IdleTimeout: requested}); timeout != expected {
+			t.Fatalf("Unexpected idle timeout:%d for requested:%d", timeout, requested)
+		}
+	}
+	//no limit if MaxStreamIdleTimeout is not set
+	opts.Mux.MaxStreamIdleTimeout = 0
+	if timeout := opts.streamIdleTimeout(&mux.ConnectRequest{IdleTimeout: 3600}); timeout != 3600 {
+		t.Fatalf("Unexpected idle timeout:%d without limit", timeout)
+	}
+}
+
+func TestSessionGroupOptions(t *testing.T) {
+	saved := DefaultServerCipher
+	defer func() {
+		DefaultServerCipher = saved
+	}()
+	DefaultServerCipher.Key = "default"
+	//groups without options follow the package level defaults
+	if key := NewSessionGroup().Options().Cipher.Key; key != "default" {
+		t.Fatalf("Unexpected cipher key:%s of default options", key)
+	}
+	var group *SessionGroup
+	if key := group.Options().Cipher.Key; key != "default" {
+		t.Fatalf("Unexpected cipher key:%s of nil group", key)
+	}
+	opts := &ServerOptions{Cipher: CipherConfig{Key: "server"}}
+	if NewServerSessionGroup(opts).Options() != opts {
+		t.Fatalf("Options of server are not used by the group")
+	}
+	if key := (&ListenerConfig{Server: opts}).ServerOptions().Cipher.Key; key != "server" {
+		t.Fatalf("Unexpected cipher key:%s of listener", key)
+	}
+}
@@ -1,12 +1,14 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -17,15 +19,16 @@ import (
 )
 
 type sshStream struct {
+	//unix nano of latest io
+	latestIOTime int64
 	net.Conn
-	conf         *channel.ProxyChannelConfig
-	addr         string
-	session      *sshMuxSession
-	latestIOTime time.Time
+	conf    *channel.ProxyChannelConfig
+	addr    string
+	session *sshMuxSession
 }
 
 func (s *sshStream) LatestIOTime() time.Time {
-	return s.latestIOTime
+	return time.Unix(0, atomic.LoadInt64(&s.latestIOTime))
 }
 
 func (tc *sshStream) Auth(req *mux.AuthRequest) error {
@@ -61,14 +64,14 @@ func (tc *sshStream) Read(p []byte) (int, error) {
 	if nil == tc.Conn {
 		return 0, io.EOF
 	}
-	tc.latestIOTime = time.Now()
+	atomic.StoreInt64(&tc.latestIOTime, time.Now().UnixNano())
 	return tc.Conn.Read(p)
 }
 func (tc *sshStream) Write(p []byte) (int, error) {
 	if nil == tc.Conn {
 		return 0, io.EOF
 	}
-	tc.latestIOTime = time.Now()
+	atomic.StoreInt64(&tc.latestIOTime, time.Now().UnixNano())
 	return tc.Conn.Write(p)
 }
 
@@ -160,11 +163,15 @@ func (p *SSHProxy) Features() channel.FeatureSet {
 }
 
 func (p *SSHProxy) CreateMuxSession(server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
+	return p.CreateMuxSessionContext(context.Background(), server, conf)
+}
+
+func (p *SSHProxy) CreateMuxSessionContext(ctx context.Context, server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
 	u, err := url.Parse(server)
 	if nil != err {
 		return nil, err
 	}
-	c, err := channel.DialServerByConf(server, conf)
+	c, err := channel.DialServerByConfContext(ctx, server, conf)
 	if err != nil {
 		return nil, err
 	}
@@ -206,8 +213,17 @@ func (p *SSHProxy) CreateMuxSession(server string, conf *channel.ProxyChannelCon
 		}
 	}
 
+	stop := channel.BindConnContext(ctx, c)
 	conn, chans, reqs, err := ssh.NewClientConn(c, u.Host, sshConf)
+	stop()
+	if nil == err {
+		err = ctx.Err()
+		if nil != err {
+			conn.Close()
+		}
+	}
 	if nil != err {
+		c.Close()
 		return nil, err
 	}
 	sClient := ssh.NewClient(conn, chans, reqs)
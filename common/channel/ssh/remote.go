@@ -0,0 +1,291 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+	"github.com/yinqiwen/gsnova/common/pmux"
+)
+
+//directTCPIPRequest is the payload of 'direct-tcpip' channel open request, see RFC 4254 7.2
+type directTCPIPRequest struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+//sshServerStream is a direct-tcpip channel served as a connected mux stream
+type sshServerStream struct {
+	ssh.Channel
+	id           uint32
+	creq         *mux.ConnectRequest
+	latestIOTime int64
+}
+
+func (s *sshServerStream) ConnectRequest() *mux.ConnectRequest {
+	return s.creq
+}
+
+func (s *sshServerStream) Connect(network string, addr string, opt mux.StreamOptions) error {
+	return fmt.Errorf("Connect is not supported by ssh server stream")
+}
+
+func (s *sshServerStream) Auth(req *mux.AuthRequest) error {
+	return nil
+}
+
+func (s *sshServerStream) StreamID() uint32 {
+	return s.id
+}
+
+//SetReadDeadline is a no-op since ssh channels have no deadline, pending reads are only interrupted by closing
+//the stream, eg: by the relay once the stream is idle longer than its idle timeout, or by the ssh client.
+func (s *sshServerStream) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+//SetWriteDeadline is a no-op like SetReadDeadline, writes are blocked by the window of ssh channel until
+//the stream closed.
+func (s *sshServerStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (s *sshServerStream) LatestIOTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.latestIOTime))
+}
+
+func (s *sshServerStream) Read(p []byte) (int, error) {
+	n, err := s.Channel.Read(p)
+	atomic.StoreInt64(&s.latestIOTime, time.Now().UnixNano())
+	return n, err
+}
+
+func (s *sshServerStream) Write(p []byte) (int, error) {
+	n, err := s.Channel.Write(p)
+	atomic.StoreInt64(&s.latestIOTime, time.Now().UnixNano())
+	return n, err
+}
+
+//sshServerSession is a ssh server connection served as an authenticated mux session, which accept
+//direct-tcpip channels as streams.
+type sshServerSession struct {
+	conn     *ssh.ServerConn
+	chans    <-chan ssh.NewChannel
+	streamID uint32
+	streams  int32
+}
+
+func (s *sshServerSession) AuthRequest() *mux.AuthRequest {
+	return &mux.AuthRequest{User: s.conn.User(), CompressMethod: mux.NoneCompressor}
+}
+
+func (s *sshServerSession) OpenStream() (mux.MuxStream, error) {
+	return nil, fmt.Errorf("OpenStream is not supported by ssh server session")
+}
+
+func (s *sshServerSession) CloseStream(stream mux.MuxStream) error {
+	return nil
+}
+
+func (s *sshServerSession) AcceptStream() (mux.MuxStream, error) {
+	for ch := range s.chans {
+		if ch.ChannelType() != "direct-tcpip" {
+			ch.Reject(ssh.UnknownChannelType, "only direct-tcpip channel is supported, eg: 'ssh -N -D'")
+			continue
+		}
+		var req directTCPIPRequest
+		if err := ssh.Unmarshal(ch.ExtraData(), &req); nil != err {
+			ch.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+			continue
+		}
+		c, reqs, err := ch.Accept()
+		if nil != err {
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		stream := &sshServerStream{
+			Channel: c,
+			id:      atomic.AddUint32(&s.streamID, 1),
+			creq: &mux.ConnectRequest{
+				Network: "tcp",
+				Addr:    net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))),
+			},
+			latestIOTime: time.Now().UnixNano(),
+		}
+		atomic.AddInt32(&s.streams, 1)
+		return &countedStream{sshServerStream: stream, session: s}, nil
+	}
+	return nil, pmux.ErrSessionShutdown
+}
+
+func (s *sshServerSession) Ping() (time.Duration, error) {
+	start := time.Now()
+	_, _, err := s.conn.SendRequest("keepalive@openssh.com", true, nil)
+	return time.Now().Sub(start), err
+}
+
+func (s *sshServerSession) NumStreams() int {
+	return int(atomic.LoadInt32(&s.streams))
+}
+
+func (s *sshServerSession) Close() error {
+	return s.conn.Close()
+}
+
+//countedStream decrease streams of session once closed
+type countedStream struct {
+	*sshServerStream
+	session *sshServerSession
+	closed  int32
+}
+
+func (s *countedStream) Close() error {
+	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		atomic.AddInt32(&s.session.streams, -1)
+	}
+	return s.sshServerStream.Close()
+}
+
+//NewServerConfig create ssh server config by options, users are verified by the server cipher config.
+func NewServerConfig(opt *channel.SSHOptions, cipher channel.CipherConfig) (*ssh.ServerConfig, error) {
+	config := &ssh.ServerConfig{}
+	if len(cipher.Key) > 0 {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if cipher.VerifyUser(c.User()) &&
+				subtle.ConstantTimeCompare(password, []byte(cipher.Key)) == 1 {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Invalid password for user:%s", c.User())
+		}
+	}
+	if len(opt.AuthorizedKeys) > 0 {
+		content, err := ioutil.ReadFile(opt.AuthorizedKeys)
+		if nil != err {
+			return nil, err
+		}
+		var keys [][]byte
+		for len(content) > 0 {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(content)
+			if nil != err {
+				break
+			}
+			keys = append(keys, key.Marshal())
+			content = rest
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("No key in authorized keys file:%s", opt.AuthorizedKeys)
+		}
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if cipher.VerifyUser(c.User()) {
+				data := key.Marshal()
+				for _, k := range keys {
+					if bytes.Equal(k, data) {
+						return nil, nil
+					}
+				}
+			}
+			return nil, fmt.Errorf("Invalid public key for user:%s", c.User())
+		}
+	}
+	var signer ssh.Signer
+	if len(opt.HostKey) > 0 {
+		content, err := ioutil.ReadFile(opt.HostKey)
+		if nil != err {
+			return nil, err
+		}
+		if signer, err = ssh.ParsePrivateKey(content); nil != err {
+			return nil, err
+		}
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if nil != err {
+			return nil, err
+		}
+		if signer, err = ssh.NewSignerFromKey(key); nil != err {
+			return nil, err
+		}
+		logger.Notice("SSH server use generated host key with fingerprint:%s", ssh.FingerprintSHA256(signer.PublicKey()))
+	}
+	config.AddHostKey(signer)
+	return config, nil
+}
+
+//ServeListener accept ssh conns from the listener & serve them in the group until the listener closed.
+func ServeListener(lp net.Listener, config *ssh.ServerConfig, group *channel.SessionGroup) error {
+	for {
+		conn, err := lp.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if group.Closed() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if nil != err {
+				logger.Error("SSH handshake with %v failed:%v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			logger.Info("SSH session of user:%s from %v", sconn.User(), conn.RemoteAddr())
+			go ssh.DiscardRequests(reqs)
+			group.Serve(&sshServerSession{conn: sconn, chans: chans})
+		}()
+	}
+}
+
+type sshListener struct {
+	net.Listener
+	config *ssh.ServerConfig
+}
+
+func (l *sshListener) Serve(group *channel.SessionGroup) error {
+	return ServeListener(l.Listener, l.config, group)
+}
+
+//SSHRemote is the remote channel of ssh scheme, it serves stock ssh clients as a gateway by
+//direct-tcpip channels, eg: 'ssh -N -D 1080 user@server', options of listener are SSHOptions.
+type SSHRemote struct {
+}
+
+func (p *SSHRemote) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	return channel.ListenStream(p, conf)
+}
+
+func (p *SSHRemote) NewListener(l net.Listener, conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	var opt channel.SSHOptions
+	if err := conf.DecodeOptions(&opt); nil != err {
+		return nil, err
+	}
+	config, err := NewServerConfig(&opt, conf.ServerOptions().Cipher)
+	if nil != err {
+		return nil, err
+	}
+	return &sshListener{Listener: l, config: config}, nil
+}
+
+func init() {
+	channel.RegisterRemoteChannelType("ssh", &SSHRemote{})
+}
@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/internal/testutil"
+)
+
+const testKey = "ssh-test-key"
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+//listen serve the ssh gateway with the authorized key of signer
+func listen(t *testing.T, signer ssh.Signer) channel.RemoteListener {
+	opts := &channel.ServerOptions{Cipher: channel.CipherConfig{Key: testKey}}
+	opts.Cipher.AllowUsers("gsnova")
+	authorizedKeys := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := ioutil.WriteFile(authorizedKeys, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); nil != err {
+		t.Fatal(err)
+	}
+	options, _ := json.Marshal(&channel.SSHOptions{AuthorizedKeys: authorizedKeys})
+	l, err := (&SSHRemote{}).Listen(&channel.ListenerConfig{Scheme: "ssh", Listen: "127.0.0.1:0", Options: options, Server: opts})
+	if nil != err {
+		t.Fatal(err)
+	}
+	go l.Serve(channel.NewServerSessionGroup(opts))
+	return l
+}
+
+func dial(addr string, user string, auth ssh.AuthMethod) (*ssh.Client, error) {
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+func TestDirectTCPIP(t *testing.T) {
+	signer := newTestSigner(t)
+	l := listen(t, signer)
+	defer l.Close()
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+
+	for _, auth := range []ssh.AuthMethod{ssh.PublicKeys(signer), ssh.Password(testKey)} {
+		client, err := dial(l.Addr().String(), "gsnova", auth)
+		if nil != err {
+			t.Fatal(err)
+		}
+		//what 'ssh -W' or 'ssh -D' does
+		conn, err := client.Dial("tcp", echo.Addr().String())
+		if nil != err {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("hello ssh"))
+		buf := make([]byte, len("hello ssh"))
+		if _, err = io.ReadFull(conn, buf); nil != err || string(buf) != "hello ssh" {
+			t.Fatalf("Unexpected echo:%s with err:%v", buf, err)
+		}
+		conn.Close()
+		//only direct-tcpip channels are accepted
+		if _, err = client.NewSession(); nil == err {
+			t.Fatalf("Expected error of session channel")
+		}
+		client.Close()
+	}
+}
+
+func TestRejectedKey(t *testing.T) {
+	l := listen(t, newTestSigner(t))
+	defer l.Close()
+	if _, err := dial(l.Addr().String(), "gsnova", ssh.PublicKeys(newTestSigner(t))); nil == err {
+		t.Fatalf("Expected error of unauthorized key")
+	}
+	if _, err := dial(l.Addr().String(), "gsnova", ssh.Password("invalid-key")); nil == err {
+		t.Fatalf("Expected error of invalid password")
+	}
+	if _, err := dial(l.Addr().String(), "nobody", ssh.Password(testKey)); nil == err {
+		t.Fatalf("Expected error of not allowed user")
+	}
+}
+
+func TestCountedStream(t *testing.T) {
+	config, err := NewServerConfig(&channel.SSHOptions{}, channel.CipherConfig{Key: testKey})
+	if nil != err {
+		t.Fatal(err)
+	}
+	//ssh handshake could not run on synchronous net.Pipe
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sessions := make(chan *sshServerSession, 1)
+	go func() {
+		c, err := l.Accept()
+		if nil != err {
+			close(sessions)
+			return
+		}
+		sconn, chans, reqs, err := ssh.NewServerConn(c, config)
+		if nil != err {
+			close(sessions)
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		sessions <- &sshServerSession{conn: sconn, chans: chans}
+	}()
+	client, err := dial(l.Addr().String(), "gsnova", ssh.Password(testKey))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session := <-sessions
+	if nil == session {
+		t.Fatalf("SSH handshake failed")
+	}
+	defer session.Close()
+
+	for i := 0; i < 2; i++ {
+		go client.Dial("tcp", "127.0.0.1:80")
+	}
+	var streams []io.Closer
+	for i := 0; i < 2; i++ {
+		stream, err := session.AcceptStream()
+		if nil != err {
+			t.Fatal(err)
+		}
+		if cs, ok := stream.(*countedStream); !ok || cs.ConnectRequest().Addr != "127.0.0.1:80" {
+			t.Fatalf("Unexpected stream:%v", stream)
+		}
+		streams = append(streams, stream)
+	}
+	if session.NumStreams() != 2 {
+		t.Fatalf("Unexpected streams:%d", session.NumStreams())
+	}
+	//streams are only counted once while closed more than once
+	streams[0].Close()
+	streams[0].Close()
+	if session.NumStreams() != 1 {
+		t.Fatalf("Unexpected streams:%d after closed", session.NumStreams())
+	}
+	streams[1].Close()
+	if session.NumStreams() != 0 {
+		t.Fatalf("Unexpected streams:%d after all closed", session.NumStreams())
+	}
+}
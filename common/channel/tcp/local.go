@@ -1,10 +1,14 @@
 package tcp
 
 import (
+	"context"
+	"io"
+	"net"
+
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
 type TcpProxy struct {
@@ -19,12 +23,30 @@ func (p *TcpProxy) Features() channel.FeatureSet {
 }
 
 func (tc *TcpProxy) CreateMuxSession(server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
-	conn, err := channel.DialServerByConf(server, conf)
+	return tc.CreateMuxSessionContext(context.Background(), server, conf)
+}
+
+func (tc *TcpProxy) CreateMuxSessionContext(ctx context.Context, server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
+	conn, err := channel.DialServerByConfContext(ctx, server, conf)
 	if err != nil {
 		return nil, err
 	}
 	logger.Info("TCP Session:%v", server)
-	ps, err := pmux.Client(conn, channel.InitialPMuxConfig(&conf.Cipher))
+	var muxConn io.ReadWriteCloser = conn
+	key := []byte(conf.Cipher.Key)
+	if conf.Resumable && !mux.ResumeAllowed(conn, key) {
+		logger.Notice("Resumable is disabled for %s since cipher key is empty over non TLS conn.", server)
+	} else if conf.Resumable {
+		dialer := func() (net.Conn, error) {
+			return channel.DialServerByConf(server, conf)
+		}
+		muxConn, err = mux.NewResumableClientConn(conn, dialer, conf.ResumeGracePeriod(), key)
+		if nil != err {
+			conn.Close()
+			return nil, err
+		}
+	}
+	ps, err := pmux.Client(muxConn, conf.PMuxConfig())
 	if nil != err {
 		return nil, err
 	}
@@ -3,50 +3,83 @@ package tcp
 import (
 	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
-func servTCP(lp net.Listener) {
+//ServeListener accept conns from the listener & serve their mux sessions in the group until the listener closed.
+func ServeListener(lp net.Listener, group *channel.SessionGroup) error {
 	for {
 		conn, err := lp.Accept()
 		if nil != err {
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
 		}
-		session, err := pmux.Server(conn, channel.InitialPMuxConfig(&channel.DefaultServerCipher))
-		if nil != err {
-			logger.Error("[ERROR]Failed to create mux session for tcp server with reason:%v", err)
-			continue
-		}
-
-		muxSession := &mux.ProxyMuxSession{Session: session}
-		go channel.ServProxyMuxSession(muxSession)
+		go servTCPConn(conn, group)
 	}
-	//ws.WriteMessage(websocket.CloseMessage, []byte{})
 }
 
-func StartTcpProxyServer(addr string) error {
-	lp, err := net.Listen("tcp", addr)
+func servTCPConn(conn net.Conn, group *channel.SessionGroup) {
+	if group.Closed() {
+		conn.Close()
+		return
+	}
+	//a resumable conn is attached to its existing session while muxConn is nil
+	opts := group.Options()
+	muxConn, err := mux.AcceptResumableConn(conn, opts.ResumeGracePeriod(), []byte(opts.Cipher.Key))
+	if nil != err || nil == muxConn {
+		if nil != err {
+			logger.Error("Failed to accept resumable conn with reason:%v", err)
+		}
+		return
+	}
+	session, err := pmux.Server(muxConn, opts.PMuxConfig())
 	if nil != err {
-		logger.Error("[ERROR]Failed to listen TCP address:%s with reason:%v", addr, err)
-		return err
+		logger.Error("[ERROR]Failed to create mux session for tcp server with reason:%v", err)
+		return
 	}
-	logger.Info("Listen on TCP address:%s", addr)
-	servTCP(lp)
-	return nil
+
+	muxSession := &mux.ProxyMuxSession{Session: session}
+	group.Serve(muxSession)
 }
 
-func StartTLSProxyServer(addr string, config *tls.Config) error {
-	lp, err := net.Listen("tcp", addr)
-	if nil != err {
-		logger.Error("[ERROR]Failed to listen TLS address:%s with reason:%v", addr, err)
-		return err
+type tcpListener struct {
+	net.Listener
+}
+
+func (l *tcpListener) Serve(group *channel.SessionGroup) error {
+	return ServeListener(l.Listener, group)
+}
+
+//TcpRemote is the remote channel of tcp/tls schemes
+type TcpRemote struct {
+}
+
+func (p *TcpRemote) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	return channel.ListenStream(p, conf)
+}
+
+//NewListener create a listener on l, conns are wrapped by TLS for tls scheme
+func (p *TcpRemote) NewListener(l net.Listener, conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	if conf.Scheme == "tls" {
+		tlscfg, err := conf.TLSConfig()
+		if nil != err {
+			return nil, err
+		}
+		l = tls.NewListener(l, tlscfg)
 	}
-	lp = tls.NewListener(lp, config)
-	logger.Info("Listen on TLS address:%s", addr)
-	servTCP(lp)
-	return nil
+	return &tcpListener{l}, nil
+}
+
+func init() {
+	remote := &TcpRemote{}
+	channel.RegisterRemoteChannelType("tcp", remote)
+	channel.RegisterRemoteChannelType("tls", remote)
 }
@@ -1,13 +1,17 @@
 package websocket
 
 import (
+	"context"
+	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
 type WebsocketProxy struct {
@@ -21,25 +25,40 @@ func (p *WebsocketProxy) Features() channel.FeatureSet {
 }
 
 func (ws *WebsocketProxy) CreateMuxSession(server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
+	return ws.CreateMuxSessionContext(context.Background(), server, conf)
+}
+
+func (ws *WebsocketProxy) CreateMuxSessionContext(ctx context.Context, server string, conf *channel.ProxyChannelConfig) (mux.MuxSession, error) {
 	u, err := url.Parse(server)
 	if nil != err {
 		return nil, err
 	}
-	u.Path = "/ws"
+	//keep the path prefix of server url, eg: server mounted under a prefix of web app
+	u.Path = strings.TrimSuffix(u.Path, "/") + conf.HTTP.Path("/ws")
+	u.User = nil
+	header := make(http.Header)
+	if len(conf.HTTP.UserAgent) > 0 {
+		header.Set("User-Agent", conf.HTTP.UserAgent)
+	}
+	conf.HTTP.SetHeaders(header, nil)
 	wsDialer := &websocket.Dialer{}
-	wsDialer.NetDial = channel.NewDialByConf(conf, u.Scheme)
+	wsDialer.NetDial = channel.NewDialContextByConf(ctx, conf, u.Scheme)
+	if deadline, ok := ctx.Deadline(); ok {
+		wsDialer.HandshakeTimeout = deadline.Sub(time.Now())
+	}
 	wsDialer.TLSClientConfig = channel.NewTLSConfig(conf)
-	c, _, err := wsDialer.Dial(u.String(), nil)
+	c, _, err := wsDialer.Dial(u.String(), header)
 	if err != nil {
 		logger.Notice("dial websocket error:%v %v", err, u.String())
 		return nil, err
 	}
 	logger.Debug("Connect %s success.", server)
-	ps, err := pmux.Client(&mux.WsConn{Conn: c}, channel.InitialPMuxConfig(&conf.Cipher))
+	wsConn := mux.NewWsConn(c)
+	ps, err := pmux.Client(wsConn, conf.PMuxConfig())
 	if nil != err {
 		return nil, err
 	}
-	return &mux.ProxyMuxSession{Session: ps}, nil
+	return mux.NewWsMuxSession(ps, wsConn), nil
 }
 
 func init() {
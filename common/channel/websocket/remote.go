@@ -1,12 +1,14 @@
 package websocket
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
 
 	"github.com/gorilla/websocket"
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/mux"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
 var (
@@ -18,22 +20,80 @@ var (
 
 // handleWebsocket connection. Update to
 func WebsocketInvoke(w http.ResponseWriter, r *http.Request) {
+	serveWebsocket(w, r, nil, nil)
+}
+
+//NewHandler create a websocket handler with the endpoint config which serve mux sessions in the group
+func NewHandler(endpoint *channel.HTTPEndpointConfig, group *channel.SessionGroup) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveWebsocket(w, r, endpoint, group)
+	}
+}
+
+func serveWebsocket(w http.ResponseWriter, r *http.Request, endpoint *channel.HTTPEndpointConfig, group *channel.SessionGroup) {
+	if group.Closed() {
+		http.Error(w, "Server closed", 503)
+		return
+	}
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
 
-	ws, err := upgrader.Upgrade(w, r, nil)
+	var header http.Header
+	if nil != endpoint && len(endpoint.Headers) > 0 {
+		header = make(http.Header)
+		endpoint.SetHeaders(header, nil)
+	}
+	ws, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		//log.WithField("err", err).Println("Upgrading to websockets")
 		http.Error(w, "Error Upgrading to websockets", 400)
 		return
 	}
-	session, err := pmux.Server(&mux.WsConn{Conn: ws}, channel.InitialPMuxConfig(&channel.DefaultServerCipher))
+	wsConn := mux.NewWsConn(ws)
+	session, err := pmux.Server(wsConn, group.Options().PMuxConfig())
 	if nil != err {
 		return
 	}
-	muxSession := &mux.ProxyMuxSession{Session: session}
-	channel.ServProxyMuxSession(muxSession)
+	muxSession := mux.NewWsMuxSession(session, wsConn)
+	group.Serve(muxSession)
 	//ws.WriteMessage(websocket.CloseMessage, []byte{})
 }
+
+//WebsocketRemote is the remote channel of ws/wss schemes, options of wss listener are TLSOptions
+type WebsocketRemote struct {
+}
+
+func (p *WebsocketRemote) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	return channel.ListenStream(p, conf)
+}
+
+func (p *WebsocketRemote) NewListener(l net.Listener, conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	endpoint, err := conf.HTTPEndpoint()
+	if nil != err {
+		return nil, err
+	}
+	return p.NewHTTPListener(l, conf, channel.HTTPHandler(p, endpoint))
+}
+
+func (p *WebsocketRemote) HandleHTTP(mux *http.ServeMux, endpoint *channel.HTTPEndpointConfig, group *channel.SessionGroup) {
+	mux.HandleFunc(endpoint.Path("/ws"), NewHandler(endpoint, group))
+}
+
+func (p *WebsocketRemote) NewHTTPListener(l net.Listener, conf *channel.ListenerConfig, handler func(group *channel.SessionGroup) http.Handler) (channel.RemoteListener, error) {
+	var tlscfg *tls.Config
+	if conf.Scheme == "wss" {
+		var err error
+		if tlscfg, err = conf.TLSConfig(); nil != err {
+			return nil, err
+		}
+	}
+	return channel.NewHTTPListener(l, tlscfg, handler), nil
+}
+
+func init() {
+	remote := &WebsocketRemote{}
+	channel.RegisterRemoteChannelType("ws", remote)
+	channel.RegisterRemoteChannelType("wss", remote)
+}
@@ -0,0 +1,124 @@
+package dialer
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/internal/testutil"
+	"github.com/yinqiwen/gsnova/internal/testutil/testserver"
+)
+
+const testKey = "dialer-test-key"
+
+func testEcho(t *testing.T, d *Dialer, addr string) {
+	conn, err := d.Dial("tcp", addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != addr {
+		t.Fatalf("Unexpected remote addr:%v", conn.RemoteAddr())
+	}
+	conn.Write([]byte("hello dialer"))
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := ioutil.ReadAll(conn)
+	if nil != err || string(res) != "hello dialer" {
+		t.Fatalf("Unexpected echo:%s with err:%v", res, err)
+	}
+}
+
+func TestDialerRoundTrip(t *testing.T) {
+	server, addr := testserver.Start(t, testKey)
+	defer server.Close()
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+
+	d, err := NewByURL("tcp://gsnova:" + testKey + "@" + addr + "?method=chacha20poly1305")
+	if nil != err {
+		t.Fatal(err)
+	}
+	testEcho(t, d, echo.Addr().String())
+
+	d, err = New(&channel.ProxyChannelConfig{
+		Name:       "dialer_test",
+		ServerList: []string{"tcp://" + addr},
+		Cipher:     channel.CipherConfig{User: "gsnova", Key: testKey, Method: "chacha20poly1305"},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	testEcho(t, d, echo.Addr().String())
+	testEcho(t, NewByChannel("dialer_test"), echo.Addr().String())
+
+	if _, err = d.Dial("udp", echo.Addr().String()); nil == err {
+		t.Fatalf("Expected error of unsupported network")
+	}
+}
+
+func TestDialerHTTPTransport(t *testing.T) {
+	server, addr := testserver.Start(t, testKey)
+	defer server.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+
+	d, err := NewByURL("tcp://gsnova:" + testKey + "@" + addr + "?method=chacha20poly1305")
+	if nil != err {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: d.NewHTTPTransport(), Timeout: 5 * time.Second}
+	res, err := client.Get("http://" + l.Addr().String() + "/dialer")
+	if nil != err {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello /dialer" {
+		t.Fatalf("Unexpected response:%s", body)
+	}
+}
+
+func TestDialerCancel(t *testing.T) {
+	//the server accepts conns but never answers, session init hangs until cancelled
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	d, err := NewByURL("tcp://gsnova:" + testKey + "@" + l.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err = d.DialContext(ctx, "tcp", "127.0.0.1:80"); nil == err {
+		t.Fatalf("Expected error after cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Dial is not cancelled in time, elapsed:%v", elapsed)
+	}
+	if _, err = NewByURL("unknown://127.0.0.1"); nil == err {
+		t.Fatalf("Expected error of unknown channel scheme")
+	}
+}
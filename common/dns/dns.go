@@ -2,6 +2,7 @@ package dns
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"net"
 
@@ -48,6 +49,13 @@ func getIPByDefaultResolver(domain string) (string, error) {
 }
 
 func DnsGetDoaminIP(domain string) (string, error) {
+	if nil != ServerResolver {
+		ips, err := ServerResolver.LookupIP(domain)
+		if nil != err {
+			return "", err
+		}
+		return ips[0].String(), nil
+	}
 	if nil != LocalDNS {
 		ips, err := LocalDNS.LookupA(domain)
 		if len(ips) > 0 {
@@ -57,6 +65,80 @@ func DnsGetDoaminIP(domain string) (string, error) {
 	return getIPByDefaultResolver(domain)
 }
 
+//DnsGetDoaminIPs lookup both A & AAAA records of the domain concurrently.
+func DnsGetDoaminIPs(domain string) ([]net.IP, error) {
+	if nil != ServerResolver {
+		return ServerResolver.LookupIP(domain)
+	}
+	return lookupIPs(LocalDNS, domain)
+}
+
+//lookupIPs lookup A & AAAA records of the domain by the trusted dns if not nil, then by the system resolver
+func lookupIPs(trusted *fdns.TrustedDNS, domain string) ([]net.IP, error) {
+	if nil != trusted {
+		var aaaa []dns.RR
+		var aaaaErr error
+		done := make(chan struct{})
+		go func() {
+			aaaa, aaaaErr = trusted.LookupAAAA(domain)
+			close(done)
+		}()
+		a, err := trusted.LookupA(domain)
+		<-done
+		var ips []net.IP
+		for _, answer := range append(a, aaaa...) {
+			switch rr := answer.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+		if len(ips) > 0 {
+			return ips, nil
+		}
+		if nil == err {
+			err = aaaaErr
+		}
+		logger.Debug("Failed to lookup %s by local dns with reason:%v", domain, err)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), domain)
+	if nil != err {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	return ips, nil
+}
+
+//IPResolver lookup addresses of domains, it's implemented by both Resolver & Local.
+type IPResolver interface {
+	LookupIP(domain string) ([]net.IP, error)
+}
+
+//LookupHost return one address of the domain by the resolver, IPv4 is preferred.
+//Domains are resolved by DnsGetDoaminIP if the resolver is nil.
+func LookupHost(r IPResolver, domain string) (string, error) {
+	if nil == r {
+		return DnsGetDoaminIP(domain)
+	}
+	ips, err := r.LookupIP(domain)
+	if nil != err {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("No address found for %s", domain)
+	}
+	for _, ip := range ips {
+		if nil != ip.To4() {
+			return ip.String(), nil
+		}
+	}
+	return ips[0].String(), nil
+}
+
 var CNIPSet *cip.CountryIPSet
 
 type LocalDNSConfig struct {
@@ -66,12 +148,21 @@ type LocalDNSConfig struct {
 	CNIPSet    string
 }
 
-func Init(conf *LocalDNSConfig) {
+//Local is the local dns server & CN ip set owned by a client
+type Local struct {
+	DNS     *fdns.TrustedDNS
+	CNIPSet *cip.CountryIPSet
+	server  *dns.Server
+}
+
+//NewLocal create the local dns by config, the dns server is not started.
+func NewLocal(conf *LocalDNSConfig) *Local {
+	l := &Local{}
 	cnipset, err := cip.LoadIPSet(conf.CNIPSet, "CN")
 	if nil != err {
 		logger.Error("Failed to load IP range file:%s with reason:%v", conf.CNIPSet, err)
 	} else {
-		CNIPSet = cnipset
+		l.CNIPSet = cnipset
 	}
 	cfg := &fdns.Config{}
 	cfg.Listen = conf.Listen
@@ -93,23 +184,55 @@ func Init(conf *LocalDNSConfig) {
 	}
 	cfg.MinTTL = 24 * 3600
 	cfg.DialTimeout = netx.DialTimeout
-	cfg.IsCNIP = func(ip net.IP) bool {
-		if nil == CNIPSet {
-			return false
-		}
-		return CNIPSet.IsInCountry(ip, "CN")
-	}
+	cfg.IsCNIP = l.IsCNIP
 	cfg.IsDomainPoisioned = func(domain string) int {
 		//conf.GFWList.Load()
 		return -1
 	}
-	LocalDNS, _ = fdns.NewTrustedDNS(cfg)
-	if len(conf.Listen) > 0 {
-		go func() {
-			err := LocalDNS.Start()
-			if nil != err {
-				logger.Error("Failed to start dns server:%v", err)
-			}
-		}()
+	l.DNS, _ = fdns.NewTrustedDNS(cfg)
+	return l
+}
+
+//IsCNIP check if the ip is in CN ip set
+func (l *Local) IsCNIP(ip net.IP) bool {
+	if nil == l.CNIPSet {
+		return false
 	}
+	return l.CNIPSet.IsInCountry(ip, "CN")
+}
+
+//Start serve dns queries on the listen address if configured
+func (l *Local) Start() {
+	if len(l.DNS.Config.Listen) == 0 {
+		return
+	}
+	l.server = &dns.Server{Addr: l.DNS.Config.Listen, Net: "udp", Handler: l.DNS}
+	go func(server *dns.Server) {
+		err := server.ListenAndServe()
+		if nil != err {
+			logger.Error("Failed to start dns server:%v", err)
+		}
+	}(l.server)
+}
+
+//LookupIP lookup addresses of the domain by the trusted dns, then by the system resolver
+func (l *Local) LookupIP(domain string) ([]net.IP, error) {
+	return lookupIPs(l.DNS, domain)
+}
+
+//Stop shutdown the dns server
+func (l *Local) Stop() error {
+	if nil == l.server {
+		return nil
+	}
+	err := l.server.Shutdown()
+	l.server = nil
+	return err
+}
+
+func Init(conf *LocalDNSConfig) {
+	l := NewLocal(conf)
+	LocalDNS = l.DNS
+	CNIPSet = l.CNIPSet
+	l.Start()
 }
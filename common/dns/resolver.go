@@ -0,0 +1,357 @@
+package dns
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+const (
+	defaultResolverTimeout   = 3000
+	defaultResolverCacheSize = 4096
+	defaultNegativeTTL       = 30
+	//the system resolver does not tell TTL of records
+	systemResolverTTL = 60
+)
+
+var errNoSuchHost = errors.New("no such host")
+
+//ResolverConfig is the config of server side resolver.
+type ResolverConfig struct {
+	//upstream servers, eg:"8.8.8.8", "udp://8.8.8.8:53", "tcp://1.1.1.1:53", "https://127.0.0.1:8053/dns-query",
+	//empty means the system resolver
+	Servers []string
+	//milliseconds of every query
+	Timeout int
+	//max domains in cache
+	CacheSize int
+	//seconds to cache a domain without any address, 30 by default
+	NegativeTTL int
+	//max seconds to cache addresses of a domain, which are cached by TTL of their records if it's 0 or larger
+	MaxTTL int
+	//static overrides, domain -> addresses
+	Hosts map[string][]string
+}
+
+type resolverCacheEntry struct {
+	domain string
+	ips    []net.IP
+	err    error
+	expire time.Time
+}
+
+//Resolver lookup domains with configured upstreams and cache the results by TTL.
+type Resolver struct {
+	conf      ResolverConfig
+	upstreams []*url.URL
+	client    *http.Client
+	hosts     map[string][]net.IP
+
+	mutex sync.Mutex
+	cache map[string]*list.Element
+	lru   *list.List
+
+	hits   int64
+	misses int64
+}
+
+//NewResolver create a resolver with config.
+func NewResolver(conf *ResolverConfig) (*Resolver, error) {
+	r := &Resolver{
+		conf:  *conf,
+		hosts: make(map[string][]net.IP),
+		cache: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+	if r.conf.Timeout <= 0 {
+		r.conf.Timeout = defaultResolverTimeout
+	}
+	if r.conf.CacheSize <= 0 {
+		r.conf.CacheSize = defaultResolverCacheSize
+	}
+	if r.conf.NegativeTTL <= 0 {
+		r.conf.NegativeTTL = defaultNegativeTTL
+	}
+	for _, server := range conf.Servers {
+		if !strings.Contains(server, "://") {
+			server = "udp://" + server
+		}
+		u, err := url.Parse(server)
+		if nil != err {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "udp", "tcp":
+			if _, _, err := net.SplitHostPort(u.Host); nil != err {
+				u.Host = net.JoinHostPort(u.Host, "53")
+			}
+		case "https", "http":
+			if nil == r.client {
+				r.client = &http.Client{Timeout: r.timeout()}
+			}
+		default:
+			return nil, fmt.Errorf("invalid dns server:%s", server)
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	for domain, addrs := range conf.Hosts {
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if nil == ip {
+				return nil, fmt.Errorf("invalid address:%s for host:%s", addr, domain)
+			}
+			domain = normalizeDomain(domain)
+			r.hosts[domain] = append(r.hosts[domain], ip)
+		}
+	}
+	return r, nil
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+func (r *Resolver) timeout() time.Duration {
+	return time.Duration(r.conf.Timeout) * time.Millisecond
+}
+
+func (r *Resolver) getCache(domain string) (*resolverCacheEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	elem, exist := r.cache[domain]
+	if !exist {
+		return nil, false
+	}
+	entry := elem.Value.(*resolverCacheEntry)
+	if time.Now().After(entry.expire) {
+		r.lru.Remove(elem)
+		delete(r.cache, domain)
+		return nil, false
+	}
+	r.lru.MoveToFront(elem)
+	return entry, true
+}
+
+func (r *Resolver) putCache(entry *resolverCacheEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if elem, exist := r.cache[entry.domain]; exist {
+		elem.Value = entry
+		r.lru.MoveToFront(elem)
+		return
+	}
+	r.cache[entry.domain] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.conf.CacheSize {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.cache, oldest.Value.(*resolverCacheEntry).domain)
+	}
+}
+
+func (r *Resolver) exchangeDoH(u *url.URL, m *dns.Msg) (*dns.Msg, error) {
+	packed, err := m.Pack()
+	if nil != err {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(packed))
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	res, err := r.client.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("invalid DoH response status:%d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 65535))
+	if nil != err {
+		return nil, err
+	}
+	reply := &dns.Msg{}
+	err = reply.Unpack(body)
+	return reply, err
+}
+
+func (r *Resolver) exchange(m *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, u := range r.upstreams {
+		var reply *dns.Msg
+		var err error
+		switch u.Scheme {
+		case "udp", "tcp":
+			c := &dns.Client{Net: u.Scheme, Timeout: r.timeout()}
+			reply, _, err = c.Exchange(m, u.Host)
+			//truncated answers are reported as ErrTruncated by miekg/dns
+			if u.Scheme == "udp" && (err == dns.ErrTruncated || (nil == err && reply.Truncated)) {
+				c.Net = "tcp"
+				reply, _, err = c.Exchange(m, u.Host)
+			}
+		default:
+			reply, err = r.exchangeDoH(u, m)
+		}
+		if nil == err && (reply.Rcode == dns.RcodeSuccess || reply.Rcode == dns.RcodeNameError) {
+			return reply, nil
+		}
+		if nil == err {
+			err = fmt.Errorf("dns server:%s response %s", u.Host, dns.RcodeToString[reply.Rcode])
+		}
+		logger.Debug("Failed to query %s from %s with reason:%v", m.Question[0].Name, u.String(), err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (r *Resolver) lookupType(domain string, qtype uint16) ([]net.IP, uint32, error) {
+	m := &dns.Msg{}
+	m.SetQuestion(dns.Fqdn(domain), qtype)
+	m.RecursionDesired = true
+	reply, err := r.exchange(m)
+	if nil != err {
+		return nil, 0, err
+	}
+	var ips []net.IP
+	ttl := uint32(0)
+	for _, answer := range reply.Answer {
+		var ip net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		if len(ips) == 0 || answer.Header().Ttl < ttl {
+			ttl = answer.Header().Ttl
+		}
+		ips = append(ips, ip)
+	}
+	return ips, ttl, nil
+}
+
+func (r *Resolver) lookupUpstreams(domain string) ([]net.IP, time.Duration, error) {
+	var aaaa []net.IP
+	var aaaaTTL uint32
+	var aaaaErr error
+	done := make(chan struct{})
+	go func() {
+		aaaa, aaaaTTL, aaaaErr = r.lookupType(domain, dns.TypeAAAA)
+		close(done)
+	}()
+	ips, ttl, err := r.lookupType(domain, dns.TypeA)
+	<-done
+	if nil != err || nil != aaaaErr {
+		if len(ips) == 0 && len(aaaa) == 0 {
+			if nil == err {
+				err = aaaaErr
+			}
+			return nil, 0, err
+		}
+		//partial result is not cached
+		ttl, aaaaTTL = 0, 0
+	}
+	if len(ips) == 0 || (len(aaaa) > 0 && aaaaTTL < ttl) {
+		ttl = aaaaTTL
+	}
+	ips = append(ips, aaaa...)
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+func (r *Resolver) lookupSystem(domain string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, domain)
+	if nil != err {
+		if dnsErr, ok := err.(*net.DNSError); ok && !dnsErr.IsTimeout && !dnsErr.Temporary() {
+			//treat as not found
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	return ips, systemResolverTTL * time.Second, nil
+}
+
+//LookupIP return both IPv4 & IPv6 addresses of the domain.
+func (r *Resolver) LookupIP(domain string) ([]net.IP, error) {
+	if ip := net.ParseIP(domain); nil != ip {
+		return []net.IP{ip}, nil
+	}
+	domain = normalizeDomain(domain)
+	if ips, exist := r.hosts[domain]; exist {
+		return ips, nil
+	}
+	if entry, exist := r.getCache(domain); exist {
+		atomic.AddInt64(&r.hits, 1)
+		return entry.ips, entry.err
+	}
+	atomic.AddInt64(&r.misses, 1)
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if len(r.upstreams) > 0 {
+		ips, ttl, err = r.lookupUpstreams(domain)
+	} else {
+		ips, ttl, err = r.lookupSystem(domain)
+	}
+	if nil != err {
+		//transport failure is not cached
+		return nil, err
+	}
+	entry := &resolverCacheEntry{domain: domain, ips: ips}
+	if len(ips) == 0 {
+		entry.err = &net.DNSError{Err: errNoSuchHost.Error(), Name: domain}
+		ttl = time.Duration(r.conf.NegativeTTL) * time.Second
+	} else if r.conf.MaxTTL > 0 && ttl > time.Duration(r.conf.MaxTTL)*time.Second {
+		ttl = time.Duration(r.conf.MaxTTL) * time.Second
+	}
+	if ttl > 0 {
+		entry.expire = time.Now().Add(ttl)
+		r.putCache(entry)
+	}
+	return entry.ips, entry.err
+}
+
+//DumpStat dump cache stat of the resolver
+func (r *Resolver) DumpStat(w io.Writer) {
+	r.mutex.Lock()
+	size := r.lru.Len()
+	r.mutex.Unlock()
+	fmt.Fprintf(w, "ResolverCacheSize: %d\n", size)
+	fmt.Fprintf(w, "ResolverCacheHits: %d\n", atomic.LoadInt64(&r.hits))
+	fmt.Fprintf(w, "ResolverCacheMisses: %d\n", atomic.LoadInt64(&r.misses))
+}
+
+//ServerResolver is used to resolve all domains in server side if not nil.
+var ServerResolver *Resolver
+
+//InitServerResolver create the server side resolver
+func InitServerResolver(conf *ResolverConfig) error {
+	r, err := NewResolver(conf)
+	if nil != err {
+		return err
+	}
+	ServerResolver = r
+	return nil
+}
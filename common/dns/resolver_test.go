@@ -0,0 +1,243 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+//fakeUpstream answer A queries of records, AAAA queries & other domains are answered without records & NXDOMAIN.
+type fakeUpstream struct {
+	records  map[string]uint32
+	rcode    int
+	truncate bool
+	queries  int64
+}
+
+func (u *fakeUpstream) reply(req *dns.Msg, udp bool) *dns.Msg {
+	atomic.AddInt64(&u.queries, 1)
+	res := &dns.Msg{}
+	res.SetReply(req)
+	if u.rcode != dns.RcodeSuccess {
+		res.Rcode = u.rcode
+		return res
+	}
+	if udp && u.truncate {
+		res.Truncated = true
+		return res
+	}
+	q := req.Question[0]
+	ttl, exist := u.records[q.Name]
+	if !exist {
+		res.Rcode = dns.RcodeNameError
+		return res
+	}
+	if q.Qtype == dns.TypeA {
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(10, 0, 0, 1),
+		})
+	}
+	return res
+}
+
+//serve the upstream over udp & tcp on the same port
+func (u *fakeUpstream) serve(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(u.reply(req, true))
+	})}
+	tcp := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(u.reply(req, false))
+	})}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+//serveDoH serve the upstream over DNS over HTTPS(RFC 8484) in plain http
+func (u *fakeUpstream) serveDoH(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req := &dns.Msg{}
+		if r.Header.Get("Content-Type") != "application/dns-message" || nil != req.Unpack(body) {
+			w.WriteHeader(400)
+			return
+		}
+		packed, _ := u.reply(req, false).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/dns-query"
+}
+
+func (u *fakeUpstream) numQueries() int64 {
+	return atomic.LoadInt64(&u.queries)
+}
+
+func newTestResolver(t *testing.T, conf *ResolverConfig) *Resolver {
+	r, err := NewResolver(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func (r *Resolver) cacheExpire(domain string) (time.Time, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if elem, exist := r.cache[domain]; exist {
+		return elem.Value.(*resolverCacheEntry).expire, true
+	}
+	return time.Time{}, false
+}
+
+func TestResolverTTL(t *testing.T) {
+	upstream := &fakeUpstream{records: map[string]uint32{"example.com.": 1}}
+	r := newTestResolver(t, &ResolverConfig{Servers: []string{upstream.serve(t)}})
+	ips, err := r.LookupIP("example.com")
+	if nil != err || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("Unexpected result:%v with err:%v", ips, err)
+	}
+	//A & AAAA queries
+	if upstream.numQueries() != 2 {
+		t.Fatalf("Unexpected queries:%d", upstream.numQueries())
+	}
+	if _, err = r.LookupIP("Example.com."); nil != err || upstream.numQueries() != 2 {
+		t.Fatalf("Cached result is not used, queries:%d err:%v", upstream.numQueries(), err)
+	}
+	//expired by TTL of records
+	time.Sleep(1100 * time.Millisecond)
+	if _, err = r.LookupIP("example.com"); nil != err || upstream.numQueries() != 4 {
+		t.Fatalf("Expired result is used, queries:%d err:%v", upstream.numQueries(), err)
+	}
+}
+
+func TestResolverMaxTTL(t *testing.T) {
+	upstream := &fakeUpstream{records: map[string]uint32{"example.com.": 3600, "short.com.": 5}}
+	r := newTestResolver(t, &ResolverConfig{Servers: []string{upstream.serve(t)}, MaxTTL: 10})
+	for domain, ttl := range map[string]time.Duration{"example.com": 10 * time.Second, "short.com": 5 * time.Second} {
+		start := time.Now()
+		if _, err := r.LookupIP(domain); nil != err {
+			t.Fatal(err)
+		}
+		expire, exist := r.cacheExpire(domain)
+		if !exist || expire.Before(start.Add(ttl)) || expire.After(time.Now().Add(ttl)) {
+			t.Fatalf("Unexpected expire:%v of %s, expected TTL:%v", expire, domain, ttl)
+		}
+	}
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	upstream := &fakeUpstream{}
+	r := newTestResolver(t, &ResolverConfig{Servers: []string{upstream.serve(t)}, NegativeTTL: 20, MaxTTL: 10})
+	start := time.Now()
+	if _, err := r.LookupIP("nonexist.com"); nil == err {
+		t.Fatalf("Expected error of not existing domain")
+	}
+	if _, err := r.LookupIP("nonexist.com"); nil == err || upstream.numQueries() != 2 {
+		t.Fatalf("Negative result is not cached, queries:%d err:%v", upstream.numQueries(), err)
+	}
+	//NegativeTTL is not capped by MaxTTL
+	expire, _ := r.cacheExpire("nonexist.com")
+	if expire.Before(start.Add(20 * time.Second)) {
+		t.Fatalf("Unexpected expire:%v of negative result", expire)
+	}
+
+	//failures of upstreams are not cached
+	failed := &fakeUpstream{rcode: dns.RcodeServerFailure}
+	r = newTestResolver(t, &ResolverConfig{Servers: []string{failed.serve(t)}})
+	if _, err := r.LookupIP("failure.com"); nil == err {
+		t.Fatalf("Expected error of server failure")
+	}
+	if _, exist := r.cacheExpire("failure.com"); exist {
+		t.Fatalf("Server failure is cached")
+	}
+}
+
+func TestResolverCacheSize(t *testing.T) {
+	upstream := &fakeUpstream{records: map[string]uint32{"a.com.": 60, "b.com.": 60, "c.com.": 60}}
+	r := newTestResolver(t, &ResolverConfig{Servers: []string{upstream.serve(t)}, CacheSize: 2})
+	r.LookupIP("a.com")
+	r.LookupIP("b.com")
+	//a.com is used recently, b.com is the least recently used one
+	r.LookupIP("a.com")
+	r.LookupIP("c.com")
+	if r.lru.Len() != 2 {
+		t.Fatalf("Unexpected cache size:%d", r.lru.Len())
+	}
+	for domain, cached := range map[string]bool{"a.com": true, "b.com": false, "c.com": true} {
+		if _, exist := r.cacheExpire(domain); exist != cached {
+			t.Fatalf("Unexpected cache state of %s:%v", domain, exist)
+		}
+	}
+}
+
+func TestResolverHosts(t *testing.T) {
+	upstream := &fakeUpstream{records: map[string]uint32{"example.com.": 60}}
+	r := newTestResolver(t, &ResolverConfig{
+		Servers: []string{upstream.serve(t)},
+		Hosts:   map[string][]string{"Example.com.": {"192.168.1.1", "::1"}},
+	})
+	ips, err := r.LookupIP("example.COM")
+	if nil != err || len(ips) != 2 || !ips[0].Equal(net.IPv4(192, 168, 1, 1)) || !ips[1].Equal(net.IPv6loopback) {
+		t.Fatalf("Unexpected result:%v with err:%v", ips, err)
+	}
+	if upstream.numQueries() != 0 {
+		t.Fatalf("Hosts are not used")
+	}
+	if _, err = NewResolver(&ResolverConfig{Hosts: map[string][]string{"example.com": {"invalid"}}}); nil == err {
+		t.Fatalf("Expected error of invalid address")
+	}
+}
+
+func TestResolverFallback(t *testing.T) {
+	failed := &fakeUpstream{rcode: dns.RcodeServerFailure}
+	truncated := &fakeUpstream{records: map[string]uint32{"example.com.": 60}, truncate: true}
+	doh := &fakeUpstream{records: map[string]uint32{"example.com.": 60}}
+	//a closed tcp port refuses queries at once
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	//udp answers truncated are queried again over tcp
+	r := newTestResolver(t, &ResolverConfig{Servers: []string{failed.serve(t), truncated.serve(t)}})
+	if ips, err := r.LookupIP("example.com"); nil != err || len(ips) != 1 {
+		t.Fatalf("Unexpected result:%v with err:%v", ips, err)
+	}
+	if failed.numQueries() != 2 || truncated.numQueries() != 4 {
+		t.Fatalf("Unexpected queries:%d/%d", failed.numQueries(), truncated.numQueries())
+	}
+
+	r = newTestResolver(t, &ResolverConfig{Servers: []string{"tcp://" + closedAddr, doh.serveDoH(t)}})
+	if ips, err := r.LookupIP("example.com"); nil != err || len(ips) != 1 || doh.numQueries() != 2 {
+		t.Fatalf("Unexpected result:%v of DoH with err:%v", ips, err)
+	}
+
+	//all upstreams failed
+	r = newTestResolver(t, &ResolverConfig{Servers: []string{"tcp://" + closedAddr, failed.serve(t)}})
+	if _, err := r.LookupIP("example.com"); nil == err {
+		t.Fatalf("Expected error while all upstreams failed")
+	}
+	if _, err := NewResolver(&ResolverConfig{Servers: []string{"ftp://127.0.0.1"}}); nil == err {
+		t.Fatalf("Expected error of invalid upstream")
+	}
+}
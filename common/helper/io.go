@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -43,22 +44,33 @@ func IsTimeoutError(err error) bool {
 
 type TimeoutReadWriteCloser struct {
 	io.ReadWriteCloser
+	//deadlines may be set while reading/writing
+	deadlineMutex sync.Mutex
 	readDeadline  time.Time
 	writeDeadline time.Time
 }
 
 func (s *TimeoutReadWriteCloser) SetReadDeadline(t time.Time) error {
+	s.deadlineMutex.Lock()
 	s.readDeadline = t
+	s.deadlineMutex.Unlock()
 	return nil
 }
 func (s *TimeoutReadWriteCloser) SetWriteDeadline(t time.Time) error {
+	s.deadlineMutex.Lock()
 	s.writeDeadline = t
+	s.deadlineMutex.Unlock()
 	return nil
 }
+func (s *TimeoutReadWriteCloser) deadlines() (time.Time, time.Time) {
+	s.deadlineMutex.Lock()
+	defer s.deadlineMutex.Unlock()
+	return s.readDeadline, s.writeDeadline
+}
 func (s *TimeoutReadWriteCloser) Read(p []byte) (n int, err error) {
 	var timeout <-chan time.Time
-	if !s.readDeadline.IsZero() {
-		delay := s.readDeadline.Sub(time.Now())
+	if readDeadline, _ := s.deadlines(); !readDeadline.IsZero() {
+		delay := readDeadline.Sub(time.Now())
 		timeout = time.After(delay)
 	} else {
 		return s.ReadWriteCloser.Read(p)
@@ -78,8 +90,8 @@ func (s *TimeoutReadWriteCloser) Read(p []byte) (n int, err error) {
 
 func (s *TimeoutReadWriteCloser) Write(p []byte) (n int, err error) {
 	var timeout <-chan time.Time
-	if !s.writeDeadline.IsZero() {
-		delay := s.writeDeadline.Sub(time.Now())
+	if _, writeDeadline := s.deadlines(); !writeDeadline.IsZero() {
+		delay := writeDeadline.Sub(time.Now())
 		timeout = time.After(delay)
 	} else {
 		return s.ReadWriteCloser.Write(p)
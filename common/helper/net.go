@@ -3,14 +3,17 @@ package helper
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"math/big"
 	"net"
@@ -18,6 +21,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/yinqiwen/gsnova/common/logger"
@@ -231,51 +235,146 @@ func IsPrivateIP(ip string) bool {
 	return false
 }
 
+//HTTPProxyConnect send CONNECT request of addr to the http proxy on conn, proxy user of url is sent as basic auth.
+//The response is read without buffering, so that data sent by server first is not lost, eg: ssh banner.
 func HTTPProxyConnect(proxyURL *url.URL, c net.Conn, addr string) error {
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); nil == err {
+			addr = u.Host
+		}
+	}
 	connReq, err := http.NewRequest("CONNECT", "//"+addr, nil)
 	if err != nil {
 		return err
 	}
+	if nil != proxyURL.User {
+		passwd, _ := proxyURL.User.Password()
+		auth := proxyURL.User.Username() + ":" + passwd
+		connReq.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
 	err = connReq.Write(c)
 	if err != nil {
 		return err
 	}
-	connRes, err := http.ReadResponse(bufio.NewReader(c), connReq)
+	header, err := readHTTPHeader(c)
+	var connRes *http.Response
+	if nil == err {
+		connRes, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), connReq)
+	}
 	if err != nil {
 		var tmp bytes.Buffer
 		connReq.Write(&tmp)
-		logger.Error("CONNECT %v error with request %s", proxyURL, string(tmp.Bytes()))
+		logger.Error("CONNECT %v error with request %s", proxyURL.Host, string(tmp.Bytes()))
 		return err
 	}
-	if nil != connRes.Body {
-		connRes.Body.Close()
-	}
 	if connRes.StatusCode >= 300 {
-		return fmt.Errorf("Invalid Connect response:%d %v %v", connRes.StatusCode, connRes, connReq)
+		return fmt.Errorf("Invalid Connect response:%d from proxy:%s for %s", connRes.StatusCode, proxyURL.Host, addr)
 	}
 	return nil
 }
 
+const maxHTTPHeaderSize = 64 * 1024
+
+//readHTTPHeader read the http header until the empty line byte by byte
+func readHTTPHeader(c net.Conn) ([]byte, error) {
+	header := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) >= maxHTTPHeaderSize {
+			return nil, fmt.Errorf("Too large http header from %v", c.RemoteAddr())
+		}
+		if _, err := io.ReadFull(c, b); nil != err {
+			return nil, err
+		}
+		header = append(header, b[0])
+	}
+	return header, nil
+}
+
+//ProxyDial is like ProxyDialContext, while the dial is bounded by the timeout, timeout <= 0 means no timeout.
 func ProxyDial(proxyURL string, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return ProxyDialContext(ctx, proxyURL, addr)
+}
+
+//proxyHostPort return the address of proxy, with default port of the scheme if the url has no port.
+func proxyHostPort(u *url.URL) string {
+	if len(u.Port()) > 0 {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "http", "http_proxy":
+		return net.JoinHostPort(u.Hostname(), "80")
+	default:
+		return net.JoinHostPort(u.Hostname(), "1080")
+	}
+}
+
+//withConnContext run the handshake on conn, which is interrupted once the context done.
+func withConnContext(ctx context.Context, c net.Conn, handshake func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	err := handshake()
+	if nil == err {
+		err = ctx.Err()
+	}
+	return err
+}
+
+//ProxyDialContext connect addr via the proxy, the handshake with proxy is also bounded by the context.
+//Supported proxy schemes are http/https(HTTP CONNECT, with TLS to proxy for https) & socks/socks5/socks5h,
+//user info of proxy url is used to authenticate with proxy.
+func ProxyDialContext(ctx context.Context, proxyURL string, addr string) (net.Conn, error) {
 	u, err := url.Parse(proxyURL)
 	if nil != err {
 		return nil, err
 	}
-	c, err := netx.DialTimeout("tcp", u.Host, timeout)
-	if err != nil {
-		return nil, err
-	}
 	switch u.Scheme {
-	case "http":
-		fallthrough
-	case "https":
-		err = HTTPProxyConnect(u, c, addr)
-	case "socks":
-	case "socks5":
-		err = Socks5ProxyConnect(u, c, addr)
+	case "http", "http_proxy", "https", "socks", "socks5", "socks5h":
 	default:
 		return nil, fmt.Errorf("invalid proxy schema:%s", u.Scheme)
 	}
+	c, err := netx.DialContext(ctx, "tcp", proxyHostPort(u))
+	if err != nil {
+		return nil, err
+	}
+	err = withConnContext(ctx, c, func() error {
+		switch u.Scheme {
+		case "https":
+			tlsconn := tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+			if err := tlsconn.Handshake(); nil != err {
+				return err
+			}
+			c = tlsconn
+			fallthrough
+		case "http", "http_proxy":
+			return HTTPProxyConnect(u, c, addr)
+		default:
+			return Socks5ProxyConnect(u, c, addr)
+		}
+	})
 	if nil != err {
 		c.Close()
 		return nil, err
@@ -290,7 +389,10 @@ const (
 	socks5AuthPassword = 2
 )
 
-const socks5Connect = 1
+const (
+	socks5Connect      = 1
+	socks5UDPAssociate = 3
+)
 
 const (
 	socks5IP4    = 1
@@ -311,20 +413,17 @@ var socks5Errors = []string{
 }
 
 func Socks5ProxyConnect(proxyURL *url.URL, conn net.Conn, addr string) error {
-	host, portStr, err := net.SplitHostPort(addr)
-	if err != nil {
+	if err := socks5Greeting(proxyURL, conn, addr); nil != err {
 		return err
 	}
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return errors.New("proxy: failed to parse port number: " + portStr)
-	}
-	if port < 1 || port > 0xffff {
-		return errors.New("proxy: port number out of range: " + portStr)
-	}
+	_, err := socks5Request(conn, socks5Connect, addr)
+	return err
+}
 
+//socks5Greeting negotiate auth method with the SOCKS5 proxy, user/password of proxy url is used if set.
+func socks5Greeting(proxyURL *url.URL, conn net.Conn, addr string) error {
 	// the size here is just an estimate
-	buf := make([]byte, 0, 6+len(host))
+	buf := make([]byte, 0, 3)
 
 	buf = append(buf, socks5Version)
 	if nil != proxyURL.User && len(proxyURL.User.Username()) > 0 && len(proxyURL.User.Username()) < 256 {
@@ -348,6 +447,9 @@ func Socks5ProxyConnect(proxyURL *url.URL, conn net.Conn, addr string) error {
 	}
 
 	if buf[1] == socks5AuthPassword {
+		if nil == proxyURL.User {
+			return errors.New("proxy: SOCKS5 proxy at " + addr + " requires username/password")
+		}
 		buf = buf[:0]
 		passwd, _ := proxyURL.User.Password()
 		buf = append(buf, 1 /* password protocol version */)
@@ -368,10 +470,22 @@ func Socks5ProxyConnect(proxyURL *url.URL, conn net.Conn, addr string) error {
 			return errors.New("proxy: SOCKS5 proxy at " + addr + " rejected username/password")
 		}
 	}
+	return nil
+}
 
-	buf = buf[:0]
-	buf = append(buf, socks5Version, socks5Connect, 0 /* reserved */)
-
+//appendSocks5Addr append the ATYP/DST.ADDR/DST.PORT of addr to buf
+func appendSocks5Addr(buf []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, errors.New("proxy: failed to parse port number: " + portStr)
+	}
+	if port < 0 || port > 0xffff {
+		return nil, errors.New("proxy: port number out of range: " + portStr)
+	}
 	if ip := net.ParseIP(host); ip != nil {
 		if ip4 := ip.To4(); ip4 != nil {
 			buf = append(buf, socks5IP4)
@@ -382,20 +496,30 @@ func Socks5ProxyConnect(proxyURL *url.URL, conn net.Conn, addr string) error {
 		buf = append(buf, ip...)
 	} else {
 		if len(host) > 255 {
-			return errors.New("proxy: destination hostname too long: " + host)
+			return nil, errors.New("proxy: destination hostname too long: " + host)
 		}
 		buf = append(buf, socks5Domain)
 		buf = append(buf, byte(len(host)))
 		buf = append(buf, host...)
 	}
-	buf = append(buf, byte(port>>8), byte(port))
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+//socks5Request send the request of cmd to the SOCKS5 proxy and return the bound address of reply
+func socks5Request(conn net.Conn, cmd byte, addr string) (string, error) {
+	buf := make([]byte, 0, 6+len(addr))
+	buf = append(buf, socks5Version, cmd, 0 /* reserved */)
+	buf, err := appendSocks5Addr(buf, addr)
+	if nil != err {
+		return "", err
+	}
 
 	if _, err := conn.Write(buf); err != nil {
-		return errors.New("proxy: failed to write connect request to SOCKS5 proxy at " + addr + ": " + err.Error())
+		return "", errors.New("proxy: failed to write connect request to SOCKS5 proxy at " + addr + ": " + err.Error())
 	}
 
 	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
-		return errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " + addr + ": " + err.Error())
+		return "", errors.New("proxy: failed to read connect reply from SOCKS5 proxy at " + addr + ": " + err.Error())
 	}
 
 	failure := "unknown error"
@@ -404,39 +528,37 @@ func Socks5ProxyConnect(proxyURL *url.URL, conn net.Conn, addr string) error {
 	}
 
 	if len(failure) > 0 {
-		return errors.New("proxy: SOCKS5 proxy at " + addr + " failed to connect: " + failure)
+		return "", errors.New("proxy: SOCKS5 proxy at " + addr + " failed to connect: " + failure)
 	}
 
-	bytesToDiscard := 0
+	bytesToRead := 0
 	switch buf[3] {
 	case socks5IP4:
-		bytesToDiscard = net.IPv4len
+		bytesToRead = net.IPv4len
 	case socks5IP6:
-		bytesToDiscard = net.IPv6len
+		bytesToRead = net.IPv6len
 	case socks5Domain:
 		_, err := io.ReadFull(conn, buf[:1])
 		if err != nil {
-			return errors.New("proxy: failed to read domain length from SOCKS5 proxy at " + addr + ": " + err.Error())
+			return "", errors.New("proxy: failed to read domain length from SOCKS5 proxy at " + addr + ": " + err.Error())
 		}
-		bytesToDiscard = int(buf[0])
+		bytesToRead = int(buf[0])
 	default:
-		return errors.New("proxy: got unknown address type " + strconv.Itoa(int(buf[3])) + " from SOCKS5 proxy at " + addr)
+		return "", errors.New("proxy: got unknown address type " + strconv.Itoa(int(buf[3])) + " from SOCKS5 proxy at " + addr)
 	}
+	atyp := buf[3]
 
-	if cap(buf) < bytesToDiscard {
-		buf = make([]byte, bytesToDiscard)
-	} else {
-		buf = buf[:bytesToDiscard]
-	}
+	// with the port number
+	buf = make([]byte, bytesToRead+2)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return errors.New("proxy: failed to read address from SOCKS5 proxy at " + addr + ": " + err.Error())
+		return "", errors.New("proxy: failed to read address from SOCKS5 proxy at " + addr + ": " + err.Error())
 	}
-
-	// Also need to discard the port number
-	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
-		return errors.New("proxy: failed to read port from SOCKS5 proxy at " + addr + ": " + err.Error())
+	host := string(buf[:bytesToRead])
+	if atyp != socks5Domain {
+		host = net.IP(buf[:bytesToRead]).String()
 	}
-	return nil
+	port := int(buf[bytesToRead])<<8 | int(buf[bytesToRead+1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
 
 func Socks5ProxyDial(proxyURL string, addr string, timeout time.Duration) (net.Conn, error) {
@@ -456,7 +578,153 @@ func Socks5ProxyDial(proxyURL string, addr string, timeout time.Duration) (net.C
 	return c, nil
 }
 
+//socks5PacketConn is the packet conn relayed by SOCKS5 proxy via UDP ASSOCIATE, the association is kept
+//by the control conn, and the packet conn is closed once the control conn closed by proxy.
+type socks5PacketConn struct {
+	net.PacketConn
+	ctrl      net.Conn
+	relay     *net.UDPAddr
+	readMutex sync.Mutex
+	readBuf   []byte
+	closeOnce sync.Once
+}
+
+func (c *socks5PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	for {
+		n, from, err := c.PacketConn.ReadFrom(c.readBuf)
+		if nil != err {
+			return 0, nil, err
+		}
+		if udpAddr, ok := from.(*net.UDPAddr); !ok || !udpAddr.IP.Equal(c.relay.IP) || udpAddr.Port != c.relay.Port {
+			continue
+		}
+		//RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT(2), fragments are not supported
+		data := c.readBuf[:n]
+		if len(data) < 4 || data[2] != 0 {
+			continue
+		}
+		var addr *net.UDPAddr
+		switch data[3] {
+		case socks5IP4:
+			if len(data) < 4+net.IPv4len+2 {
+				continue
+			}
+			addr = &net.UDPAddr{IP: net.IP(append([]byte{}, data[4:4+net.IPv4len]...))}
+			data = data[4+net.IPv4len:]
+		case socks5IP6:
+			if len(data) < 4+net.IPv6len+2 {
+				continue
+			}
+			addr = &net.UDPAddr{IP: net.IP(append([]byte{}, data[4:4+net.IPv6len]...))}
+			data = data[4+net.IPv6len:]
+		case socks5Domain:
+			if len(data) < 5 || len(data) < 5+int(data[4])+2 {
+				continue
+			}
+			addr = &net.UDPAddr{}
+			if ipAddr, err := net.ResolveIPAddr("ip", string(data[5:5+int(data[4])])); nil == err {
+				addr.IP = ipAddr.IP
+			}
+			data = data[5+int(data[4]):]
+		default:
+			continue
+		}
+		addr.Port = int(data[0])<<8 | int(data[1])
+		return copy(p, data[2:]), addr, nil
+	}
+}
+
+func (c *socks5PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	buf, err := appendSocks5Addr(make([]byte, 3, 3+1+net.IPv6len+2+len(p)), addr.String())
+	if nil != err {
+		return 0, err
+	}
+	buf = append(buf, p...)
+	if _, err = c.PacketConn.WriteTo(buf, c.relay); nil != err {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socks5PacketConn) SetReadBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return nc.SetReadBuffer(bytes)
+	}
+	return nil
+}
+
+func (c *socks5PacketConn) SetWriteBuffer(bytes int) error {
+	if nc, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return nc.SetWriteBuffer(bytes)
+	}
+	return nil
+}
+
+func (c *socks5PacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.ctrl.Close()
+		err = c.PacketConn.Close()
+	})
+	return err
+}
+
+//Socks5UDPAssociate create a packet conn whose packets are relayed by the SOCKS5 proxy via UDP ASSOCIATE,
+//the handshake with proxy is bounded by the context.
+func Socks5UDPAssociate(ctx context.Context, proxyURL *url.URL) (net.PacketConn, error) {
+	switch proxyURL.Scheme {
+	case "socks", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("UDP ASSOCIATE is not supported by proxy schema:%s", proxyURL.Scheme)
+	}
+	c, err := netx.DialContext(ctx, "tcp", proxyHostPort(proxyURL))
+	if err != nil {
+		return nil, err
+	}
+	var bound string
+	err = withConnContext(ctx, c, func() error {
+		if err := socks5Greeting(proxyURL, c, proxyURL.Host); nil != err {
+			return err
+		}
+		var err error
+		bound, err = socks5Request(c, socks5UDPAssociate, "0.0.0.0:0")
+		return err
+	})
+	var relay *net.UDPAddr
+	if nil == err {
+		relay, err = net.ResolveUDPAddr("udp", bound)
+	}
+	if nil != err {
+		c.Close()
+		return nil, err
+	}
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok && relay.IP.IsUnspecified() {
+		//relay on the same host of proxy
+		relay.IP = tcpAddr.IP
+	}
+	udpConn, err := netx.ListenUDP("udp", &net.UDPAddr{})
+	if nil != err {
+		c.Close()
+		return nil, err
+	}
+	pc := &socks5PacketConn{
+		PacketConn: udpConn,
+		ctrl:       c,
+		relay:      relay,
+		readBuf:    make([]byte, 65536),
+	}
+	go func() {
+		io.Copy(ioutil.Discard, c)
+		logger.Debug("UDP association with SOCKS5 proxy:%s closed.", proxyURL.Host)
+		pc.Close()
+	}()
+	return pc, nil
+}
+
 var localIPSet = make(map[string]bool)
+var localIPSetOnce sync.Once
 var localIPv4 []string
 
 func GetLocalIPv4() []string {
@@ -477,20 +745,20 @@ func GetLocalIPv4() []string {
 	}
 	return localIPv4
 }
+//GetLocalIPSet return ips of local interfaces, it's safe to be called by listeners of multiple clients.
 func GetLocalIPSet() map[string]bool {
-	if len(localIPSet) > 0 {
-		return localIPSet
-	}
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		logger.Error("[ERROR]Failed to get local ip:%v", err)
-		return localIPSet
-	}
-	for _, a := range addrs {
-		if ipnet, ok := a.(*net.IPNet); ok {
-			localIPSet[ipnet.IP.String()] = true
+	localIPSetOnce.Do(func() {
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			logger.Error("[ERROR]Failed to get local ip:%v", err)
+			return
 		}
-	}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				localIPSet[ipnet.IP.String()] = true
+			}
+		}
+	})
 	return localIPSet
 }
 
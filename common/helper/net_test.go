@@ -0,0 +1,222 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenTCP(t *testing.T, serve func(c net.Conn)) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return l
+}
+
+//the fake http proxy accept CONNECT requests authenticated as gsnova:secret, & send the banner with the response
+func serveHTTPProxy(t *testing.T, c net.Conn) {
+	defer c.Close()
+	req, err := http.ReadRequest(bufio.NewReader(c))
+	if nil != err {
+		t.Error(err)
+		return
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("gsnova:secret"))
+	if req.Method != "CONNECT" || req.Host != "example.com:22" {
+		c.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return
+	}
+	if req.Header.Get("Proxy-Authorization") != expected {
+		c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n"))
+		return
+	}
+	c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-test\r\n"))
+	io.Copy(c, c)
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	l := listenTCP(t, func(c net.Conn) { serveHTTPProxy(t, c) })
+	defer l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, err := ProxyDialContext(ctx, "http://gsnova:secret@"+l.Addr().String(), "example.com:22")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//data sent with the response is not consumed by the CONNECT handshake
+	banner := make([]byte, len("SSH-2.0-test\r\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(c, banner); nil != err || string(banner) != "SSH-2.0-test\r\n" {
+		t.Fatalf("Unexpected banner:%q with err:%v", banner, err)
+	}
+
+	for _, proxy := range []string{"http://gsnova:invalid@", "http://"} {
+		if _, err = ProxyDialContext(ctx, proxy+l.Addr().String(), "example.com:22"); nil == err || !strings.Contains(err.Error(), "407") {
+			t.Fatalf("Expected error of 407 response via %s, but got:%v", proxy, err)
+		}
+	}
+	if _, err = ProxyDialContext(ctx, "ftp://"+l.Addr().String(), "example.com:22"); nil == err {
+		t.Fatalf("Expected error of invalid proxy schema")
+	}
+	//zero timeout means no timeout
+	c, err = ProxyDial("http://gsnova:secret@"+l.Addr().String(), "example.com:22", 0)
+	if nil != err {
+		t.Fatalf("Failed to dial without timeout:%v", err)
+	}
+	c.Close()
+}
+
+func TestReadHTTPHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	header := "HTTP/1.1 200 OK\r\nServer: test\r\n\r\n"
+	go server.Write([]byte(header + "body"))
+	b, err := readHTTPHeader(client)
+	if nil != err || string(b) != header {
+		t.Fatalf("Unexpected header:%q with err:%v", b, err)
+	}
+	body := make([]byte, 4)
+	if _, err = io.ReadFull(client, body); nil != err || string(body) != "body" {
+		t.Fatalf("Unexpected body:%q with err:%v", body, err)
+	}
+
+	go func() {
+		server.Write([]byte("HTTP/1.1 200 OK\r\n"))
+		server.Write(bytes.Repeat([]byte("X-Padding: test\r\n"), maxHTTPHeaderSize/16))
+	}()
+	if _, err = readHTTPHeader(client); nil == err || !strings.Contains(err.Error(), "Too large") {
+		t.Fatalf("Expected error of too large header, but got:%v", err)
+	}
+	server.Close()
+	if _, err = readHTTPHeader(client); nil == err {
+		t.Fatalf("Expected error of closed conn")
+	}
+}
+
+//serveSocks5Associate answer the UDP ASSOCIATE request authenticated as gsnova:secret with the bound port of relay,
+//and keep the association until the control conn closed.
+func serveSocks5Associate(t *testing.T, c net.Conn, relay *net.UDPAddr, ctrls chan net.Conn) {
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(c, buf[:2]); nil != err || buf[0] != socks5Version {
+		t.Errorf("Unexpected greeting:%v with err:%v", buf[:2], err)
+		c.Close()
+		return
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	io.ReadFull(c, methods)
+	if !bytes.Contains(methods, []byte{socks5AuthPassword}) {
+		c.Write([]byte{socks5Version, 0xff})
+		c.Close()
+		return
+	}
+	c.Write([]byte{socks5Version, socks5AuthPassword})
+	//VER(1) ULEN(1) UNAME PLEN(1) PASSWD
+	io.ReadFull(c, buf[:2])
+	user := make([]byte, buf[1])
+	io.ReadFull(c, user)
+	io.ReadFull(c, buf[:1])
+	passwd := make([]byte, buf[0])
+	io.ReadFull(c, passwd)
+	if string(user) != "gsnova" || string(passwd) != "secret" {
+		c.Write([]byte{1, 1})
+		c.Close()
+		return
+	}
+	c.Write([]byte{1, 0})
+	//VER(1) CMD(1) RSV(1) ATYP(1) 0.0.0.0 PORT(2)
+	if _, err := io.ReadFull(c, buf[:10]); nil != err || buf[1] != socks5UDPAssociate || buf[3] != socks5IP4 {
+		t.Errorf("Unexpected request:%v with err:%v", buf[:10], err)
+		c.Close()
+		return
+	}
+	//the relay is bound to unspecified address, which is on the same host of proxy
+	c.Write([]byte{socks5Version, 0, 0, socks5IP4, 0, 0, 0, 0, byte(relay.Port >> 8), byte(relay.Port)})
+	ctrls <- c
+}
+
+func TestSocks5UDPAssociate(t *testing.T) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	ctrls := make(chan net.Conn, 1)
+	l := listenTCP(t, func(c net.Conn) { serveSocks5Associate(t, c, relay.LocalAddr().(*net.UDPAddr), ctrls) })
+	defer l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxyURL, _ := url.Parse("socks5://gsnova:invalid@" + l.Addr().String())
+	if _, err = Socks5UDPAssociate(ctx, proxyURL); nil == err {
+		t.Fatalf("Expected error of rejected password")
+	}
+	proxyURL, _ = url.Parse("http://" + l.Addr().String())
+	if _, err = Socks5UDPAssociate(ctx, proxyURL); nil == err {
+		t.Fatalf("Expected error of http proxy")
+	}
+	proxyURL, _ = url.Parse("socks5://gsnova:secret@" + l.Addr().String())
+	pc, err := Socks5UDPAssociate(ctx, proxyURL)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ctrl := <-ctrls
+
+	//RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT(2) DATA
+	if _, err = pc.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 53}); nil != err {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	relay.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, client, err := relay.ReadFrom(buf)
+	if expected := []byte{0, 0, 0, socks5IP4, 1, 2, 3, 4, 0, 53, 'h', 'e', 'l', 'l', 'o'}; nil != err || !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("Unexpected relayed packet:%v with err:%v", buf[:n], err)
+	}
+
+	//packets not from relay & fragments are dropped
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	stranger.WriteTo([]byte{0, 0, 0, socks5IP4, 9, 9, 9, 9, 0, 80, 'x'}, client)
+	relay.WriteTo([]byte{0, 0, 1, socks5IP4, 9, 9, 9, 9, 0, 80, 'x'}, client)
+	relay.WriteTo([]byte{0, 0, 0, socks5IP4, 5, 6, 7, 8, 0, 80, 'w', 'o', 'r', 'l', 'd'}, client)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if nil != err || string(buf[:n]) != "world" || from.String() != "5.6.7.8:80" {
+		t.Fatalf("Unexpected packet:%q from %v with err:%v", buf[:n], from, err)
+	}
+	relay.WriteTo([]byte{0, 0, 0, socks5Domain, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0x01, 0xbb, 'd', 'n', 's'}, client)
+	n, from, err = pc.ReadFrom(buf)
+	if nil != err || string(buf[:n]) != "dns" || from.(*net.UDPAddr).Port != 443 {
+		t.Fatalf("Unexpected packet:%q from %v with err:%v", buf[:n], from, err)
+	}
+
+	//the packet conn is closed once the association closed by proxy
+	ctrl.Close()
+	if _, _, err = pc.ReadFrom(buf); nil == err || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Expected error of closed association, but got:%v", err)
+	}
+}
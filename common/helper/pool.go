@@ -0,0 +1,99 @@
+package helper
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+//RelayBufferSize is the size of pooled buffers used by relaying
+const RelayBufferSize = 32 * 1024
+
+var (
+	relayBufferAllocated int64
+	relayBufferInUse     int64
+	splicedRelays        int64
+)
+
+var relayBufferPool = sync.Pool{
+	New: func() interface{} {
+		atomic.AddInt64(&relayBufferAllocated, 1)
+		return make([]byte, RelayBufferSize)
+	},
+}
+
+//GetRelayBuffer get a buffer from pool, it should be returned by PutRelayBuffer
+func GetRelayBuffer() []byte {
+	atomic.AddInt64(&relayBufferInUse, 1)
+	return relayBufferPool.Get().([]byte)
+}
+
+//PutRelayBuffer return the buffer to pool
+func PutRelayBuffer(buf []byte) {
+	if cap(buf) != RelayBufferSize {
+		return
+	}
+	atomic.AddInt64(&relayBufferInUse, -1)
+	relayBufferPool.Put(buf[0:RelayBufferSize])
+}
+
+//SpliceConn is implemented by conns/streams which read & write an underlying tcp conn directly,
+//they would be bypassed while relaying if the other side is also a tcp conn.
+type SpliceConn interface {
+	SpliceConn() *net.TCPConn
+}
+
+//SpliceNotifier is notified before relaying bypass it
+type SpliceNotifier interface {
+	OnSplice()
+}
+
+func spliceTCPConn(v interface{}) *net.TCPConn {
+	switch c := v.(type) {
+	case *net.TCPConn:
+		return c
+	case SpliceConn:
+		return c.SpliceConn()
+	}
+	return nil
+}
+
+//hide ReadFrom/WriteTo to make sure io.CopyBuffer use the given buffer
+type writerOnly struct {
+	io.Writer
+}
+type readerOnly struct {
+	io.Reader
+}
+
+//Relay copy src to dst until EOF or error. It use the zero copy path(splice on linux) if both sides are
+//tcp conns, otherwise a pooled buffer.
+func Relay(dst io.Writer, src io.Reader) (int64, error) {
+	if dstConn, srcConn := spliceTCPConn(dst), spliceTCPConn(src); spliceSupported && nil != dstConn && nil != srcConn {
+		for _, v := range []interface{}{dst, src} {
+			if notifier, ok := v.(SpliceNotifier); ok {
+				notifier.OnSplice()
+			}
+		}
+		atomic.AddInt64(&splicedRelays, 1)
+		defer atomic.AddInt64(&splicedRelays, -1)
+		return dstConn.ReadFrom(srcConn)
+	}
+	buf := GetRelayBuffer()
+	defer PutRelayBuffer(buf)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf)
+}
+
+//DumpRelayStat dump buffer pool stat, streams is the running stream number to compute memory per stream
+func DumpRelayStat(w io.Writer, streams int64) {
+	inUse := atomic.LoadInt64(&relayBufferInUse)
+	fmt.Fprintf(w, "RelayBufferAllocated: %d\n", atomic.LoadInt64(&relayBufferAllocated))
+	fmt.Fprintf(w, "RelayBufferInUse: %d\n", inUse)
+	fmt.Fprintf(w, "RelayBufferBytesInUse: %d\n", inUse*RelayBufferSize)
+	fmt.Fprintf(w, "SplicedRelayNum: %d\n", atomic.LoadInt64(&splicedRelays))
+	if streams > 0 {
+		fmt.Fprintf(w, "RelayBufferBytesPerStream: %d\n", inUse*RelayBufferSize/streams)
+	}
+}
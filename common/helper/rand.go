@@ -9,8 +9,9 @@ func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
+//RandBetween return a random int in [min, max), the seed is never reset here since random strings like session ids
+//generated in the same second would be the same.
 func RandBetween(min, max int) int {
-	rand.Seed(time.Now().Unix())
 	return rand.Intn(max-min) + min
 }
 
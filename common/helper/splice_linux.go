@@ -0,0 +1,33 @@
+package helper
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+//tcp conns are relayed by splice in kernel
+const spliceSupported = true
+
+//TCPLatestIOTime return the time of latest data sent or received on the tcp conn by TCP_INFO,
+//which is still updated while data is spliced by the kernel.
+func TCPLatestIOTime(c *net.TCPConn) (time.Time, bool) {
+	rc, err := c.SyscallConn()
+	if nil != err {
+		return time.Time{}, false
+	}
+	var info *unix.TCPInfo
+	var infoErr error
+	err = rc.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if nil != err || nil != infoErr {
+		return time.Time{}, false
+	}
+	idle := info.Last_data_recv
+	if info.Last_data_sent < idle {
+		idle = info.Last_data_sent
+	}
+	return time.Now().Add(-time.Duration(idle) * time.Millisecond), true
+}
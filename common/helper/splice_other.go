@@ -0,0 +1,16 @@
+// +build !linux
+
+package helper
+
+import (
+	"net"
+	"time"
+)
+
+//there is no zero copy path between tcp conns, they are relayed with pooled buffer
+const spliceSupported = false
+
+//TCPLatestIOTime is only supported on linux
+func TCPLatestIOTime(c *net.TCPConn) (time.Time, bool) {
+	return time.Time{}, false
+}
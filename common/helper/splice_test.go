@@ -0,0 +1,47 @@
+package helper
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestTCPLatestIOTime(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO is only supported on linux")
+	}
+	lp, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer lp.Close()
+	go func() {
+		conn, err := lp.Accept()
+		if nil != err {
+			return
+		}
+		io.Copy(conn, conn)
+	}()
+	c, err := net.Dial("tcp", lp.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := c.(*net.TCPConn)
+	echo := func() {
+		conn.Write([]byte("ping"))
+		io.ReadFull(conn, make([]byte, 4))
+	}
+	echo()
+	time.Sleep(300 * time.Millisecond)
+	latest, ok := TCPLatestIOTime(conn)
+	if !ok || time.Since(latest) < 250*time.Millisecond {
+		t.Fatalf("Unexpected latest io time:%v of idle conn", time.Since(latest))
+	}
+	echo()
+	if latest, _ = TCPLatestIOTime(conn); time.Since(latest) > 100*time.Millisecond {
+		t.Fatalf("Unexpected latest io time:%v of active conn", time.Since(latest))
+	}
+}
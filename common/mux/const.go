@@ -1,6 +1,10 @@
 package mux
 
-import "errors"
+import (
+	"errors"
+	"strings"
+	"time"
+)
 
 const (
 	DefaultMuxCipherMethod         = "chacha20poly1305"
@@ -12,10 +16,54 @@ const (
 	HTTPMuxSessionIDHeader    = "X-Session-ID"
 	HTTPMuxSessionACKIDHeader = "X-Session-ACK-ID"
 	HTTPMuxPullPeriodHeader   = "X-PullPeriod"
+
+	//PingNetwork is used in connect request to probe round trip time on stream based session
+	PingNetwork        = "ping"
+	DefaultPingTimeout = 5 * time.Second
+
+	//stream priority classes, which are the index of weights in session writer
+	PriorityNormal      = 0
+	PriorityBulk        = 1
+	PriorityInteractive = 2
 )
 
+var priorityNames = []string{"normal", "bulk", "interactive"}
+
+//DefaultPriorityWeights is the weights of normal/bulk/interactive streams
+var DefaultPriorityWeights = []int{4, 1, 16}
+
+//ParsePriority returns the priority class by name, unknown name is treated as normal.
+func ParsePriority(name string) int {
+	for class, n := range priorityNames {
+		if strings.EqualFold(n, name) {
+			return class
+		}
+	}
+	return PriorityNormal
+}
+
+//NormalizePriority treat invalid priority class as normal
+func NormalizePriority(class int) int {
+	if class < 0 || class >= len(priorityNames) {
+		return PriorityNormal
+	}
+	return class
+}
+
+func PriorityName(class int) string {
+	return priorityNames[NormalizePriority(class)]
+}
+
+func PriorityClasses() int {
+	return len(priorityNames)
+}
+
 var (
 	ErrToolargeMessage = errors.New("too large message length")
 	ErrAuthFailed      = errors.New("auth failed")
 	ErrDataReadMissing = errors.New("auth failed")
+	ErrPingTimeout     = errors.New("ping timeout")
+
+	ErrHalfCloseUnsupported = errors.New("half close unsupported")
+	ErrRelaySwitchStream    = errors.New("relay switch stream")
 )
@@ -13,7 +13,7 @@ import (
 
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 	"golang.org/x/net/http2"
 )
 
@@ -48,30 +48,41 @@ type http2ClientMuxStream struct {
 	r         io.ReadCloser
 	readReady chan struct{}
 	closed    bool
+	lock      sync.Mutex
 }
 
 func (s *http2ClientMuxStream) setReader(rr io.ReadCloser) {
+	s.lock.Lock()
 	s.r = rr
+	s.lock.Unlock()
 	helper.AsyncNotify(s.readReady)
 }
 
+func (s *http2ClientMuxStream) reader() (io.ReadCloser, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.r, s.closed
+}
+
 func (s *http2ClientMuxStream) Read(b []byte) (n int, err error) {
-	for s.r == nil && !s.closed {
+	r, closed := s.reader()
+	for r == nil && !closed {
 		select {
 		case <-s.readReady:
 		case <-time.After(30 * time.Second):
 			return 0, pmux.ErrTimeout
 		}
+		r, closed = s.reader()
 	}
-	if s.closed {
+	if closed {
 		return 0, io.EOF
 	}
-	n, err = s.r.Read(b)
+	n, err = r.Read(b)
 	return
 }
 
 func (s *http2ClientMuxStream) Write(b []byte) (n int, err error) {
-	if s.closed {
+	if _, closed := s.reader(); closed {
 		return 0, io.EOF
 	}
 	n, err = s.w.Write(b)
@@ -79,10 +90,13 @@ func (s *http2ClientMuxStream) Write(b []byte) (n int, err error) {
 }
 
 func (s *http2ClientMuxStream) Close() (err error) {
+	s.lock.Lock()
 	s.closed = true
+	r := s.r
+	s.lock.Unlock()
 	s.w.Close()
-	if nil != s.r {
-		s.r.Close()
+	if nil != r {
+		r.Close()
 	}
 	helper.AsyncNotify(s.readReady)
 	return nil
@@ -99,6 +113,7 @@ type HTTP2MuxSession struct {
 	AcceptCh chan MuxStream
 	closeCh  chan struct{}
 	streams  sync.Map
+	closed   int32
 }
 
 func (q *HTTP2MuxSession) CloseStream(stream MuxStream) error {
@@ -121,14 +136,19 @@ func (q *HTTP2MuxSession) OfferStream(stream TimeoutReadWriteCloser) error {
 func (q *HTTP2MuxSession) Ping() (time.Duration, error) {
 	start := time.Now()
 	if nil != q.h2Conn {
-		q.h2Conn.Ping(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultPingTimeout)
+		defer cancel()
+		err := q.h2Conn.Ping(ctx)
+		if nil != err {
+			return 0, err
+		}
 		return time.Now().Sub(start), nil
 	}
 	return 0, nil
 }
 
 func (q *HTTP2MuxSession) OpenStream() (MuxStream, error) {
-	if nil == q.Conn {
+	if nil == q.Conn || atomic.LoadInt32(&q.closed) > 0 {
 		return nil, pmux.ErrSessionShutdown
 	}
 	pr, pw := io.Pipe()
@@ -180,10 +200,12 @@ func (q *HTTP2MuxSession) NumStreams() int {
 }
 
 func (q *HTTP2MuxSession) Close() error {
+	if !atomic.CompareAndSwapInt32(&q.closed, 0, 1) {
+		return nil
+	}
 	helper.AsyncNotify(q.closeCh)
 	if nil != q.Conn {
 		q.Conn.Close()
-		q.Conn = nil
 	}
 	q.streams.Range(func(key, value interface{}) bool {
 		stream := key.(MuxStream)
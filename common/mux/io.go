@@ -1,20 +1,282 @@
 package mux
 
 import (
+	"compress/flate"
 	"io"
+	"strings"
+	"sync/atomic"
 
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/yinqiwen/gsnova/common/logger"
 )
 
 const (
-	SnappyCompressor = "snappy"
-	NoneCompressor   = "none"
+	SnappyCompressor  = "snappy"
+	NoneCompressor    = "none"
+	ZstdCompressor    = "zstd"
+	LZ4Compressor     = "lz4"
+	DeflateCompressor = "deflate"
+
+	//AdaptiveCompressorPrefix enable sampling for compressor, eg:"adaptive:zstd"
+	AdaptiveCompressorPrefix = "adaptive:"
+
+	adaptiveSampleSize   = 4096
+	adaptiveMinSaveRatio = 0.1
+
+	adaptiveFlagRaw        = byte(0)
+	adaptiveFlagCompressed = byte(1)
 )
 
-func GetCompressStreamReaderWriter(stream MuxStream, method string) (io.Reader, io.Writer) {
+//CompressStat counts raw & wire bytes which passed compressor
+type CompressStat struct {
+	rawBytes       int64
+	wireBytes      int64
+	bypassedStream int64
+}
+
+func (s *CompressStat) addRaw(n int) {
+	if nil != s && n > 0 {
+		atomic.AddInt64(&s.rawBytes, int64(n))
+	}
+}
+func (s *CompressStat) addWire(n int) {
+	if nil != s && n > 0 {
+		atomic.AddInt64(&s.wireBytes, int64(n))
+	}
+}
+
+func (s *CompressStat) RawBytes() int64 {
+	return atomic.LoadInt64(&s.rawBytes)
+}
+func (s *CompressStat) WireBytes() int64 {
+	return atomic.LoadInt64(&s.wireBytes)
+}
+func (s *CompressStat) SavedBytes() int64 {
+	return s.RawBytes() - s.WireBytes()
+}
+func (s *CompressStat) BypassedStreams() int64 {
+	return atomic.LoadInt64(&s.bypassedStream)
+}
+
+type countReader struct {
+	io.Reader
+	count func(int)
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count(n)
+	return n, err
+}
+
+type countWriter struct {
+	io.Writer
+	count func(int)
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count(n)
+	return n, err
+}
+
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter flush compressed data after every write, since mux streams are interactive.
+type compressWriter struct {
+	w    flushWriter
+	stat *CompressStat
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if nil == err {
+		err = c.w.Flush()
+	}
+	c.stat.addRaw(n)
+	return n, err
+}
+
+func (c *compressWriter) Close() error {
+	return c.w.Close()
+}
+
+type compressReader struct {
+	r     io.Reader
+	close func()
+	stat  *CompressStat
+}
+
+func (c *compressReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.stat.addRaw(n)
+	return n, err
+}
+
+func (c *compressReader) Close() error {
+	if nil != c.close {
+		c.close()
+	}
+	return nil
+}
+
+func newCompressReader(r io.Reader, method string, stat *CompressStat) io.Reader {
+	if nil != stat {
+		r = &countReader{Reader: r, count: stat.addWire}
+	}
+	switch method {
+	case SnappyCompressor:
+		return &compressReader{r: snappy.NewReader(r), stat: stat}
+	case LZ4Compressor:
+		return &compressReader{r: lz4.NewReader(r), stat: stat}
+	case DeflateCompressor:
+		fr := flate.NewReader(r)
+		return &compressReader{r: fr, stat: stat, close: func() { fr.Close() }}
+	case ZstdCompressor:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderLowmem(true), zstd.WithDecoderConcurrency(1))
+		if nil != err {
+			logger.Error("Failed to create zstd reader:%v", err)
+			return r
+		}
+		return &compressReader{r: zr, stat: stat, close: zr.Close}
+	}
+	return r
+}
+
+func newCompressWriter(w io.Writer, method string, stat *CompressStat) io.Writer {
+	if nil != stat {
+		w = &countWriter{Writer: w, count: stat.addWire}
+	}
 	switch method {
 	case SnappyCompressor:
-		return snappy.NewReader(stream), snappy.NewWriter(stream)
+		return &compressWriter{w: snappy.NewWriter(w), stat: stat}
+	case LZ4Compressor:
+		lw := lz4.NewWriter(w)
+		lw.Header.BlockMaxSize = 64 * 1024
+		return &compressWriter{w: lw, stat: stat}
+	case DeflateCompressor:
+		fw, _ := flate.NewWriter(w, flate.BestSpeed)
+		return &compressWriter{w: fw, stat: stat}
+	case ZstdCompressor:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		if nil != err {
+			logger.Error("Failed to create zstd writer:%v", err)
+			return w
+		}
+		return &compressWriter{w: zw, stat: stat}
+	}
+	return w
+}
+
+//IsTLSRecordHeader check if the data starts with a TLS record header which is not compressable.
+func IsTLSRecordHeader(p []byte) bool {
+	if len(p) < 3 {
+		return false
+	}
+	//ChangeCipherSpec/Alert/Handshake/ApplicationData with SSL3.0~TLS1.3 version
+	return p[0] >= 0x14 && p[0] <= 0x17 && p[1] == 3 && p[2] <= 4
+}
+
+func isCompressable(p []byte) bool {
+	if IsTLSRecordHeader(p) {
+		return false
+	}
+	sample := p
+	if len(sample) > adaptiveSampleSize {
+		sample = sample[0:adaptiveSampleSize]
+	}
+	encoded := snappy.Encode(nil, sample)
+	return float64(len(encoded)) < float64(len(sample))*(1-adaptiveMinSaveRatio)
+}
+
+// adaptiveWriter sample the first written bytes to decide whether to compress the stream,
+// a one byte flag is written ahead to tell the peer.
+type adaptiveWriter struct {
+	stream io.Writer
+	method string
+	stat   *CompressStat
+	w      io.Writer
+}
+
+func (a *adaptiveWriter) Write(p []byte) (int, error) {
+	if nil == a.w {
+		flag := adaptiveFlagRaw
+		if isCompressable(p) {
+			flag = adaptiveFlagCompressed
+			a.w = newCompressWriter(a.stream, a.method, a.stat)
+		} else {
+			if nil != a.stat {
+				atomic.AddInt64(&a.stat.bypassedStream, 1)
+			}
+			a.w = a.stream
+		}
+		if _, err := a.stream.Write([]byte{flag}); nil != err {
+			return 0, err
+		}
+	}
+	return a.w.Write(p)
+}
+
+func (a *adaptiveWriter) Close() error {
+	if closer, ok := a.w.(io.Closer); ok && a.w != a.stream {
+		return closer.Close()
+	}
+	return nil
+}
+
+type adaptiveReader struct {
+	stream io.Reader
+	method string
+	stat   *CompressStat
+	r      io.Reader
+}
+
+func (a *adaptiveReader) Read(p []byte) (int, error) {
+	if nil == a.r {
+		flag := make([]byte, 1)
+		if _, err := io.ReadFull(a.stream, flag); nil != err {
+			return 0, err
+		}
+		if flag[0] == adaptiveFlagCompressed {
+			a.r = newCompressReader(a.stream, a.method, a.stat)
+		} else {
+			a.r = a.stream
+		}
+	}
+	return a.r.Read(p)
+}
+
+func (a *adaptiveReader) Close() error {
+	if closer, ok := a.r.(io.Closer); ok && a.r != a.stream {
+		return closer.Close()
+	}
+	return nil
+}
+
+func parseCompressor(method string) (string, bool) {
+	if strings.HasPrefix(method, AdaptiveCompressorPrefix) {
+		return strings.TrimPrefix(method, AdaptiveCompressorPrefix), true
+	}
+	return method, false
+}
+
+//GetCompressStreamReaderWriter wrap stream with compressor, stat could be nil.
+func GetCompressStreamReaderWriter(stream MuxStream, method string, stat *CompressStat) (io.Reader, io.Writer) {
+	if isDatagramStream(stream) {
+		return stream, stream
+	}
+	method, adaptive := parseCompressor(method)
+	switch method {
+	case SnappyCompressor, LZ4Compressor, DeflateCompressor, ZstdCompressor:
+		if adaptive {
+			return &adaptiveReader{stream: stream, method: method, stat: stat}, &adaptiveWriter{stream: stream, method: method, stat: stat}
+		}
+		return newCompressReader(stream, method, stat), newCompressWriter(stream, method, stat)
 	case NoneCompressor:
 		fallthrough
 	default:
@@ -23,11 +285,39 @@ func GetCompressStreamReaderWriter(stream MuxStream, method string) (io.Reader,
 }
 
 func IsValidCompressor(method string) bool {
+	method, adaptive := parseCompressor(method)
 	switch method {
 	case SnappyCompressor:
+	case ZstdCompressor:
+	case LZ4Compressor:
+	case DeflateCompressor:
 	case NoneCompressor:
+		if adaptive {
+			return false
+		}
 	default:
 		return false
 	}
 	return true
 }
+
+//LegacyCompressor select the first compressor in candidates known by old servers which only accept compress
+//method of snappy/none & ignore candidates, none is selected if no such compressor.
+func LegacyCompressor(candidates []string) string {
+	for _, method := range candidates {
+		if method == SnappyCompressor || method == NoneCompressor {
+			return method
+		}
+	}
+	return NoneCompressor
+}
+
+//SelectCompressor select the first valid compressor in candidates.
+func SelectCompressor(candidates []string) string {
+	for _, method := range candidates {
+		if IsValidCompressor(method) {
+			return method
+		}
+	}
+	return ""
+}
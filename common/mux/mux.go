@@ -2,6 +2,7 @@ package mux
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"io"
 	"io/ioutil"
@@ -9,10 +10,9 @@ import (
 	"sync/atomic"
 	"time"
 
-	quic "github.com/lucas-clemente/quic-go"
 	"github.com/vmihailenco/msgpack"
 	"github.com/yinqiwen/gsnova/common/helper"
-	"github.com/yinqiwen/pmux"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
 var streamIDSeed int64
@@ -29,17 +29,29 @@ type ConnectRequest struct {
 	DialTimeout int
 	ReadTimeout int
 	Hops        []string
+	//subflow info of a striped stream
+	StripeID    string
+	StripeIndex int
+	StripeCount int
+	Priority    int
+	//stream idle timeout seconds selected by client, 0 means server default
+	IdleTimeout int
 }
 
 type AuthRequest struct {
-	Rand           string
-	User           string
-	CipherCounter  uint64
-	CipherMethod   string
-	CompressMethod string
+	Rand               string
+	User               string
+	CipherCounter      uint64
+	CipherMethod       string
+	CompressMethod     string
+	CompressCandidates []string
+	//client support half close of streams
+	HalfClose bool
 }
 type AuthResponse struct {
-	Code int
+	Code           int
+	CompressMethod string
+	HalfClose      bool
 }
 
 func ReadConnectRequest(stream io.Reader) (*ConnectRequest, error) {
@@ -93,6 +105,11 @@ type StreamOptions struct {
 	DialTimeout int
 	ReadTimeout int
 	Hops        []string
+	StripeID    string
+	StripeIndex int
+	StripeCount int
+	Priority    int
+	IdleTimeout int
 }
 
 type MuxStream interface {
@@ -114,15 +131,34 @@ type MuxSession interface {
 	Close() error
 }
 
+//AuthenticatedSession is implemented by server sessions authenticated by their own protocol, eg: SSH,
+//there is no auth stream in such sessions.
+type AuthenticatedSession interface {
+	MuxSession
+	AuthRequest() *AuthRequest
+}
+
+//ConnectedStream is implemented by server streams whose target is carried by their own protocol, eg: direct-tcpip
+//channels of SSH, there is no connect request in such streams.
+type ConnectedStream interface {
+	MuxStream
+	ConnectRequest() *ConnectRequest
+}
+
 type ProxyMuxStream struct {
+	//unix nano of latest io, updated by readers & writers concurrently
+	latestIOTime int64
 	TimeoutReadWriteCloser
-	session      MuxSession
-	sessionID    int64
-	latestIOTime time.Time
+	session   MuxSession
+	sessionID int64
+}
+
+func (s *ProxyMuxStream) touch() {
+	atomic.StoreInt64(&s.latestIOTime, time.Now().UnixNano())
 }
 
 func (s *ProxyMuxStream) OnIO(read bool) {
-	s.latestIOTime = time.Now()
+	s.touch()
 }
 func (s *ProxyMuxStream) WriteTo(w io.Writer) (n int64, err error) {
 	if writerTo, ok := s.TimeoutReadWriteCloser.(io.WriterTo); ok {
@@ -147,21 +183,21 @@ func (s *ProxyMuxStream) WriteTo(w io.Writer) (n int64, err error) {
 }
 
 func (s *ProxyMuxStream) Read(p []byte) (int, error) {
-	s.latestIOTime = time.Now()
+	s.touch()
 	return s.TimeoutReadWriteCloser.Read(p)
 }
 func (s *ProxyMuxStream) Write(p []byte) (int, error) {
-	s.latestIOTime = time.Now()
+	s.touch()
 	return s.TimeoutReadWriteCloser.Write(p)
 }
 func (s *ProxyMuxStream) LatestIOTime() time.Time {
-	return s.latestIOTime
+	return time.Unix(0, atomic.LoadInt64(&s.latestIOTime))
 }
 
 func (s *ProxyMuxStream) StreamID() uint32 {
 	if ps, ok := s.TimeoutReadWriteCloser.(*pmux.Stream); ok {
 		return ps.ID()
-	} else if qs, ok := s.TimeoutReadWriteCloser.(quic.Stream); ok {
+	} else if qs, ok := s.TimeoutReadWriteCloser.(*quicStream); ok {
 		return uint32(qs.StreamID())
 	}
 	if 0 == s.sessionID {
@@ -178,14 +214,107 @@ func (s *ProxyMuxStream) Close() error {
 }
 
 func (s *ProxyMuxStream) Connect(network string, addr string, opt StreamOptions) error {
+	return s.ConnectContext(context.Background(), network, addr, opt)
+}
+
+//ConnectContext send the connect request, the write is interrupted once the context done.
+func (s *ProxyMuxStream) ConnectContext(ctx context.Context, network string, addr string, opt StreamOptions) error {
+	if nil != ctx.Done() {
+		if deadline, ok := ctx.Deadline(); ok {
+			s.SetWriteDeadline(deadline)
+		}
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				s.SetWriteDeadline(time.Now())
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+			s.SetWriteDeadline(time.Time{})
+		}()
+	}
 	req := &ConnectRequest{
 		Network:     network,
 		Addr:        addr,
 		DialTimeout: opt.DialTimeout,
 		ReadTimeout: opt.ReadTimeout,
 		Hops:        opt.Hops,
+		StripeID:    opt.StripeID,
+		StripeIndex: opt.StripeIndex,
+		StripeCount: opt.StripeCount,
+		Priority:    opt.Priority,
+		IdleTimeout: opt.IdleTimeout,
+	}
+	s.SetPriority(opt.Priority)
+	//the datagram flow is registered before connecting, so that no packet of server is missed
+	enableDatagrams(s, network, true)
+	err := WriteMessage(s, req)
+	if nil != err && nil != ctx.Err() {
+		return ctx.Err()
+	}
+	return err
+}
+
+//ContextConnector is implemented by streams which could cancel connecting by context
+type ContextConnector interface {
+	ConnectContext(ctx context.Context, network string, addr string, opt StreamOptions) error
+}
+
+//ConnectStream connect the stream with context, the stream is closed if the context done before
+//a stream without context support connected.
+func ConnectStream(ctx context.Context, stream MuxStream, network string, addr string, opt StreamOptions) error {
+	if cc, ok := stream.(ContextConnector); ok {
+		return cc.ConnectContext(ctx, network, addr, opt)
+	}
+	if nil == ctx.Done() {
+		return stream.Connect(network, addr, opt)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- stream.Connect(network, addr, opt)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		stream.Close()
+		return ctx.Err()
+	}
+}
+
+//SetPriority set priority class of the stream, only pmux stream support priority scheduling.
+func (s *ProxyMuxStream) SetPriority(class int) {
+	if ps, ok := s.TimeoutReadWriteCloser.(*pmux.Stream); ok {
+		ps.SetPriority(class)
+	}
+}
+
+//CloseWrite close the write direction of the stream, the peer read EOF while the stream is still readable.
+func (s *ProxyMuxStream) CloseWrite() error {
+	if ps, ok := s.TimeoutReadWriteCloser.(*pmux.Stream); ok {
+		return ps.CloseWrite()
+	} else if qs, ok := s.TimeoutReadWriteCloser.(*quicStream); ok {
+		//close of quic stream only close the send direction
+		return qs.Stream.Close()
+	}
+	return ErrHalfCloseUnsupported
+}
+
+type priorityStream interface {
+	SetPriority(class int)
+}
+
+//SetStreamPriority set priority class if the stream support it
+func SetStreamPriority(stream MuxStream, class int) {
+	if ps, ok := stream.(priorityStream); ok {
+		ps.SetPriority(class)
 	}
-	return WriteMessage(s, req)
 }
 func (s *ProxyMuxStream) Auth(req *AuthRequest) error {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -207,11 +336,25 @@ func (s *ProxyMuxStream) Auth(req *AuthRequest) error {
 	if res.Code != AuthOK {
 		return ErrAuthFailed
 	}
+	if len(res.CompressMethod) > 0 {
+		//compressor negotiated by server
+		req.CompressMethod = res.CompressMethod
+	}
+	//old server would never response half close
+	req.HalfClose = req.HalfClose && res.HalfClose
 	return nil
 }
 
 type ProxyMuxSession struct {
 	*pmux.Session
+	pinger func() (time.Duration, error)
+}
+
+func (s *ProxyMuxSession) Ping() (time.Duration, error) {
+	if nil != s.pinger {
+		return s.pinger()
+	}
+	return s.Session.Ping()
 }
 
 func (s *ProxyMuxSession) CloseStream(stream MuxStream) error {
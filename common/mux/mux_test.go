@@ -2,10 +2,24 @@ package mux
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
+var testResumeKey = []byte("test resume key")
+
 type A struct {
 	VV int
 }
@@ -36,3 +50,483 @@ func TestXYZ(t *testing.T) {
 	// err := ReadMessage(&buffer, zz)
 	// log.Printf("#### %v %v", zz, err)
 }
+
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p *pipeConn) Close() error {
+	p.PipeWriter.Close()
+	return p.PipeReader.Close()
+}
+
+func newPipeStreams() (MuxStream, MuxStream) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	s1 := &ProxyMuxStream{TimeoutReadWriteCloser: &helper.TimeoutReadWriteCloser{ReadWriteCloser: &pipeConn{r1, w2}}}
+	s2 := &ProxyMuxStream{TimeoutReadWriteCloser: &helper.TimeoutReadWriteCloser{ReadWriteCloser: &pipeConn{r2, w1}}}
+	return s1, s2
+}
+
+func TestCompressors(t *testing.T) {
+	text := bytes.Repeat([]byte("hello gsnova compressor "), 100)
+	random := make([]byte, 2048)
+	rand.Read(random)
+	tlsRecord := append([]byte{0x17, 0x03, 0x03, 0x08, 0x00}, text...)
+	methods := []string{SnappyCompressor, ZstdCompressor, LZ4Compressor, DeflateCompressor, "adaptive:zstd", "adaptive:lz4"}
+	for _, method := range methods {
+		for _, data := range [][]byte{text, random, tlsRecord} {
+			local, remote := newPipeStreams()
+			var stat CompressStat
+			_, w := GetCompressStreamReaderWriter(local, method, &stat)
+			r, _ := GetCompressStreamReaderWriter(remote, method, nil)
+			written := make(chan error, 1)
+			go func() {
+				_, err := w.Write(data)
+				written <- err
+			}()
+			buf := make([]byte, len(data))
+			//every write should be flushed to peer without close
+			if _, err := io.ReadFull(r, buf); nil != err || !bytes.Equal(buf, data) {
+				t.Fatalf("Compressor:%s read mismatch with err:%v", method, err)
+			}
+			if err := <-written; nil != err {
+				t.Fatalf("Compressor:%s write failed with err:%v", method, err)
+			}
+			if strings.HasPrefix(method, AdaptiveCompressorPrefix) && !bytes.Equal(data, text) && stat.BypassedStreams() != 1 {
+				t.Fatalf("Compressor:%s should bypass uncompressable data", method)
+			}
+			if bytes.Equal(data, text) && stat.SavedBytes() <= 0 {
+				t.Fatalf("Compressor:%s saved nothing", method)
+			}
+			local.Close()
+			remote.Close()
+		}
+	}
+}
+
+func TestSelectCompressor(t *testing.T) {
+	if m := SelectCompressor([]string{"gzip", "adaptive:none", "adaptive:zstd", "snappy"}); m != "adaptive:zstd" {
+		t.Fatalf("Unexpected compressor:%s", m)
+	}
+	if m := SelectCompressor([]string{"gzip"}); len(m) > 0 {
+		t.Fatalf("Unexpected compressor:%s", m)
+	}
+	if m := LegacyCompressor([]string{"zstd", "adaptive:snappy", "snappy"}); m != SnappyCompressor {
+		t.Fatalf("Unexpected legacy compressor:%s", m)
+	}
+	if m := LegacyCompressor([]string{"zstd", "lz4"}); m != NoneCompressor {
+		t.Fatalf("Unexpected legacy compressor:%s", m)
+	}
+}
+
+func TestResumableConn(t *testing.T) {
+	lp, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer lp.Close()
+	accepted := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		for {
+			conn, err := lp.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				rc, _ := AcceptResumableConn(conn, 5*time.Second, testResumeKey)
+				if nil != rc {
+					accepted <- rc
+				}
+			}()
+		}
+	}()
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", lp.Addr().String())
+	}
+	conn, _ := dialer()
+	client, err := NewResumableClientConn(conn, dialer, 5*time.Second, testResumeKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+
+	content := []byte(helper.RandAsciiString(256 * 1024))
+	go func() {
+		for i := 0; i < len(content); i += 1024 {
+			if i == len(content)/2 {
+				//break the underlying conn, written data should be replayed after resumed
+				client.mutex.Lock()
+				client.conn.Close()
+				client.mutex.Unlock()
+			}
+			client.Write(content[i : i+1024])
+		}
+	}()
+	received := make([]byte, len(content))
+	if _, err = io.ReadFull(server, received); nil != err {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatalf("resumed content mismatch")
+	}
+}
+
+func newResumablePair(t *testing.T) (*ResumableConn, io.ReadWriteCloser, net.Listener) {
+	lp, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	accepted := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		for {
+			conn, err := lp.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				rc, _ := AcceptResumableConn(conn, 5*time.Second, testResumeKey)
+				if nil != rc {
+					accepted <- rc
+				}
+			}()
+		}
+	}()
+	dialer := func() (net.Conn, error) {
+		return net.Dial("tcp", lp.Addr().String())
+	}
+	conn, _ := dialer()
+	client, err := NewResumableClientConn(conn, dialer, 5*time.Second, testResumeKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return client, <-accepted, lp
+}
+
+func TestResumableConnFullDuplex(t *testing.T) {
+	client, server, lp := newResumablePair(t)
+	defer lp.Close()
+	defer client.Close()
+	//both sides write more than the replay buffer before reading, acks must not wait for blocked writers
+	content := []byte(helper.RandAsciiString(3 * resumeMaxReplayBuffer))
+	done := make(chan error, 4)
+	for _, c := range []io.ReadWriter{client, server} {
+		go func(c io.ReadWriter) {
+			_, err := c.Write(content)
+			done <- err
+		}(c)
+		go func(c io.ReadWriter) {
+			received := make([]byte, len(content))
+			_, err := io.ReadFull(c, received)
+			if nil == err && !bytes.Equal(received, content) {
+				err = io.ErrUnexpectedEOF
+			}
+			done <- err
+		}(c)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-done:
+			if nil != err {
+				t.Fatal(err)
+			}
+		case <-time.After(20 * time.Second):
+			t.Fatalf("resumable conns deadlocked")
+		}
+	}
+}
+
+func TestResumableConnRejected(t *testing.T) {
+	client, server, lp := newResumablePair(t)
+	defer lp.Close()
+	defer client.Close()
+	resume := func(key []byte, counter uint64, useTLS bool) byte {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		go func() {
+			var conn net.Conn = c2
+			if useTLS {
+				conn = tls.Server(c2, &tls.Config{})
+			}
+			AcceptResumableConn(conn, 5*time.Second, testResumeKey)
+		}()
+		req := make([]byte, resumeRequestSize)
+		copy(req, resumeMagic)
+		copy(req[len(resumeMagic):], client.token[:])
+		binary.BigEndian.PutUint64(req[len(resumeMagic)+24:], counter)
+		copy(req[resumeRequestSize-sha256.Size:], resumeRequestMAC(key, req))
+		c1.Write(req)
+		res := make([]byte, 1+16+8)
+		if _, err := io.ReadFull(c1, res); nil != err {
+			t.Fatal(err)
+		}
+		return res[0]
+	}
+	if status := resume([]byte("wrong key"), 10, false); status != resumeStatusUnknown {
+		t.Fatalf("resume with forged request is accepted")
+	}
+	//counter 1 is used by the first handshake of client
+	if status := resume(testResumeKey, 1, false); status != resumeStatusUnknown {
+		t.Fatalf("replayed resume request is accepted")
+	}
+	if status := resume(testResumeKey, 10, false); status != resumeStatusResumed {
+		t.Fatalf("Unexpected resume status:%d", status)
+	}
+	server.Close()
+
+	conn, _ := net.Dial("tcp", lp.Addr().String())
+	defer conn.Close()
+	if _, err := NewResumableClientConn(conn, nil, 5*time.Second, nil); err != ErrResumeNotAllowed {
+		t.Fatalf("Unexpected error:%v for resumable conn without key over tcp", err)
+	}
+	if ResumeAllowed(conn, nil) || !ResumeAllowed(tls.Client(conn, &tls.Config{}), nil) {
+		t.Fatalf("resume should be only allowed over TLS without key")
+	}
+}
+
+func TestAcceptResumableConnTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := AcceptResumableConn(c2, 5*time.Second, testResumeKey)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if nil == err {
+			t.Fatalf("Expected timeout error")
+		}
+	case <-time.After(resumeHandshakeTimeout + 5*time.Second):
+		t.Fatalf("AcceptResumableConn blocked by silent conn")
+	}
+}
+
+func TestStripedStream(t *testing.T) {
+	remotes := make([]MuxStream, 3)
+	local, remote := newPipeStreams()
+	remotes[0] = remote
+	opener := func(index int) (MuxStream, error) {
+		l, r := newPipeStreams()
+		remotes[index] = r
+		return l, nil
+	}
+	client := NewStripedStream(local, 3, opener)
+	connected := make(chan error, 1)
+	go func() {
+		connected <- client.Connect("tcp", "example.com:80", StreamOptions{})
+	}()
+	var server *StripedStream
+	for i := 0; i < 3; i++ {
+		creq, err := ReadConnectRequest(remotes[i])
+		if nil != err || creq.StripeCount != 3 || creq.StripeIndex != i {
+			t.Fatalf("Invalid connect request:%v with err:%v", creq, err)
+		}
+		server = JoinStripedStream("gsnova", creq.StripeID, creq.StripeIndex, creq.StripeCount, NoneCompressor, remotes[i])
+	}
+	if err := <-connected; nil != err || nil == server {
+		t.Fatalf("Failed to join striped stream:%v", err)
+	}
+	content := []byte(helper.RandAsciiString(512 * 1024))
+	go func() {
+		client.Write(content)
+		client.Close()
+	}()
+	received, err := ioutil.ReadAll(server)
+	if nil != err || !bytes.Equal(received, content) {
+		t.Fatalf("Striped content mismatch with err:%v", err)
+	}
+}
+
+func TestStripedStreamCloseWrite(t *testing.T) {
+	c1, c2 := net.Pipe()
+	cfg := pmux.DefaultConfig()
+	cfg.CipherMethod = "chacha20poly1305"
+	client, _ := pmux.Client(c1, cfg)
+	server, _ := pmux.Server(c2, cfg)
+	client.EnableHalfClose()
+	server.EnableHalfClose()
+	clientSession := &ProxyMuxSession{Session: client}
+	serverSession := &ProxyMuxSession{Session: server}
+	defer clientSession.Close()
+	defer serverSession.Close()
+
+	joined := make(chan *StripedStream, 1)
+	go func() {
+		for {
+			stream, err := serverSession.AcceptStream()
+			if nil != err {
+				return
+			}
+			creq, err := ReadConnectRequest(stream)
+			if nil != err {
+				return
+			}
+			if striped := JoinStripedStream("gsnova", creq.StripeID, creq.StripeIndex, creq.StripeCount, NoneCompressor, stream); nil != striped {
+				joined <- striped
+			}
+		}
+	}()
+	primary, _ := clientSession.OpenStream()
+	opener := func(index int) (MuxStream, error) {
+		return clientSession.OpenStream()
+	}
+	local := NewStripedStream(primary, 3, opener)
+	if err := local.Connect("tcp", "example.com:80", StreamOptions{}); nil != err {
+		t.Fatal(err)
+	}
+	remote := <-joined
+	go func() {
+		req, _ := ioutil.ReadAll(remote)
+		remote.Write(append([]byte("echo:"), req...))
+		remote.Close()
+	}()
+	local.Write([]byte("hello"))
+	if err := local.CloseWrite(); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := local.Write([]byte("more")); nil == err {
+		t.Fatalf("write after CloseWrite should fail")
+	}
+	res, err := ioutil.ReadAll(local)
+	if nil != err || string(res) != "echo:hello" {
+		t.Fatalf("unexpected response:%s %v", res, err)
+	}
+	local.Close()
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	cfg := pmux.DefaultConfig()
+	cfg.CipherMethod = "chacha20poly1305"
+	client, _ := pmux.Client(c1, cfg)
+	server, _ := pmux.Server(c2, cfg)
+	client.EnableHalfClose()
+	server.EnableHalfClose()
+	clientSession := &ProxyMuxSession{Session: client}
+	serverSession := &ProxyMuxSession{Session: server}
+
+	//target response after read EOF
+	target, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if nil != err {
+			return
+		}
+		req, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("echo:"), req...))
+		conn.Close()
+	}()
+	go func() {
+		stream, err := serverSession.AcceptStream()
+		if nil != err {
+			return
+		}
+		conn, _ := net.Dial("tcp", target.Addr().String())
+		(&Relay{Conn: conn, Stream: stream}).Run()
+	}()
+
+	proxy, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer proxy.Close()
+	reasons := make(chan string, 1)
+	go func() {
+		conn, err := proxy.Accept()
+		if nil != err {
+			return
+		}
+		stream, _ := clientSession.OpenStream()
+		reasons <- (&Relay{Conn: conn, Stream: stream}).Run()
+	}()
+
+	conn, _ := net.Dial("tcp", proxy.Addr().String())
+	conn.Write([]byte("hello"))
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := ioutil.ReadAll(conn)
+	if nil != err || string(res) != "echo:hello" {
+		t.Fatalf("unexpected response:%s %v", res, err)
+	}
+	if reason := <-reasons; reason != RelayCloseEOF {
+		t.Fatalf("unexpected close reason:%s", reason)
+	}
+}
+
+func TestResumableRegistryLimits(t *testing.T) {
+	registry := newResumableRegistry(3, 2)
+	newConn := func(i byte) *ResumableConn {
+		c := newResumableConn(resumeToken{i}, testResumeKey, time.Second)
+		registry.add(c)
+		return c
+	}
+	closed := func(c *ResumableConn) bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return c.closed && c.closeErr == ErrResumeEvicted
+	}
+	conns := []*ResumableConn{newConn(1), newConn(2), newConn(3), newConn(4)}
+	//the oldest is evicted over the global limit
+	if _, exist := registry.load(conns[0].token); exist || !closed(conns[0]) {
+		t.Fatalf("The oldest conn is not evicted")
+	}
+	//the oldest of user is evicted over the per user limit
+	for _, c := range conns[1:] {
+		registry.bindUser(c, "gsnova")
+	}
+	if _, exist := registry.load(conns[1].token); exist || !closed(conns[1]) || closed(conns[2]) || closed(conns[3]) {
+		t.Fatalf("The oldest conn of user is not evicted")
+	}
+	other := newConn(5)
+	registry.bindUser(other, "other")
+	if registry.users["gsnova"] != 2 || registry.users["other"] != 1 || len(registry.conns) != 3 {
+		t.Fatalf("Unexpected registry:%v %d", registry.users, len(registry.conns))
+	}
+	//closed conns are removed
+	conns[2].Close()
+	conns[3].Close()
+	other.Close()
+	if len(registry.conns) != 0 || len(registry.users) != 0 || registry.order.Len() != 0 {
+		t.Fatalf("Closed conns are not removed:%v %d", registry.users, len(registry.conns))
+	}
+}
+
+func TestStripeGroupsScopedByUser(t *testing.T) {
+	//subflows of other users never join the group, even with the same stripe id
+	_, s1 := newPipeStreams()
+	_, s2 := newPipeStreams()
+	if nil != JoinStripedStream("alice", "same-id", 0, 2, NoneCompressor, s1) || nil != JoinStripedStream("bob", "same-id", 1, 2, NoneCompressor, s2) {
+		t.Fatalf("Subflows of different users are joined")
+	}
+	stripeGroupsMutex.Lock()
+	groups, users := len(stripeGroups), len(stripeUserGroups)
+	stripeGroupsMutex.Unlock()
+	if groups != 2 || users != 2 {
+		t.Fatalf("Unexpected pending groups:%d of %d users", groups, users)
+	}
+	_, s3 := newPipeStreams()
+	if striped := JoinStripedStream("alice", "same-id", 1, 2, NoneCompressor, s3); nil == striped {
+		t.Fatalf("Failed to join striped stream of the same user")
+	}
+
+	//pending groups of a user are bounded
+	for i := 0; i < stripeMaxGroupsPerUser; i++ {
+		_, s := newPipeStreams()
+		JoinStripedStream("mallory", helper.RandAsciiString(16), 0, 2, NoneCompressor, s)
+	}
+	_, s := newPipeStreams()
+	JoinStripedStream("mallory", "one-more", 0, 2, NoneCompressor, s)
+	stripeGroupsMutex.Lock()
+	_, exist := stripeGroups[stripeGroupKey{user: "mallory", id: "one-more"}]
+	pending := stripeUserGroups["mallory"]
+	stripeGroupsMutex.Unlock()
+	if exist || pending != stripeMaxGroupsPerUser {
+		t.Fatalf("Pending groups:%d of user is not bounded", pending)
+	}
+	//too many subflows
+	_, s = newPipeStreams()
+	if nil != JoinStripedStream("alice", "too-many", 0, MaxStripeSubflows+1, NoneCompressor, s) {
+		t.Fatalf("Expected rejected subflow")
+	}
+}
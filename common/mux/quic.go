@@ -1,19 +1,110 @@
 package mux
 
 import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	quic "github.com/lucas-clemente/quic-go"
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
+//max UDP packets queued in a datagram flow, packets are dropped like lost ones while the queue is full
+const datagramFlowQueueLen = 256
+
+//QUICMuxSession is the mux session over a QUIC connection, each mux stream is a QUIC stream.
+//UDP packets of streams connected to udp addresses are carried by the unreliable DATAGRAM extension(RFC 9221)
+//if both peers negotiated it, the QUIC stream is still the fallback of packets too large for a datagram.
 type QUICMuxSession struct {
 	streamCounter int64
-	quic.Session
+	*quic.Conn
+
+	datagrams bool
+	flows     sync.Map
+}
+
+//NewQUICMuxSession create the mux session of the QUIC connection after its handshake completed.
+func NewQUICMuxSession(conn *quic.Conn) *QUICMuxSession {
+	state := conn.ConnectionState()
+	q := &QUICMuxSession{Conn: conn}
+	q.datagrams = state.SupportsDatagrams.Local && state.SupportsDatagrams.Remote
+	if q.datagrams {
+		go q.receiveDatagrams()
+	}
+	return q
+}
+
+//SupportsDatagrams return true if UDP packets are carried by QUIC datagrams
+func (q *QUICMuxSession) SupportsDatagrams() bool {
+	return q.datagrams
+}
+
+//datagrams are framed as: flow id(varint of the QUIC stream id) | UDP packet
+func (q *QUICMuxSession) receiveDatagrams() {
+	for {
+		b, err := q.Conn.ReceiveDatagram(context.Background())
+		if nil != err {
+			q.flows.Range(func(key, value interface{}) bool {
+				value.(*datagramFlow).close()
+				return true
+			})
+			return
+		}
+		id, n, err := quicvarint.Parse(b)
+		if nil != err {
+			continue
+		}
+		//datagrams of unknown flows are dropped
+		if v, exist := q.flows.Load(id); exist {
+			v.(*datagramFlow).receive(b[n:])
+		}
+	}
 }
 
+func (q *QUICMuxSession) sendDatagram(id uint64, p []byte) error {
+	b := make([]byte, 0, quicvarint.Len(id)+len(p))
+	b = quicvarint.Append(b, id)
+	return q.Conn.SendDatagram(append(b, p...))
+}
+
+//Ping send a ping connect request on a new stream and wait the echo from server.
+//quic-go does NOT expose PING frames to applications, they're only sent by its keepalive(KeepAlivePeriod)
+//while the connection is idle, and the RTT samples of them could not tell a dead peer within the ping timeout.
+//Opening a QUIC stream costs no extra round trip and the stream is released once both sides closed it,
+//so the stream echo is kept as the probe, which also detects servers no longer serving streams.
 func (q *QUICMuxSession) Ping() (time.Duration, error) {
-	return 0, nil
+	//the connection closed by idle timeout or keepalive failure
+	if err := q.Conn.Context().Err(); nil != err {
+		return 0, err
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultPingTimeout)
+	defer cancel()
+	s, err := q.Conn.OpenStreamSync(ctx)
+	if nil != err {
+		return 0, err
+	}
+	defer s.Close()
+	s.SetDeadline(start.Add(DefaultPingTimeout))
+	err = WriteMessage(s, &ConnectRequest{Network: PingNetwork})
+	if nil == err {
+		var echo ConnectRequest
+		err = ReadMessage(s, &echo)
+		if err == io.EOF {
+			//old server close the stream directly, it's still a round trip
+			err = nil
+		}
+	}
+	if nil != err {
+		return 0, err
+	}
+	return time.Now().Sub(start), nil
 }
 
 func (q *QUICMuxSession) CloseStream(stream MuxStream) error {
@@ -22,27 +113,258 @@ func (q *QUICMuxSession) CloseStream(stream MuxStream) error {
 }
 
 func (q *QUICMuxSession) OpenStream() (MuxStream, error) {
-	s, err := q.OpenStreamSync()
+	s, err := q.Conn.OpenStreamSync(context.Background())
 	if nil != err {
 		return nil, err
 	}
 	atomic.AddInt64(&q.streamCounter, 1)
-	return &ProxyMuxStream{TimeoutReadWriteCloser: s, session: q}, nil
+	return &ProxyMuxStream{TimeoutReadWriteCloser: &quicStream{Stream: s, session: q}, session: q}, nil
 }
 
 func (q *QUICMuxSession) AcceptStream() (MuxStream, error) {
-	s, err := q.Session.AcceptStream()
+	s, err := q.Conn.AcceptStream(context.Background())
 	if nil != err {
 		return nil, err
 	}
-	return &ProxyMuxStream{TimeoutReadWriteCloser: s}, nil
+	return &ProxyMuxStream{TimeoutReadWriteCloser: &quicStream{Stream: s, session: q}}, nil
 }
 
 func (q *QUICMuxSession) NumStreams() int {
-	return int(q.streamCounter)
+	return int(atomic.LoadInt64(&q.streamCounter))
 }
 
 func (q *QUICMuxSession) Close() error {
-	q.streamCounter = 0
-	return q.Session.Close(nil)
+	atomic.StoreInt64(&q.streamCounter, 0)
+	return q.Conn.CloseWithError(0, "")
+}
+
+//quicStream is the QUIC stream of a mux stream, reads & writes go through the datagram flow once it's enabled.
+type quicStream struct {
+	*quic.Stream
+	session *QUICMuxSession
+	flow    *datagramFlow
+}
+
+//enableDatagrams switch the stream to carry UDP packets by datagrams, it should be called before any data
+//read or written after the connect request. The opener sends packets on the stream until the flow is
+//confirmed by any datagram of the peer, while the acceptor confirms the flow once switched.
+func (s *quicStream) enableDatagrams(opener bool) bool {
+	if !s.session.datagrams || nil != s.flow {
+		return false
+	}
+	f := newDatagramFlow(s)
+	if !opener {
+		f.confirmed = 1
+	}
+	s.session.flows.Store(f.id, f)
+	s.flow = f
+	go f.readStream()
+	if !opener {
+		if err := s.session.sendDatagram(f.id, nil); nil != err {
+			logger.Debug("[%d]Failed to confirm datagram flow:%v", f.id, err)
+		}
+	}
+	return true
+}
+
+func (s *quicStream) Read(p []byte) (int, error) {
+	if nil != s.flow {
+		return s.flow.read(p)
+	}
+	return s.Stream.Read(p)
+}
+
+func (s *quicStream) Write(p []byte) (int, error) {
+	if nil != s.flow {
+		return s.flow.write(p)
+	}
+	return s.Stream.Write(p)
+}
+
+func (s *quicStream) SetReadDeadline(t time.Time) error {
+	if nil != s.flow {
+		s.flow.setReadDeadline(t)
+		return nil
+	}
+	return s.Stream.SetReadDeadline(t)
+}
+
+func (s *quicStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.Stream.SetWriteDeadline(t)
+}
+
+//Close only close the send direction like QUIC streams, while the datagram flow is closed at once.
+func (s *quicStream) Close() error {
+	if nil != s.flow {
+		s.flow.close()
+	}
+	return s.Stream.Close()
+}
+
+//datagramFlow carry UDP packets of a stream by datagrams, packets sent on the stream are received too.
+type datagramFlow struct {
+	id        uint64
+	stream    *quicStream
+	confirmed int32
+
+	packets      chan []byte
+	pending      []byte
+	streamErr    error
+	streamDone   chan struct{}
+	closed       chan struct{}
+	closeOnce    sync.Once
+	deadline     atomic.Value
+	deadlineNote chan struct{}
+}
+
+func newDatagramFlow(s *quicStream) *datagramFlow {
+	f := &datagramFlow{
+		id:           uint64(s.StreamID()),
+		stream:       s,
+		packets:      make(chan []byte, datagramFlowQueueLen),
+		streamDone:   make(chan struct{}),
+		closed:       make(chan struct{}),
+		deadlineNote: make(chan struct{}, 1),
+	}
+	f.deadline.Store(time.Time{})
+	return f
+}
+
+func (f *datagramFlow) receive(p []byte) {
+	atomic.StoreInt32(&f.confirmed, 1)
+	if len(p) == 0 {
+		return
+	}
+	select {
+	case f.packets <- append([]byte(nil), p...):
+	default:
+	}
+}
+
+//readStream receive packets sent on the stream until EOF of the stream
+func (f *datagramFlow) readStream() {
+	defer close(f.streamDone)
+	for {
+		b := make([]byte, 8192)
+		n, err := f.stream.Stream.Read(b)
+		if n > 0 {
+			select {
+			case f.packets <- b[:n]:
+			case <-f.closed:
+				return
+			}
+		}
+		if nil != err {
+			f.streamErr = err
+			return
+		}
+	}
+}
+
+func (f *datagramFlow) setReadDeadline(t time.Time) {
+	f.deadline.Store(t)
+	select {
+	case f.deadlineNote <- struct{}{}:
+	default:
+	}
+}
+
+func (f *datagramFlow) read(p []byte) (int, error) {
+	if len(f.pending) > 0 {
+		n := copy(p, f.pending)
+		f.pending = f.pending[n:]
+		return n, nil
+	}
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if deadline := f.deadline.Load().(time.Time); !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, pmux.ErrTimeout
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		var b []byte
+		var err error
+		select {
+		case b = <-f.packets:
+		case <-f.streamDone:
+			//packets received before EOF of the stream are still readable
+			select {
+			case b = <-f.packets:
+			default:
+				err = f.streamErr
+			}
+		case <-f.closed:
+			err = io.EOF
+		case <-f.deadlineNote:
+		case <-timeout:
+			err = pmux.ErrTimeout
+		}
+		if nil != timer {
+			timer.Stop()
+		}
+		if nil != b {
+			n := copy(p, b)
+			f.pending = b[n:]
+			return n, nil
+		}
+		if nil != err {
+			return 0, err
+		}
+	}
+}
+
+func (f *datagramFlow) write(p []byte) (int, error) {
+	if atomic.LoadInt32(&f.confirmed) == 1 {
+		err := f.stream.session.sendDatagram(f.id, p)
+		if nil == err {
+			return len(p), nil
+		}
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return 0, err
+		}
+	}
+	return f.stream.Stream.Write(p)
+}
+
+func (f *datagramFlow) close() {
+	f.closeOnce.Do(func() {
+		close(f.closed)
+		f.stream.session.flows.Delete(f.id)
+	})
+}
+
+//enableDatagrams switch the stream to carry UDP packets by datagrams if the session supports.
+func enableDatagrams(stream MuxStream, network string, opener bool) bool {
+	if !strings.HasPrefix(network, "udp") {
+		return false
+	}
+	if ps, ok := stream.(*ProxyMuxStream); ok {
+		if qs, ok := ps.TimeoutReadWriteCloser.(*quicStream); ok {
+			return qs.enableDatagrams(opener)
+		}
+	}
+	return false
+}
+
+//AcceptDatagrams switch the accepted stream to carry UDP packets by datagrams if the session supports,
+//it should be called by servers once the connect request of the stream is read.
+func AcceptDatagrams(stream MuxStream, network string) bool {
+	return enableDatagrams(stream, network, false)
+}
+
+//isDatagramStream return true if packets of the stream are carried by datagrams, such streams are never
+//compressed since the loss of any datagram would break the compressor.
+func isDatagramStream(stream MuxStream) bool {
+	if ps, ok := stream.(*ProxyMuxStream); ok {
+		if qs, ok := ps.TimeoutReadWriteCloser.(*quicStream); ok {
+			return nil != qs.flow
+		}
+	}
+	return false
 }
@@ -0,0 +1,180 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/pmux"
+)
+
+func newTestQUICSessions(t *testing.T, serverDatagrams bool) (*QUICMuxSession, *QUICMuxSession) {
+	tlscfg := helper.GenerateTLSConfig()
+	tlscfg.NextProtos = []string{"test"}
+	l, err := quic.ListenAddr("127.0.0.1:0", tlscfg, &quic.Config{EnableDatagrams: serverDatagrams})
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan *quic.Conn, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept(ctx)
+		if nil != err {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	conn, err := quic.DialAddr(ctx, l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"test"}},
+		&quic.Config{EnableDatagrams: true})
+	if nil != err {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if nil == server {
+		t.FailNow()
+	}
+	return NewQUICMuxSession(conn), NewQUICMuxSession(server)
+}
+
+//openTestUDPStream connect a udp stream from client, & accept it in server like remote channels.
+func openTestUDPStream(t *testing.T, client, server *QUICMuxSession) (MuxStream, MuxStream) {
+	stream, err := client.OpenStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = ConnectStream(context.Background(), stream, "udp", "127.0.0.1:53", StreamOptions{}); nil != err {
+		t.Fatal(err)
+	}
+	remote, err := server.AcceptStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	creq, err := ReadConnectRequest(remote)
+	if nil != err || creq.Network != "udp" {
+		t.Fatalf("Unexpected connect request:%v with err:%v", creq, err)
+	}
+	AcceptDatagrams(remote, creq.Network)
+	return stream, remote
+}
+
+func readPacket(t *testing.T, stream MuxStream, expected []byte) {
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 8192)
+	n, err := stream.Read(buf)
+	if nil != err || !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("Unexpected packet:%d/%d bytes with err:%v", n, len(expected), err)
+	}
+}
+
+func TestQUICDatagramFlow(t *testing.T) {
+	client, server := newTestQUICSessions(t, true)
+	defer client.Close()
+	defer server.Close()
+	if !client.SupportsDatagrams() || !server.SupportsDatagrams() {
+		t.Fatalf("Datagrams are not negotiated")
+	}
+	stream, remote := openTestUDPStream(t, client, server)
+	if !isDatagramStream(stream) || !isDatagramStream(remote) {
+		t.Fatalf("Streams are not switched to datagram flows")
+	}
+	//streams of datagram flows are never compressed
+	if r, w := GetCompressStreamReaderWriter(stream, SnappyCompressor, nil); r != io.Reader(stream) || w != io.Writer(stream) {
+		t.Fatalf("Datagram flow is compressed")
+	}
+
+	//packets of server are carried by datagrams, which confirm the flow for client
+	for i := 0; i < 3; i++ {
+		packet := bytes.Repeat([]byte{byte(i)}, 100+i)
+		remote.Write(packet)
+		readPacket(t, stream, packet)
+	}
+	if atomic.LoadInt32(&stream.(*ProxyMuxStream).TimeoutReadWriteCloser.(*quicStream).flow.confirmed) != 1 {
+		t.Fatalf("Flow is not confirmed by datagrams of server")
+	}
+	packet := []byte("hello datagram")
+	stream.Write(packet)
+	readPacket(t, remote, packet)
+	//packets too large for a datagram fall back to the stream
+	packet = bytes.Repeat([]byte("large"), 1000)
+	if _, err := stream.Write(packet); nil != err {
+		t.Fatal(err)
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len(packet))
+	if _, err := io.ReadFull(remote, buf); nil != err || !bytes.Equal(buf, packet) {
+		t.Fatalf("Unexpected large packet with err:%v", err)
+	}
+
+	//read deadline of flows
+	remote.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := remote.Read(buf); err != pmux.ErrTimeout {
+		t.Fatalf("Unexpected read error:%v after deadline", err)
+	}
+	//half close is still carried by the stream
+	if err := stream.(*ProxyMuxStream).CloseWrite(); nil != err {
+		t.Fatal(err)
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Read(buf); err != io.EOF {
+		t.Fatalf("Expected EOF after half closed, but got:%v", err)
+	}
+	stream.Close()
+	remote.Close()
+}
+
+func TestQUICDatagramFallback(t *testing.T) {
+	//the server does not negotiate datagrams, udp packets are carried by streams
+	client, server := newTestQUICSessions(t, false)
+	defer client.Close()
+	defer server.Close()
+	if client.SupportsDatagrams() || server.SupportsDatagrams() {
+		t.Fatalf("Datagrams are negotiated while disabled in server")
+	}
+	stream, remote := openTestUDPStream(t, client, server)
+	if isDatagramStream(stream) || isDatagramStream(remote) {
+		t.Fatalf("Streams are switched to datagram flows")
+	}
+	packet := []byte("hello stream")
+	stream.Write(packet)
+	readPacket(t, remote, packet)
+	remote.Write(packet)
+	readPacket(t, stream, packet)
+	stream.Close()
+	remote.Close()
+}
+
+func TestQUICPing(t *testing.T) {
+	client, server := newTestQUICSessions(t, true)
+	defer client.Close()
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if nil != err {
+				return
+			}
+			var req ConnectRequest
+			if nil == ReadMessage(stream, &req) && req.Network == PingNetwork {
+				WriteMessage(stream, &req)
+			}
+			stream.Close()
+		}
+	}()
+	if _, err := client.Ping(); nil != err {
+		t.Fatal(err)
+	}
+	server.Close()
+	//pings of closed connections fail at once
+	<-client.Conn.Context().Done()
+	start := time.Now()
+	if _, err := client.Ping(); nil == err || time.Since(start) > time.Second {
+		t.Fatalf("Unexpected ping result of closed connection:%v", err)
+	}
+}
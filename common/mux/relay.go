@@ -0,0 +1,201 @@
+package mux
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+const (
+	defaultRelayIdleTimeout = 10 * time.Second
+	relayIdleCheckPeriod    = 2 * time.Second
+)
+
+//close reasons of relay
+const (
+	//both directions finished with EOF
+	RelayCloseEOF = "eof"
+	//no read&write action longer than idle timeout
+	RelayCloseIdle = "idle"
+	//relay from conn to stream failed
+	RelayCloseConnError = "conn_error"
+	//relay from stream to conn failed
+	RelayCloseStreamError = "stream_error"
+	//one direction finished while the other side can not be half closed
+	RelayCloseNoHalfClose = "no_half_close"
+	//forwarder switch to another stream
+	RelayCloseSwitch = "switch"
+)
+
+type halfCloser interface {
+	CloseWrite() error
+}
+
+//CloseWrite close the write direction of conn/stream if supported
+func CloseWrite(v interface{}) error {
+	if hc, ok := v.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return ErrHalfCloseUnsupported
+}
+
+//Relay relay data between a conn and a mux stream in both directions. EOF in one direction is propagated
+//as half close to the other side, the relay finishes when both directions finished, or any error/idle timeout.
+type Relay struct {
+	//the conn of local client or remote target
+	Conn io.ReadWriteCloser
+	//the stream, and the reader&writer of it which may be compressors
+	Stream       MuxStream
+	StreamReader io.Reader
+	StreamWriter io.Writer //closed by relay if it's not the stream
+	//Forward copy data from conn to stream writer, default relay until EOF of conn.
+	//If it returns ErrRelaySwitchStream, only the stream is closed.
+	Forward func(w io.Writer) error
+	//max duration without any read&write action, default 10s
+	IdleTimeout time.Duration
+	//OnActive is called periodically with latest io time of stream
+	OnActive func(latest time.Time)
+
+	//bytes relayed from conn to stream & from stream to conn
+	ForwardBytes  int64
+	BackwardBytes int64
+	//reason to finish relay
+	CloseReason string
+
+	closeOnce sync.Once
+	closed    int32
+}
+
+type relayDone struct {
+	forward bool
+	n       int64
+	err     error
+}
+
+func (r *Relay) forward(done chan relayDone) {
+	var n int64
+	var err error
+	if nil != r.Forward {
+		counter := &countWriter{Writer: r.StreamWriter, count: func(c int) { n += int64(c) }}
+		err = r.Forward(counter)
+	} else {
+		n, err = helper.Relay(r.StreamWriter, r.Conn)
+	}
+	//flush compressor before closing stream write direction
+	if closer, ok := r.StreamWriter.(io.Closer); ok && r.StreamWriter != io.Writer(r.Stream) {
+		closer.Close()
+	}
+	if nil == err {
+		if nil != CloseWrite(r.Stream) {
+			err = ErrHalfCloseUnsupported
+		}
+	}
+	done <- relayDone{forward: true, n: n, err: err}
+}
+
+func (r *Relay) backward(done chan relayDone) {
+	n, err := helper.Relay(r.Conn, r.StreamReader)
+	//stream closed by relay should not be propagated to conn
+	if nil == err && atomic.LoadInt32(&r.closed) == 0 {
+		if nil != CloseWrite(r.Conn) {
+			err = ErrHalfCloseUnsupported
+		}
+	}
+	done <- relayDone{forward: false, n: n, err: err}
+}
+
+func (r *Relay) close(reason string, closeConn bool) {
+	r.closeOnce.Do(func() {
+		atomic.StoreInt32(&r.closed, 1)
+		r.CloseReason = reason
+		if closeConn {
+			r.Conn.Close()
+		}
+		r.Stream.Close()
+	})
+}
+
+//Run relay until both directions finished, it returns the close reason.
+func (r *Relay) Run() string {
+	if nil == r.StreamReader {
+		r.StreamReader = r.Stream
+	}
+	if nil == r.StreamWriter {
+		r.StreamWriter = r.Stream
+	}
+	idleTimeout := r.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultRelayIdleTimeout
+	}
+	done := make(chan relayDone, 2)
+	go r.forward(done)
+	go r.backward(done)
+	ticker := time.NewTicker(relayIdleCheckPeriod)
+	defer ticker.Stop()
+	for finished := 0; finished < 2; {
+		select {
+		case res := <-done:
+			finished++
+			if res.forward {
+				r.ForwardBytes = res.n
+			} else {
+				r.BackwardBytes = res.n
+			}
+			switch res.err {
+			case nil:
+				if finished == 2 {
+					r.close(RelayCloseEOF, true)
+				}
+			case ErrRelaySwitchStream:
+				r.close(RelayCloseSwitch, false)
+			case ErrHalfCloseUnsupported:
+				r.close(RelayCloseNoHalfClose, true)
+			default:
+				if res.forward {
+					r.close(RelayCloseConnError, true)
+				} else {
+					r.close(RelayCloseStreamError, true)
+				}
+			}
+		case <-ticker.C:
+			latest := r.Stream.LatestIOTime()
+			if nil != r.OnActive {
+				r.OnActive(latest)
+			}
+			if time.Now().Sub(latest) > idleTimeout {
+				logger.Debug("Close stream[%d] since it's not active since %v ago.", r.Stream.StreamID(), time.Now().Sub(latest))
+				r.close(RelayCloseIdle, true)
+			}
+		}
+	}
+	recordRelay(r)
+	return r.CloseReason
+}
+
+var relayStat struct {
+	forwardBytes  int64
+	backwardBytes int64
+	reasons       sync.Map
+}
+
+func recordRelay(r *Relay) {
+	atomic.AddInt64(&relayStat.forwardBytes, r.ForwardBytes)
+	atomic.AddInt64(&relayStat.backwardBytes, r.BackwardBytes)
+	counter, _ := relayStat.reasons.LoadOrStore(r.CloseReason, new(int64))
+	atomic.AddInt64(counter.(*int64), 1)
+}
+
+//DumpRelayStat dump relayed bytes & close reasons of all finished relays
+func DumpRelayStat(w io.Writer) {
+	fmt.Fprintf(w, "RelayForwardBytes: %d\n", atomic.LoadInt64(&relayStat.forwardBytes))
+	fmt.Fprintf(w, "RelayBackwardBytes: %d\n", atomic.LoadInt64(&relayStat.backwardBytes))
+	relayStat.reasons.Range(func(key, value interface{}) bool {
+		fmt.Fprintf(w, "RelayClose[%s]: %d\n", key, atomic.LoadInt64(value.(*int64)))
+		return true
+	})
+}
@@ -0,0 +1,80 @@
+package mux
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/pmux"
+)
+
+func TestRelayIdleTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	cfg := pmux.DefaultConfig()
+	cfg.CipherMethod = "chacha20poly1305"
+	client, _ := pmux.Client(c1, cfg)
+	server, _ := pmux.Server(c2, cfg)
+	defer client.Close()
+	defer server.Close()
+	clientSession := &ProxyMuxSession{Session: client}
+	serverSession := &ProxyMuxSession{Session: server}
+
+	stream, err := clientSession.OpenStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	go func() {
+		remote, err := serverSession.AcceptStream()
+		if nil != err {
+			return
+		}
+		//keep the remote stream open without any io
+		buf := make([]byte, 1)
+		remote.Read(buf)
+	}()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	start := time.Now()
+	reason := (&Relay{Conn: conn, Stream: stream, IdleTimeout: time.Second}).Run()
+	if reason != RelayCloseIdle {
+		t.Fatalf("unexpected close reason:%s", reason)
+	}
+	//the idle stream is checked periodically, it's closed in the next check after timeout
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > time.Second+2*relayIdleCheckPeriod {
+		t.Fatalf("unexpected idle duration:%v", elapsed)
+	}
+}
+
+func TestConnectStreamCancel(t *testing.T) {
+	c1, c2 := net.Pipe()
+	cfg := pmux.DefaultConfig()
+	cfg.CipherMethod = "chacha20poly1305"
+	client, _ := pmux.Client(c1, cfg)
+	server, _ := pmux.Server(c2, cfg)
+	defer client.Close()
+	defer server.Close()
+	clientSession := &ProxyMuxSession{Session: client}
+	serverSession := &ProxyMuxSession{Session: server}
+
+	stream, err := clientSession.OpenStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	go serverSession.AcceptStream()
+	//the peer never reads, the send window is exhausted
+	if _, err = stream.Write(make([]byte, cfg.MaxStreamWindowSize)); nil != err {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err = ConnectStream(ctx, stream, "tcp", "127.0.0.1:80", StreamOptions{}); err != context.Canceled {
+		t.Fatalf("Unexpected error:%v after cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Connect is not cancelled in time, elapsed:%v", elapsed)
+	}
+}
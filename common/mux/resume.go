@@ -0,0 +1,645 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+const (
+	resumeMagic = "GSNR"
+
+	resumeStatusNew     = byte(0)
+	resumeStatusResumed = byte(1)
+	resumeStatusUnknown = byte(2)
+
+	resumeFrameData  = byte(1)
+	resumeFrameAck   = byte(2)
+	resumeFrameClose = byte(3)
+
+	resumeAckThreshold    = 32 * 1024
+	resumeMaxFrameSize    = 64 * 1024
+	resumeMaxReplayBuffer = 4 * 1024 * 1024
+
+	resumeHandshakeTimeout = 10 * time.Second
+	//magic + token + recv seq + counter + hmac
+	resumeRequestSize = len(resumeMagic) + 16 + 8 + 8 + sha256.Size
+
+	DefaultResumeGracePeriod = 60 * time.Second
+
+	//server side resumable conns pin their replay buffers in memory for the grace period,
+	//the oldest ones are evicted once the global or per user limit reached
+	MaxResumableConns        = 1024
+	MaxResumableConnsPerUser = 32
+)
+
+var (
+	ErrResumeTimeout      = errors.New("resumable conn not resumed in grace period")
+	ErrResumeUnknownToken = errors.New("unknown resume token")
+	ErrResumeDataLost     = errors.New("resume data lost")
+	ErrResumeNotAllowed   = errors.New("resume not allowed without key over non TLS conn")
+	ErrResumeEvicted      = errors.New("resumable conn evicted by newer ones")
+)
+
+type resumeToken [16]byte
+
+//ResumableConn is a byte stream which survive underlying connection loss.
+//Every side keeps written bytes in a replay buffer until acked by peer, after a reconnect within
+//grace period, both sides exchange the received sequence & replay the missing bytes,
+//so the mux session above it continue without noticing.
+//Resume requests are authenticated by HMAC of the shared key with an increasing counter, so that a token
+//sniffed from a plain tcp conn could not be used or replayed to hijack the session.
+type ResumableConn struct {
+	token  resumeToken
+	key    []byte
+	dialer func() (net.Conn, error)
+	grace  time.Duration
+	//counter of resume handshakes, increased by client & checked by server to reject replayed requests
+	counter uint64
+	//user authenticated by the mux session over the conn & the element in registry, only used by server
+	user     string
+	registry *resumableRegistry
+	elem     *list.Element
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	writeLock sync.Mutex
+	conn      net.Conn
+	connGen   int
+	closed    bool
+	closeErr  error
+
+	sendBuf   []byte
+	sendAcked uint64
+	recvSeq   uint64
+	ackedSeq  uint64
+	recvBuf   bytes.Buffer
+}
+
+func newResumableConn(token resumeToken, key []byte, grace time.Duration) *ResumableConn {
+	if grace <= 0 {
+		grace = DefaultResumeGracePeriod
+	}
+	c := &ResumableConn{token: token, key: key, grace: grace}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+func writeResumeFrame(conn net.Conn, typ byte, payload []byte) error {
+	header := make([]byte, 5)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	_, err := conn.Write(append(header, payload...))
+	return err
+}
+
+func readResumeFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); nil != err {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > resumeMaxFrameSize {
+		return 0, nil, ErrToolargeMessage
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); nil != err {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+func (c *ResumableConn) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.recvBuf.Len() == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if c.recvBuf.Len() > 0 {
+		return c.recvBuf.Read(p)
+	}
+	return 0, c.closeErr
+}
+
+func (c *ResumableConn) Write(p []byte) (int, error) {
+	//never wait for acks with writeLock held, acks & replays after resumed need it
+	for {
+		c.writeLock.Lock()
+		c.mutex.Lock()
+		if c.closed || len(c.sendBuf) == 0 || len(c.sendBuf)+len(p) <= resumeMaxReplayBuffer {
+			break
+		}
+		c.writeLock.Unlock()
+		c.cond.Wait()
+		c.mutex.Unlock()
+	}
+	defer c.writeLock.Unlock()
+	if c.closed {
+		err := c.closeErr
+		c.mutex.Unlock()
+		return 0, err
+	}
+	c.sendBuf = append(c.sendBuf, p...)
+	conn, gen := c.conn, c.connGen
+	c.mutex.Unlock()
+	if nil != conn {
+		if err := c.writeData(conn, p); nil != err {
+			//data is kept in replay buffer, would be sent after resumed
+			c.broken(gen, err)
+		}
+	}
+	return len(p), nil
+}
+
+func (c *ResumableConn) writeData(conn net.Conn, p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if n > resumeMaxFrameSize {
+			n = resumeMaxFrameSize
+		}
+		if err := writeResumeFrame(conn, resumeFrameData, p[0:n]); nil != err {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func (c *ResumableConn) sendAck(conn net.Conn, seq uint64) error {
+	ack := make([]byte, 8)
+	binary.BigEndian.PutUint64(ack, seq)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return writeResumeFrame(conn, resumeFrameAck, ack)
+}
+
+func (c *ResumableConn) trimSendBuffer(seq uint64) error {
+	if seq < c.sendAcked {
+		return nil
+	}
+	n := seq - c.sendAcked
+	if n > uint64(len(c.sendBuf)) {
+		return ErrResumeDataLost
+	}
+	c.sendBuf = c.sendBuf[n:]
+	c.sendAcked = seq
+	c.cond.Broadcast()
+	return nil
+}
+
+//ackLoop send the acked seq once notified, acks are sent out of readLoop so that reading never blocks
+//on a writer which is blocked by the peer.
+func (c *ResumableConn) ackLoop(conn net.Conn, notify chan struct{}) {
+	for range notify {
+		c.mutex.Lock()
+		seq := c.ackedSeq
+		c.mutex.Unlock()
+		if nil != c.sendAck(conn, seq) {
+			return
+		}
+	}
+}
+
+func (c *ResumableConn) readLoop(conn net.Conn, gen int) {
+	reader := bufio.NewReader(conn)
+	ackNotify := make(chan struct{}, 1)
+	go c.ackLoop(conn, ackNotify)
+	defer close(ackNotify)
+	for {
+		typ, payload, err := readResumeFrame(reader)
+		if nil != err {
+			c.broken(gen, err)
+			return
+		}
+		switch typ {
+		case resumeFrameData:
+			c.mutex.Lock()
+			if gen != c.connGen {
+				//frames from detached conn would be replayed by peer on the new conn
+				c.mutex.Unlock()
+				return
+			}
+			c.recvBuf.Write(payload)
+			c.recvSeq += uint64(len(payload))
+			seq := c.recvSeq
+			needAck := seq-c.ackedSeq >= resumeAckThreshold
+			if needAck {
+				c.ackedSeq = seq
+			}
+			c.cond.Broadcast()
+			c.mutex.Unlock()
+			if needAck {
+				select {
+				case ackNotify <- struct{}{}:
+				default:
+				}
+			}
+		case resumeFrameAck:
+			if len(payload) == 8 {
+				c.mutex.Lock()
+				c.trimSendBuffer(binary.BigEndian.Uint64(payload))
+				c.mutex.Unlock()
+			}
+		case resumeFrameClose:
+			c.shutdown(io.EOF, false)
+			return
+		}
+	}
+}
+
+//attach bind a new underlying connection & replay bytes which the peer has not received
+func (c *ResumableConn) attach(conn net.Conn, peerRecvSeq uint64) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		conn.Close()
+		return c.closeErr
+	}
+	if err := c.trimSendBuffer(peerRecvSeq); nil != err {
+		c.mutex.Unlock()
+		conn.Close()
+		c.shutdown(err, false)
+		return err
+	}
+	if nil != c.conn {
+		c.conn.Close()
+	}
+	c.conn = conn
+	c.connGen++
+	gen := c.connGen
+	c.ackedSeq = c.recvSeq
+	pending := make([]byte, len(c.sendBuf))
+	copy(pending, c.sendBuf)
+	c.mutex.Unlock()
+	go c.readLoop(conn, gen)
+	if err := c.writeData(conn, pending); nil != err {
+		go c.broken(gen, err)
+	}
+	return nil
+}
+
+//detach close current underlying connection, frames still in flight on it are ignored
+func (c *ResumableConn) detach() (int, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if nil != c.conn {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.connGen++
+	return c.connGen, c.recvSeq
+}
+
+func (c *ResumableConn) broken(gen int, err error) {
+	c.mutex.Lock()
+	if c.closed || gen != c.connGen || nil == c.conn {
+		c.mutex.Unlock()
+		return
+	}
+	c.mutex.Unlock()
+	detachedGen, _ := c.detach()
+	logger.Notice("Resumable conn broken with reason:%v, wait resume in %v", err, c.grace)
+
+	deadline := time.Now().Add(c.grace)
+	if nil != c.dialer {
+		go c.reconnect(deadline)
+	}
+	time.AfterFunc(c.grace, func() {
+		c.mutex.Lock()
+		resumed := c.connGen != detachedGen
+		c.mutex.Unlock()
+		if !resumed {
+			c.shutdown(ErrResumeTimeout, false)
+		}
+	})
+}
+
+func (c *ResumableConn) reconnect(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		closed := c.closed
+		c.mutex.Unlock()
+		if closed {
+			return
+		}
+		conn, err := c.dialer()
+		if nil == err {
+			var peerRecvSeq uint64
+			peerRecvSeq, err = c.clientHandshake(conn)
+			if nil == err {
+				err = c.attach(conn, peerRecvSeq)
+				if nil == err {
+					logger.Notice("Resumable conn resumed.")
+				}
+				return
+			}
+			conn.Close()
+			if err == ErrResumeUnknownToken {
+				c.shutdown(err, false)
+				return
+			}
+		}
+		logger.Notice("Failed to resume conn with reason:%v", err)
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func resumeRequestMAC(key []byte, req []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(req[:resumeRequestSize-sha256.Size])
+	return mac.Sum(nil)
+}
+
+//ResumeAllowed return true if conn could be resumed securely, the token is sent in plain text over non TLS conns,
+//which is only safe while resume requests are authenticated by a key.
+func ResumeAllowed(conn net.Conn, key []byte) bool {
+	if len(key) > 0 {
+		return true
+	}
+	if pc, ok := conn.(*peekedConn); ok {
+		conn = pc.Conn
+	}
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+func (c *ResumableConn) clientHandshake(conn net.Conn) (uint64, error) {
+	c.mutex.Lock()
+	recvSeq := c.recvSeq
+	c.counter++
+	counter := c.counter
+	c.mutex.Unlock()
+	req := make([]byte, resumeRequestSize)
+	copy(req, resumeMagic)
+	copy(req[len(resumeMagic):], c.token[:])
+	binary.BigEndian.PutUint64(req[len(resumeMagic)+16:], recvSeq)
+	binary.BigEndian.PutUint64(req[len(resumeMagic)+24:], counter)
+	copy(req[resumeRequestSize-sha256.Size:], resumeRequestMAC(c.key, req))
+	conn.SetDeadline(time.Now().Add(resumeHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(req); nil != err {
+		return 0, err
+	}
+	res := make([]byte, 1+16+8)
+	if _, err := io.ReadFull(conn, res); nil != err {
+		return 0, err
+	}
+	if res[0] == resumeStatusUnknown {
+		return 0, ErrResumeUnknownToken
+	}
+	copy(c.token[:], res[1:17])
+	return binary.BigEndian.Uint64(res[17:]), nil
+}
+
+func (c *ResumableConn) shutdown(err error, notifyPeer bool) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	c.closeErr = err
+	conn := c.conn
+	c.conn = nil
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+	if nil != conn {
+		if notifyPeer {
+			c.writeLock.Lock()
+			writeResumeFrame(conn, resumeFrameClose, nil)
+			c.writeLock.Unlock()
+		}
+		conn.Close()
+	}
+	if nil != c.registry {
+		c.registry.remove(c)
+	}
+}
+
+func (c *ResumableConn) Close() error {
+	c.shutdown(io.EOF, true)
+	return nil
+}
+
+//NewResumableClientConn create resumable conn on the connected conn, dialer is used to reconnect server,
+//key is shared with server to authenticate resume requests.
+func NewResumableClientConn(conn net.Conn, dialer func() (net.Conn, error), grace time.Duration, key []byte) (*ResumableConn, error) {
+	if !ResumeAllowed(conn, key) {
+		return nil, ErrResumeNotAllowed
+	}
+	c := newResumableConn(resumeToken{}, key, grace)
+	c.dialer = dialer
+	peerRecvSeq, err := c.clientHandshake(conn)
+	if nil != err {
+		return nil, err
+	}
+	return c, c.attach(conn, peerRecvSeq)
+}
+
+//resumableRegistry holds server side resumable conns by token, oldest first.
+type resumableRegistry struct {
+	mutex           sync.Mutex
+	conns           map[resumeToken]*ResumableConn
+	order           *list.List
+	users           map[string]int
+	maxConns        int
+	maxConnsPerUser int
+}
+
+func newResumableRegistry(maxConns, maxConnsPerUser int) *resumableRegistry {
+	return &resumableRegistry{
+		conns:           make(map[resumeToken]*ResumableConn),
+		order:           list.New(),
+		users:           make(map[string]int),
+		maxConns:        maxConns,
+		maxConnsPerUser: maxConnsPerUser,
+	}
+}
+
+var resumableConns = newResumableRegistry(MaxResumableConns, MaxResumableConnsPerUser)
+
+func (r *resumableRegistry) load(token resumeToken) (*ResumableConn, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, exist := r.conns[token]
+	return c, exist
+}
+
+//add register the new conn, & evict the oldest conns while over the global limit
+func (r *resumableRegistry) add(c *ResumableConn) {
+	var evicted []*ResumableConn
+	r.mutex.Lock()
+	r.conns[c.token] = c
+	c.registry = r
+	c.elem = r.order.PushBack(c)
+	for len(r.conns) > r.maxConns {
+		oldest := r.order.Front().Value.(*ResumableConn)
+		r.removeLocked(oldest)
+		evicted = append(evicted, oldest)
+	}
+	r.mutex.Unlock()
+	shutdownEvicted(evicted)
+}
+
+//bindUser count the conn for the user, & evict the oldest conn of the user while over the per user limit
+func (r *resumableRegistry) bindUser(c *ResumableConn, user string) {
+	var evicted []*ResumableConn
+	r.mutex.Lock()
+	if nil == c.elem || len(c.user) > 0 {
+		r.mutex.Unlock()
+		return
+	}
+	c.user = user
+	r.users[user]++
+	for e := r.order.Front(); nil != e && r.users[user] > r.maxConnsPerUser; {
+		next := e.Next()
+		if old := e.Value.(*ResumableConn); old != c && old.user == user {
+			r.removeLocked(old)
+			evicted = append(evicted, old)
+		}
+		e = next
+	}
+	r.mutex.Unlock()
+	shutdownEvicted(evicted)
+}
+
+func (r *resumableRegistry) removeLocked(c *ResumableConn) {
+	if nil == c.elem {
+		return
+	}
+	r.order.Remove(c.elem)
+	c.elem = nil
+	delete(r.conns, c.token)
+	if len(c.user) > 0 {
+		if r.users[c.user]--; r.users[c.user] <= 0 {
+			delete(r.users, c.user)
+		}
+	}
+}
+
+func (r *resumableRegistry) remove(c *ResumableConn) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.removeLocked(c)
+}
+
+func shutdownEvicted(evicted []*ResumableConn) {
+	for _, c := range evicted {
+		logger.Notice("Evict resumable conn of user:%s since too many resumable conns.", c.user)
+		c.shutdown(ErrResumeEvicted, true)
+	}
+}
+
+//BindResumableUser count the resumable conn under the mux session for the user authenticated by the session,
+//so that a user could only pin limited resumable conns. It does nothing if the session is not over a resumable conn.
+func BindResumableUser(session MuxSession, user string) {
+	if ps, ok := session.(*ProxyMuxSession); ok {
+		if c, ok := ps.Session.Conn().(*ResumableConn); ok {
+			resumableConns.bindUser(c, user)
+		}
+	}
+}
+
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+//AcceptResumableConn check if the accepted conn is a resumable conn, return the conn which should be served by mux session,
+//and nil if the conn is attached to an existing resumable conn.
+func AcceptResumableConn(conn net.Conn, grace time.Duration, key []byte) (io.ReadWriteCloser, error) {
+	conn.SetDeadline(time.Now().Add(resumeHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	magic, err := reader.Peek(len(resumeMagic))
+	if nil != err {
+		conn.Close()
+		return nil, err
+	}
+	if string(magic) != resumeMagic {
+		conn.SetDeadline(time.Time{})
+		return &peekedConn{Conn: conn, r: reader}, nil
+	}
+	req := make([]byte, resumeRequestSize)
+	if _, err = io.ReadFull(reader, req); nil != err {
+		conn.Close()
+		return nil, err
+	}
+	var token resumeToken
+	copy(token[:], req[len(resumeMagic):])
+	peerRecvSeq := binary.BigEndian.Uint64(req[len(resumeMagic)+16:])
+	counter := binary.BigEndian.Uint64(req[len(resumeMagic)+24:])
+	res := make([]byte, 1+16+8)
+	if !ResumeAllowed(conn, key) || !hmac.Equal(req[resumeRequestSize-sha256.Size:], resumeRequestMAC(key, req)) {
+		res[0] = resumeStatusUnknown
+		conn.Write(res)
+		conn.Close()
+		return nil, ErrResumeNotAllowed
+	}
+	var rc *ResumableConn
+	var recvSeq uint64
+	isNew := token == resumeToken{}
+	if isNew {
+		rand.Read(token[:])
+		rc = newResumableConn(token, key, grace)
+		rc.counter = counter
+		resumableConns.add(rc)
+		res[0] = resumeStatusNew
+	} else if v, exist := resumableConns.load(token); exist && v.acceptCounter(counter) {
+		rc = v
+		res[0] = resumeStatusResumed
+		//the old conn may be still alive in server side
+		_, recvSeq = rc.detach()
+	} else {
+		res[0] = resumeStatusUnknown
+		conn.Write(res)
+		conn.Close()
+		return nil, ErrResumeUnknownToken
+	}
+	copy(res[1:], token[:])
+	binary.BigEndian.PutUint64(res[17:], recvSeq)
+	if _, err = conn.Write(res); nil != err {
+		conn.Close()
+		if isNew {
+			rc.shutdown(err, false)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if err = rc.attach(&peekedConn{Conn: conn, r: reader}, peerRecvSeq); nil != err {
+		return nil, err
+	}
+	if isNew {
+		return rc, nil
+	}
+	logger.Notice("Resumable conn resumed from %v", conn.RemoteAddr())
+	return nil, nil
+}
+
+//acceptCounter check the counter of a resume request is greater than all accepted ones
+func (c *ResumableConn) acceptCounter(counter uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed || counter <= c.counter {
+		return false
+	}
+	c.counter = counter
+	return true
+}
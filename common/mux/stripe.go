@@ -0,0 +1,420 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/logger"
+)
+
+const (
+	stripeChunkSize      = 16 * 1024
+	stripeMaxPending     = 256
+	stripeJoinTimeout    = 10 * time.Second
+	stripeCloseTimeout   = 5 * time.Second
+	stripeChunkHeaderLen = 12
+	MaxStripeSubflows    = 16
+	//groups waiting for subflows to join, bounded globally & per user
+	stripeMaxGroups        = 1024
+	stripeMaxGroupsPerUser = 64
+)
+
+var ErrStripeBroken = errors.New("striped stream broken")
+
+type stripeChunk struct {
+	seq  uint64
+	data []byte
+}
+
+// StripedStream split one logical stream into sequence numbered chunks over several subflow streams,
+// faster subflows would carry more chunks, and the peer reorder chunks before delivering.
+// It behaves as the primary stream until connected with 'tcp' network.
+type StripedStream struct {
+	//unix nano of latest io, accessed atomically by readers & writers
+	latestIOTime int64
+	MuxStream
+	count    int
+	opener   func(index int) (MuxStream, error)
+	subflows []MuxStream
+	striped  bool
+
+	writeSeq    uint64
+	chunks      chan stripeChunk
+	writers     sync.WaitGroup
+	closeCh     chan struct{}
+	closeChOnce sync.Once
+	closeOnce   sync.Once
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	pending map[uint64][]byte
+	readSeq uint64
+	readBuf []byte
+	eofs    int
+	err     error
+}
+
+// NewStripedStream create a striped stream with primary stream, opener is used to open other subflows while connecting.
+func NewStripedStream(primary MuxStream, count int, opener func(index int) (MuxStream, error)) *StripedStream {
+	return &StripedStream{MuxStream: primary, count: count, opener: opener}
+}
+
+func (s *StripedStream) start(subflows []MuxStream) {
+	s.subflows = subflows
+	s.striped = true
+	s.cond = sync.NewCond(&s.mutex)
+	s.pending = make(map[uint64][]byte)
+	s.chunks = make(chan stripeChunk, len(subflows)*4)
+	s.closeCh = make(chan struct{})
+	s.touch()
+	for _, sub := range subflows {
+		s.writers.Add(1)
+		go s.writeLoop(sub)
+		go s.readLoop(sub)
+	}
+}
+
+func (s *StripedStream) touch() {
+	atomic.StoreInt64(&s.latestIOTime, time.Now().UnixNano())
+}
+
+func (s *StripedStream) fail(err error) {
+	s.mutex.Lock()
+	if nil == s.err {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+}
+
+func (s *StripedStream) writeChunk(sub MuxStream, c stripeChunk) error {
+	frame := make([]byte, stripeChunkHeaderLen+len(c.data))
+	binary.BigEndian.PutUint64(frame, c.seq)
+	binary.BigEndian.PutUint32(frame[8:], uint32(len(c.data)))
+	copy(frame[stripeChunkHeaderLen:], c.data)
+	_, err := sub.Write(frame)
+	return err
+}
+
+func (s *StripedStream) writeLoop(sub MuxStream) {
+	defer s.writers.Done()
+	for {
+		select {
+		case c := <-s.chunks:
+			if err := s.writeChunk(sub, c); nil != err {
+				//the chunk is lost, the whole stream is broken
+				s.fail(err)
+				return
+			}
+		case <-s.closeCh:
+			//flush chunks already queued before close
+			for {
+				select {
+				case c := <-s.chunks:
+					if err := s.writeChunk(sub, c); nil != err {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *StripedStream) readLoop(sub MuxStream) {
+	header := make([]byte, stripeChunkHeaderLen)
+	for {
+		_, err := io.ReadFull(sub, header)
+		var data []byte
+		if nil == err {
+			length := binary.BigEndian.Uint32(header[8:])
+			if length > stripeChunkSize {
+				err = ErrToolargeMessage
+			} else {
+				data = make([]byte, length)
+				_, err = io.ReadFull(sub, data)
+			}
+		}
+		s.mutex.Lock()
+		if nil != err {
+			if err == io.EOF {
+				s.eofs++
+			} else if nil == s.err {
+				s.err = err
+			}
+			s.cond.Broadcast()
+			s.mutex.Unlock()
+			return
+		}
+		seq := binary.BigEndian.Uint64(header)
+		//a subflow always carry increasing sequence, so the expected chunk is never blocked here
+		for len(s.pending) >= stripeMaxPending && seq != s.readSeq && nil == s.err {
+			s.cond.Wait()
+		}
+		s.pending[seq] = data
+		s.cond.Broadcast()
+		s.mutex.Unlock()
+	}
+}
+
+func (s *StripedStream) Connect(network string, addr string, opt StreamOptions) error {
+	return s.ConnectContext(context.Background(), network, addr, opt)
+}
+
+func (s *StripedStream) ConnectContext(ctx context.Context, network string, addr string, opt StreamOptions) error {
+	if network != "tcp" || s.count <= 1 || nil == s.opener {
+		return ConnectStream(ctx, s.MuxStream, network, addr, opt)
+	}
+	subflows := []MuxStream{s.MuxStream}
+	for i := 1; i < s.count; i++ {
+		sub, err := s.opener(i)
+		if nil != err {
+			logger.Notice("Stripe stream with %d subflows since failed to open more with reason:%v", len(subflows), err)
+			break
+		}
+		subflows = append(subflows, sub)
+	}
+	if len(subflows) == 1 {
+		return ConnectStream(ctx, s.MuxStream, network, addr, opt)
+	}
+	opt.StripeID = helper.RandAsciiString(16)
+	opt.StripeCount = len(subflows)
+	for i, sub := range subflows {
+		opt.StripeIndex = i
+		if err := ConnectStream(ctx, sub, network, addr, opt); nil != err {
+			for _, sub := range subflows {
+				sub.Close()
+			}
+			return err
+		}
+	}
+	s.start(subflows)
+	return nil
+}
+
+func (s *StripedStream) Write(p []byte) (int, error) {
+	if !s.striped {
+		return s.MuxStream.Write(p)
+	}
+	s.touch()
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > stripeChunkSize {
+			n = stripeChunkSize
+		}
+		data := make([]byte, n)
+		copy(data, p)
+		select {
+		case <-s.closeCh:
+			return written, io.ErrClosedPipe
+		default:
+		}
+		s.mutex.Lock()
+		err := s.err
+		s.mutex.Unlock()
+		if nil != err {
+			return written, err
+		}
+		select {
+		case s.chunks <- stripeChunk{seq: s.writeSeq, data: data}:
+			s.writeSeq++
+		case <-s.closeCh:
+			return written, io.ErrClosedPipe
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *StripedStream) Read(p []byte) (int, error) {
+	if !s.striped {
+		return s.MuxStream.Read(p)
+	}
+	s.touch()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		if len(s.readBuf) > 0 {
+			n := copy(p, s.readBuf)
+			s.readBuf = s.readBuf[n:]
+			return n, nil
+		}
+		if data, exist := s.pending[s.readSeq]; exist {
+			delete(s.pending, s.readSeq)
+			s.readSeq++
+			s.readBuf = data
+			s.cond.Broadcast()
+			continue
+		}
+		if nil != s.err {
+			return 0, s.err
+		}
+		if s.eofs == len(s.subflows) {
+			if len(s.pending) > 0 {
+				return 0, ErrStripeBroken
+			}
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+}
+
+func (s *StripedStream) Close() error {
+	if !s.striped {
+		return s.MuxStream.Close()
+	}
+	s.closeOnce.Do(func() {
+		s.closeWriters()
+		deadline := time.Now().Add(stripeCloseTimeout)
+		for _, sub := range s.subflows {
+			sub.SetWriteDeadline(deadline)
+		}
+		s.writers.Wait()
+		for _, sub := range s.subflows {
+			sub.Close()
+		}
+		s.fail(io.ErrClosedPipe)
+	})
+	return nil
+}
+
+// closeWriters stop accepting writes, chunks already queued are flushed by the writers
+func (s *StripedStream) closeWriters() {
+	s.closeChOnce.Do(func() {
+		close(s.closeCh)
+	})
+}
+
+// CloseWrite flush queued chunks & half close all subflows, the peer read EOF once all subflows reach EOF.
+func (s *StripedStream) CloseWrite() error {
+	if !s.striped {
+		return CloseWrite(s.MuxStream)
+	}
+	s.closeWriters()
+	s.writers.Wait()
+	var err error
+	for _, sub := range s.subflows {
+		if cerr := CloseWrite(sub); nil != cerr && nil == err {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *StripedStream) SetReadDeadline(t time.Time) error {
+	for _, sub := range s.subflows {
+		sub.SetReadDeadline(t)
+	}
+	return s.MuxStream.SetReadDeadline(t)
+}
+
+func (s *StripedStream) SetWriteDeadline(t time.Time) error {
+	for _, sub := range s.subflows {
+		sub.SetWriteDeadline(t)
+	}
+	return s.MuxStream.SetWriteDeadline(t)
+}
+
+func (s *StripedStream) SetPriority(class int) {
+	SetStreamPriority(s.MuxStream, class)
+	for _, sub := range s.subflows {
+		SetStreamPriority(sub, class)
+	}
+}
+
+func (s *StripedStream) LatestIOTime() time.Time {
+	if !s.striped {
+		return s.MuxStream.LatestIOTime()
+	}
+	return time.Unix(0, atomic.LoadInt64(&s.latestIOTime))
+}
+
+type stripeGroup struct {
+	compressor string
+	subflows   []MuxStream
+	joined     int
+	timer      *time.Timer
+}
+
+//stripe ids are chosen by clients, so groups are scoped by the authenticated user
+type stripeGroupKey struct {
+	user string
+	id   string
+}
+
+var stripeGroups = make(map[stripeGroupKey]*stripeGroup)
+var stripeUserGroups = make(map[string]int)
+var stripeGroupsMutex sync.Mutex
+
+func removeStripeGroup(key stripeGroupKey) {
+	delete(stripeGroups, key)
+	if stripeUserGroups[key.user]--; stripeUserGroups[key.user] <= 0 {
+		delete(stripeUserGroups, key.user)
+	}
+}
+
+// JoinStripedStream collect subflows of a striped stream of the user in server side,
+// return the striped stream when all subflows joined, otherwise nil.
+// All subflows must be from sessions negotiated the same compressor, since the striped stream is compressed as a whole.
+func JoinStripedStream(user string, id string, index int, count int, compressor string, stream MuxStream) *StripedStream {
+	if count > MaxStripeSubflows || index < 0 || index >= count {
+		stream.Close()
+		return nil
+	}
+	key := stripeGroupKey{user: user, id: id}
+	stripeGroupsMutex.Lock()
+	defer stripeGroupsMutex.Unlock()
+	group, exist := stripeGroups[key]
+	if !exist {
+		if len(stripeGroups) >= stripeMaxGroups || stripeUserGroups[user] >= stripeMaxGroupsPerUser {
+			logger.Error("Striped stream:%s of user:%s rejected since too many striped streams are joining.", id, user)
+			stream.Close()
+			return nil
+		}
+		group = &stripeGroup{compressor: compressor, subflows: make([]MuxStream, count)}
+		stripeGroups[key] = group
+		stripeUserGroups[user]++
+		group.timer = time.AfterFunc(stripeJoinTimeout, func() {
+			stripeGroupsMutex.Lock()
+			defer stripeGroupsMutex.Unlock()
+			if stripeGroups[key] != group {
+				return
+			}
+			logger.Error("Striped stream:%s closed since only %d/%d subflows joined.", id, group.joined, count)
+			removeStripeGroup(key)
+			for _, sub := range group.subflows {
+				if nil != sub {
+					sub.Close()
+				}
+			}
+		})
+	}
+	if len(group.subflows) != count || nil != group.subflows[index] {
+		stream.Close()
+		return nil
+	}
+	if group.compressor != compressor {
+		logger.Error("Striped stream:%s closed since subflows use different compressors:%s/%s.", id, group.compressor, compressor)
+		stream.Close()
+		return nil
+	}
+	group.subflows[index] = stream
+	group.joined++
+	if group.joined < count {
+		return nil
+	}
+	group.timer.Stop()
+	removeStripeGroup(key)
+	s := &StripedStream{MuxStream: group.subflows[0], count: count}
+	s.start(group.subflows)
+	return s
+}
@@ -2,14 +2,57 @@ package mux
 
 import (
 	"io"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/pmux"
 )
 
 type WsConn struct {
 	*websocket.Conn
 	msgReader io.Reader
+	pongCh    chan struct{}
+}
+
+func NewWsConn(c *websocket.Conn) *WsConn {
+	ws := &WsConn{Conn: c}
+	ws.pongCh = make(chan struct{}, 1)
+	c.SetPongHandler(func(string) error {
+		helper.AsyncNotify(ws.pongCh)
+		return nil
+	})
+	return ws
+}
+
+//Ping send websocket ping control message & wait pong,
+//the pong is handled in the reading loop of mux session.
+func (ws *WsConn) Ping() (time.Duration, error) {
+	c := ws.Conn
+	if nil == c {
+		return 0, io.EOF
+	}
+	select {
+	case <-ws.pongCh:
+	default:
+	}
+	start := time.Now()
+	err := c.WriteControl(websocket.PingMessage, nil, start.Add(DefaultPingTimeout))
+	if nil != err {
+		return 0, err
+	}
+	select {
+	case <-ws.pongCh:
+		return time.Now().Sub(start), nil
+	case <-time.After(DefaultPingTimeout):
+		return 0, ErrPingTimeout
+	}
+}
+
+//NewWsMuxSession create mux session over websocket which ping by websocket control message
+func NewWsMuxSession(session *pmux.Session, conn *WsConn) *ProxyMuxSession {
+	return &ProxyMuxSession{Session: session, pinger: conn.Ping}
 }
 
 func (ws *WsConn) Write(p []byte) (int, error) {
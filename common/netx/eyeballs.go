@@ -0,0 +1,173 @@
+package netx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	//IPv6Prefer try IPv6 addresses first, which is the default as RFC 8305 recommended
+	IPv6Prefer = "prefer"
+	//IPv6Fallback try IPv4 addresses first, IPv6 addresses are still raced after them
+	IPv6Fallback = "fallback"
+	//IPv6Require only use IPv6 addresses
+	IPv6Require = "require"
+	//IPv6Disable only use IPv4 addresses
+	IPv6Disable = "disable"
+
+	//DefaultAttemptDelay is the recommended 'Connection Attempt Delay' in RFC 8305
+	DefaultAttemptDelay = 250 * time.Millisecond
+)
+
+var ErrNoSuitableAddress = errors.New("no suitable address")
+
+//IsValidIPv6Mode check if the mode is one of ""/prefer/fallback/require/disable, empty mode means prefer.
+func IsValidIPv6Mode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case "", IPv6Prefer, IPv6Fallback, IPv6Require, IPv6Disable:
+		return true
+	}
+	return false
+}
+
+//SortIPs filter addresses by IPv6 mode, and interleave the two address families
+//with the preferred family first as RFC 8305 section 4 described.
+func SortIPs(ips []net.IP, mode string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if nil != ip.To4() {
+			v4 = append(v4, ip)
+		} else if nil != ip.To16() {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	switch strings.ToLower(mode) {
+	case IPv6Require:
+		return v6
+	case IPv6Disable:
+		return v4
+	case IPv6Fallback:
+		first, second = v4, v6
+	}
+	sorted := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+//DialParallel dial addresses in order with staggered attempts, a new attempt is started when
+//the previous one failed or the delay elapsed. The first established connection wins, others are cancelled.
+func DialParallel(ctx context.Context, network string, addrs []string, delay time.Duration) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, ErrNoSuitableAddress
+	}
+	if len(addrs) == 1 {
+		return DialContext(ctx, network, addrs[0])
+	}
+	if delay <= 0 {
+		delay = DefaultAttemptDelay
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	next, running := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		running++
+		go func() {
+			conn, err := DialContext(ctx, network, addr)
+			results <- dialResult{conn, err}
+		}()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	start()
+	var lastErr error
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if nil == r.err {
+				//close connections established by other attempts after the winner
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if loser := <-results; nil != loser.conn {
+							loser.conn.Close()
+						}
+					}
+				}(running)
+				return r.conn, nil
+			}
+			lastErr = r.err
+			if next < len(addrs) {
+				start()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(delay)
+			}
+		}
+	}
+	return nil, lastErr
+}
+
+//DialHappyEyeballs resolve the host of addr with lookup(nil means the default resolver), then race
+//connections to all returned addresses as RFC 8305. IP literal is dialed directly, non TCP network only dial the first suitable address.
+func DialHappyEyeballs(ctx context.Context, network, addr string, mode string, lookup func(host string) ([]net.IP, error)) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+	if nil != net.ParseIP(host) {
+		return DialContext(ctx, network, addr)
+	}
+	var ips []net.IP
+	if nil != lookup {
+		ips, err = lookup(host)
+	} else {
+		var addrs []net.IPAddr
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	if nil != err {
+		return nil, err
+	}
+	ips = SortIPs(ips, mode)
+	if len(ips) == 0 {
+		return nil, ErrNoSuitableAddress
+	}
+	if !strings.HasPrefix(network, "tcp") {
+		ips = ips[0:1]
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return DialParallel(ctx, network, addrs, DefaultAttemptDelay)
+}
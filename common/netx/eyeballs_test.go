@@ -0,0 +1,137 @@
+package netx
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSortIPs(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}
+	cases := map[string]string{
+		"":           "2001:db8::1,192.0.2.1,2001:db8::2,192.0.2.2",
+		IPv6Prefer:   "2001:db8::1,192.0.2.1,2001:db8::2,192.0.2.2",
+		IPv6Fallback: "192.0.2.1,2001:db8::1,192.0.2.2,2001:db8::2",
+		IPv6Require:  "2001:db8::1,2001:db8::2",
+		IPv6Disable:  "192.0.2.1,192.0.2.2",
+	}
+	for mode, expected := range cases {
+		var sorted []string
+		for _, ip := range SortIPs(ips, mode) {
+			sorted = append(sorted, ip.String())
+		}
+		if strings.Join(sorted, ",") != expected {
+			t.Fatalf("Unexpected sorted IPs:%v for mode:%s", sorted, mode)
+		}
+	}
+	if IsValidIPv6Mode("ipv4") || !IsValidIPv6Mode("Fallback") {
+		t.Fatalf("Invalid IPv6 mode check")
+	}
+}
+
+//fakeDial records dialed addresses, IPv6 addresses hang until cancelled, addresses with port 1 are refused
+type fakeDial struct {
+	mutex     sync.Mutex
+	dialed    []string
+	cancelled []string
+}
+
+func (f *fakeDial) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	f.mutex.Lock()
+	f.dialed = append(f.dialed, addr)
+	f.mutex.Unlock()
+	host, port, _ := net.SplitHostPort(addr)
+	if port == "1" {
+		return nil, errors.New("connection refused")
+	}
+	if strings.Contains(host, ":") {
+		<-ctx.Done()
+		f.mutex.Lock()
+		f.cancelled = append(f.cancelled, addr)
+		f.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (f *fakeDial) records() ([]string, []string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.dialed...), append([]string{}, f.cancelled...)
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	f := &fakeDial{}
+	OverrideDial(f.dial)
+	defer Reset()
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+	}
+	start := time.Now()
+	conn, err := DialHappyEyeballs(context.Background(), "tcp", "example.com:80", "", lookup)
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Close()
+	//the IPv6 attempt hangs, IPv4 attempt starts after the attempt delay
+	if elapsed := time.Since(start); elapsed < DefaultAttemptDelay || elapsed > 4*DefaultAttemptDelay {
+		t.Fatalf("Unexpected dial duration:%v", elapsed)
+	}
+	dialed, _ := f.records()
+	if strings.Join(dialed, ",") != "[2001:db8::1]:80,192.0.2.1:80" {
+		t.Fatalf("Unexpected dial order:%v", dialed)
+	}
+	//the losing attempt is cancelled once a connection established
+	for i := 0; i < 100; i++ {
+		if _, cancelled := f.records(); len(cancelled) == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("The losing attempt is not cancelled")
+}
+
+func TestDialParallelFailFast(t *testing.T) {
+	f := &fakeDial{}
+	OverrideDial(f.dial)
+	defer Reset()
+	start := time.Now()
+	conn, err := DialParallel(context.Background(), "tcp", []string{"192.0.2.1:1", "192.0.2.2:80"}, time.Second)
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Close()
+	//a failed attempt starts the next one without waiting the attempt delay
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("Next attempt is not started after failure, elapsed:%v", elapsed)
+	}
+	if _, err = DialParallel(context.Background(), "tcp", []string{"192.0.2.1:1", "192.0.2.2:1"}, time.Second); nil == err {
+		t.Fatalf("Expected error while all attempts failed")
+	}
+}
+
+func TestDialHappyEyeballsCancel(t *testing.T) {
+	f := &fakeDial{}
+	OverrideDial(f.dial)
+	defer Reset()
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := DialHappyEyeballs(ctx, "tcp", "example.com:80", IPv6Require, lookup); nil == err {
+		t.Fatalf("Expected error after cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Dial is not cancelled in time, elapsed:%v", elapsed)
+	}
+	if _, err := DialHappyEyeballs(context.Background(), "tcp", "example.com:80", IPv6Disable, lookup); err != ErrNoSuitableAddress {
+		t.Fatalf("Unexpected error:%v without suitable address", err)
+	}
+}
@@ -30,8 +30,18 @@ type Config struct {
 	MaxStreamWindowSize uint32
 	StreamMinRefresh    uint32
 
+	// EnableWindowAutoTune is used to grow stream receive window by RTT & delivery rate
+	// up to MaxStreamWindowSize, MaxSessionWindowSize limits the total grown size of all
+	// streams in a session, 0 means no limit.
+	EnableWindowAutoTune bool
+	MaxSessionWindowSize uint32
+
 	EnableCompress bool
 
+	// PriorityWeights is the weights of stream priority classes used to
+	// schedule data frames, streams are in class 0 by default.
+	PriorityWeights []int
+
 	CipherMethod         string
 	CipherKey            []byte
 	CipherInitialCounter uint64
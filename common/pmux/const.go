@@ -56,10 +56,14 @@ var (
 	ErrInvalidCipherMethod = fmt.Errorf("invalid cipher method")
 
 	ErrToolargeDataFrame = fmt.Errorf("too large data frame")
+
+	// ErrHalfCloseDisabled is returned when closing write direction of a stream while half close not enabled
+	ErrHalfCloseDisabled = fmt.Errorf("half close disabled")
 )
 
 const (
 	// initialStreamWindow is the initial stream window size
 	initialStreamWindow uint32 = 512 * 1024
 	maxDataPacketSize   uint32 = 1024 * 1024
+	maxDataFrameSize    uint32 = initialStreamWindow
 )
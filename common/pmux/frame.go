@@ -18,6 +18,8 @@ const (
 	flagWindowUpdate
 	flagPing
 	flagPingACK
+	//flagHalfClose close the write direction of a stream, only sent if half close enabled in session
+	flagHalfClose
 
 	flagHandshake = byte(100)
 )
@@ -0,0 +1,64 @@
+package pmux
+
+import "sync/atomic"
+
+// EnableHalfClose enable half close of streams, it should be called only if the peer support it,
+// since the peer would shutdown the session for the unknown frame.
+func (s *Session) EnableHalfClose() {
+	atomic.StoreInt32(&s.halfClose, 1)
+}
+
+// HalfCloseEnabled returns if the half close of streams enabled
+func (s *Session) HalfCloseEnabled() bool {
+	return atomic.LoadInt32(&s.halfClose) == 1
+}
+
+func (s *Session) handleHalfClose(frame Frame) error {
+	stream := s.getStream(frame.Header().StreamID())
+	if nil != stream {
+		stream.remoteCloseWrite()
+	}
+	return nil
+}
+
+func (s *Stream) isRemoteWriteClosed() bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.remoteWriteClosed
+}
+
+// CloseWrite close the write direction of the stream, the peer would read EOF after all data
+// written before, while the stream is still readable. The stream is closed after both directions closed.
+func (s *Stream) CloseWrite() error {
+	if !s.session.HalfCloseEnabled() {
+		return ErrHalfCloseDisabled
+	}
+	s.stateLock.Lock()
+	if s.state != streamEstablished || s.writeClosed {
+		s.stateLock.Unlock()
+		return ErrStreamClosed
+	}
+	s.writeClosed = true
+	bothClosed := s.remoteWriteClosed
+	s.stateLock.Unlock()
+	//scheduled in same class with data frames, so it never overtakes them
+	err := s.session.doWriteFrame(newFrame(flagHalfClose, s.id, 0, nil), true, s.priority)
+	if bothClosed {
+		s.forceClose(true)
+	} else {
+		asyncNotify(s.sendNotifyCh)
+	}
+	return err
+}
+
+func (s *Stream) remoteCloseWrite() {
+	s.stateLock.Lock()
+	s.remoteWriteClosed = true
+	bothClosed := s.writeClosed
+	s.stateLock.Unlock()
+	if bothClosed {
+		s.forceClose(true)
+	} else {
+		asyncNotify(s.recvNotifyCh)
+	}
+}
@@ -1,3 +1,5 @@
+//Package pmux is the stream multiplexer of gsnova sessions, forked from github.com/yinqiwen/pmux at
+//d2dcbc92ad8a739658c21afb5f85f63f45c96cc7 with priority scheduling, half close & stream window auto tuning.
 package pmux
 
 import (
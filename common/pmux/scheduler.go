@@ -0,0 +1,93 @@
+package pmux
+
+// controlPriority is used for control frames which are always sent ahead of data frames
+const controlPriority = -1
+
+const schedulerQuantum = 16 * 1024
+
+// frameScheduler schedules data frames by weighted fair queueing(deficit round robin) on priority classes,
+// frames of same class are sent in FIFO order.
+type frameScheduler struct {
+	control  []sendReady
+	queues   [][]sendReady
+	quantums []int
+	deficits []int
+	cur      int
+	pending  int
+	barrier  []sendReady
+}
+
+func newFrameScheduler(weights []int) *frameScheduler {
+	if len(weights) == 0 {
+		weights = []int{1}
+	}
+	f := &frameScheduler{
+		queues:   make([][]sendReady, len(weights)),
+		quantums: make([]int, len(weights)),
+		deficits: make([]int, len(weights)),
+	}
+	for i, w := range weights {
+		if w <= 0 {
+			w = 1
+		}
+		f.quantums[i] = w * schedulerQuantum
+	}
+	return f
+}
+
+func (f *frameScheduler) empty() bool {
+	return len(f.control) == 0 && f.pending == 0 && len(f.barrier) == 0
+}
+
+// blocked means a barrier frame is waiting all queued frames sent, no more frame should be pushed.
+func (f *frameScheduler) blocked() bool {
+	return len(f.barrier) > 0
+}
+
+func (f *frameScheduler) push(ready sendReady) {
+	if len(ready.F) == 0 {
+		//empty frame is used as a barrier to wait all previous frames sent
+		f.barrier = append(f.barrier, ready)
+		return
+	}
+	if ready.priority < 0 {
+		f.control = append(f.control, ready)
+		return
+	}
+	class := ready.priority
+	if class >= len(f.queues) {
+		class = 0
+	}
+	f.queues[class] = append(f.queues[class], ready)
+	f.pending++
+}
+
+func (f *frameScheduler) next() sendReady {
+	if len(f.control) > 0 {
+		ready := f.control[0]
+		f.control = f.control[1:]
+		return ready
+	}
+	if f.pending > 0 {
+		for {
+			q := f.queues[f.cur]
+			if len(q) > 0 && f.deficits[f.cur] >= len(q[0].F) {
+				ready := q[0]
+				f.queues[f.cur] = q[1:]
+				f.deficits[f.cur] -= len(ready.F)
+				f.pending--
+				return ready
+			}
+			if len(q) == 0 {
+				f.deficits[f.cur] = 0
+			}
+			f.cur = (f.cur + 1) % len(f.queues)
+			if len(f.queues[f.cur]) > 0 {
+				f.deficits[f.cur] += f.quantums[f.cur]
+			}
+		}
+	}
+	ready := f.barrier[0]
+	f.barrier = f.barrier[1:]
+	return ready
+}
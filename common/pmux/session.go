@@ -15,8 +15,9 @@ import (
 // sendReady is used to either mark a stream as ready
 // or to directly send a header
 type sendReady struct {
-	F   Frame
-	Err chan error
+	F        Frame
+	Err      chan error
+	priority int
 }
 
 type Session struct {
@@ -35,7 +36,7 @@ type Session struct {
 	sendCh         chan sendReady
 	pingCh         chan struct{}
 
-	shutdown     bool
+	shutdown     int32
 	shutdownErr  error
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
@@ -43,14 +44,22 @@ type Session struct {
 
 	handshakeDone bool
 
-	cryptoContext *CryptoContext
-	lastRecvTime  time.Time
+	//*CryptoContext, it's reset by the auth caller while the recv loop is running
+	cryptoContext atomic.Value
+	lastRecvTime  int64
+
+	rtt             int64
+	rttTime         int64
+	rttProbing      int32
+	allocatedWindow uint32
+
+	halfClose int32
 }
 
 // keepalive is a long running goroutine that periodically does
 // a ping to keep the connection alive.
 func (s *Session) keepalive() {
-	for !s.shutdown {
+	for !s.IsClosed() {
 		select {
 		case <-time.After(s.config.KeepAliveInterval):
 			_, err := s.Ping()
@@ -80,7 +89,7 @@ func (s *Session) Ping() (time.Duration, error) {
 	select {
 	case <-s.pingCh:
 	case <-time.After(s.config.PingTimeout):
-		if time.Now().Sub(s.lastRecvTime) >= s.config.PingTimeout {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecvTime))) >= s.config.PingTimeout {
 			return 0, ErrTimeout
 		}
 		return s.config.PingTimeout, nil
@@ -89,7 +98,10 @@ func (s *Session) Ping() (time.Duration, error) {
 	}
 
 	// Compute the RTT
-	return time.Now().Sub(start), nil
+	rtt := time.Now().Sub(start)
+	atomic.StoreInt64(&s.rtt, int64(rtt))
+	atomic.StoreInt64(&s.rttTime, time.Now().UnixNano())
+	return rtt, nil
 }
 
 func (s *Session) closeRemoteStream(id uint32) error {
@@ -100,14 +112,14 @@ func (s *Session) closeRemoteStream(id uint32) error {
 	return err
 }
 
-func (s *Session) doWriteFrame(frame Frame, noWait bool) error {
+func (s *Session) doWriteFrame(frame Frame, noWait bool, priority int) error {
 	// if frame.Header.Flags() != flagData {
 	// 	return s.writeFrameNowait(frame)
 	// }
 	timer := time.NewTimer(30 * time.Second)
 	defer timer.Stop()
 
-	ready := sendReady{F: frame, Err: nil}
+	ready := sendReady{F: frame, Err: nil, priority: priority}
 	if !noWait {
 		ready.Err = make(chan error, 1)
 	}
@@ -132,11 +144,11 @@ func (s *Session) doWriteFrame(frame Frame, noWait bool) error {
 }
 
 func (s *Session) writeFrame(frame Frame) error {
-	return s.doWriteFrame(frame, false)
+	return s.doWriteFrame(frame, false, controlPriority)
 }
 
 func (s *Session) writeFrameNowait(frame Frame) error {
-	return s.doWriteFrame(frame, true)
+	return s.doWriteFrame(frame, true, controlPriority)
 }
 
 func (s *Session) updateWindow(sid uint32, delta uint32) error {
@@ -198,10 +210,14 @@ func (s *Session) resetCryptoContext(method string, iv uint64, wait bool) error
 		return err
 	}
 	//ctx.encryptCounter = ctx.decryptCounter =
-	s.cryptoContext = ctx
+	s.cryptoContext.Store(ctx)
 	return nil
 }
 
+func (s *Session) getCryptoContext() *CryptoContext {
+	return s.cryptoContext.Load().(*CryptoContext)
+}
+
 func (s *Session) ResetCryptoContext(method string, iv uint64) error {
 	return s.resetCryptoContext(method, iv, true)
 }
@@ -212,7 +228,7 @@ func (s *Session) recvFrame(reader io.Reader) (Frame, error) {
 	if nil != err {
 		return nil, err
 	}
-	ctx := s.cryptoContext
+	ctx := s.getCryptoContext()
 	length := binary.BigEndian.Uint32(lenbuf)
 	length = ctx.decodeLength(length)
 	//log.Printf("[Recv]Read len:%d %d %d", length, binary.BigEndian.Uint32(lenbuf), ctx.decryptCounter)
@@ -242,17 +258,17 @@ func (s *Session) recvFrame(reader io.Reader) (Frame, error) {
 }
 
 func (s *Session) recvLoop() error {
-	for !s.shutdown {
+	for !s.IsClosed() {
 		// Read the frame
 		var frame Frame
 		var err error
 		if frame, err = s.recvFrame(s.connReader); err != nil {
 			if err != io.EOF && !strings.Contains(err.Error(), "closed") && !strings.Contains(err.Error(), "reset by peer") {
-				log.Printf("[ERROR]: Failed to read frame: %v while decrypt counter %d ", err, s.cryptoContext.decryptCounter)
+				log.Printf("[ERROR]: Failed to read frame: %v while decrypt counter %d ", err, s.getCryptoContext().decryptCounter)
 			}
 			return err
 		}
-		s.lastRecvTime = time.Now()
+		atomic.StoreInt64(&s.lastRecvTime, time.Now().UnixNano())
 		//log.Printf("####Recv %d", frame.Header.Flags())
 		// Switch on the type
 		switch frame.Header().Flags() {
@@ -268,6 +284,8 @@ func (s *Session) recvLoop() error {
 			s.writeFrameNowait(newFrame(flagPingACK, frame.Header().StreamID(), 0, nil))
 		case flagPingACK:
 			asyncNotify(s.pingCh)
+		case flagHalfClose:
+			err = s.handleHalfClose(frame)
 		default:
 			return ErrInvalidMsgType
 
@@ -280,9 +298,10 @@ func (s *Session) handleWindowUpdate(frame Frame) error {
 	stream := s.getStream(frame.Header().StreamID())
 	if nil != stream {
 		stream.incrSendWindow(frame)
-	} else {
-		s.closeRemoteStream(frame.Header().StreamID())
 	}
+	// window update for a closed stream is expected since the peer is still consuming
+	// data, the FIN is already sent in order with data frames, a FIN response here would
+	// overtake queued data frames in scheduler.
 	return nil
 }
 
@@ -321,47 +340,48 @@ func (s *Session) handleFIN(frame Frame) error {
 
 // send is a long running goroutine that sends data
 func (s *Session) send() {
-	readFrames := func() ([]sendReady, error) {
-		var frs []sendReady
-		for len(s.sendCh) > 0 {
-			frame := <-s.sendCh
-			frs = append(frs, frame)
-		}
-		if len(frs) == 0 {
+	scheduler := newFrameScheduler(s.config.PriorityWeights)
+	readFrames := func() error {
+		if scheduler.empty() {
 			select {
 			case frame := <-s.sendCh:
-				frs = append(frs, frame)
+				scheduler.push(frame)
 			case <-s.shutdownCh:
-				return frs, ErrSessionShutdown
+				return ErrSessionShutdown
 			}
 		}
-		return frs, nil
-	}
-	for !s.shutdown {
-		frs, err := readFrames()
-		if nil == err {
-			for _, frame := range frs {
-				err = writeFrame(s.connWriter, frame.F, s.cryptoContext)
-				if nil != err {
-					break
-				}
-			}
-		}
-		for _, frame := range frs {
-			if nil != frame.Err {
-				asyncSendErr(frame.Err, err)
-			}
+		for len(s.sendCh) > 0 && !scheduler.blocked() {
+			scheduler.push(<-s.sendCh)
 		}
-		if err != nil {
+		return nil
+	}
+	for !s.IsClosed() {
+		err := readFrames()
+		if nil != err {
 			if err != ErrSessionShutdown {
 				log.Printf("[ERR] pmux: Failed to write frames: %v", err)
 			}
 			s.exitErr(err)
 			return
 		}
+		frame := scheduler.next()
+		err = writeFrame(s.connWriter, frame.F, s.getCryptoContext())
+		if nil != frame.Err {
+			asyncSendErr(frame.Err, err)
+		}
+		if err != nil {
+			log.Printf("[ERR] pmux: Failed to write frames: %v", err)
+			s.exitErr(err)
+			return
+		}
 	}
 }
 
+//Conn return the underlying conn of the session
+func (s *Session) Conn() io.ReadWriteCloser {
+	return s.conn
+}
+
 func (s *Session) NumStreams() int {
 	return int(s.streamsCounter)
 }
@@ -373,10 +393,10 @@ func (s *Session) Close() error {
 	defer s.shutdownLock.Unlock()
 
 	//log.Printf("###Close sesion with %v", s.shutdown)
-	if s.shutdown {
+	if s.IsClosed() {
 		return nil
 	}
-	s.shutdown = true
+	atomic.StoreInt32(&s.shutdown, 1)
 	if s.shutdownErr == nil {
 		s.shutdownErr = ErrSessionShutdown
 	}
@@ -401,7 +421,7 @@ func (s *Session) Close() error {
 // AcceptStream is used to block until the next available stream
 // is ready to be accepted.
 func (s *Session) AcceptStream() (*Stream, error) {
-	if s.shutdown {
+	if s.IsClosed() {
 		return nil, ErrSessionShutdown
 	}
 	select {
@@ -417,7 +437,7 @@ func (s *Session) AcceptStream() (*Stream, error) {
 
 // IsClosed does a safe check to see if we have shutdown
 func (s *Session) IsClosed() bool {
-	return s.shutdown
+	return atomic.LoadInt32(&s.shutdown) == 1
 }
 
 // OpenStream is used to create a new stream
@@ -486,5 +506,8 @@ func newSession(config *Config, conn io.ReadWriteCloser, client bool) *Session {
 	if config.EnableKeepAlive {
 		go s.keepalive()
 	}
+	if config.EnableWindowAutoTune {
+		go s.shrinkIdleWindows()
+	}
 	return s
 }
@@ -0,0 +1,153 @@
+package pmux
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestSessions(t *testing.T, cfg *Config) (*Session, *Session) {
+	if nil == cfg {
+		cfg = DefaultConfig()
+	}
+	cfg.CipherMethod = CipherChacha20Poly1305
+	c1, c2 := net.Pipe()
+	client, err := Client(c1, cfg)
+	if nil != err {
+		t.Fatal(err)
+	}
+	server, err := Server(c2, cfg)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestWindowUpdateOfClosedStream(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PriorityWeights = []int{1, 64}
+	client, server := newTestSessions(t, cfg)
+	defer client.Close()
+	defer server.Close()
+
+	//a bulk stream in higher class keeps data frames of the other stream queued in scheduler
+	bulk, err := client.OpenStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	bulk.SetPriority(1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			if _, err := bulk.Write(buf); nil != err {
+				return
+			}
+		}
+	}()
+	remoteBulk, err := server.AcceptStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	go ioutil.ReadAll(remoteBulk)
+
+	content := make([]byte, 4*initialStreamWindow)
+	rand.Read(content)
+	go func() {
+		stream, err := client.OpenStream()
+		if nil != err {
+			return
+		}
+		//data frames are still queued while the stream is closed & removed, the peer keep sending
+		//window updates of the removed stream until all data consumed
+		stream.Write(content)
+		stream.Close()
+	}()
+	stream, err := server.AcceptStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	received, err := ioutil.ReadAll(stream)
+	if nil != err || !bytes.Equal(received, content) {
+		t.Fatalf("Received %d/%d bytes with err:%v", len(received), len(content), err)
+	}
+}
+
+func TestUnknownStreamData(t *testing.T) {
+	client, server := newTestSessions(t, nil)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	remote, err := server.AcceptStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	//the stream is closed without FIN in server side, data of it is answered with FIN
+	remote.forceClose(true)
+	stream.Write([]byte("hello"))
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(stream); nil != err {
+		t.Fatalf("Expected EOF of unknown stream, but got err:%v", err)
+	}
+}
+
+func TestAutoTuneRTT(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EnableWindowAutoTune = true
+	cfg.MaxStreamWindowSize = 8 * initialStreamWindow
+	client, server := newTestSessions(t, cfg)
+	defer client.Close()
+	defer server.Close()
+
+	content := make([]byte, 8*initialStreamWindow)
+	go func() {
+		stream, err := client.OpenStream()
+		if nil != err {
+			return
+		}
+		stream.Write(content)
+		stream.Close()
+	}()
+	stream, err := server.AcceptStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if received, err := ioutil.ReadAll(stream); nil != err || len(received) != len(content) {
+		t.Fatalf("Received %d/%d bytes with err:%v", len(received), len(content), err)
+	}
+	//the receiver never pings explicitly, the RTT is probed by window auto tuning
+	for i := 0; i < 100 && server.RTT() <= 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.RTT() <= 0 {
+		t.Fatalf("RTT is not probed by the receiver")
+	}
+}
+
+func TestStreamDeadlineWakeup(t *testing.T) {
+	client, server := newTestSessions(t, nil)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	//a pending read without deadline is woken up by the deadline set later
+	time.AfterFunc(100*time.Millisecond, func() {
+		stream.SetReadDeadline(time.Now())
+	})
+	start := time.Now()
+	if _, err = stream.Read(make([]byte, 1)); err != ErrTimeout {
+		t.Fatalf("Unexpected read error:%v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Pending read is not woken up in time, elapsed:%v", elapsed)
+	}
+}
@@ -20,12 +20,22 @@ type Stream struct {
 	id      uint32
 	session *Session
 
-	//recvWindow uint32
 	sendWindow  uint32
 	deltaWindow uint32
 
+	// receive window auto tuning state
+	windowLock       sync.Mutex
+	recvWindow       uint32
+	withheldWindow   uint32
+	epochStart       time.Time
+	epochBytes       uint32
+	windowUpdateTime time.Time
+
 	state     streamState
 	stateLock sync.Mutex
+	// half closed directions
+	writeClosed       bool
+	remoteWriteClosed bool
 
 	//recvBuf  *bytes.Buffer
 	recvBuf  ByteSliceBuffer
@@ -41,8 +51,11 @@ type Stream struct {
 	recvNotifyCh chan struct{}
 	sendNotifyCh chan struct{}
 
-	readDeadline  time.Time
-	writeDeadline time.Time
+	// deadlines may be set while reading/writing, they are stored as time.Time
+	readDeadline  atomic.Value
+	writeDeadline atomic.Value
+
+	priority int
 
 	IOCallback IOCallback
 }
@@ -51,11 +64,11 @@ type Stream struct {
 // a given session for an ID
 func newStream(session *Session, id uint32) *Stream {
 	s := &Stream{
-		id:      id,
-		session: session,
-		state:   streamEstablished,
-		sendErr: make(chan error, 1),
-		//recvWindow:   initialStreamWindow,
+		id:           id,
+		session:      session,
+		state:        streamEstablished,
+		sendErr:      make(chan error, 1),
+		recvWindow:   initialStreamWindow,
 		sendWindow:   initialStreamWindow,
 		recvNotifyCh: make(chan struct{}, 1),
 		sendNotifyCh: make(chan struct{}, 1),
@@ -74,7 +87,7 @@ START:
 	s.recvLock.Lock()
 	if s.recvBuf.Len() == 0 {
 		s.recvLock.Unlock()
-		if s.state != streamEstablished {
+		if !s.isEstablished() || s.isRemoteWriteClosed() {
 			return total, io.EOF
 		}
 		goto WAIT
@@ -103,8 +116,8 @@ START:
 WAIT:
 	var timeout <-chan time.Time
 	var timer *time.Timer
-	if !s.readDeadline.IsZero() {
-		delay := s.readDeadline.Sub(time.Now())
+	if deadline := loadDeadline(&s.readDeadline); !deadline.IsZero() {
+		delay := deadline.Sub(time.Now())
 		timer = time.NewTimer(delay)
 		timeout = timer.C
 	}
@@ -125,7 +138,7 @@ START:
 	s.recvLock.Lock()
 	if s.recvBuf.Len() == 0 {
 		s.recvLock.Unlock()
-		if s.state != streamEstablished {
+		if !s.isEstablished() || s.isRemoteWriteClosed() {
 			return 0, io.EOF
 		}
 		goto WAIT
@@ -143,8 +156,8 @@ START:
 WAIT:
 	var timeout <-chan time.Time
 	var timer *time.Timer
-	if !s.readDeadline.IsZero() {
-		delay := s.readDeadline.Sub(time.Now())
+	if deadline := loadDeadline(&s.readDeadline); !deadline.IsZero() {
+		delay := deadline.Sub(time.Now())
 		timer = time.NewTimer(delay)
 		timeout = timer.C
 	}
@@ -169,8 +182,13 @@ func (s *Stream) updateRemoteSendWindow() error {
 	}
 
 	// Update our window
-	//atomic.AddUint32(&s.recvWindow, delta)
-	atomic.StoreUint32(&s.deltaWindow, 0)
+	delta = atomic.SwapUint32(&s.deltaWindow, 0)
+	if s.session.config.EnableWindowAutoTune {
+		delta = s.autoTuneWindow(delta)
+		if delta == 0 {
+			return nil
+		}
+	}
 	if err := s.session.updateWindow(s.id, delta); err != nil {
 		return err
 	}
@@ -220,7 +238,8 @@ func (s *Stream) write(b []byte) (n int, err error) {
 	var max uint32
 START:
 	s.stateLock.Lock()
-	if s.state != streamEstablished {
+	if s.state != streamEstablished || s.writeClosed {
+		s.stateLock.Unlock()
 		return 0, ErrStreamClosed
 	}
 	s.stateLock.Unlock()
@@ -232,12 +251,12 @@ START:
 		goto WAIT
 	}
 
-	// Send up to our send window
-	max = min(window, uint32(len(b)))
+	// Send up to our send window, the window may be larger than a data frame while auto tuned
+	max = min(min(window, uint32(len(b))), maxDataFrameSize)
 
 	// Send the header
 	//s.sendHdr.encode(flagData, s.id, max)
-	if err := s.session.writeFrameNowait(newFrame(flagData, s.id, 0, b[:max])); err != nil {
+	if err := s.session.doWriteFrame(newFrame(flagData, s.id, 0, b[:max]), true, s.priority); err != nil {
 		return 0, err
 	}
 
@@ -249,8 +268,8 @@ START:
 
 WAIT:
 	var timeout <-chan time.Time
-	if !s.writeDeadline.IsZero() {
-		delay := s.writeDeadline.Sub(time.Now())
+	if deadline := loadDeadline(&s.writeDeadline); !deadline.IsZero() {
+		delay := deadline.Sub(time.Now())
 		timeout = time.After(delay)
 	}
 	select {
@@ -269,7 +288,7 @@ func (s *Stream) notifyWaiting() {
 
 // Close is used to close the stream
 func (s *Stream) Close() error {
-	if s.state != streamEstablished {
+	if !s.isEstablished() {
 		return nil
 	}
 	s.sendClose()
@@ -279,23 +298,53 @@ func (s *Stream) Close() error {
 
 // sendClose is used to send a FIN
 func (s *Stream) sendClose() error {
-	if err := s.session.closeRemoteStream(s.id); err != nil {
+	//FIN is scheduled in same class with data frames, so it never overtakes them
+	if err := s.session.doWriteFrame(newFrame(flagFIN, s.id, 0, nil), true, s.priority); err != nil {
 		return err
 	}
 	return nil
 }
 
+// SetPriority set the priority class of the stream, which is the index of Config.PriorityWeights.
+// It should be called before writing data.
+func (s *Stream) SetPriority(class int) {
+	if class < 0 {
+		class = 0
+	}
+	s.priority = class
+}
+
+// Priority returns the priority class of the stream
+func (s *Stream) Priority() int {
+	return s.priority
+}
+
+// isEstablished reports whether the stream is not closed, state is written by the recv loop on FIN
+func (s *Stream) isEstablished() bool {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state == streamEstablished
+}
+
 // forceClose is used for when the session is exiting
 func (s *Stream) forceClose(remove bool) {
 	s.stateLock.Lock()
 	s.state = streamClosed
 	s.stateLock.Unlock()
 	s.notifyWaiting()
+	s.releaseWindow()
 	if remove {
 		s.session.removeStream(s.id)
 	}
 }
 
+func loadDeadline(v *atomic.Value) time.Time {
+	if t, ok := v.Load().(time.Time); ok {
+		return t
+	}
+	return time.Time{}
+}
+
 // SetDeadline sets the read and write deadlines
 func (s *Stream) SetDeadline(t time.Time) error {
 	if err := s.SetReadDeadline(t); err != nil {
@@ -307,14 +356,18 @@ func (s *Stream) SetDeadline(t time.Time) error {
 	return nil
 }
 
-// SetReadDeadline sets the deadline for future Read calls.
+// SetReadDeadline sets the deadline for future Read calls,
+// a pending Read is woken up to apply the new deadline.
 func (s *Stream) SetReadDeadline(t time.Time) error {
-	s.readDeadline = t
+	s.readDeadline.Store(t)
+	asyncNotify(s.recvNotifyCh)
 	return nil
 }
 
-// SetWriteDeadline sets the deadline for future Write calls
+// SetWriteDeadline sets the deadline for future Write calls,
+// a pending Write is woken up to apply the new deadline.
 func (s *Stream) SetWriteDeadline(t time.Time) error {
-	s.writeDeadline = t
+	s.writeDeadline.Store(t)
+	asyncNotify(s.sendNotifyCh)
 	return nil
 }
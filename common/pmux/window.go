@@ -0,0 +1,149 @@
+package pmux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultAutoTuneRTT is used before any ping measured the RTT of session
+	defaultAutoTuneRTT = 100 * time.Millisecond
+	// rttProbeInterval is the max age of the RTT used by auto tuning before probed again
+	rttProbeInterval = 10 * time.Second
+	// windowIdleTimeout is the duration after which an idle stream's window shrinks back to initial size
+	windowIdleTimeout = 30 * time.Second
+)
+
+// RTT returns latest RTT measured by Ping, 0 if not measured yet.
+func (s *Session) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// probeRTT pings the peer in background if the RTT is not measured recently. The receiver of a stream
+// tunes its window, which may be the side never pinging, or pinging by the transport(eg: websocket ping).
+func (s *Session) probeRTT() {
+	if time.Since(time.Unix(0, atomic.LoadInt64(&s.rttTime))) < rttProbeInterval {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&s.rttProbing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.rttProbing, 0)
+		s.Ping()
+	}()
+}
+
+// AllocatedWindow returns the receive window allocated beyond initial window by auto tuning.
+func (s *Session) AllocatedWindow() uint32 {
+	return atomic.LoadUint32(&s.allocatedWindow)
+}
+
+// allocWindow try to reserve n bytes window in the session budget, returns the reserved size.
+func (s *Session) allocWindow(n uint32) uint32 {
+	budget := s.config.MaxSessionWindowSize
+	for {
+		allocated := atomic.LoadUint32(&s.allocatedWindow)
+		if budget > 0 {
+			if allocated >= budget {
+				return 0
+			}
+			if allocated+n > budget {
+				n = budget - allocated
+			}
+		}
+		if atomic.CompareAndSwapUint32(&s.allocatedWindow, allocated, allocated+n) {
+			return n
+		}
+	}
+}
+
+func (s *Session) releaseWindow(n uint32) {
+	if n > 0 {
+		atomic.AddUint32(&s.allocatedWindow, ^uint32(n-1))
+	}
+}
+
+// shrinkIdleWindows is a long running goroutine which shrinks windows of idle streams to release the session budget.
+func (s *Session) shrinkIdleWindows() {
+	ticker := time.NewTicker(windowIdleTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			s.streams.Range(func(key, value interface{}) bool {
+				stream := value.(*Stream)
+				stream.windowLock.Lock()
+				if stream.recvWindow > initialStreamWindow && now.Sub(stream.windowUpdateTime) > windowIdleTimeout {
+					extra := stream.recvWindow - initialStreamWindow
+					//credit already granted can not be retracted, withhold it from later updates
+					stream.withheldWindow += extra
+					stream.recvWindow = initialStreamWindow
+					s.releaseWindow(extra)
+				}
+				stream.windowLock.Unlock()
+				return true
+			})
+		case <-s.shutdownCh:
+			return
+		}
+	}
+}
+
+// autoTuneWindow returns the credit to grant the peer after consumed bytes.
+// Like TCP receive buffer auto tuning, the window grows while it's smaller than
+// twice of the BDP computed by delivery rate & RTT, bounded by MaxStreamWindowSize & the session budget.
+func (s *Stream) autoTuneWindow(consumed uint32) uint32 {
+	s.windowLock.Lock()
+	defer s.windowLock.Unlock()
+	now := time.Now()
+	if s.recvWindow == 0 {
+		s.recvWindow = initialStreamWindow
+	}
+	if s.epochStart.IsZero() {
+		s.epochStart = now
+	}
+	s.windowUpdateTime = now
+	s.epochBytes += consumed
+	credit := consumed
+	if s.withheldWindow > 0 {
+		withheld := min(s.withheldWindow, credit)
+		s.withheldWindow -= withheld
+		credit -= withheld
+	}
+	if s.epochBytes < s.recvWindow {
+		return credit
+	}
+	//a full window consumed, check if the window limits the delivery rate
+	s.session.probeRTT()
+	elapsed := now.Sub(s.epochStart)
+	rtt := s.session.RTT()
+	if rtt <= 0 {
+		rtt = defaultAutoTuneRTT
+	}
+	if elapsed <= 0 {
+		elapsed = time.Millisecond
+	}
+	rate := float64(s.epochBytes) / elapsed.Seconds()
+	desired := rate * rtt.Seconds() * 2
+	if desired > float64(s.recvWindow) && s.recvWindow < s.session.config.MaxStreamWindowSize {
+		grow := min(s.recvWindow, s.session.config.MaxStreamWindowSize-s.recvWindow)
+		grow = s.session.allocWindow(grow)
+		s.recvWindow += grow
+		credit += grow
+	}
+	s.epochStart = now
+	s.epochBytes = 0
+	return credit
+}
+
+// releaseWindow give back the auto tuned window to session budget
+func (s *Stream) releaseWindow() {
+	s.windowLock.Lock()
+	defer s.windowLock.Unlock()
+	if s.recvWindow > initialStreamWindow {
+		s.session.releaseWindow(s.recvWindow - initialStreamWindow)
+		s.recvWindow = initialStreamWindow
+	}
+}
@@ -2,6 +2,7 @@ package socks
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -74,6 +75,20 @@ type SocksConn struct {
 	socksVersion byte
 }
 
+//SpliceConn return the raw tcp conn for zero copy relaying
+func (conn *SocksConn) SpliceConn() *net.TCPConn {
+	c, _ := conn.Conn.(*net.TCPConn)
+	return c
+}
+
+//CloseWrite half close the raw tcp conn
+func (conn *SocksConn) CloseWrite() error {
+	if c, ok := conn.Conn.(*net.TCPConn); ok {
+		return c.CloseWrite()
+	}
+	return errors.New("half close unsupported")
+}
+
 func (conn *SocksConn) Version() string {
 	if conn.socksVersion == socks4Version {
 		return "socks4"
@@ -0,0 +1,27 @@
+//Package testserver starts remote servers for tests of packages which are not imported by the remote package.
+package testserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/remote"
+)
+
+//Start start a remote server serving TCP transport on loopback for user 'gsnova' with the key
+func Start(t testing.TB, key string) (*remote.Server, string) {
+	conf := &remote.ServerConfig{}
+	conf.Cipher = channel.CipherConfig{User: "gsnova", Key: key, Method: "chacha20poly1305"}
+	conf.Mux.StreamIdleTimeout = 10
+	server, err := remote.NewServer(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go server.ServeTCP(l)
+	return server, l.Addr().String()
+}
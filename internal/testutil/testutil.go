@@ -0,0 +1,29 @@
+//Package testutil holds fixtures shared by tests of gsnova packages.
+package testutil
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+//StartEchoServer start a tcp server on loopback echoing all received data
+func StartEchoServer(t testing.TB) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
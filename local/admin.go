@@ -1,6 +1,7 @@
 package local
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,17 +10,19 @@ import (
 	"net/http"
 	//_ "net/http/pprof"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/yinqiwen/gotoolkit/ots"
 	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/helper"
+	"github.com/yinqiwen/gsnova/common/mux"
 	"github.com/yinqiwen/gsnova/common/netx"
 )
 
-func getConfigList(w http.ResponseWriter, r *http.Request) {
+func (c *Client) getConfigList(w http.ResponseWriter, r *http.Request) {
 	var confs []string
-	files, _ := ioutil.ReadDir(GConf.Admin.ConfigDir)
+	files, _ := ioutil.ReadDir(c.Config().Admin.ConfigDir)
 	for _, f := range files {
 		if f.IsDir() {
 			confs = append(confs, f.Name())
@@ -30,13 +33,18 @@ func getConfigList(w http.ResponseWriter, r *http.Request) {
 	w.Write(js)
 }
 
-func statCallback(w http.ResponseWriter, r *http.Request) {
+func (c *Client) statCallback(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 	fmt.Fprintf(w, "Version: %s\n", channel.Version)
 	//fmt.Fprintf(w, "NumSession: %d\n", getProxySessionSize())
 	ots.Handle("stat", w)
-	fmt.Fprintf(w, "RunningProxyStreamNum: %d\n", runningProxyStreamCount)
-	channel.DumpLoaclChannelStat(w)
+	fmt.Fprintf(w, "RunningProxyStreamNum: %d\n", atomic.LoadInt64(&c.runningStreams))
+	for class := range c.runningPriorityStreams {
+		fmt.Fprintf(w, "RunningProxyStreamNum[%s]: %d\n", mux.PriorityName(class), atomic.LoadInt64(&c.runningPriorityStreams[class]))
+	}
+	helper.DumpRelayStat(w, atomic.LoadInt64(&c.runningStreams))
+	mux.DumpRelayStat(w)
+	c.channels.DumpStat(w)
 }
 func stackdumpCallback(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(200)
@@ -51,47 +59,58 @@ func gcCallback(w http.ResponseWriter, req *http.Request) {
 	ots.Handle("gc", w)
 }
 
-func startAdminServer() {
-	if len(GConf.Admin.Listen) == 0 {
+//startAdminServer start the admin server in background, the mutex of client is held.
+func (c *Client) startAdminServer(conf *LocalConfig) {
+	if len(conf.Admin.Listen) == 0 {
 		return
 	}
-	if len(GConf.Admin.ConfigDir) == 0 {
+	if len(conf.Admin.ConfigDir) == 0 {
 		log.Printf("[WARN]The ConfigDir's Dir is empty, use current dir instead")
-		GConf.Admin.ConfigDir = "./"
+		conf.Admin.ConfigDir = "./"
 	}
-	if len(GConf.Admin.BroadcastAddr) > 0 {
+	if len(conf.Admin.BroadcastAddr) > 0 {
 		ticker := time.NewTicker(3 * time.Second)
 		localIP := helper.GetLocalIPv4()
-		_, adminPort, _ := net.SplitHostPort(GConf.Admin.Listen)
-		go func() {
-			for _ = range ticker.C {
-				addr, err := net.ResolveUDPAddr("udp", GConf.Admin.BroadcastAddr)
-				var c *net.UDPConn
+		_, adminPort, _ := net.SplitHostPort(conf.Admin.Listen)
+		go func(ctx context.Context) {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				addr, err := net.ResolveUDPAddr("udp", conf.Admin.BroadcastAddr)
+				var uc *net.UDPConn
 				if nil == err {
-					c, err = net.DialUDP("udp", nil, addr)
+					uc, err = net.DialUDP("udp", nil, addr)
 				}
 				if err != nil {
 					log.Printf("Failed to resolve multicast addr.")
 				} else {
 					for _, ip := range localIP {
-						c.Write([]byte(net.JoinHostPort(ip, adminPort)))
+						uc.Write([]byte(net.JoinHostPort(ip, adminPort)))
 					}
+					uc.Close()
 				}
 			}
-		}()
+		}(c.ctx)
 	}
 	mux := http.NewServeMux()
-	fs := http.FileServer(http.Dir(GConf.Admin.ConfigDir))
+	fs := http.FileServer(http.Dir(conf.Admin.ConfigDir))
 	mux.Handle("/", fs)
-	mux.HandleFunc("/_conflist", getConfigList)
-	mux.HandleFunc("/stat", statCallback)
+	mux.HandleFunc("/_conflist", c.getConfigList)
+	mux.HandleFunc("/stat", c.statCallback)
 	mux.HandleFunc("/stackdump", stackdumpCallback)
 	mux.HandleFunc("/gc", gcCallback)
 	mux.HandleFunc("/memdump", memdumpCallback)
-	err := http.ListenAndServe(GConf.Admin.Listen, mux)
-	if nil != err {
-		log.Printf("[ERROR]Failed to start config store server:%v", err)
-	}
+	c.admin = &http.Server{Addr: conf.Admin.Listen, Handler: mux}
+	go func(server *http.Server) {
+		err := server.ListenAndServe()
+		if nil != err && err != http.ErrServerClosed {
+			log.Printf("[ERROR]Failed to start config store server:%v", err)
+		}
+	}(c.admin)
 }
 
 var syncClient *http.Client
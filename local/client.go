@@ -0,0 +1,260 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yinqiwen/gotoolkit/gfwlist"
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/dns"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
+)
+
+var ErrClientRunning = errors.New("client is already running")
+
+//ruleContext is the state used to match PAC rules, every client owns one.
+type ruleContext struct {
+	gfwList  atomic.Value
+	localDNS atomic.Value
+}
+
+func (r *ruleContext) getGFWList() *gfwlist.GFWList {
+	v := r.gfwList.Load()
+	if nil != v {
+		return v.(*gfwlist.GFWList)
+	}
+	return nil
+}
+
+func (r *ruleContext) getLocalDNS() *dns.Local {
+	v := r.localDNS.Load()
+	if nil != v {
+		return v.(*dns.Local)
+	}
+	return nil
+}
+
+//Client is a local proxy instance which owns its config, channels, listeners, dns & rule state,
+//so that multiple clients with different configs could run in one process.
+type Client struct {
+	conf     *LocalConfig
+	rules    ruleContext
+	channels *channel.LocalChannelTable
+	udp      *udpSessionTable
+
+	mutex     sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners []*net.TCPListener
+	admin     *http.Server
+
+	conns                  sync.Map
+	runningStreams         int64
+	runningPriorityStreams []int64
+}
+
+//NewClient create a client by config, the config is copied.
+func NewClient(conf *LocalConfig) *Client {
+	c := &Client{
+		channels:               channel.NewLocalChannelTable(),
+		udp:                    newUDPSessionTable(),
+		runningPriorityStreams: make([]int64, mux.PriorityClasses()),
+	}
+	cfg := *conf
+	c.conf = &cfg
+	return c
+}
+
+//Config return the current config of client, it should not be modified.
+func (c *Client) Config() *LocalConfig {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conf
+}
+
+//LocalDNS return the local dns of running client
+func (c *Client) LocalDNS() *dns.Local {
+	return c.rules.getLocalDNS()
+}
+
+func (c *Client) context() context.Context {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if nil == c.ctx {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+//Start init channels and start all listeners of the client, the client is stopped once the context done.
+func (c *Client) Start(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if nil != c.ctx {
+		return ErrClientRunning
+	}
+	conf := c.conf
+	conf.init()
+	if len(conf.Log) > 0 {
+		logger.InitLogger(conf.Log)
+	}
+	if conf.TransparentMark > 0 {
+		enableTransparentSocketMark(conf.TransparentMark)
+	}
+	localDNS := dns.NewLocal(&conf.LocalDNS)
+	localDNS.Start()
+	c.rules.localDNS.Store(localDNS)
+	//servers of channels are resolved by the local dns of client
+	c.channels.Configure(conf.Mux, localDNS)
+
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	go c.syncGFWList(c.ctx, conf)
+	go c.udp.expire(c.ctx)
+
+	logger.Notice("Allowed proxy channel with schema:%v", channel.AllowedSchema())
+	var wg sync.WaitGroup
+	for i := range conf.Channel {
+		if !conf.Channel[i].Enable {
+			continue
+		}
+		ch := channel.NewProxyChannel(&conf.Channel[i])
+		wg.Add(1)
+		go func(ctx context.Context) {
+			c.channels.InitChannelContext(ctx, ch, true)
+			wg.Done()
+		}(c.ctx)
+	}
+	wg.Wait()
+
+	logger.Info("Started GSnova %s.", channel.Version)
+	c.startAdminServer(conf)
+	c.listeners = make([]*net.TCPListener, len(conf.Proxy))
+	for i := range conf.Proxy {
+		var err error
+		c.listeners[i], err = c.startLocalProxyServer(c.ctx, &conf.Proxy[i])
+		if nil != err {
+			c.stopLocked()
+			return err
+		}
+	}
+	go func(ctx context.Context) {
+		<-ctx.Done()
+		c.stop(ctx)
+	}(c.ctx)
+	return nil
+}
+
+//Stop close all listeners, running conns & channels of the client.
+func (c *Client) Stop() error {
+	return c.stop(nil)
+}
+
+//stop the client if it's running with the context, nil means the current running.
+func (c *Client) stop(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if nil == c.ctx || (nil != ctx && ctx != c.ctx) {
+		return nil
+	}
+	c.stopLocked()
+	return nil
+}
+
+func (c *Client) stopLocked() {
+	c.cancel()
+	c.ctx, c.cancel = nil, nil
+	for _, l := range c.listeners {
+		if nil != l {
+			l.Close()
+		}
+	}
+	c.listeners = nil
+	if nil != c.admin {
+		c.admin.Close()
+		c.admin = nil
+	}
+	c.udp.closeAll()
+	c.conns.Range(func(key, value interface{}) bool {
+		conn := key.(net.Conn)
+		if nil != conn {
+			conn.Close()
+		}
+		return true
+	})
+	c.channels.Stop()
+	if localDNS := c.rules.getLocalDNS(); nil != localDNS {
+		localDNS.Stop()
+	}
+}
+
+//Reload stop the running client, then start it with the new config.
+func (c *Client) Reload(ctx context.Context, conf *LocalConfig) error {
+	c.Stop()
+	cfg := *conf
+	c.mutex.Lock()
+	c.conf = &cfg
+	c.mutex.Unlock()
+	return c.Start(ctx)
+}
+
+func (c *Client) loadGFWList(hc *http.Client, conf *GFWListConfig) error {
+	resp, err := hc.Get(conf.URL)
+	if nil != err {
+		logger.Error("Failed to fetch GFWList")
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		logger.Error("Failed to fetch GFWList with res:%v", resp)
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if nil != err {
+		logger.Error("Failed to read GFWList with err:%v", err)
+		return err
+	}
+	gfw, err := gfwlist.NewFromString(string(body), true)
+	if nil != err {
+		logger.Error("Invalid GFWList content:%v", err)
+		return err
+	}
+	for _, rule := range conf.UserRule {
+		gfw.Add(rule)
+	}
+	logger.Info("GFWList sync success.")
+	c.rules.gfwList.Store(gfw)
+	return nil
+}
+
+func (c *Client) syncGFWList(ctx context.Context, conf *LocalConfig) {
+	if len(conf.GFWList.URL) == 0 {
+		return
+	}
+	hc, _ := channel.NewHTTPClient(&channel.ProxyChannelConfig{Proxy: conf.GFWList.Proxy}, "http")
+	for {
+		err := c.loadGFWList(hc, &conf.GFWList)
+		var nextRefreshTime time.Duration
+		if nil == err {
+			refreshPeriod := conf.GFWList.RefershPeriodMiniutes
+			if refreshPeriod <= 0 {
+				refreshPeriod = 1440
+			}
+			nextRefreshTime = time.Duration(refreshPeriod) * time.Minute
+		} else {
+			nextRefreshTime = 5 * time.Second
+		}
+		logger.Info("Refresh GFWList after %v.", nextRefreshTime)
+		select {
+		case <-time.After(nextRefreshTime):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package local
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/pmux"
+	"github.com/yinqiwen/gsnova/internal/testutil"
+	"github.com/yinqiwen/gsnova/internal/testutil/testserver"
+)
+
+const testKey = "client-test-key"
+
+func newTestClient(server string) *Client {
+	conf := &LocalConfig{
+		Cipher: channel.CipherConfig{User: "gsnova", Key: testKey, Method: "chacha20poly1305"},
+		Proxy: []ProxyConfig{
+			{Local: "127.0.0.1:0", PAC: []PACConfig{{Remote: "test"}}},
+		},
+		Channel: []channel.ProxyChannelConfig{
+			{Name: "test", Enable: true, ServerList: []string{"tcp://" + server}, ConnsPerServer: 1},
+		},
+	}
+	return NewClient(conf)
+}
+
+func (c *Client) proxyAddr() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.listeners) == 0 {
+		return ""
+	}
+	return c.listeners[0].Addr().String()
+}
+
+//connectProxy open a tunnel to addr by HTTP CONNECT via the local proxy
+func connectProxy(proxy, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy, time.Second)
+	if nil != err {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest("CONNECT", "http://"+addr, nil)
+	req.Host = addr
+	req.Write(conn)
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if nil != err {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		conn.Close()
+		return nil, io.ErrUnexpectedEOF
+	}
+	return conn, nil
+}
+
+func testEcho(t *testing.T, proxy, addr string) {
+	conn, err := connectProxy(proxy, addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello client"))
+	buf := make([]byte, len("hello client"))
+	if _, err = io.ReadFull(conn, buf); nil != err || string(buf) != "hello client" {
+		t.Fatalf("Unexpected echo:%s with err:%v", buf, err)
+	}
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	server, addr := testserver.Start(t, testKey)
+	defer server.Close()
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+
+	//clients with their own configs & channels run in one process
+	c1, c2 := newTestClient(addr), newTestClient(addr)
+	if err := c1.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	defer c1.Stop()
+	if err := c2.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	defer c2.Stop()
+	if err := c1.Start(context.Background()); err != ErrClientRunning {
+		t.Fatalf("Unexpected error:%v while starting a running client", err)
+	}
+	testEcho(t, c1.proxyAddr(), echo.Addr().String())
+	testEcho(t, c2.proxyAddr(), echo.Addr().String())
+
+	//stopping one client does not affect the other
+	proxy := c1.proxyAddr()
+	conn, err := connectProxy(proxy, echo.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	c1.Stop()
+	if _, err = conn.Read(make([]byte, 1)); nil == err {
+		t.Fatalf("Running conn is not closed after stopped")
+	}
+	conn.Close()
+	if _, err = net.DialTimeout("tcp", proxy, time.Second); nil == err {
+		t.Fatalf("Listener is not closed after stopped")
+	}
+	testEcho(t, c2.proxyAddr(), echo.Addr().String())
+
+	//reload with the new config
+	conf := *c1.Config()
+	conf.Proxy = []ProxyConfig{{Local: "127.0.0.1:0", PAC: []PACConfig{{Remote: channel.DirectChannelName}}}}
+	if err = c1.Reload(context.Background(), &conf); nil != err {
+		t.Fatal(err)
+	}
+	testEcho(t, c1.proxyAddr(), echo.Addr().String())
+}
+
+func TestClientMuxConfig(t *testing.T) {
+	server, addr := testserver.Start(t, testKey)
+	defer server.Close()
+
+	//clients keep their own mux configs while the process default is untouched
+	c1, c2 := newTestClient(addr), newTestClient(addr)
+	c1.conf.Mux.MaxStreamWindow = "1m"
+	c2.conf.Mux.MaxStreamWindow = "2m"
+	for _, c := range []*Client{c1, c2} {
+		if err := c.Start(context.Background()); nil != err {
+			t.Fatal(err)
+		}
+		defer c.Stop()
+	}
+	for c, window := range map[*Client]uint32{c1: 1024 * 1024, c2: 2 * 1024 * 1024} {
+		stream, conf, err := c.channels.GetMuxStreamContext(context.Background(), "test")
+		if nil != err {
+			t.Fatal(err)
+		}
+		stream.Close()
+		if size := conf.PMuxConfig().MaxStreamWindowSize; size != window {
+			t.Fatalf("Unexpected stream window:%d, expected:%d", size, window)
+		}
+	}
+	if size := channel.InitialPMuxConfig(&channel.CipherConfig{}).MaxStreamWindowSize; size != pmux.DefaultConfig().MaxStreamWindowSize {
+		t.Fatalf("Default mux config is changed by clients, stream window:%d", size)
+	}
+}
+
+func TestClientContextCancel(t *testing.T) {
+	server, addr := testserver.Start(t, testKey)
+	defer server.Close()
+
+	c := newTestClient(addr)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.Start(ctx); nil != err {
+		t.Fatal(err)
+	}
+	proxy := c.proxyAddr()
+	cancel()
+	for i := 0; i < 100 && len(c.proxyAddr()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(c.proxyAddr()) > 0 {
+		t.Fatalf("Client is not stopped after context cancelled")
+	}
+	if _, err := net.DialTimeout("tcp", proxy, time.Second); nil == err {
+		t.Fatalf("Listener is not closed after context cancelled")
+	}
+	//the client could be started again after stopped
+	if err := c.Start(context.Background()); nil != err {
+		t.Fatal(err)
+	}
+	c.Stop()
+}
@@ -11,8 +11,10 @@ import (
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/hosts"
 	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/mux"
 )
 
+//GConf is the config of the client started by Start
 var GConf LocalConfig
 
 const (
@@ -72,7 +74,7 @@ func (pac *PACConfig) matchProtocol(protocol string) bool {
 	return false
 }
 
-func (pac *PACConfig) matchRules(ip string, req *http.Request) bool {
+func (pac *PACConfig) matchRules(rules *ruleContext, ip string, req *http.Request) bool {
 	if len(pac.Rule) == 0 {
 		return true
 	}
@@ -92,7 +94,7 @@ func (pac *PACConfig) matchRules(ip string, req *http.Request) bool {
 				ok = pac.ruleInHosts(req)
 			}
 		} else if strings.EqualFold(rule, BlockedByGFWRule) {
-			gfwList := getGFWList()
+			gfwList := rules.getGFWList()
 			if nil != gfwList && nil != req {
 				ok = gfwList.IsBlockedByGFW(req)
 				if !ok {
@@ -103,16 +105,17 @@ func (pac *PACConfig) matchRules(ip string, req *http.Request) bool {
 				logger.Debug("NIL GFWList object or request")
 			}
 		} else if strings.EqualFold(rule, IsCNIPRule) {
-			if len(ip) == 0 || nil == dns.CNIPSet {
+			localDNS := rules.getLocalDNS()
+			if len(ip) == 0 || nil == localDNS || nil == localDNS.CNIPSet {
 				logger.Debug("NIL CNIP content  or IP/Domain")
 				ok = false
 			} else {
 				var err error
 				if net.ParseIP(ip) == nil {
-					ip, err = dns.DnsGetDoaminIP(ip)
+					ip, err = dns.LookupHost(localDNS, ip)
 				}
 				if nil == err {
-					ok = dns.CNIPSet.IsInCountry(net.ParseIP(ip), "CN")
+					ok = localDNS.IsCNIP(net.ParseIP(ip))
 				}
 				logger.Debug("ip:%s is CNIP:%v", ip, ok)
 			}
@@ -147,12 +150,12 @@ func MatchPatterns(str string, rules []string) bool {
 	return false
 }
 
-func (pac *PACConfig) Match(protocol string, ip string, req *http.Request) bool {
+func (pac *PACConfig) match(rules *ruleContext, protocol string, ip string, req *http.Request) bool {
 	ret := pac.matchProtocol(protocol)
 	if !ret {
 		return false
 	}
-	ret = pac.matchRules(ip, req)
+	ret = pac.matchRules(rules, ip, req)
 	if !ret {
 		return false
 	}
@@ -169,26 +172,83 @@ func (pac *PACConfig) Match(protocol string, ip string, req *http.Request) bool
 	return MatchPatterns(host, pac.Host) && MatchPatterns(req.Method, pac.Method) && MatchPatterns(req.URL.String(), pac.URL)
 }
 
+//DestinationRule match destination port, host & PAC rules
+type DestinationRule struct {
+	Port     []string
+	Host     []string
+	Rule     []string
+	Protocol []string
+}
+
+func (p *DestinationRule) match(rules *ruleContext, protocol string, host string, port string, req *http.Request) bool {
+	pac := &PACConfig{Rule: p.Rule, Protocol: p.Protocol}
+	if !pac.matchProtocol(protocol) || !pac.matchRules(rules, host, req) {
+		return false
+	}
+	return MatchPatterns(port, p.Port) && MatchPatterns(host, p.Host)
+}
+
+//PriorityConfig select stream priority class(normal/bulk/interactive) by destination
+type PriorityConfig struct {
+	DestinationRule
+	Class string
+}
+
+//IdleTimeoutConfig set stream idle timeout seconds by destination, it's also sent to remote server
+type IdleTimeoutConfig struct {
+	DestinationRule
+	Timeout int
+}
+
 type ProxyConfig struct {
 	Local string
 	//DNSReadMSTimeout int
 	//UDPReadMSTimeout int
-	PAC []PACConfig
+	PAC         []PACConfig
+	Priority    []PriorityConfig
+	IdleTimeout []IdleTimeoutConfig
+}
+
+func (cfg *ProxyConfig) getPriority(rules *ruleContext, proto string, host string, port string) int {
+	if len(cfg.Priority) == 0 {
+		return mux.PriorityNormal
+	}
+	creq, _ := http.NewRequest("Connect", "https://"+host, nil)
+	for _, p := range cfg.Priority {
+		if p.match(rules, proto, host, port, creq) {
+			return mux.ParsePriority(p.Class)
+		}
+	}
+	return mux.PriorityNormal
+}
+
+//getIdleTimeout return stream idle timeout seconds of the destination, 0 means default
+func (cfg *ProxyConfig) getIdleTimeout(rules *ruleContext, proto string, host string, port string) int {
+	if len(cfg.IdleTimeout) == 0 {
+		return 0
+	}
+	creq, _ := http.NewRequest("Connect", "https://"+host, nil)
+	for _, p := range cfg.IdleTimeout {
+		if p.match(rules, proto, host, port, creq) {
+			return p.Timeout
+		}
+	}
+	return 0
 }
 
-func (cfg *ProxyConfig) getProxyChannelByHost(proto string, host string) string {
+func (cfg *ProxyConfig) getProxyChannelByHost(rules *ruleContext, proto string, host string) string {
 	creq, _ := http.NewRequest("Connect", "https://"+host, nil)
-	return cfg.findProxyChannelByRequest(proto, host, creq)
+	return cfg.findProxyChannelByRequest(rules, proto, host, creq)
 }
 
-func (cfg *ProxyConfig) findProxyChannelByRequest(proto string, ip string, req *http.Request) string {
+func (cfg *ProxyConfig) findProxyChannelByRequest(rules *ruleContext, proto string, ip string, req *http.Request) string {
 	var channelName string
 	if len(ip) > 0 && helper.IsPrivateIP(ip) {
 		//channel = "direct"
 		return channel.DirectChannelName
 	}
 	for _, pac := range cfg.PAC {
-		if pac.Match(proto, ip, req) {
+		if pac.match(rules, proto, ip, req) {
 			channelName = pac.Remote
 			break
 		}
@@ -251,19 +311,19 @@ type LocalConfig struct {
 
 func (cfg *LocalConfig) init() error {
 	haveDirect := false
-	for i := range GConf.Channel {
-		if GConf.Channel[i].Name == channel.DirectChannelName && GConf.Channel[i].Enable {
+	for i := range cfg.Channel {
+		if cfg.Channel[i].Name == channel.DirectChannelName && cfg.Channel[i].Enable {
 			haveDirect = true
-			GConf.Channel[i].ServerList = []string{"direct://0.0.0.0:0"}
-			GConf.Channel[i].ConnsPerServer = 1
+			cfg.Channel[i].ServerList = []string{"direct://0.0.0.0:0"}
+			cfg.Channel[i].ConnsPerServer = 1
 		}
-		if len(GConf.Channel[i].Cipher.Key) == 0 {
-			GConf.Channel[i].Cipher = GConf.Cipher
+		if len(cfg.Channel[i].Cipher.Key) == 0 {
+			cfg.Channel[i].Cipher = cfg.Cipher
 		}
-		if len(GConf.Channel[i].HTTP.UserAgent) == 0 {
-			GConf.Channel[i].HTTP.UserAgent = GConf.UserAgent
+		if len(cfg.Channel[i].HTTP.UserAgent) == 0 {
+			cfg.Channel[i].HTTP.UserAgent = cfg.UserAgent
 		}
-		GConf.Channel[i].Adjust()
+		cfg.Channel[i].Adjust()
 	}
 	if !haveDirect {
 		directProxyChannel := make([]channel.ProxyChannelConfig, 1)
@@ -272,7 +332,7 @@ func (cfg *LocalConfig) init() error {
 		directProxyChannel[0].ConnsPerServer = 1
 		directProxyChannel[0].LocalDialMSTimeout = 5000
 		directProxyChannel[0].ServerList = []string{"direct://0.0.0.0:0"}
-		GConf.Channel = append(directProxyChannel, GConf.Channel...)
+		cfg.Channel = append(directProxyChannel, cfg.Channel...)
 	}
 	return nil
 }
@@ -0,0 +1,34 @@
+package local
+
+import "testing"
+
+func TestGetIdleTimeout(t *testing.T) {
+	cfg := &ProxyConfig{
+		IdleTimeout: []IdleTimeoutConfig{
+			{DestinationRule: DestinationRule{Port: []string{"22"}}, Timeout: 3600},
+			{DestinationRule: DestinationRule{Host: []string{"*.example.com"}, Protocol: []string{"http"}}, Timeout: 30},
+			{DestinationRule: DestinationRule{Host: []string{"*.example.org"}, Rule: []string{"!InHosts"}}, Timeout: 60},
+		},
+	}
+	rules := &ruleContext{}
+	cases := []struct {
+		proto    string
+		host     string
+		port     string
+		expected int
+	}{
+		{"socks", "10.0.0.1", "22", 3600},
+		{"http", "www.example.com", "80", 30},
+		{"socks", "www.example.com", "80", 0},
+		{"socks", "www.example.org", "443", 60},
+		{"http", "www.example.net", "443", 0},
+	}
+	for _, c := range cases {
+		if timeout := cfg.getIdleTimeout(rules, c.proto, c.host, c.port); timeout != c.expected {
+			t.Fatalf("Unexpected idle timeout:%d for %s %s:%s", timeout, c.proto, c.host, c.port)
+		}
+	}
+	if timeout := (&ProxyConfig{}).getIdleTimeout(rules, "http", "www.example.com", "80"); timeout != 0 {
+		t.Fatalf("Unexpected idle timeout:%d without rules", timeout)
+	}
+}
@@ -2,17 +2,15 @@ package local
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/yinqiwen/gsnova/common/channel"
-	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/hosts"
 	"github.com/yinqiwen/gsnova/common/logger"
@@ -20,20 +18,23 @@ import (
 	"github.com/yinqiwen/gsnova/common/socks"
 )
 
-var proxyServerRunning = true
-
-var runningProxyStreamCount int64
-var runningProxyConns sync.Map
-
-func serveProxyConn(conn net.Conn, remoteHost, remotePort string, proxy *ProxyConfig) {
+func (c *Client) serveProxyConn(ctx context.Context, conn net.Conn, remoteHost, remotePort string, proxy *ProxyConfig) {
 	var proxyChannelName string
 	protocol := "tcp"
 	localConn := conn
-	atomic.AddInt64(&runningProxyStreamCount, 1)
-	runningProxyConns.Store(conn, true)
+	conf := c.Config()
+	rules := &c.rules
+	atomic.AddInt64(&c.runningStreams, 1)
+	c.conns.Store(conn, true)
 	defer localConn.Close()
-	defer atomic.AddInt64(&runningProxyStreamCount, -1)
-	defer runningProxyConns.Delete(conn)
+	defer atomic.AddInt64(&c.runningStreams, -1)
+	defer c.conns.Delete(conn)
+	var priorityStreams *int64
+	defer func() {
+		if nil != priorityStreams {
+			atomic.AddInt64(priorityStreams, -1)
+		}
+	}()
 
 	isSocksProxy := false
 	isHttpsProxy := false
@@ -50,9 +51,9 @@ func serveProxyConn(conn net.Conn, remoteHost, remotePort string, proxy *ProxyCo
 			socksConn.Grant(&net.TCPAddr{
 				IP: net.ParseIP("0.0.0.0"), Port: 0})
 			localConn = socksConn
-			if socksConn.Req.Target == GConf.UDPGW.Addr {
+			if socksConn.Req.Target == conf.UDPGW.Addr {
 				logger.Debug("Handle udpgw conn for %v", socksConn.Req.Target)
-				handleUDPGatewayConn(localConn, proxy)
+				c.handleUDPGatewayConn(localConn, proxy)
 				return
 			}
 
@@ -89,15 +90,15 @@ func serveProxyConn(conn net.Conn, remoteHost, remotePort string, proxy *ProxyCo
 			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
 		}
 
-		if nil != dns.CNIPSet {
+		if localDNS := rules.getLocalDNS(); nil != localDNS && nil != localDNS.CNIPSet {
 			remoteIP := net.ParseIP(remoteHost)
-			logger.Debug("Recv proxy request to IP:%v CNIP:%v", remoteIP, dns.CNIPSet.IsInCountry(remoteIP, "CN"))
+			logger.Debug("Recv proxy request to IP:%v CNIP:%v", remoteIP, localDNS.IsCNIP(remoteIP))
 		}
 		sni, err := helper.PeekTLSServerName(bufconn)
 		if nil != err {
 			//logger.Debug("##Failed to sniff SNI with error:%v", err)
 		} else {
-			if redirect, ok := GConf.SNI.redirect(sni); ok {
+			if redirect, ok := conf.SNI.redirect(sni); ok {
 				sni = redirect
 			}
 			logger.Debug("Sniffed SNI:%s:%s for IP:%s:%s", sni, remotePort, remoteHost, remotePort)
@@ -182,26 +183,35 @@ START:
 		logger.Error("Can NOT resolve remote host or port %s:%s %v", remoteHost, remotePort, initialHTTPReq)
 		return
 	}
-	proxyChannelName = proxy.getProxyChannelByHost(protocol, remoteHost)
+	proxyChannelName = proxy.getProxyChannelByHost(rules, protocol, remoteHost)
 
 	if len(proxyChannelName) == 0 {
 		logger.Error("[ERROR]No proxy found for %s:%s", protocol, remoteHost)
 		return
 	}
-	stream, conf, err := channel.GetMuxStreamByChannel(proxyChannelName)
+	stream, streamConf, err := c.channels.GetMuxStreamContext(ctx, proxyChannelName)
 	if nil != err || nil == stream {
 		logger.Error("Failed to open stream for reason:%v by proxy:%s", err, proxyChannelName)
 		return
 	}
 	defer stream.Close()
 	ssid := stream.StreamID()
+	priority := proxy.getPriority(rules, protocol, remoteHost, remotePort)
+	idleTimeout := proxy.getIdleTimeout(rules, protocol, remoteHost, remotePort)
 	opt := mux.StreamOptions{
-		DialTimeout: conf.RemoteDialMSTimeout,
-		Hops:        conf.Hops,
+		DialTimeout: streamConf.RemoteDialMSTimeout,
+		Hops:        streamConf.Hops,
+		Priority:    priority,
+		IdleTimeout: idleTimeout,
+	}
+	if nil != priorityStreams {
+		atomic.AddInt64(priorityStreams, -1)
 	}
+	priorityStreams = &c.runningPriorityStreams[priority]
+	atomic.AddInt64(priorityStreams, 1)
 
 	if remotePort == "443" && nil == net.ParseIP(remoteHost) {
-		remoteSNI := conf.GetRemoteSNI(remoteHost)
+		remoteSNI := streamConf.GetRemoteSNI(remoteHost)
 		if len(remoteSNI) > 0 {
 			sniHost := hosts.GetHost(remoteSNI)
 			logger.Notice("Proxy stream[%d] select remote SNI host %s for proxy to %s:%s", ssid, sniHost, remoteHost, remotePort)
@@ -209,8 +219,8 @@ START:
 		}
 	}
 
-	logger.Notice("Proxy stream[%d] select %s for proxy to %s:%s", ssid, proxyChannelName, remoteHost, remotePort)
-	err = stream.Connect("tcp", net.JoinHostPort(remoteHost, remotePort), opt)
+	logger.Notice("Proxy %s stream[%d] select %s for proxy to %s:%s", mux.PriorityName(priority), ssid, proxyChannelName, remoteHost, remotePort)
+	err = mux.ConnectStream(ctx, stream, "tcp", net.JoinHostPort(remoteHost, remotePort), opt)
 	if nil != err {
 		logger.Error("Connect failed from proxy connection for reason:%v", err)
 		return
@@ -219,84 +229,78 @@ START:
 	//clear read timeout
 	var zero time.Time
 	localConn.SetReadDeadline(zero)
-	streamReader, streamWriter := mux.GetCompressStreamReaderWriter(stream, conf.Compressor)
-
-	closeCh := make(chan int, 1)
-	go func() {
-		buf := make([]byte, 128*1024)
-		io.CopyBuffer(localConn, streamReader, buf)
-		closeCh <- 1
-	}()
-
-	//start task to check stream timeout(if the stream has no read&write action more than 10s)
-	timeoutTicker := time.NewTicker(2 * time.Second)
-	stopTicker := make(chan bool, 1)
-	go func() {
-		maxIdleTime := time.Duration(GConf.Mux.StreamIdleTimeout) * time.Second
-		if maxIdleTime == 0 {
-			maxIdleTime = 10 * time.Second
-		}
+	streamReader, streamWriter := mux.GetCompressStreamReaderWriter(stream, streamConf.Compressor, streamConf.CompressStat())
+	if close, ok := streamReader.(io.Closer); ok {
+		defer close.Close()
+	}
 
-		for {
-			select {
-			case <-timeoutTicker.C:
-				if time.Now().Sub(stream.LatestIOTime()) > maxIdleTime {
-					localConn.Close()
-					stream.Close()
-					logger.Error("Close stream[%d] since it's not active since %v ago.", ssid, time.Now().Sub(stream.LatestIOTime()))
-					return
-				}
-			case <-stopTicker:
-				return
-			}
-		}
-	}()
+	relay := &mux.Relay{
+		Conn:         localConn,
+		Stream:       stream,
+		StreamReader: streamReader,
+		StreamWriter: streamWriter,
+		IdleTimeout:  time.Duration(conf.Mux.StreamIdleTimeout) * time.Second,
+	}
+	if idleTimeout > 0 {
+		relay.IdleTimeout = time.Duration(idleTimeout) * time.Second
+	}
 	if (isSocksProxy || isHttpsProxy || isTransparentProxy) && nil == initialHTTPReq {
-		buf := make([]byte, 128*1024)
-		io.CopyBuffer(streamWriter, bufconn, buf)
-		if close, ok := streamWriter.(io.Closer); ok {
-			close.Close()
+		//flush bytes buffered by sniffing, then relay from the conn directly
+		if n := bufconn.Buffered(); n > 0 {
+			buffered, _ := bufconn.Peek(n)
+			streamWriter.Write(buffered)
+			bufconn.Discard(n)
 		}
 	} else {
 		proxyReq := initialHTTPReq
 		initialHTTPReq = nil
-		for {
-			if nil != proxyReq {
-				proxyReq.Header.Del("Proxy-Connection")
-				proxyReq.Header.Del("Proxy-Authorization")
-				err = proxyReq.Write(streamWriter)
-				if nil != err {
-					logger.Error("Failed to write http request for reason:%v", err)
-					return
+		relay.Forward = func(w io.Writer) error {
+			for {
+				if nil != proxyReq {
+					proxyReq.Header.Del("Proxy-Connection")
+					proxyReq.Header.Del("Proxy-Authorization")
+					err := proxyReq.Write(w)
+					if nil != err {
+						logger.Error("Failed to write http request for reason:%v", err)
+						return err
+					}
 				}
-			}
-			prevReq := proxyReq
-			//localConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-			proxyReq, err = http.ReadRequest(bufconn)
-			if nil != err {
-				if err, ok := err.(net.Error); ok && err.Timeout() {
-
+				prevReq := proxyReq
+				//localConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				nextReq, err := http.ReadRequest(bufconn)
+				if nil != err {
+					if err == io.EOF {
+						return nil
+					}
+					if !strings.Contains(err.Error(), "use of closed network connection") {
+						logger.Notice("Failed to read proxy http request to %s:%s for reason:%v", remoteHost, remotePort, err)
+					}
+					return err
 				}
-				if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
-					logger.Notice("Failed to read proxy http request to %s:%s for reason:%v", remoteHost, remotePort, err)
+				proxyReq = nextReq
+				if nil != prevReq && prevReq.Host != proxyReq.Host {
+					logger.Debug("Switch to next stream since target host change from %s to %s", prevReq.Host, proxyReq.Host)
+					//the request is sent by next stream
+					initialHTTPReq = proxyReq
+					remoteHost, remotePort = proxyReq.Host, "80"
+					if strings.Contains(proxyReq.Host, ":") {
+						remoteHost, remotePort, _ = net.SplitHostPort(proxyReq.Host)
+					}
+					return mux.ErrRelaySwitchStream
 				}
-				return
-			}
-			if nil != prevReq && prevReq.Host != proxyReq.Host {
-				logger.Debug("Switch to next stream since target host change from %s to %s", prevReq.Host, proxyReq.Host)
-				stream.Close()
-				goto START
 			}
 		}
 	}
-	<-closeCh
-	close(stopTicker)
+	reason := relay.Run()
+	logger.Debug("Proxy stream[%d] to %s:%s closed by %s, sent %d bytes, received %d bytes.", ssid, remoteHost, remotePort, reason, relay.ForwardBytes, relay.BackwardBytes)
+	if reason == mux.RelayCloseSwitch {
+		goto START
+	}
 }
 
-func startLocalProxyServer(proxyIdx int) (*net.TCPListener, error) {
-	proxyConf := &GConf.Proxy[proxyIdx]
+func (c *Client) startLocalProxyServer(ctx context.Context, proxyConf *ProxyConfig) (*net.TCPListener, error) {
 	if supportTransparentProxy() {
-		go startTransparentUDProxy(proxyConf.Local, proxyConf)
+		go c.startTransparentUDProxy(ctx, proxyConf.Local, proxyConf)
 	}
 	tcpaddr, err := net.ResolveTCPAddr("tcp", proxyConf.Local)
 	if nil != err {
@@ -310,9 +314,8 @@ func startLocalProxyServer(proxyIdx int) (*net.TCPListener, error) {
 		return nil, err
 	}
 	logger.Info("Listen on address %s", proxyConf.Local)
-	runningServers[proxyIdx] = lp
 	go func() {
-		for proxyServerRunning {
+		for nil == ctx.Err() {
 			var conn net.Conn
 			conn, err = lp.AcceptTCP()
 			if nil != err {
@@ -339,38 +342,9 @@ func startLocalProxyServer(proxyIdx int) (*net.TCPListener, error) {
 				originalHost = remoteIP.String()
 				originalPort = fmt.Sprintf("%d", remotePort)
 			}
-			go serveProxyConn(conn, originalHost, originalPort, &GConf.Proxy[proxyIdx])
+			go c.serveProxyConn(ctx, conn, originalHost, originalPort, proxyConf)
 		}
 		lp.Close()
 	}()
 	return lp, nil
 }
-
-var runningServers []*net.TCPListener
-
-func startLocalServers() error {
-	proxyServerRunning = true
-	runningServers = make([]*net.TCPListener, len(GConf.Proxy))
-	for i := range GConf.Proxy {
-		startLocalProxyServer(i)
-	}
-	return nil
-}
-
-func stopLocalServers() {
-	proxyServerRunning = false
-	for _, l := range runningServers {
-		if nil != l {
-			l.Close()
-		}
-	}
-	//closeAllProxySession()
-	closeAllUDPSession()
-	runningProxyConns.Range(func(key, value interface{}) bool {
-		conn := key.(net.Conn)
-		if nil != conn {
-			conn.Close()
-		}
-		return true
-	})
-}
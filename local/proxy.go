@@ -1,17 +1,11 @@
 package local
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"net/http"
-	"sync/atomic"
-	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/yinqiwen/gotoolkit/gfwlist"
-	"github.com/yinqiwen/gsnova/common/channel"
-	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/helper"
 	"github.com/yinqiwen/gsnova/common/hosts"
 	"github.com/yinqiwen/gsnova/common/logger"
@@ -19,9 +13,6 @@ import (
 
 var proxyHome string
 
-var localGFWList atomic.Value
-var fetchGFWListRunning bool
-
 func init() {
 	proxyHome = "."
 }
@@ -56,7 +47,13 @@ func watchConf(watcher *fsnotify.Watcher) {
 		case event := <-watcher.Events:
 			logger.Debug("fsnotify event:%v", event)
 			if (event.Op & fsnotify.Write) == fsnotify.Write {
-				loadClientConf(event.Name)
+				if nil == loadClientConf(event.Name) && nil != defaultClient {
+					logger.Notice("Reload client with config:%s", event.Name)
+					GConf.LocalDNS.CNIPSet = defaultClient.Config().LocalDNS.CNIPSet
+					if err := defaultClient.Reload(context.Background(), &GConf); nil != err {
+						logger.Error("Failed to reload client with reason:%v", err)
+					}
+				}
 			}
 		case err := <-watcher.Errors:
 			logger.Error("error:%v", err)
@@ -72,102 +69,15 @@ type ProxyOptions struct {
 	WatchConf bool
 }
 
-func getGFWList() *gfwlist.GFWList {
-	v := localGFWList.Load()
-	if nil != v {
-		return v.(*gfwlist.GFWList)
-	}
-	return nil
-}
-
-func loadGFWList(hc *http.Client) error {
-	resp, err := hc.Get(GConf.GFWList.URL)
-	if nil != err {
-		logger.Error("Failed to fetch GFWList")
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		logger.Error("Failed to fetch GFWList with res:%v", resp)
-		return err
-	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if nil != err {
-		logger.Error("Failed to read GFWList with err:%v", err)
-		return err
-	}
-	gfw, err := gfwlist.NewFromString(string(body), true)
-	if nil != err {
-		logger.Error("Invalid GFWList content:%v", err)
-		return err
-	}
-	for _, rule := range GConf.GFWList.UserRule {
-		gfw.Add(rule)
-	}
-	logger.Info("GFWList sync success.")
-	localGFWList.Store(gfw)
-	return nil
-}
-
-func initGFWList() {
-	if fetchGFWListRunning {
-		return
-	}
-	fetchGFWListRunning = true
-	if len(GConf.GFWList.URL) > 0 {
-		hc, _ := channel.NewHTTPClient(&channel.ProxyChannelConfig{Proxy: GConf.GFWList.Proxy}, "http")
-		for {
-			err := loadGFWList(hc)
-			var nextRefreshTime time.Duration
-			if nil == err {
-				if GConf.GFWList.RefershPeriodMiniutes <= 0 {
-					GConf.GFWList.RefershPeriodMiniutes = 1440
-				}
-				nextRefreshTime = time.Duration(GConf.GFWList.RefershPeriodMiniutes) * time.Minute
-			} else {
-				nextRefreshTime = 5 * time.Second
-			}
-			logger.Info("Refresh GFWList after %v.", nextRefreshTime)
-			time.Sleep(nextRefreshTime)
-		}
-	}
-}
+//defaultClient is the client started by Start/StartProxy with GConf
+var defaultClient *Client
 
 func StartProxy() error {
-	GConf.init()
-	logger.InitLogger(GConf.Log)
-	channel.SetDefaultMuxConfig(GConf.Mux)
-
-	if GConf.TransparentMark > 0 {
-		enableTransparentSocketMark(GConf.TransparentMark)
+	if nil != defaultClient {
+		defaultClient.Stop()
 	}
-	dns.Init(&GConf.LocalDNS)
-	go initGFWList()
-
-	logger.Notice("Allowed proxy channel with schema:%v", channel.AllowedSchema())
-	singalCh := make(chan bool, len(GConf.Channel))
-	channelCount := 0
-	for _, conf := range GConf.Channel {
-		if !conf.Enable {
-			continue
-		}
-		channel := channel.NewProxyChannel(&conf)
-		channel.Conf = conf
-		channelCount++
-		go func() {
-			channel.Init(true)
-			singalCh <- true
-		}()
-	}
-	for i := 0; i < channelCount; i++ {
-		<-singalCh
-	}
-
-	logger.Info("Started GSnova %s.", channel.Version)
-
-	go startAdminServer()
-	startLocalServers()
-	return nil
+	defaultClient = NewClient(&GConf)
+	return defaultClient.Start(context.Background())
 }
 
 func Start(options ProxyOptions) error {
@@ -203,8 +113,9 @@ func Start(options ProxyOptions) error {
 }
 
 func Stop() error {
-	stopLocalServers()
-	channel.StopLocalChannels()
+	if nil != defaultClient {
+		defaultClient.Stop()
+	}
 	hosts.Clear()
 	return nil
 }
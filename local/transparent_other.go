@@ -3,6 +3,7 @@
 package local
 
 import (
+	"context"
 	"fmt"
 	"net"
 
@@ -13,7 +14,7 @@ func getOrinalTCPRemoteAddr(conn net.Conn) (net.Conn, net.IP, uint16, error) {
 	return nil, nil, 0, fmt.Errorf("'getOrinalTCPRemoteAddr' Not supported in current system")
 }
 
-func startTransparentUDProxy(addr string, proxy *ProxyConfig) {
+func (c *Client) startTransparentUDProxy(ctx context.Context, addr string, proxy *ProxyConfig) {
 	logger.Error("'startTransparentUDProxy' Not supported in current system")
 }
 
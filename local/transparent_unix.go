@@ -3,6 +3,7 @@
 package local
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
@@ -11,7 +12,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/yinqiwen/gsnova/common/channel"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
 	"github.com/yinqiwen/gsnova/common/netx"
@@ -68,6 +68,7 @@ type tudpSession struct {
 	local  syscall.Sockaddr
 	remote syscall.Sockaddr
 	conf   *ProxyConfig
+	client *Client
 	stream mux.MuxStream
 
 	key        string
@@ -99,14 +100,15 @@ func (t *tudpSession) handle(p []byte) {
 			protocol = "dns"
 			isDNS = true
 		}
-		proxyChannelName := t.conf.getProxyChannelByHost(protocol, t.remoteIP.String())
+		proxyChannelName := t.conf.getProxyChannelByHost(&t.client.rules, protocol, t.remoteIP.String())
 		if len(proxyChannelName) == 0 {
 			logger.Error("[ERROR]No proxy found for %s:%s", protocol, t.remoteIP.String())
 			t.close(nil)
 			return
 		}
 		logger.Debug("Select %s to proxy udp packet to %s:%s", proxyChannelName, t.remoteIP.String(), t.remotePort)
-		stream, conf, err := channel.GetMuxStreamByChannel(proxyChannelName)
+		ctx := t.client.context()
+		stream, conf, err := t.client.channels.GetMuxStreamContext(ctx, proxyChannelName)
 		var readTimeout int
 		if nil == err {
 			readTimeout = conf.RemoteDNSReadMSTimeout
@@ -119,7 +121,7 @@ func (t *tudpSession) handle(p []byte) {
 				DialTimeout: conf.RemoteDialMSTimeout,
 				ReadTimeout: readTimeout,
 			}
-			err = stream.Connect("udp", net.JoinHostPort(t.remoteIP.String(), t.remotePort), opt)
+			err = mux.ConnectStream(ctx, stream, "udp", net.JoinHostPort(t.remoteIP.String(), t.remotePort), opt)
 		}
 		if nil != err || nil == stream {
 			logger.Error("Failed to open stream for reason:%v by proxy:%s", err, proxyChannelName)
@@ -158,11 +160,12 @@ func (t *tudpSession) handle(p []byte) {
 
 var tudpSessions sync.Map
 
-func getTUDPSession(proxy *ProxyConfig, laddr, raddr syscall.Sockaddr) *tudpSession {
+func getTUDPSession(c *Client, proxy *ProxyConfig, laddr, raddr syscall.Sockaddr) *tudpSession {
 	t := &tudpSession{
 		local:  laddr,
 		remote: raddr,
 		conf:   proxy,
+		client: c,
 	}
 	if _, ok := raddr.(*syscall.SockaddrInet4); ok {
 		t.remotePort = fmt.Sprintf("%d", raddr.(*syscall.SockaddrInet4).Port)
@@ -184,7 +187,7 @@ func getTUDPSession(proxy *ProxyConfig, laddr, raddr syscall.Sockaddr) *tudpSess
 	return actual.(*tudpSession)
 }
 
-func startTransparentUDProxy(addr string, proxy *ProxyConfig) {
+func (c *Client) startTransparentUDProxy(ctx context.Context, addr string, proxy *ProxyConfig) {
 	lhost, lport, err := net.SplitHostPort(addr)
 	if nil != err {
 		logger.Error("Split error:%v", err)
@@ -247,13 +250,20 @@ func startTransparentUDProxy(addr string, proxy *ProxyConfig) {
 		return
 	}
 	logger.Info("Listen transparent UDP proxy on %s:%d", ip.String(), port)
-	for proxyServerRunning {
+	go func() {
+		<-ctx.Done()
+		syscall.Shutdown(socketFd, syscall.SHUT_RD)
+		syscall.Close(socketFd)
+	}()
+	for nil == ctx.Err() {
 		data, local, remote, err := recvTransparentUDP(socketFd)
 		if nil != err {
-			logger.Error("Recv msg error:%v", err)
+			if nil == ctx.Err() {
+				logger.Error("Recv msg error:%v", err)
+			}
 			continue
 		}
-		u := getTUDPSession(proxy, local, remote)
+		u := getTUDPSession(c, proxy, local, remote)
 		u.handle(data)
 	}
 }
@@ -3,6 +3,7 @@ package local
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -12,7 +13,6 @@ import (
 
 	"github.com/google/btree"
 	"github.com/yinqiwen/gsnova/common/channel"
-	"github.com/yinqiwen/gsnova/common/dns"
 	"github.com/yinqiwen/gsnova/common/logger"
 	"github.com/yinqiwen/gsnova/common/mux"
 )
@@ -118,6 +118,7 @@ type udpSession struct {
 	streamWriter     io.Writer
 	streamReader     io.Reader
 	proxyChannelName string
+	client           *Client
 }
 
 func (u *udpSession) closeStream() {
@@ -130,8 +131,8 @@ func (u *udpSession) closeStream() {
 }
 func (u *udpSession) close() {
 	u.closeStream()
-	removeUdpSession(&u.udpSessionId, 0)
-	updateUdpSession(u, true)
+	u.client.udp.remove(&u.udpSessionId, 0)
+	u.client.udp.update(u, true)
 }
 
 func (u *udpSession) Write(content []byte) error {
@@ -151,11 +152,17 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 		return nil
 	}
 
+	rules := &u.client.rules
 	remoteAddr := packet.address()
 	if packet.addr.port == 53 {
-		selectProxy := proxy.findProxyChannelByRequest("dns", packet.addr.ip.String(), nil)
+		selectProxy := proxy.findProxyChannelByRequest(rules, "dns", packet.addr.ip.String(), nil)
 		if selectProxy == channel.DirectChannelName {
-			res, err := dns.LocalDNS.QueryRaw(packet.content)
+			localDNS := rules.getLocalDNS()
+			if nil == localDNS {
+				u.close()
+				return nil
+			}
+			res, err := localDNS.DNS.QueryRaw(packet.content)
 			if nil == err {
 				err = u.Write(res)
 			}
@@ -166,12 +173,12 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 			return err
 		}
 		u.proxyChannelName = selectProxy
-		if len(GConf.LocalDNS.TrustedDNS) > 0 {
-			remoteAddr = GConf.LocalDNS.TrustedDNS[0]
+		if trustedDNS := u.client.Config().LocalDNS.TrustedDNS; len(trustedDNS) > 0 {
+			remoteAddr = trustedDNS[0]
 		}
 	}
 	if len(u.proxyChannelName) == 0 {
-		u.proxyChannelName = proxy.findProxyChannelByRequest("udp", packet.addr.ip.String(), nil)
+		u.proxyChannelName = proxy.findProxyChannelByRequest(rules, "udp", packet.addr.ip.String(), nil)
 	}
 	if len(u.proxyChannelName) == 0 {
 		logger.Error("[ERROR]No proxy found for udp to %s", packet.addr.ip.String())
@@ -183,7 +190,8 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 			u.closeStream()
 		}
 	}
-	stream, conf, err := channel.GetMuxStreamByChannel(u.proxyChannelName)
+	ctx := u.client.context()
+	stream, conf, err := u.client.channels.GetMuxStreamContext(ctx, u.proxyChannelName)
 	readTimeoutMS := conf.RemoteUDPReadMSTimeout
 	if packet.addr.port == 53 {
 		readTimeoutMS = conf.RemoteDNSReadMSTimeout
@@ -193,7 +201,7 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 			DialTimeout: conf.RemoteDialMSTimeout,
 			ReadTimeout: readTimeoutMS,
 		}
-		err = stream.Connect("udp", remoteAddr, opt)
+		err = mux.ConnectStream(ctx, stream, "udp", remoteAddr, opt)
 	}
 	if nil != err {
 		logger.Error("[ERROR]Failed to create mux stream:%v for proxy:%s by address:%v", err, u.proxyChannelName, packet.addr)
@@ -201,12 +209,16 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 	}
 
 	u.stream = stream
-	u.streamReader, u.streamWriter = mux.GetCompressStreamReaderWriter(stream, conf.Compressor)
-	go func() {
+	u.streamReader, u.streamWriter = mux.GetCompressStreamReaderWriter(stream, conf.Compressor, conf.CompressStat())
+	go func(streamReader io.Reader) {
+		//the reader is only closed here since decoders could not be closed while reading
+		if close, ok := streamReader.(io.Closer); ok {
+			defer close.Close()
+		}
 		b := make([]byte, 8192)
 		for {
 			stream.SetReadDeadline(time.Now().Add(time.Duration(readTimeoutMS) * time.Millisecond))
-			n, err := u.streamReader.Read(b)
+			n, err := streamReader.Read(b)
 			if n > 0 {
 				err = u.Write(b[0:n])
 			}
@@ -214,56 +226,65 @@ func (u *udpSession) handlePacket(proxy *ProxyConfig, packet *udpgwPacket) error
 				break
 			}
 		}
-
-	}()
+	}(u.streamReader)
 	u.streamWriter.Write(packet.content)
 	return nil
 }
 
-var udpSessionTable sync.Map
-var udpSessionIdSet = btree.New(4)
-var cidTable = make(map[uint32]uint16)
-var udpSessionMutex sync.Mutex
+//udpSessionTable holds udpgw sessions of a client
+type udpSessionTable struct {
+	sessions sync.Map
+	idSet    *btree.BTree
+	cidTable map[uint32]uint16
+	mutex    sync.Mutex
+}
 
-func closeAllUDPSession() {
-	udpSessionTable.Range(func(key, value interface{}) bool {
+func newUDPSessionTable() *udpSessionTable {
+	return &udpSessionTable{
+		idSet:    btree.New(4),
+		cidTable: make(map[uint32]uint16),
+	}
+}
+
+func (t *udpSessionTable) closeAll() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sessions.Range(func(key, value interface{}) bool {
 		session := value.(*udpSession)
 		session.closeStream()
+		t.sessions.Delete(key)
 		return true
 	})
-	udpSessionTable = sync.Map{}
-	cidTable = make(map[uint32]uint16)
+	t.idSet.Clear(false)
+	t.cidTable = make(map[uint32]uint16)
 }
 
-func removeUdpSession(id *udpSessionId, expireTime time.Duration) {
-	v, exist := udpSessionTable.Load(id.id)
+func (t *udpSessionTable) remove(id *udpSessionId, expireTime time.Duration) {
+	v, exist := t.sessions.Load(id.id)
 	if exist {
 		if expireTime > 0 {
 			logger.Debug("Delete udpsession:%d since it's not active since %v ago.", id.id, expireTime)
 		}
 		v.(*udpSession).closeStream()
-		udpSessionTable.Delete(id.id)
+		t.sessions.Delete(id.id)
 		//delete(udpSessionTable, s.id)
 	}
 }
 
-func init() {
-	go expireUdpSessions()
-}
-
-func expireUdpSessions() {
+func (t *udpSessionTable) expire(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
 	removeExpiredSession := func() {
-		udpSessionMutex.Lock()
-		defer udpSessionMutex.Unlock()
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
 		for i := 0; i < 5; i++ {
-			tmp := udpSessionIdSet.Min()
+			tmp := t.idSet.Min()
 			if nil != tmp {
 				id := tmp.(*udpSessionId)
 				expireTime := time.Now().Sub(id.activeTime)
 				if expireTime >= 30*time.Second {
-					udpSessionIdSet.Delete(id)
-					removeUdpSession(id, expireTime)
+					t.idSet.Delete(id)
+					t.remove(id, expireTime)
 				} else {
 					return
 				}
@@ -274,32 +295,35 @@ func expireUdpSessions() {
 		select {
 		case <-ticker.C:
 			removeExpiredSession()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func updateUdpSession(u *udpSession, remove bool) {
-	udpSessionMutex.Lock()
-	defer udpSessionMutex.Unlock()
+func (t *udpSessionTable) update(u *udpSession, remove bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	if !u.activeTime.IsZero() {
-		udpSessionIdSet.Delete(&u.udpSessionId)
+		t.idSet.Delete(&u.udpSessionId)
 	}
 	if !remove {
 		u.activeTime = time.Now()
-		udpSessionIdSet.ReplaceOrInsert(&u.udpSessionId)
+		t.idSet.ReplaceOrInsert(&u.udpSessionId)
 	}
 }
 
-func getUDPSession(id uint16, conn net.Conn, createIfMissing bool) *udpSession {
-	udpSessionMutex.Lock()
-	defer udpSessionMutex.Unlock()
-	usession, exist := udpSessionTable.Load(id)
+func (t *udpSessionTable) get(c *Client, id uint16, conn net.Conn, createIfMissing bool) *udpSession {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	usession, exist := t.sessions.Load(id)
 	if !exist {
 		if createIfMissing {
 			s := new(udpSession)
 			s.localConn = conn
 			s.id = id
-			udpSessionTable.Store(id, s)
+			s.client = c
+			t.sessions.Store(id, s)
 			//cidTable[s.session.id] = id
 			return s
 		}
@@ -307,14 +331,14 @@ func getUDPSession(id uint16, conn net.Conn, createIfMissing bool) *udpSession {
 	}
 	return usession.(*udpSession)
 }
-func getCid(sid uint32) (uint16, bool) {
-	udpSessionMutex.Lock()
-	defer udpSessionMutex.Unlock()
-	cid, exist := cidTable[sid]
+func (t *udpSessionTable) getCid(sid uint32) (uint16, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	cid, exist := t.cidTable[sid]
 	return cid, exist
 }
 
-func handleUDPGatewayConn(localConn net.Conn, proxy *ProxyConfig) {
+func (c *Client) handleUDPGatewayConn(localConn net.Conn, proxy *ProxyConfig) {
 	bufconn := bufio.NewReader(localConn)
 	defer func() {
 		localConn.Close()
@@ -332,9 +356,9 @@ func handleUDPGatewayConn(localConn net.Conn, proxy *ProxyConfig) {
 			//log.Printf("###Recv udpgw packet to %s:%d", packet.addr.ip.String(), packet.addr.port)
 		}
 
-		usession := getUDPSession(packet.conid, localConn, true)
+		usession := c.udp.get(c, packet.conid, localConn, true)
 		usession.addr = packet.addr
-		updateUdpSession(usession, false)
+		c.udp.update(usession, false)
 		go usession.handlePacket(proxy, &packet)
 	}
 }
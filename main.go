@@ -75,6 +75,8 @@ func main() {
 	quicServer := flag.String("quic", "", "Remote QUIC proxy server listen address")
 	kcpServer := flag.String("kcp", "", "Remote KCP proxy server listen address")
 	tlsServer := flag.String("tls", "", "Remote TLS proxy server listen address")
+	grpcServer := flag.String("grpc", "", "Remote gRPC(h2c) proxy server listen address")
+	sshServer := flag.String("ssh", "", "Remote SSH gateway listen address")
 
 	flag.Parse()
 
@@ -111,7 +113,7 @@ func main() {
 		}
 		if *cmd {
 			if len(hops) == 0 {
-				logger.Error("At least one -hop argument required.", err)
+				logger.Error("At least one -hop argument required.")
 				flag.PrintDefaults()
 				return
 			}
@@ -186,6 +188,12 @@ func main() {
 			if len(*tlsServer) > 0 {
 				remote.ServerConf.TLS.Listen = *tlsServer
 			}
+			if len(*sshServer) > 0 {
+				remote.ServerConf.SSH.Listen = *sshServer
+			}
+			if len(*grpcServer) > 0 {
+				remote.ServerConf.Listeners = append(remote.ServerConf.Listeners, channel.ListenerConfig{Scheme: "grpc", Listen: *grpcServer})
+			}
 			if len(*key) > 0 {
 				remote.ServerConf.Cipher.Key = *key
 			}
@@ -220,16 +228,15 @@ func main() {
 			remote.ServerConf.Cipher.Key = cipherKey
 			logger.Notice("Server cipher key overide by env:GSNOVA_CIPHER_KEY")
 		}
-		channel.SetDefaultMuxConfig(remote.ServerConf.Mux)
-		remote.ServerConf.Cipher.AllowUsers(remote.ServerConf.Cipher.User)
-		channel.DefaultServerCipher = remote.ServerConf.Cipher
-
 		logger.InitLogger(remote.ServerConf.Log)
 
 		logger.Info("Load server conf success.")
 		confdata, _ := json.MarshalIndent(&remote.ServerConf, "", "    ")
 		logger.Info("GSnova server:%s start with config:\n%s", channel.Version, string(confdata))
-		remote.StartRemoteProxy()
+		if err := remote.StartRemoteProxy(); nil != err {
+			logger.Error("Start gsnova server error:%v", err)
+			return
+		}
 	}
 
 	if len(*pid) > 0 {
@@ -1,7 +1,10 @@
 package remote
 
 import (
+	"encoding/json"
+
 	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/dns"
 )
 
 type TLServerConfig struct {
@@ -24,6 +27,10 @@ type QUICServerConfig struct {
 
 type HTTPServerConfig struct {
 	Listen string
+	//path prefix & headers of HTTP/Websocket channels, which should be same as clients
+	channel.HTTPEndpointConfig
+	//instances sharing sessions of HTTP channel behind a load balancer
+	Cluster channel.HTTPClusterConfig
 }
 type HTTP2ServerConfig struct {
 	Listen string
@@ -35,6 +42,15 @@ type TCPServerConfig struct {
 	Listen string
 }
 
+//SSHServerConfig is the ssh gateway serving stock ssh clients by direct-tcpip channels, eg: 'ssh -N -D'
+type SSHServerConfig struct {
+	Listen string
+	//private key file of host key, a key is generated while starting if empty
+	HostKey string
+	//authorized keys file of clients, password of cipher key is always accepted for allowed users
+	AuthorizedKeys string
+}
+
 type ServerConfig struct {
 	Cipher channel.CipherConfig
 	Mux    channel.MuxConfig
@@ -45,6 +61,41 @@ type ServerConfig struct {
 	HTTP   HTTPServerConfig
 	TCP    TCPServerConfig
 	HTTP2  HTTP2ServerConfig
+	SSH    SSHServerConfig
+	//listeners of registered channel schemes, eg: {"Scheme":"wss", "Listen":":443", "Options":{"Cert":"", "Key":""}}
+	Listeners []channel.ListenerConfig
+	//IPv6 could be prefer/fallback/require/disable, empty means prefer
+	IPv6 string
+	//seconds of tcp keepalive period to targets, 0 means system default, negative means disabled
+	KeepAlive int
+	//resolver of target domains
+	Resolver dns.ResolverConfig
+}
+
+func newListenerConfig(scheme, listen string, options interface{}) *channel.ListenerConfig {
+	conf := &channel.ListenerConfig{Scheme: scheme, Listen: listen}
+	if nil != options {
+		conf.Options, _ = json.Marshal(options)
+	}
+	return conf
+}
+
+//listenerConfigs return listeners of the transport configs & the generic listeners
+func (c *ServerConfig) listenerConfigs() []channel.ListenerConfig {
+	var confs []channel.ListenerConfig
+	add := func(scheme, listen string, options interface{}) {
+		if len(listen) > 0 {
+			confs = append(confs, *newListenerConfig(scheme, listen, options))
+		}
+	}
+	add("tcp", c.TCP.Listen, nil)
+	add("tls", c.TLS.Listen, &channel.TLSOptions{Cert: c.TLS.Cert, Key: c.TLS.Key})
+	add("http", c.HTTP.Listen, nil)
+	add("http2", c.HTTP2.Listen, &channel.TLSOptions{Cert: c.HTTP2.Cert, Key: c.HTTP2.Key})
+	add("kcp", c.KCP.Listen, &c.KCP.Params)
+	add("quic", c.QUIC.Listen, &channel.TLSOptions{Cert: c.QUIC.Cert, Key: c.QUIC.Key})
+	add("ssh", c.SSH.Listen, &channel.SSHOptions{HostKey: c.SSH.HostKey, AuthorizedKeys: c.SSH.AuthorizedKeys})
+	return append(confs, c.Listeners...)
 }
 
 var ServerConf ServerConfig
@@ -0,0 +1,110 @@
+package remote
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/dialer"
+	"github.com/yinqiwen/gsnova/internal/testutil"
+)
+
+func TestHTTPEndpoint(t *testing.T) {
+	endpoint := channel.HTTPEndpointConfig{
+		PathPrefix:      "/api/",
+		SessionIDHeader: "X-Test-Session",
+		ContentType:     "application/octet-stream",
+		Headers:         map[string]string{"X-Server": "gsnova"},
+	}
+	conf := &ServerConfig{}
+	conf.Cipher = channel.CipherConfig{User: "gsnova", Key: testKey, Method: "chacha20poly1305"}
+	conf.HTTP.HTTPEndpointConfig = endpoint
+	server, err := NewServer(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+
+	//record paths & headers of requests from clients
+	var mutex sync.Mutex
+	paths := make(map[string]bool)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		paths[r.URL.Path] = true
+		mutex.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/api/") && r.Header.Get("X-Client") != "gsnova" {
+			t.Errorf("Missing client header of request:%s", r.URL.Path)
+		}
+		server.Handler().ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	defer channel.StopLocalChannels()
+	defer server.Close()
+
+	host := strings.TrimPrefix(hs.URL, "http://")
+	for _, scheme := range []string{"ws", "http"} {
+		cc := &channel.ProxyChannelConfig{
+			Name:       "endpoint_" + scheme,
+			ServerList: []string{scheme + "://" + host},
+			Cipher:     conf.Cipher,
+		}
+		cc.HTTP.HTTPEndpointConfig = endpoint
+		cc.HTTP.Headers = map[string]string{"X-Client": "gsnova"}
+		d, err := dialer.New(cc)
+		if nil != err {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := d.DialContext(ctx, "tcp", echo.Addr().String())
+		cancel()
+		if nil != err {
+			t.Fatalf("Failed to dial via %s:%v", scheme, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("hello endpoint"))
+		buf := make([]byte, len("hello endpoint"))
+		if _, err = conn.Read(buf); nil != err || string(buf) != "hello endpoint" {
+			t.Fatalf("Unexpected echo:%s with err:%v via %s", buf, err, scheme)
+		}
+		conn.Close()
+	}
+	mutex.Lock()
+	for _, path := range []string{"/api/ws", "/api/http/pull", "/api/http/push"} {
+		if !paths[path] {
+			t.Fatalf("No request of path:%s in %v", path, paths)
+		}
+	}
+	mutex.Unlock()
+
+	//server headers & content type are set in responses
+	req, _ := http.NewRequest("POST", hs.URL+"/api/http/pull", nil)
+	req.Header.Set("X-Client", "gsnova")
+	req.Header.Set("X-Test-Session", "endpoint-test-session")
+	adjusted := endpoint
+	adjusted.Adjust()
+	req.Header.Set(adjusted.PullPeriodHeader, "1")
+	res, err := http.DefaultClient.Do(req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("X-Server") != "gsnova" || res.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("Unexpected response headers:%v", res.Header)
+	}
+
+	//the default paths are not served
+	res, err = http.Get(hs.URL + "/ws")
+	if nil != err {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusSwitchingProtocols || res.StatusCode == http.StatusBadRequest {
+		t.Fatalf("Unexpected status:%d of default websocket path", res.StatusCode)
+	}
+}
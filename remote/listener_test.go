@@ -0,0 +1,39 @@
+package remote
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/internal/testutil"
+)
+
+//TestListenerRoundTrip serve every registered remote channel scheme on loopback by the generic listener, and
+//connect it by the local channel of the same scheme.
+func TestListenerRoundTrip(t *testing.T) {
+	server := newTestServer(t)
+	defer channel.StopLocalChannels()
+	defer server.Close()
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+
+	for _, scheme := range channel.RemoteSchemes() {
+		if scheme == "ssh" {
+			//ssh gateway serves stock ssh clients, it's tested with ssh channel
+			continue
+		}
+		if _, exist := channel.LocalChannelTypeTable[scheme]; !exist {
+			t.Fatalf("No local channel of remote scheme:%s", scheme)
+		}
+		l, err := server.Listen(&channel.ListenerConfig{Scheme: scheme, Listen: "127.0.0.1:0"})
+		if nil != err {
+			t.Fatalf("Failed to listen %s:%v", scheme, err)
+		}
+		go server.ServeListener(l)
+		start := time.Now()
+		//listeners serve self signed certs
+		conn := testEcho(t, scheme+"://gsnova:"+testKey+"@"+l.Addr().String()+"?method=chacha20poly1305&insecure=true", echo.Addr().String())
+		conn.Close()
+		t.Logf("Round trip via %s listener:%v in %v", scheme, l.Addr(), time.Since(start))
+	}
+}
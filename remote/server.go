@@ -0,0 +1,375 @@
+package remote
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	_ "github.com/yinqiwen/gsnova/common/channel/common"
+	"github.com/yinqiwen/gsnova/common/dns"
+	"github.com/yinqiwen/gsnova/common/logger"
+	"github.com/yinqiwen/gsnova/common/netx"
+)
+
+//ErrServerClosed is returned by the Serve methods after Shutdown or Close
+var ErrServerClosed = channel.ErrServerClosed
+
+//Server is an embeddable gsnova remote server. It serves http channels(HTTP/Websocket) as a http.Handler, and
+//serves all registered remote channels on listeners declared in config or given by caller.
+type Server struct {
+	conf     ServerConfig
+	options  *channel.ServerOptions
+	sessions *channel.SessionGroup
+	handler  *http.ServeMux
+	//handler of standalone http listeners
+	listenerHandler *http.ServeMux
+
+	mutex     sync.Mutex
+	listeners map[channel.RemoteListener]struct{}
+	closed    bool
+}
+
+//shutdowner is implemented by listeners which could wait active requests finished, eg: http listeners
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+//NewServer create a server by config, the config is copied.
+func NewServer(conf *ServerConfig) (*Server, error) {
+	s := &Server{
+		conf:      *conf,
+		listeners: make(map[channel.RemoteListener]struct{}),
+	}
+	cfg := &s.conf
+	if !netx.IsValidIPv6Mode(cfg.IPv6) {
+		return nil, fmt.Errorf("Invalid IPv6 mode:%s, only prefer/fallback/require/disable supported", cfg.IPv6)
+	}
+	cfg.Cipher.AllowUsers(cfg.Cipher.User)
+	if err := cfg.HTTP.Cluster.Adjust(); nil != err {
+		return nil, err
+	}
+	s.options = &channel.ServerOptions{
+		Cipher:      cfg.Cipher,
+		Mux:         cfg.Mux,
+		IPv6:        cfg.IPv6,
+		KeepAlive:   time.Duration(cfg.KeepAlive) * time.Second,
+		HTTPCluster: cfg.HTTP.Cluster,
+		Hops:        channel.NewLocalChannelTable(),
+	}
+	if len(s.options.HTTPCluster.Secret) == 0 {
+		s.options.HTTPCluster.Secret = cfg.Cipher.Key
+	}
+	var hopsResolver dns.IPResolver
+	if resolver, err := dns.NewResolver(&cfg.Resolver); nil != err {
+		logger.Error("Failed to init resolver with reason:%v", err)
+	} else {
+		s.options.Resolver = resolver
+		hopsResolver = resolver
+	}
+	//servers of next hops are resolved by the resolver of server too
+	s.options.Hops.Configure(cfg.Mux, hopsResolver)
+	s.sessions = channel.NewServerSessionGroup(s.options)
+	cfg.HTTP.HTTPEndpointConfig.Adjust()
+	s.handler = s.newHandler(&cfg.HTTP.HTTPEndpointConfig, false)
+	s.listenerHandler = s.newHandler(&cfg.HTTP.HTTPEndpointConfig, true)
+	return s, nil
+}
+
+//newHandler create the handler of all http channels with endpoint config, the index/stat/stackdump pages
+//are only served by standalone http listeners
+func (s *Server) newHandler(endpoint *channel.HTTPEndpointConfig, standalone bool) *http.ServeMux {
+	handler := http.NewServeMux()
+	if standalone {
+		handler.HandleFunc("/", indexCallback)
+		handler.HandleFunc("/stat", s.statCallback)
+		handler.HandleFunc("/stackdump", stackdumpCallback)
+	}
+	//one channel may be registered with multiple schemes, eg: http/https
+	handled := make(map[channel.HTTPRemoteChannel]bool)
+	for _, scheme := range channel.RemoteSchemes() {
+		if hc, ok := channel.RemoteChannelTypeTable[scheme].(channel.HTTPRemoteChannel); ok && !handled[hc] {
+			hc.HandleHTTP(handler, endpoint, s.sessions)
+			handled[hc] = true
+		}
+	}
+	return handler
+}
+
+//Handler return the handler of HTTP/Websocket transports with paths of HTTP config relative to '/', use
+//http.StripPrefix to mount it under a path prefix, clients then connect the server url with the prefix, eg: 'wss://host/prefix'.
+//Only transport paths are registered, other paths are left to the caller.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+func (s *Server) addListener(l channel.RemoteListener) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) removeListener(l channel.RemoteListener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.listeners, l)
+}
+
+//listenerConfig return a copy of the listener config with options of server
+func (s *Server) listenerConfig(conf *channel.ListenerConfig) *channel.ListenerConfig {
+	c := *conf
+	c.Server = s.options
+	return &c
+}
+
+func (s *Server) remoteChannel(conf *channel.ListenerConfig) (channel.RemoteChannel, error) {
+	p, exist := channel.RemoteChannelTypeTable[conf.Scheme]
+	if !exist {
+		return nil, fmt.Errorf("Invalid listener scheme:%s, registered schemes:%v", conf.Scheme, channel.RemoteSchemes())
+	}
+	return p, nil
+}
+
+//httpHandler return the handler factory for http listeners, endpoint options of listener override the HTTP config
+func (s *Server) httpHandler(conf *channel.ListenerConfig) (func(group *channel.SessionGroup) http.Handler, error) {
+	handler := s.listenerHandler
+	if len(conf.Options) > 0 {
+		endpoint := s.conf.HTTP.HTTPEndpointConfig
+		endpoint.Headers = make(map[string]string)
+		for k, v := range s.conf.HTTP.Headers {
+			endpoint.Headers[k] = v
+		}
+		if err := conf.DecodeOptions(&endpoint); nil != err {
+			return nil, err
+		}
+		endpoint.Adjust()
+		handler = s.newHandler(&endpoint, true)
+	}
+	return func(group *channel.SessionGroup) http.Handler {
+		return handler
+	}, nil
+}
+
+//ServeListener serve the listener until it's closed, it returns ErrServerClosed after Shutdown or Close.
+func (s *Server) ServeListener(l channel.RemoteListener) error {
+	if !s.addListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	err := l.Serve(s.sessions)
+	s.removeListener(l)
+	if s.sessions.Closed() || err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+//NewListener create a listener of the channel scheme on a given tcp listener, listeners of http channels
+//serve the handler of server which include all http channels.
+func (s *Server) NewListener(conf *channel.ListenerConfig, l net.Listener) (channel.RemoteListener, error) {
+	conf = s.listenerConfig(conf)
+	p, err := s.remoteChannel(conf)
+	if nil != err {
+		return nil, err
+	}
+	switch rc := p.(type) {
+	case channel.HTTPRemoteChannel:
+		handler, err := s.httpHandler(conf)
+		if nil != err {
+			return nil, err
+		}
+		return rc.NewHTTPListener(l, conf, handler)
+	case channel.StreamRemoteChannel:
+		return rc.NewListener(l, conf)
+	}
+	return nil, fmt.Errorf("Listener scheme:%s could not be served on tcp listener", conf.Scheme)
+}
+
+//NewPacketListener create a listener of the channel scheme on a given udp packet conn
+func (s *Server) NewPacketListener(conf *channel.ListenerConfig, conn net.PacketConn) (channel.RemoteListener, error) {
+	conf = s.listenerConfig(conf)
+	p, err := s.remoteChannel(conf)
+	if nil != err {
+		return nil, err
+	}
+	if rc, ok := p.(channel.PacketRemoteChannel); ok {
+		return rc.NewPacketListener(conn, conf)
+	}
+	return nil, fmt.Errorf("Listener scheme:%s could not be served on udp packet conn", conf.Scheme)
+}
+
+//Listen listen the address of config by the registered remote channel of scheme
+func (s *Server) Listen(conf *channel.ListenerConfig) (channel.RemoteListener, error) {
+	conf = s.listenerConfig(conf)
+	p, err := s.remoteChannel(conf)
+	if nil != err {
+		return nil, err
+	}
+	if _, ok := p.(channel.HTTPRemoteChannel); ok {
+		l, err := net.Listen("tcp", conf.Listen)
+		if nil != err {
+			return nil, err
+		}
+		rl, err := s.NewListener(conf, l)
+		if nil != err {
+			l.Close()
+		}
+		return rl, err
+	}
+	return p.Listen(conf)
+}
+
+//Serve serve the channel scheme on a given tcp listener, it blocks until the listener closed.
+func (s *Server) Serve(conf *channel.ListenerConfig, l net.Listener) error {
+	rl, err := s.NewListener(conf, l)
+	if nil != err {
+		return err
+	}
+	return s.ServeListener(rl)
+}
+
+//ServePacket serve the channel scheme on a given udp packet conn, it blocks until the listener closed.
+func (s *Server) ServePacket(conf *channel.ListenerConfig, conn net.PacketConn) error {
+	rl, err := s.NewPacketListener(conf, conn)
+	if nil != err {
+		return err
+	}
+	return s.ServeListener(rl)
+}
+
+//ServeTCP serve the TCP transport on the listener.
+func (s *Server) ServeTCP(l net.Listener) error {
+	return s.Serve(&channel.ListenerConfig{Scheme: "tcp"}, l)
+}
+
+//ServeTLS serve the TLS transport on the listener with cert/key of TLS config.
+func (s *Server) ServeTLS(l net.Listener) error {
+	return s.Serve(newListenerConfig("tls", "", &channel.TLSOptions{Cert: s.conf.TLS.Cert, Key: s.conf.TLS.Key}), l)
+}
+
+//ServeHTTP2 serve the HTTP2 transport on the listener with cert/key of HTTP2 config.
+func (s *Server) ServeHTTP2(l net.Listener) error {
+	return s.Serve(newListenerConfig("http2", "", &channel.TLSOptions{Cert: s.conf.HTTP2.Cert, Key: s.conf.HTTP2.Key}), l)
+}
+
+//ServeHTTP serve the handler of HTTP/Websocket transports on the listener.
+func (s *Server) ServeHTTP(l net.Listener) error {
+	return s.Serve(&channel.ListenerConfig{Scheme: "http"}, l)
+}
+
+//ServeKCP serve the KCP transport with params of KCP config on the packet conn.
+func (s *Server) ServeKCP(conn net.PacketConn) error {
+	return s.ServePacket(newListenerConfig("kcp", "", &s.conf.KCP.Params), conn)
+}
+
+//ServeQUIC serve the QUIC transport with cert/key of QUIC config on the packet conn.
+func (s *Server) ServeQUIC(conn net.PacketConn) error {
+	return s.ServePacket(newListenerConfig("quic", "", &channel.TLSOptions{Cert: s.conf.QUIC.Cert, Key: s.conf.QUIC.Key}), conn)
+}
+
+//ServeSSH serve the SSH gateway with host key & authorized keys of SSH config on the listener.
+func (s *Server) ServeSSH(l net.Listener) error {
+	return s.Serve(newListenerConfig("ssh", "", &channel.SSHOptions{HostKey: s.conf.SSH.HostKey, AuthorizedKeys: s.conf.SSH.AuthorizedKeys}), l)
+}
+
+//Start listen all listeners in config and serve them in background, listening errors are returned after all
+//others started.
+func (s *Server) Start() error {
+	var lastErr error
+	for _, conf := range s.conf.listenerConfigs() {
+		l, err := s.Listen(&conf)
+		if nil != err {
+			logger.Error("[ERROR]Failed to listen %s address:%s with reason:%v", conf.Scheme, conf.Listen, err)
+			lastErr = err
+			continue
+		}
+		logger.Info("Listen on %s address:%s", conf.Scheme, l.Addr())
+		go func(conf channel.ListenerConfig) {
+			if err := s.ServeListener(l); nil != err && err != ErrServerClosed {
+				logger.Error("Serve %s address:%s error:%v", conf.Scheme, conf.Listen, err)
+			}
+		}(conf)
+	}
+	return lastErr
+}
+
+//Shutdown stop accepting new sessions, wait running sessions closed until the context done, then close all.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.closed = true
+	s.sessions.Close(false)
+	var wg sync.WaitGroup
+	for l := range s.listeners {
+		if sl, ok := l.(shutdowner); ok {
+			wg.Add(1)
+			go func(sl shutdowner) {
+				sl.Shutdown(ctx)
+				wg.Done()
+			}(sl)
+		} else if !isPacketListener(l) {
+			//listeners over udp are closed at last since their sessions are closed together
+			l.Close()
+		}
+	}
+	s.mutex.Unlock()
+	listenersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(listenersDone)
+	}()
+
+	var err error
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+WAIT:
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			break WAIT
+		case <-ticker.C:
+			select {
+			case <-listenersDone:
+				if s.sessions.Len() == 0 {
+					break WAIT
+				}
+			default:
+			}
+		}
+	}
+	s.close()
+	return err
+}
+
+func isPacketListener(l channel.RemoteListener) bool {
+	addr := l.Addr()
+	return nil != addr && strings.HasPrefix(addr.Network(), "udp")
+}
+
+//Close close all listeners & running sessions immediately.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.close()
+	return nil
+}
+
+func (s *Server) close() {
+	s.sessions.Close(true)
+	s.options.Hops.Stop()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = make(map[channel.RemoteListener]struct{})
+}
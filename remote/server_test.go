@@ -0,0 +1,175 @@
+package remote
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yinqiwen/gsnova/common/channel"
+	"github.com/yinqiwen/gsnova/common/dialer"
+	"github.com/yinqiwen/gsnova/internal/testutil"
+)
+
+const testKey = "server-test-key"
+
+func newTestServer(t *testing.T) *Server {
+	conf := &ServerConfig{}
+	conf.Cipher = channel.CipherConfig{User: "gsnova", Key: testKey, Method: "chacha20poly1305"}
+	conf.Mux.StreamIdleTimeout = 10
+	server, err := NewServer(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return server
+}
+
+//testEcho dial the echo server via the channel url, the returned conn is still open
+func testEcho(t *testing.T, channelURL string, addr string) net.Conn {
+	d, err := dialer.NewByURL(channelURL)
+	if nil != err {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if nil != err {
+		t.Fatalf("Failed to dial via %s:%v", channelURL, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello server"))
+	buf := make([]byte, len("hello server"))
+	if _, err = io.ReadFull(conn, buf); nil != err || string(buf) != "hello server" {
+		t.Fatalf("Unexpected echo:%s with err:%v via %s", buf, err, channelURL)
+	}
+	return conn
+}
+
+func TestServerHandler(t *testing.T) {
+	server := newTestServer(t)
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+
+	//the handler is mounted under a path prefix of the caller's http server
+	mux := http.NewServeMux()
+	mux.Handle("/gsnova/", http.StripPrefix("/gsnova", server.Handler()))
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+	//pending pull requests are finished after sessions closed, push requests are finished after clients stopped
+	defer channel.StopLocalChannels()
+	defer server.Close()
+	host := strings.TrimPrefix(hs.URL, "http://")
+	for _, scheme := range []string{"ws", "http"} {
+		conn := testEcho(t, scheme+"://gsnova:"+testKey+"@"+host+"/gsnova?method=chacha20poly1305", echo.Addr().String())
+		conn.Close()
+	}
+	//index/stat/stackdump pages are only served by standalone listeners
+	for _, path := range []string{"/", "/stat", "/stackdump"} {
+		res, err := http.Get(hs.URL + "/gsnova" + path)
+		if nil != err {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Unexpected status:%d of %s on mounted handler", res.StatusCode, path)
+		}
+		rec := httptest.NewRecorder()
+		server.listenerHandler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Unexpected status:%d of %s on listener handler", rec.Code, path)
+		}
+	}
+}
+
+func TestServerStart(t *testing.T) {
+	conf := &ServerConfig{}
+	conf.Cipher = channel.CipherConfig{User: "gsnova", Key: testKey, Method: "chacha20poly1305"}
+	conf.Listeners = []channel.ListenerConfig{
+		{Scheme: "tcp", Listen: "127.0.0.1:0"},
+		{Scheme: "unknown", Listen: "127.0.0.1:0"},
+	}
+	server, err := NewServer(conf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+
+	//listeners in config are started even if others failed
+	if err = server.Start(); nil == err {
+		t.Fatalf("Expected error of the unknown scheme")
+	}
+	//listeners are served in background
+	var addr string
+	for i := 0; i < 100 && len(addr) == 0; i++ {
+		server.mutex.Lock()
+		for l := range server.listeners {
+			addr = l.Addr().String()
+		}
+		server.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(addr) == 0 {
+		t.Fatalf("No listener started")
+	}
+	conn := testEcho(t, "tcp://gsnova:"+testKey+"@"+addr+"?method=chacha20poly1305", echo.Addr().String())
+	conn.Close()
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := newTestServer(t)
+	echo := testutil.StartEchoServer(t)
+	defer echo.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeTCP(l)
+	}()
+	conn := testEcho(t, "tcp://gsnova:"+testKey+"@"+l.Addr().String()+"?method=chacha20poly1305", echo.Addr().String())
+	defer conn.Close()
+
+	//the running session is waited until the context done, then closed
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected shutdown error:%v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Unexpected shutdown duration:%v", elapsed)
+	}
+	select {
+	case err = <-served:
+		if err != ErrServerClosed {
+			t.Fatalf("Unexpected serve error:%v after shutdown", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve is not returned after shutdown")
+	}
+	if _, err = conn.Read(make([]byte, 1)); nil == err {
+		t.Fatalf("Running stream is not closed after shutdown")
+	}
+	if err = server.ServeTCP(l); err != ErrServerClosed {
+		t.Fatalf("Unexpected serve error:%v of closed server", err)
+	}
+
+	//shutdown returns once all sessions closed
+	server = newTestServer(t)
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	go server.ServeTCP(l)
+	time.Sleep(50 * time.Millisecond)
+	if err = server.Shutdown(context.Background()); nil != err {
+		t.Fatalf("Unexpected shutdown error:%v without sessions", err)
+	}
+}
@@ -8,9 +8,6 @@ import (
 
 	"github.com/yinqiwen/gotoolkit/ots"
 	"github.com/yinqiwen/gsnova/common/channel"
-	httpChannel "github.com/yinqiwen/gsnova/common/channel/http"
-	"github.com/yinqiwen/gsnova/common/channel/websocket"
-	"github.com/yinqiwen/gsnova/common/logger"
 )
 
 // hello world, the web server
@@ -18,10 +15,14 @@ func indexCallback(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, strings.Replace(html, "${Version}", channel.Version, -1))
 }
 
-func statCallback(w http.ResponseWriter, req *http.Request) {
+func (s *Server) statCallback(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(200)
 	fmt.Fprintf(w, "Version:    %s\n", channel.Version)
 	ots.Handle("stat", w)
+	channel.DumpRemoteChannelStat(w)
+	if nil != s.options.Resolver {
+		s.options.Resolver.DumpStat(w)
+	}
 }
 
 func stackdumpCallback(w http.ResponseWriter, req *http.Request) {
@@ -29,23 +30,6 @@ func stackdumpCallback(w http.ResponseWriter, req *http.Request) {
 	ots.Handle("stackdump", w)
 }
 
-func startHTTPProxyServer(listenAddr string) {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", indexCallback)
-	mux.HandleFunc("/stat", statCallback)
-	mux.HandleFunc("/stackdump", stackdumpCallback)
-	mux.HandleFunc("/ws", websocket.WebsocketInvoke)
-	mux.HandleFunc("/http/pull", httpChannel.HTTPInvoke)
-	mux.HandleFunc("/http/push", httpChannel.HTTPInvoke)
-	mux.HandleFunc("/http/test", httpChannel.HttpTest)
-
-	logger.Info("Listen on HTTP address:%s", listenAddr)
-	err := http.ListenAndServe(listenAddr, mux)
-	if nil != err {
-		logger.Error("Listen HTTP server error:%v", err)
-	}
-}
-
 const html = `
 <!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.0 Strict//EN"
 	"http://www.w3.org/TR/xhtml1/DTD/xhtml1-strict.dtd">